@@ -60,6 +60,10 @@ func main() {
 	go svr.Run()
 
 	http.HandleFunc("/api/reload", svr.HandleReload)
+	http.HandleFunc("/api/maintenance", svr.HandleMaintenance)
+	http.HandleFunc("/debug/table_stats/", svr.HandleTableStats)
+	http.HandleFunc("/debug/plans/", svr.HandlePlans)
+	http.HandleFunc("/metrics", svr.HandleMetrics)
 	//todo: using configuration
 	http.ListenAndServe(":8888", nil)
 }
@@ -44,6 +44,84 @@ type Config struct {
 	Shards       []ShardConfig               `json:"shards"`
 	Schemas      []SchemaConfig              `json:"schemas"`
 	RowCacheConf tabletserver.RowCacheConfig `json:"rowcache_conf"`
+	// PassUnknownTables sends queries on tables missing from the
+	// schema to the backend as is instead of rejecting them.
+	PassUnknownTables bool `json:"pass_unknown_tables"`
+	// MaxQueryTimeout caps, in seconds, the per session timeout set
+	// with proxy_query_timeout. Zero leaves it uncapped.
+	MaxQueryTimeout int `json:"max_query_timeout"`
+	// MaxFullScanRows rejects queries that would scan a table of more
+	// rows without using any index, 0 disables the check.
+	MaxFullScanRows uint64 `json:"max_full_scan_rows"`
+	// TinyIntAsBool renders cached TINYINT(1) values as 0 or 1.
+	TinyIntAsBool bool `json:"tinyint1_as_bool"`
+	// CaseInsensitiveColumns resolves column names ignoring case.
+	CaseInsensitiveColumns bool `json:"case_insensitive_columns"`
+	// FieldListDefaults adds the column default values to the
+	// COM_FIELD_LIST replies built from the schema.
+	FieldListDefaults bool `json:"field_list_defaults"`
+	// CheckJoinTypes logs the joins comparing columns of incompatible
+	// types, like an int to a varchar, RejectCoercedJoins rejects them.
+	CheckJoinTypes     bool `json:"check_join_types"`
+	RejectCoercedJoins bool `json:"reject_coerced_joins"`
+	// MaxResultRows cuts the resultsets sent to clients at that many
+	// rows, followed by an error. Sessions can change it with
+	// proxy_max_result_rows. Zero disables the cap.
+	MaxResultRows int `json:"max_result_rows"`
+	// MaxMergeBytes fails the queries whose rows, buffered as they are
+	// read from the shards, take more memory, as soon as they do. Zero
+	// disables it.
+	MaxMergeBytes int64 `json:"max_merge_bytes"`
+	// RejectSelectInto rejects SELECT ... INTO OUTFILE or DUMPFILE,
+	// which write files on the backends, instead of passing them.
+	RejectSelectInto bool `json:"reject_select_into"`
+	// LogPlans logs at debug level the normalized queries generated for
+	// each new plan, LogPlanValues their literals and pk and limit values
+	// as well.
+	LogPlans      bool `json:"log_plans"`
+	LogPlanValues bool `json:"log_plan_values"`
+	// PrometheusMetrics collects the metrics of the proxy, the row cache
+	// and the plans, served on /metrics in the Prometheus text format.
+	PrometheusMetrics bool `json:"prometheus_metrics"`
+	// PartialResults makes the reads on several shards return the rows
+	// of the shards that succeeded, with warnings, if some fail.
+	PartialResults bool `json:"partial_results"`
+	// ShardConcurrency bounds how many shards a query runs on at once,
+	// 0 runs it on all of them together.
+	ShardConcurrency int `json:"shard_concurrency"`
+	// ReadRepairSampleRate is the fraction of the cache hits, between 0
+	// and 1, that are read again from the backend to check the cached
+	// rows. Stale ones are corrected and counted.
+	ReadRepairSampleRate float64 `json:"read_repair_sample_rate"`
+	// AllowedFingerprints, if set, are the fingerprints of the only
+	// statement shapes that may run. DeniedFingerprints are rejected.
+	AllowedFingerprints []string `json:"allowed_fingerprints"`
+	DeniedFingerprints  []string `json:"denied_fingerprints"`
+	// BackendTimeZone is the time_zone of the backends, like +08:00 or
+	// Asia/Shanghai, which the TIMESTAMP values of the cached rows are
+	// converted from for the sessions setting another one. The sessions
+	// can't set time_zone if it is empty.
+	BackendTimeZone string `json:"backend_time_zone"`
+	// DefaultCharset is the charset or collation, like utf8mb4, of the
+	// character fields the proxy builds for columns of no known
+	// collation. Empty for utf8.
+	DefaultCharset string `json:"default_charset"`
+	// LocalVariables are @@ variables, like version_comment or
+	// max_allowed_packet, whose selects the proxy answers itself with
+	// these values instead of asking a backend. Integer values are
+	// sent as integers.
+	LocalVariables map[string]string `json:"local_variables"`
+	// RewriteCachedRows has updates by pk that set plain values write
+	// them into the cached rows instead of invalidating them. Unsafe if
+	// triggers change the rows of cached tables.
+	RewriteCachedRows bool `json:"rewrite_cached_rows"`
+	// SchemaSnapshotDir keeps a snapshot of the schema of each db, the
+	// proxy starts with it when the backend is slow or down and reloads
+	// the tables in the background. Empty disables the snapshots.
+	SchemaSnapshotDir string `json:"schema_snapshot_dir"`
+	// SchemaRefreshInterval reloads the tables, and saves their
+	// snapshot, every that many seconds. Zero disables it.
+	SchemaRefreshInterval int `json:"schema_refresh_interval"`
 }
 
 func ParseConfigData(data []byte) (*Config, error) {
@@ -1,5 +1,7 @@
 package mysql
 
+import "strings"
+
 type CollationId uint8
 
 //charset key is charset name and value is default collation id
@@ -90,6 +92,38 @@ var Charsets = map[string]string{
 	"eucjpms":  "eucjpms_japanese_ci",
 }
 
+//charset key is charset name and value is the most bytes a character
+//takes, charsets not listed take one
+var charsetMaxLens = map[string]uint32{
+	"big5":    2,
+	"ujis":    3,
+	"sjis":    2,
+	"euckr":   2,
+	"gb2312":  2,
+	"gbk":     2,
+	"utf8":    3,
+	"ucs2":    2,
+	"utf8mb4": 4,
+	"utf16":   4,
+	"utf16le": 4,
+	"utf32":   4,
+	"cp932":   2,
+	"eucjpms": 3,
+}
+
+// CollationMaxLen returns the most bytes a character of collation takes,
+// 1 for binary columns which have no collation.
+func CollationMaxLen(collation string) uint32 {
+	charset := collation
+	if i := strings.IndexByte(collation, '_'); i > 0 {
+		charset = collation[:i]
+	}
+	if n, ok := charsetMaxLens[charset]; ok {
+		return n
+	}
+	return 1
+}
+
 var Collations = map[CollationId]string{
 	1:   "big5_chinese_ci",
 	2:   "latin2_czech_cs",
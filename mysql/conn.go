@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/juju/errors"
@@ -29,9 +30,50 @@ type MySqlConn struct {
 	status     uint16
 	collation  CollationId
 	charset    string
+	timeZone   string //set by SetTimeZone, empty for the one of the server
 	salt       []byte
 	lastPing   int64
 	pkgErr     error
+	budget     *ReadBudget //bounds the rows read, nil for no bound
+	threadId   uint32      //the connection id the server gave c
+}
+
+// ReadBudget bounds the memory the rows of the reads sharing it take,
+// like the reads of a query on all its shards. The rows are counted
+// twice, as read and decoded.
+type ReadBudget struct {
+	limit   int64
+	used    int64
+	maxRows int64
+	rows    int64
+}
+
+// NewReadBudget returns a budget of limit bytes, zero for no limit,
+// keeping at most maxRows rows, zero for all of them.
+func NewReadBudget(limit int64, maxRows int) *ReadBudget {
+	return &ReadBudget{limit: limit, maxRows: int64(maxRows)}
+}
+
+// add counts a row of n bytes and fails with ErrMergeBudget once the
+// budget is exceeded. It returns false for the rows past maxRows,
+// which are not kept nor counted.
+func (b *ReadBudget) add(n int) (bool, error) {
+	if b.maxRows > 0 && atomic.AddInt64(&b.rows, 1) > b.maxRows {
+		return false, nil
+	}
+	if b.limit <= 0 {
+		return true, nil
+	}
+	used := atomic.AddInt64(&b.used, int64(n)*2)
+	if used > b.limit {
+		return true, errors.Annotatef(ErrMergeBudget, "%d bytes buffered, budget %d", used, b.limit)
+	}
+	return true, nil
+}
+
+// SetReadBudget has the rows read next counted by b, nil for no bound.
+func (c *MySqlConn) SetReadBudget(b *ReadBudget) {
+	c.budget = b
 }
 
 func (c *MySqlConn) Connect(addr string, user string, password string, db string) error {
@@ -68,6 +110,7 @@ func (c *MySqlConn) ReConnect() error {
 
 	c.conn = netConn
 	c.pkg = NewPacketIO(netConn)
+	c.timeZone = ""
 
 	if err := c.readInitialHandshake(); err != nil {
 		c.conn.Close()
@@ -101,6 +144,28 @@ func (c *MySqlConn) ReConnect() error {
 	return nil
 }
 
+// SetDeadline bounds the reads and writes of the next commands, a zero
+// t clears the deadline.
+func (c *MySqlConn) SetDeadline(t time.Time) error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.SetDeadline(t)
+}
+
+// KillQuery has the server abort the statement c runs, with a KILL
+// QUERY sent on a connection of its own. c stays usable.
+func (c *MySqlConn) KillQuery() error {
+	killer := new(MySqlConn)
+	if err := killer.Connect(c.addr, c.user, c.password, ""); err != nil {
+		return errors.Trace(err)
+	}
+	defer killer.Close()
+
+	_, err := killer.exec(fmt.Sprintf("KILL QUERY %d", c.threadId))
+	return errors.Trace(err)
+}
+
 func (c *MySqlConn) Close() error {
 	if c.conn != nil {
 		c.conn.Close()
@@ -136,10 +201,13 @@ func (c *MySqlConn) readInitialHandshake() error {
 		return errors.Errorf("invalid protocol version %d, must >= 10", data[0])
 	}
 
-	//skip mysql version and connection id
+	//skip mysql version
 	//mysql version end with 0x00
+	pos := 1 + bytes.IndexByte(data[1:], 0x00) + 1
+
 	//connection id length is 4
-	pos := 1 + bytes.IndexByte(data[1:], 0x00) + 1 + 4
+	c.threadId = binary.LittleEndian.Uint32(data[pos : pos+4])
+	pos += 4
 
 	c.salt = append(c.salt, data[pos:pos+8]...)
 
@@ -357,17 +425,23 @@ func (c *MySqlConn) Execute(command string, args ...interface{}) (*Result, error
 	if len(args) == 0 {
 		return c.exec(command)
 	} else {
-		if s, err := c.Prepare(command); err != nil {
-			return nil, err
-		} else {
-			var r *Result
-			r, err = s.Execute(args...)
-			s.Close()
-			return r, err
-		}
+		return c.ExecuteStmt(command, args...)
 	}
 }
 
+// ExecuteStmt runs command as a prepared statement even without args,
+// so that rows always come in the binary protocol.
+func (c *MySqlConn) ExecuteStmt(command string, args ...interface{}) (*Result, error) {
+	s, err := c.Prepare(command)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := s.Execute(args...)
+	s.Close()
+	return r, err
+}
+
 func (c *MySqlConn) Begin() error {
 	_, err := c.exec("begin")
 	return err
@@ -405,6 +479,25 @@ func (c *MySqlConn) SetCharset(charset string) error {
 	return nil
 }
 
+// SetTimeZone sets the time_zone of the session, back to the global one
+// of the server for an empty zone.
+func (c *MySqlConn) SetTimeZone(zone string) error {
+	if c.timeZone == zone {
+		return nil
+	}
+
+	sql := "set time_zone = @@global.time_zone"
+	if zone != "" {
+		sql = fmt.Sprintf("set time_zone = '%s'", strings.Replace(zone, "'", "''", -1))
+	}
+	if _, err := c.exec(sql); err != nil {
+		return err
+	}
+
+	c.timeZone = zone
+	return nil
+}
+
 func (c *MySqlConn) FieldList(table string, wildcard string) ([]*Field, error) {
 	if err := c.writeCommandStrStr(byte(COM_FIELD_LIST), table, wildcard); err != nil {
 		return nil, err
@@ -473,6 +566,9 @@ func (c *MySqlConn) readResultset(data []byte, binary bool) (*Result, error) {
 	}
 
 	if err := c.readResultRows(result, binary); err != nil {
+		if err == ErrBackendMidStream {
+			return result, err
+		}
 		return nil, err
 	}
 
@@ -515,14 +611,24 @@ func (c *MySqlConn) readResultColumns(result *Result) (err error) {
 	}
 }
 
+// readResultRows reads rows until EOF. If the backend fails after the
+// columns were sent, the rows read so far are kept in result and
+// ErrBackendMidStream is returned.
 func (c *MySqlConn) readResultRows(result *Result, isBinary bool) (err error) {
 	var data []byte
+	var streamErr error
 
 	for {
 		data, err = c.readPacket()
 
+		if err == nil && data[0] == ERR_HEADER {
+			err = c.handleErrorPacket(data)
+		}
+
 		if err != nil {
-			return
+			log.Warningf("backend failed after %d rows, %v", len(result.RowDatas), err)
+			streamErr = ErrBackendMidStream
+			break
 		}
 
 		// EOF Packet
@@ -537,6 +643,17 @@ func (c *MySqlConn) readResultRows(result *Result, isBinary bool) (err error) {
 			break
 		}
 
+		if c.budget != nil {
+			keep, err := c.budget.add(len(data))
+			if err != nil {
+				// the rows left are skipped to keep the conn usable
+				c.readUntilEOF()
+				return err
+			} else if !keep {
+				// read on up to EOF for the status
+				continue
+			}
+		}
 		result.RowDatas = append(result.RowDatas, data)
 	}
 
@@ -550,7 +667,7 @@ func (c *MySqlConn) readResultRows(result *Result, isBinary bool) (err error) {
 		}
 	}
 
-	return nil
+	return streamErr
 }
 
 func (c *MySqlConn) readUntilEOF() (err error) {
@@ -1 +1,148 @@
 package mysql
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// serveRows makes the backend send a one column resultset with the
+// given rows, then end it by calling fail instead of sending EOF.
+func serveRows(server net.Conn, rows []string, fail func(pkg *PacketIO)) {
+	pkg := NewPacketIO(server)
+	write := func(payload ...byte) {
+		pkg.WritePacket(append(make([]byte, 4), payload...))
+	}
+
+	write(1) //column count
+	f := &Field{Name: []byte("id"), Type: MYSQL_TYPE_LONGLONG}
+	write(f.AppendTo(nil)...)
+	write(EOF_HEADER, 0, 0, 0, 0)
+	for _, row := range rows {
+		write(AppendLengthEncodedString(nil, []byte(row))...)
+	}
+	fail(pkg)
+	pkg.Flush()
+}
+
+func TestReadResultMidStream(t *testing.T) {
+	fails := []func(pkg *PacketIO){
+		func(pkg *PacketIO) {}, //connection dropped
+		func(pkg *PacketIO) {
+			code := ER_QUERY_INTERRUPTED
+			data := append(make([]byte, 4), ERR_HEADER, byte(code), byte(code>>8))
+			pkg.WritePacket(append(data, "#70100interrupted"...))
+		},
+	}
+
+	for i, fail := range fails {
+		client, server := net.Pipe()
+		c := &MySqlConn{conn: client, pkg: NewPacketIO(client), capability: CLIENT_PROTOCOL_41}
+
+		go func() {
+			serveRows(server, []string{"1", "2"}, fail)
+			server.Close()
+		}()
+
+		r, err := c.readResult(false)
+		if err != ErrBackendMidStream {
+			t.Fatal(i, err)
+		}
+		if r == nil || len(r.Values) != 2 || r.Values[1][0] != int64(2) {
+			t.Fatal(i, r)
+		}
+		client.Close()
+	}
+}
+
+func TestReadBudget(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := &MySqlConn{conn: client, pkg: NewPacketIO(client), capability: CLIENT_PROTOCOL_41}
+	// the second row, counted twice, exceeds it
+	c.SetReadBudget(NewReadBudget(300, 0))
+
+	row := strings.Repeat("1", 100)
+	sent := make(chan struct{})
+	go func() {
+		serveRows(server, []string{row, row, row}, func(pkg *PacketIO) {
+			pkg.WritePacket(append(make([]byte, 4), EOF_HEADER, 0, 0, 0, 0))
+		})
+		close(sent)
+	}()
+
+	if _, err := c.readResult(false); errors.Cause(err) != ErrMergeBudget {
+		t.Fatal(err)
+	}
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("rows left unread")
+	}
+}
+
+func TestReadBudgetRows(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := &MySqlConn{conn: client, pkg: NewPacketIO(client), capability: CLIENT_PROTOCOL_41}
+	c.SetReadBudget(NewReadBudget(0, 2))
+
+	go serveRows(server, []string{"1", "2", "3", "4"}, func(pkg *PacketIO) {
+		pkg.WritePacket(append(make([]byte, 4), EOF_HEADER, 0, 0, byte(SERVER_STATUS_IN_TRANS), 0))
+	})
+
+	// the rows past the cap are read but not kept
+	r, err := c.readResult(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.RowDatas) != 2 || r.Status != SERVER_STATUS_IN_TRANS {
+		t.Fatal(len(r.RowDatas), r.Status)
+	}
+}
+
+func TestSetTimeZone(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := &MySqlConn{conn: client, pkg: NewPacketIO(client), capability: CLIENT_PROTOCOL_41}
+
+	queries := make(chan string, 8)
+	go func() {
+		pkg := NewPacketIO(server)
+		for {
+			pkg.Sequence = 0
+			data, err := pkg.ReadPacket()
+			if err != nil {
+				close(queries)
+				return
+			}
+			queries <- string(data[1:])
+			pkg.WritePacket(append(make([]byte, 4), OK_HEADER, 0, 0, 0, 0, 0, 0))
+			pkg.Flush()
+		}
+	}()
+
+	for _, zone := range []string{"+08:00", "+08:00", "", "", "Asia/Shanghai"} {
+		if err := c.SetTimeZone(zone); err != nil {
+			t.Fatal(zone, err)
+		}
+	}
+	server.Close()
+
+	var got []string
+	for q := range queries {
+		got = append(got, q)
+	}
+	expect := []string{"set time_zone = '+08:00'", "set time_zone = @@global.time_zone", "set time_zone = 'Asia/Shanghai'"}
+	if len(got) != len(expect) {
+		t.Fatal(got)
+	}
+	for i := range expect {
+		if got[i] != expect[i] {
+			t.Fatal(got)
+		}
+	}
+}
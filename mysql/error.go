@@ -9,6 +9,18 @@ var (
 	ErrBadConn       = errors.New("connection was bad")
 	ErrMalformPacket = errors.New("Malform packet error")
 	ErrTxDone        = errors.New("sql: Transaction has already been committed or rolled back")
+
+	// ErrBackendMidStream is returned along with the rows read so far
+	// when the backend fails in the middle of a resultset.
+	ErrBackendMidStream = NewError(ER_QUERY_INTERRUPTED, "backend failed mid-stream, result is incomplete")
+
+	// ErrTooManyRows ends a resultset cut at the maximum number of rows
+	// a client may be sent.
+	ErrTooManyRows = NewError(ER_QUERY_INTERRUPTED, "result has more rows than allowed, result is incomplete")
+
+	// ErrMergeBudget is returned when the rows buffered to merge and
+	// sort the results of a query take more memory than allowed.
+	ErrMergeBudget = NewError(ER_OUT_OF_SORTMEMORY, "out of merge memory, result is larger than the query budget")
 )
 
 type SqlError struct {
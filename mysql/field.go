@@ -124,33 +124,67 @@ func (f *Field) Dump(alloc arena.ArenaAllocator) []byte {
 		return []byte(f.Data)
 	}
 
+	if alloc == nil {
+		alloc = arena.StdAllocator
+	}
+
 	l := len(f.Schema) + len(f.Table) + len(f.OrgTable) + len(f.Name) + len(f.OrgName) + len(f.DefaultValue) + 48
 
-	data := alloc.AllocBytes(l)
+	return f.AppendTo(alloc.AllocBytes(l))
+}
+
+// AppendTo appends the column definition of f to data and returns
+// the extended buffer, without allocating anything else.
+func (f *Field) AppendTo(data []byte) []byte {
+	if f.Data != nil {
+		return append(data, f.Data...)
+	}
 
 	data = append(data, defCache...)
 
-	data = append(data, PutLengthEncodedString(f.Schema, alloc)...)
+	data = AppendLengthEncodedString(data, f.Schema)
 
-	data = append(data, PutLengthEncodedString(f.Table, alloc)...)
-	data = append(data, PutLengthEncodedString(f.OrgTable, alloc)...)
+	data = AppendLengthEncodedString(data, f.Table)
+	data = AppendLengthEncodedString(data, f.OrgTable)
 
-	data = append(data, PutLengthEncodedString(f.Name, alloc)...)
-	data = append(data, PutLengthEncodedString(f.OrgName, alloc)...)
+	data = AppendLengthEncodedString(data, f.Name)
+	data = AppendLengthEncodedString(data, f.OrgName)
 
 	data = append(data, 0x0c)
 
-	data = append(data, Uint16ToBytes(f.Charset)...)
-	data = append(data, Uint32ToBytes(f.ColumnLength)...)
+	data = append(data, byte(f.Charset), byte(f.Charset>>8))
+	data = append(data, byte(f.ColumnLength), byte(f.ColumnLength>>8), byte(f.ColumnLength>>16), byte(f.ColumnLength>>24))
 	data = append(data, f.Type)
-	data = append(data, Uint16ToBytes(f.Flag)...)
+	data = append(data, byte(f.Flag), byte(f.Flag>>8))
 	data = append(data, f.Decimal)
 	data = append(data, 0, 0)
 
 	if f.DefaultValue != nil {
-		data = append(data, Uint64ToBytes(f.DefaultValueLength)...)
+		data = append(data, PutLengthEncodedInt(uint64(len(f.DefaultValue)))...)
 		data = append(data, f.DefaultValue...)
 	}
 
 	return data
 }
+
+type PacketWriter interface {
+	WritePacket(data []byte) error
+}
+
+// WriteFields writes one column definition packet per field to w.
+// A single buffer is reused for all packets, so the peak allocation
+// depends on the largest field rather than on the number of fields.
+func WriteFields(w PacketWriter, fields []*Field, buf []byte) error {
+	if cap(buf) < 4 {
+		buf = make([]byte, 4, 1024)
+	}
+	for _, f := range fields {
+		data := f.AppendTo(buf[:4])
+		if err := w.WritePacket(data); err != nil {
+			return err
+		}
+		// keep the grown buffer for the next field
+		buf = data
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package mysql
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/ngaut/arena"
+)
+
+type packetRecorder struct {
+	packets [][]byte
+}
+
+func (r *packetRecorder) WritePacket(data []byte) error {
+	r.packets = append(r.packets, append([]byte(nil), data[4:]...))
+	return nil
+}
+
+func TestWriteFields(t *testing.T) {
+	fields := make([]*Field, 200)
+	for i := range fields {
+		fields[i] = &Field{
+			Schema:       []byte("test"),
+			Table:        []byte("wide"),
+			OrgTable:     []byte("wide"),
+			Name:         []byte(fmt.Sprintf("column_%d", i)),
+			OrgName:      []byte(fmt.Sprintf("column_%d", i)),
+			Charset:      33,
+			ColumnLength: uint32(i * 3),
+			Type:         MYSQL_TYPE_VARCHAR,
+			Flag:         uint16(i),
+		}
+	}
+
+	r := &packetRecorder{}
+	if err := WriteFields(r, fields, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.packets) != len(fields) {
+		t.Fatal(len(r.packets))
+	}
+
+	alloc := arena.NewArenaAllocator(1024)
+	for i, p := range r.packets {
+		if !bytes.Equal(p, fields[i].Dump(alloc)) {
+			t.Fatal(i, p)
+		}
+		f, err := FieldData(p).Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(f.Name) != string(fields[i].Name) || f.ColumnLength != fields[i].ColumnLength ||
+			f.Flag != fields[i].Flag || f.Type != MYSQL_TYPE_VARCHAR || f.Charset != 33 {
+			t.Fatalf("%d %+v", i, f)
+		}
+	}
+}
+
+func TestFieldDefaultValue(t *testing.T) {
+	for _, def := range []string{"", "none", string(bytes.Repeat([]byte("x"), 300))} {
+		f := &Field{Name: []byte("c"), Type: MYSQL_TYPE_VAR_STRING, DefaultValue: []byte(def), DefaultValueLength: uint64(len(def))}
+		p, err := FieldData(f.AppendTo(nil)).Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(p.DefaultValue) != def || p.DefaultValueLength != uint64(len(def)) {
+			t.Fatalf("%d %+v", len(def), p)
+		}
+	}
+
+	// without a default value there is nothing after the filler
+	f := &Field{Name: []byte("c"), Type: MYSQL_TYPE_VAR_STRING}
+	p, err := FieldData(f.AppendTo(nil)).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.DefaultValue != nil {
+		t.Fatalf("%+v", p)
+	}
+}
+
+func TestFieldDumpNilAllocator(t *testing.T) {
+	f := &Field{Schema: []byte("test"), Table: []byte("t"), Name: []byte("id"), Type: MYSQL_TYPE_LONGLONG}
+	if !bytes.Equal(f.Dump(nil), f.AppendTo(nil)) {
+		t.Fatal(f.Dump(nil))
+	}
+	if b := PutLengthEncodedString([]byte("abc"), nil); string(b) != "\x03abc" {
+		t.Fatal(b)
+	}
+}
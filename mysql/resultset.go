@@ -1,9 +1,11 @@
 package mysql
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"math"
+	"math/big"
 	"strconv"
 
 	log "github.com/ngaut/logging"
@@ -50,6 +52,134 @@ func Raw(t byte, val Value, isUnsigned bool) []byte {
 	return ret
 }
 
+// rawValue is Raw for the values of field f, decimals being rendered
+// with the scale of f.
+func rawValue(f *Field, val Value) []byte {
+	switch f.Type {
+	case MYSQL_TYPE_NEWDECIMAL, MYSQL_TYPE_DECIMAL:
+		return rawDecimal(val, f.Decimal)
+	}
+	return Raw(f.Type, val, f.IsUnsigned)
+}
+
+// rawDecimal renders val with exactly scale digits after the point,
+// like the backend does for a DECIMAL(M, scale) column. Values read
+// from the backend have that scale already and are returned as is.
+func rawDecimal(val Value, scale uint8) []byte {
+	r := new(big.Rat)
+	switch v := val.(type) {
+	case []byte:
+		if decimalScale(v) == int(scale) {
+			return v
+		}
+		if _, ok := r.SetString(string(v)); !ok {
+			log.Errorf("invalid decimal %q", v)
+			return v
+		}
+	case string:
+		if _, ok := r.SetString(v); !ok {
+			log.Errorf("invalid decimal %q", v)
+			return hack.Slice(v)
+		}
+	case float64:
+		r.SetFloat64(v)
+	case int64:
+		r.SetInt64(v)
+	case uint64:
+		r.SetString(strconv.FormatUint(v, 10))
+	default:
+		log.Errorf("%+v, %T", val, val)
+		return nil
+	}
+	return []byte(r.FloatString(int(scale)))
+}
+
+// decimalScale returns the number of digits after the point of v, -1
+// if v is not a plain decimal number.
+func decimalScale(v []byte) int {
+	if bytes.IndexAny(v, "eE") >= 0 {
+		return -1
+	}
+	if i := bytes.IndexByte(v, '.'); i >= 0 {
+		return len(v) - i - 1
+	}
+	return 0
+}
+
+// Protocol is the resultset row format a client expects, text for
+// COM_QUERY and binary for COM_STMT_EXECUTE.
+type Protocol int
+
+const (
+	TEXT_PROTOCOL Protocol = iota
+	BINARY_PROTOCOL
+)
+
+// BuildRowData encodes values as a row of fields in the given protocol.
+// Values come as ParseText returns them, temporal ones as strings.
+func BuildRowData(f []*Field, values RowValue, protocol Protocol) (RowData, error) {
+	if len(values) != len(f) {
+		return nil, fmt.Errorf("row has %d column not equal %d", len(values), len(f))
+	}
+
+	if protocol == TEXT_PROTOCOL {
+		var row []byte
+		for i, v := range values {
+			if v == nil {
+				row = append(row, 0xfb)
+			} else {
+				row = AppendLengthEncodedString(row, rawValue(f[i], v))
+			}
+		}
+		return row, nil
+	}
+
+	// header and null bitmap, with its 2 bits offset
+	row := make([]byte, 1+(len(f)+7+2)>>3)
+	row[0] = OK_HEADER
+	var err error
+	for i, v := range values {
+		if v == nil {
+			row[1+(i+2)/8] |= 1 << (uint(i+2) % 8)
+			continue
+		}
+		if row, err = appendBinaryValue(row, f[i], v); err != nil {
+			return nil, err
+		}
+	}
+	return row, nil
+}
+
+func appendBinaryValue(data []byte, f *Field, v Value) ([]byte, error) {
+	switch f.Type {
+	case MYSQL_TYPE_TINY:
+		return append(data, byte(intValue(v))), nil
+	case MYSQL_TYPE_SHORT, MYSQL_TYPE_YEAR:
+		return append(data, Uint16ToBytes(uint16(intValue(v)))...), nil
+	case MYSQL_TYPE_INT24, MYSQL_TYPE_LONG:
+		return append(data, Uint32ToBytes(uint32(intValue(v)))...), nil
+	case MYSQL_TYPE_LONGLONG:
+		return append(data, Uint64ToBytes(intValue(v))...), nil
+	case MYSQL_TYPE_FLOAT:
+		return append(data, Uint32ToBytes(math.Float32bits(float32(v.(float64))))...), nil
+	case MYSQL_TYPE_DOUBLE:
+		return append(data, Uint64ToBytes(math.Float64bits(v.(float64)))...), nil
+	case MYSQL_TYPE_DATE, MYSQL_TYPE_NEWDATE, MYSQL_TYPE_TIMESTAMP, MYSQL_TYPE_DATETIME:
+		return AppendBinaryDateTime(data, Raw(f.Type, v, false), f.Type != MYSQL_TYPE_DATE && f.Type != MYSQL_TYPE_NEWDATE)
+	case MYSQL_TYPE_TIME:
+		return AppendBinaryTime(data, Raw(f.Type, v, false))
+	}
+	return AppendLengthEncodedString(data, rawValue(f, v)), nil
+}
+
+// intValue returns the bits of an integer value as ParseText returns it.
+func intValue(v Value) uint64 {
+	if u, ok := v.(uint64); ok {
+		return u
+	}
+	return uint64(v.(int64))
+}
+
 func (p RowData) Parse(f []*Field, binary bool) (RowValue, error) {
 	if binary {
 		return p.ParseBinary(f)
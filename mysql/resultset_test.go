@@ -0,0 +1,108 @@
+package mysql
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBuildRowDataDateTime(t *testing.T) {
+	f := []*Field{
+		&Field{Name: []byte("id"), Type: MYSQL_TYPE_LONGLONG},
+		&Field{Name: []byte("created"), Type: MYSQL_TYPE_DATETIME},
+		&Field{Name: []byte("deleted"), Type: MYSQL_TYPE_DATETIME},
+	}
+
+	cases := []struct {
+		value  string
+		binary []byte
+	}{
+		{"2015-06-30 12:00:01", []byte{7, 0xdf, 0x07, 6, 30, 12, 0, 1}},
+		{"2015-06-30 00:00:00", []byte{4, 0xdf, 0x07, 6, 30}},
+		{"2015-06-30 12:00:01.000300", []byte{11, 0xdf, 0x07, 6, 30, 12, 0, 1, 0x2c, 0x01, 0, 0}},
+		{"0000-00-00 00:00:00", []byte{0}},
+	}
+	for _, c := range cases {
+		values := RowValue{int64(7), []byte(c.value), nil}
+
+		text, err := BuildRowData(f, values, TEXT_PROTOCOL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := append([]byte{1, '7', byte(len(c.value))}, c.value...)
+		if !bytes.Equal(text, append(expect, 0xfb)) {
+			t.Fatal(c.value, text)
+		}
+
+		bin, err := BuildRowData(f, values, BINARY_PROTOCOL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// header, null bitmap with the third column set, the bigint
+		expect = append([]byte{OK_HEADER, 0x10}, Uint64ToBytes(7)...)
+		if !bytes.Equal(bin, append(expect, c.binary...)) {
+			t.Fatal(c.value, bin)
+		}
+
+		// both decode back to the same value
+		for _, row := range []RowData{text, bin} {
+			v, err := row.Parse(f, row[0] == OK_HEADER)
+			if err != nil {
+				t.Fatal(c.value, err)
+			}
+			if v[0] != int64(7) || string(v[1].([]byte)) != c.value || v[2] != nil {
+				t.Fatal(c.value, v)
+			}
+		}
+	}
+}
+
+func TestAppendBinaryTime(t *testing.T) {
+	cases := map[string][]byte{
+		"00:00:00":   {0},
+		"12:30:01":   {8, 0, 0, 0, 0, 0, 12, 30, 1},
+		"-838:59:59": {8, 1, 34, 0, 0, 0, 22, 59, 59},
+		"01:00:00.5": {12, 0, 0, 0, 0, 0, 1, 0, 0, 0x20, 0xa1, 0x07, 0},
+	}
+	for s, expect := range cases {
+		data, err := AppendBinaryTime(nil, []byte(s))
+		if err != nil || !bytes.Equal(data, expect) {
+			t.Fatal(s, data, err)
+		}
+	}
+}
+
+func TestBuildRowDataDecimal(t *testing.T) {
+	cases := []struct {
+		scale  uint8
+		value  Value
+		expect string
+	}{
+		{0, []byte("15"), "15"},
+		{0, float64(1.5), "2"},
+		{0, int64(-3), "-3"},
+		{2, []byte("1.5"), "1.50"},
+		{2, []byte("1.50"), "1.50"},
+		{2, "-0.125", "-0.13"},
+		{2, float64(1.5), "1.50"},
+		{2, uint64(7), "7.00"},
+		{4, []byte("1.5"), "1.5000"},
+		{4, []byte("123.45678"), "123.4568"},
+		{4, float64(0.1), "0.1000"},
+	}
+	for _, c := range cases {
+		f := []*Field{&Field{Name: []byte("price"), Type: MYSQL_TYPE_NEWDECIMAL, Decimal: c.scale}}
+		for _, protocol := range []Protocol{TEXT_PROTOCOL, BINARY_PROTOCOL} {
+			row, err := BuildRowData(f, RowValue{c.value}, protocol)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if protocol == BINARY_PROTOCOL {
+				// header and null bitmap
+				row = row[2:]
+			}
+			if expect := append([]byte{byte(len(c.expect))}, c.expect...); !bytes.Equal(row, expect) {
+				t.Fatalf("%v with scale %d: %q", c.value, c.scale, row)
+			}
+		}
+	}
+}
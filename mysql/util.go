@@ -1,9 +1,12 @@
 package mysql
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/sha1"
 	"encoding/binary"
+	"strconv"
+	"strings"
 
 	"fmt"
 	"github.com/ngaut/arena"
@@ -151,12 +154,21 @@ func SkipLengthEnodedString(b []byte) (int, error) {
 }
 
 func PutLengthEncodedString(b []byte, alloc arena.ArenaAllocator) []byte {
+	if alloc == nil {
+		alloc = arena.StdAllocator
+	}
 	data := alloc.AllocBytes(len(b) + 9)
 	data = append(data, PutLengthEncodedInt(uint64(len(b)))...)
 	data = append(data, b...)
 	return data
 }
 
+// AppendLengthEncodedString appends b to data as a length encoded string.
+func AppendLengthEncodedString(data []byte, b []byte) []byte {
+	data = append(data, PutLengthEncodedInt(uint64(len(b)))...)
+	return append(data, b...)
+}
+
 func Uint16ToBytes(n uint16) []byte {
 	return []byte{
 		byte(n),
@@ -266,6 +278,99 @@ func FormatBinaryTime(n int, data []byte) ([]byte, error) {
 	}
 }
 
+// AppendBinaryDateTime appends the binary protocol form of a date or
+// datetime like 2015-06-30 12:00:01.000300, leaving out the time
+// part unless withTime is set.
+func AppendBinaryDateTime(data []byte, s []byte, withTime bool) ([]byte, error) {
+	var year, month, day, hour, minute, second, usec int
+	var n int
+	var err error
+	if withTime && len(s) > 10 {
+		n, err = fmt.Sscanf(string(s), "%d-%d-%d %d:%d:%d", &year, &month, &day, &hour, &minute, &second)
+	} else {
+		n, err = fmt.Sscanf(string(s), "%d-%d-%d", &year, &month, &day)
+	}
+	if err != nil || (n != 3 && n != 6) {
+		return nil, fmt.Errorf("invalid datetime %q", s)
+	}
+	if withTime {
+		if usec, err = parseMicroseconds(s); err != nil {
+			return nil, err
+		}
+	}
+
+	date := []byte{byte(year), byte(year >> 8), byte(month), byte(day)}
+	switch {
+	case usec != 0:
+		data = append(data, 11)
+		data = append(data, date...)
+		data = append(data, byte(hour), byte(minute), byte(second))
+		return append(data, Uint32ToBytes(uint32(usec))...), nil
+	case hour != 0 || minute != 0 || second != 0:
+		data = append(data, 7)
+		data = append(data, date...)
+		return append(data, byte(hour), byte(minute), byte(second)), nil
+	case year != 0 || month != 0 || day != 0:
+		data = append(data, 4)
+		return append(data, date...), nil
+	}
+	return append(data, 0), nil
+}
+
+// AppendBinaryTime appends the binary protocol form of a time like
+// -838:59:59.000001.
+func AppendBinaryTime(data []byte, s []byte) ([]byte, error) {
+	var sign byte
+	t := string(s)
+	if strings.HasPrefix(t, "-") {
+		sign, t = 1, t[1:]
+	}
+
+	var hours, minute, second int
+	if n, err := fmt.Sscanf(t, "%d:%d:%d", &hours, &minute, &second); err != nil || n != 3 {
+		return nil, fmt.Errorf("invalid time %q", s)
+	}
+	usec, err := parseMicroseconds(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if hours == 0 && minute == 0 && second == 0 && usec == 0 {
+		return append(data, 0), nil
+	}
+
+	length := byte(8)
+	if usec != 0 {
+		length = 12
+	}
+	data = append(data, length, sign)
+	data = append(data, Uint32ToBytes(uint32(hours/24))...)
+	data = append(data, byte(hours%24), byte(minute), byte(second))
+	if usec != 0 {
+		data = append(data, Uint32ToBytes(uint32(usec))...)
+	}
+	return data, nil
+}
+
+// parseMicroseconds returns the fractional seconds of a temporal
+// value, scaled to microseconds.
+func parseMicroseconds(s []byte) (int, error) {
+	i := bytes.IndexByte(s, '.')
+	if i == -1 {
+		return 0, nil
+	}
+	frac := string(s[i+1:])
+	if len(frac) > 6 {
+		return 0, fmt.Errorf("invalid fractional seconds %q", s)
+	}
+	frac += strings.Repeat("0", 6-len(frac))
+	usec, err := strconv.Atoi(frac)
+	if err != nil {
+		return 0, fmt.Errorf("invalid fractional seconds %q", s)
+	}
+	return usec, nil
+}
+
 var (
 	DONTESCAPE   = byte(255)
 	EncodeMap    [256]byte
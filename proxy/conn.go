@@ -8,17 +8,22 @@ import (
 	"net"
 	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/juju/errors"
 	"github.com/ngaut/arena"
 	log "github.com/ngaut/logging"
 	"github.com/wandoulabs/cm/hack"
 	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/vt/tabletserver"
+	"github.com/wandoulabs/cm/vt/tabletserver/planbuilder"
 )
 
 var DEFAULT_CAPABILITY uint32 = mysql.CLIENT_LONG_PASSWORD | mysql.CLIENT_LONG_FLAG |
 	mysql.CLIENT_CONNECT_WITH_DB | mysql.CLIENT_PROTOCOL_41 |
-	mysql.CLIENT_TRANSACTIONS | mysql.CLIENT_SECURE_CONNECTION
+	mysql.CLIENT_TRANSACTIONS | mysql.CLIENT_SECURE_CONNECTION |
+	mysql.CLIENT_SESSION_TRACK
 
 //client <-> proxy
 type Conn struct {
@@ -38,6 +43,79 @@ type Conn struct {
 	alloc        arena.ArenaAllocator
 	txConns      map[string]*mysql.SqlConn
 	lastCmd      string
+	sessionState []byte        //pending session state changes for the next OK packet
+	queryTimeout time.Duration //set by proxy_query_timeout, zero for none
+
+	resultRowsLimit int             //set by proxy_max_result_rows, zero for the global one
+	timeZone        *time.Location  //set by time_zone, nil for the one of the backends
+	timeZoneName    string          //the time_zone set on the backend conns, empty for theirs
+	span            Span            //of the query being served if traced
+	setVariables    map[string]bool //local @@ variables the session has set
+
+	stmts          map[uint32]*Stmt //prepared statements by id
+	stmtId         uint32
+	binaryProtocol bool   //replying to a COM_STMT_EXECUTE
+	backendQueries int    //backend queries run for the current command
+	warnings       uint16 //warnings of the current command, sent with its EOF
+
+	infoMu     sync.Mutex //guards the fields below, read by Server.Clients
+	queries    int64
+	lastQuery  string
+	lastActive time.Time
+}
+
+// ConnInfo is a snapshot of the activity of a client connection.
+type ConnInfo struct {
+	Id         uint32
+	User       string
+	Queries    int64 //COM_QUERY and COM_STMT_EXECUTE commands
+	LastQuery  string
+	LastActive time.Time
+}
+
+// Info returns a snapshot of the activity of c.
+func (c *Conn) Info() ConnInfo {
+	c.infoMu.Lock()
+	defer c.infoMu.Unlock()
+
+	return ConnInfo{
+		Id:         c.connectionId,
+		User:       c.user,
+		Queries:    c.queries,
+		LastQuery:  c.lastQuery,
+		LastActive: c.lastActive,
+	}
+}
+
+// maxLastQuery caps the bytes of the last query a conn keeps, large
+// inserts would otherwise stay in memory until the next command.
+const maxLastQuery = 1024
+
+// recordCommand updates the activity of c with a command it received,
+// data is the command payload.
+func (c *Conn) recordCommand(cmd mysql.MYSQL_COMMAND, data []byte) {
+	c.infoMu.Lock()
+	defer c.infoMu.Unlock()
+
+	c.lastActive = time.Now()
+	switch cmd {
+	case mysql.COM_QUERY:
+		c.queries++
+		if len(data) > maxLastQuery {
+			data = data[:maxLastQuery]
+		}
+		c.lastQuery = string(data)
+	case mysql.COM_STMT_EXECUTE:
+		c.queries++
+		if len(data) >= 4 {
+			if s, ok := c.stmts[binary.LittleEndian.Uint32(data[0:4])]; ok {
+				c.lastQuery = s.sql
+				if len(c.lastQuery) > maxLastQuery {
+					c.lastQuery = c.lastQuery[:maxLastQuery]
+				}
+			}
+		}
+	}
 }
 
 func (c *Conn) String() string {
@@ -46,6 +124,12 @@ func (c *Conn) String() string {
 	)
 }
 
+// BackendQueries returns how many queries the last client command sent
+// to the backends, one per shard connection a query was run on.
+func (c *Conn) BackendQueries() int {
+	return c.backendQueries
+}
+
 func (c *Conn) schema() *Schema {
 	return c.server.GetSchema(c.db)
 }
@@ -202,23 +286,57 @@ func (c *Conn) Run() {
 	}
 }
 
+// commandLabels label the metrics of each command, the unknown ones
+// share unknownCommandLabels.
+var (
+	commandLabels = func() (labels [mysql.COM_RESET_CONNECTION + 1]tabletserver.Labels) {
+		for i := range labels {
+			labels[i] = tabletserver.Labels{"command": mysql.MYSQL_COMMAND(i).String()}
+		}
+		return labels
+	}()
+	unknownCommandLabels = tabletserver.Labels{"command": "unknown"}
+)
+
+func labelsOfCommand(cmd byte) tabletserver.Labels {
+	if int(cmd) < len(commandLabels) {
+		return commandLabels[cmd]
+	}
+	return unknownCommandLabels
+}
+
 func (c *Conn) dispatch(data []byte) error {
 	cmd := data[0]
 	data = data[1:]
 
 	log.Debug(c.connectionId, cmd, hack.String(data))
 	c.lastCmd = hack.String(data)
+	c.backendQueries = 0
+	c.warnings = 0
+	c.recordCommand(mysql.MYSQL_COMMAND(cmd), data)
 
+	start := time.Now()
 	token := c.server.GetToken()
 
 	c.server.GetRWlock().RLock()
 	defer func() {
 		c.server.GetRWlock().RUnlock()
 		c.server.ReleaseToken(token)
+		tabletserver.GetMetrics().Histogram("command_seconds", labelsOfCommand(cmd), time.Since(start).Seconds())
+		log.Debugf("connectionId: %d, 1 client query -> %d backend queries", c.connectionId, c.backendQueries)
 	}()
 
 	c.server.IncCounter(mysql.MYSQL_COMMAND(cmd).String())
 
+	// in maintenance the clients may only leave
+	if planbuilder.InMaintenance() && mysql.MYSQL_COMMAND(cmd) != mysql.COM_QUIT {
+		return errors.Trace(planbuilder.ErrMaintenance)
+	}
+
+	if err := c.checkCommand(mysql.MYSQL_COMMAND(cmd), data); err != nil {
+		return errors.Trace(err)
+	}
+
 	switch mysql.MYSQL_COMMAND(cmd) {
 	case mysql.COM_QUIT:
 		c.Close()
@@ -227,25 +345,22 @@ func (c *Conn) dispatch(data []byte) error {
 		return c.handleQuery(hack.String(data))
 	case mysql.COM_PING:
 		return c.writeOkFlush(nil)
+	case mysql.COM_DEBUG:
+		return c.handleDebug()
 	case mysql.COM_INIT_DB:
-		log.Debug(cmd, hack.String(data))
-		if err := c.useDB(hack.String(data)); err != nil {
-			return errors.Trace(err)
-		}
-
-		return c.writeOkFlush(nil)
+		return c.handleInitDB(data)
 	case mysql.COM_FIELD_LIST:
 		return c.handleFieldList(data)
 	case mysql.COM_STMT_PREPARE:
-		// not support server side prepare yet
+		return c.handleStmtPrepare(string(data))
 	case mysql.COM_STMT_EXECUTE:
-		log.Fatal("not support", data)
+		return c.handleStmtExecute(data)
 	case mysql.COM_STMT_CLOSE:
 		return c.handleStmtClose(data)
 	case mysql.COM_STMT_SEND_LONG_DATA:
 		log.Fatal("not support", data)
 	case mysql.COM_STMT_RESET:
-		log.Fatal("not support", data)
+		return c.handleStmtReset(data)
 	default:
 		msg := fmt.Sprintf("command %d not supported now", cmd)
 		return mysql.NewError(mysql.ER_UNKNOWN_ERROR, msg)
@@ -254,17 +369,60 @@ func (c *Conn) dispatch(data []byte) error {
 	return nil
 }
 
+// handleDebug answers COM_DEBUG, with which admin tools ask the server
+// to dump its debug information to the log.
+func (c *Conn) handleDebug() error {
+	log.Debugf("COM_DEBUG %+v, db: %s, status: %d, transactions: %d, prepared statements: %d",
+		c.Info(), c.db, c.status, len(c.txConns), len(c.stmts))
+
+	return c.writeOkFlush(nil)
+}
+
+// handleInitDB switches the session db like USE does, unknown dbs
+// are reported as ER_BAD_DB_ERROR by the caller.
+func (c *Conn) handleInitDB(data []byte) error {
+	log.Debug(mysql.COM_INIT_DB, hack.String(data))
+	if err := c.useDB(hack.String(data)); err != nil {
+		return errors.Trace(err)
+	}
+
+	return c.writeOkFlush(nil)
+}
+
 func (c *Conn) useDB(db string) error {
 	db = strings.ToLower(db)
 	if s := c.server.GetSchema(db); s == nil {
 		return mysql.NewDefaultError(mysql.ER_BAD_DB_ERROR, db)
 	} else {
 		c.db = db
+		c.trackSessionState(mysql.SESSION_TRACK_SCHEMA, mysql.PutLengthEncodedString([]byte(db), c.alloc))
 	}
 
 	return nil
 }
 
+func (c *Conn) sessionTrackEnabled() bool {
+	return c.capability&DEFAULT_CAPABILITY&mysql.CLIENT_SESSION_TRACK > 0
+}
+
+// trackSessionState queues a session state change, it is sent to
+// the client with the next OK packet if the client asked for it.
+func (c *Conn) trackSessionState(typ byte, data []byte) {
+	if !c.sessionTrackEnabled() {
+		return
+	}
+
+	c.sessionState = append(c.sessionState, typ)
+	c.sessionState = append(c.sessionState, mysql.PutLengthEncodedInt(uint64(len(data)))...)
+	c.sessionState = append(c.sessionState, data...)
+}
+
+func (c *Conn) trackSystemVariable(name string, value string) {
+	data := mysql.PutLengthEncodedString([]byte(name), c.alloc)
+	data = append(data, mysql.PutLengthEncodedString([]byte(value), c.alloc)...)
+	c.trackSessionState(mysql.SESSION_TRACK_SYSTEM_VARIABLES, data)
+}
+
 func (c *Conn) writeOkFlush(r *mysql.Result) error {
 	if err := c.writeOK(r); err != nil {
 		return errors.Trace(err)
@@ -281,10 +439,23 @@ func (c *Conn) writeOK(r *mysql.Result) error {
 	data = append(data, mysql.OK_HEADER)
 	data = append(data, mysql.PutLengthEncodedInt(r.AffectedRows)...)
 	data = append(data, mysql.PutLengthEncodedInt(r.InsertId)...)
+	status := r.Status
+	if len(c.sessionState) > 0 {
+		status |= mysql.SERVER_SESSION_STATE_CHANGED
+	}
 	if c.capability&mysql.CLIENT_PROTOCOL_41 > 0 {
-		data = append(data, byte(r.Status), byte(r.Status>>8))
+		data = append(data, byte(status), byte(status>>8))
 		data = append(data, 0, 0)
 	}
+	if c.sessionTrackEnabled() {
+		//empty info
+		data = append(data, 0)
+		if len(c.sessionState) > 0 {
+			data = append(data, mysql.PutLengthEncodedInt(uint64(len(c.sessionState)))...)
+			data = append(data, c.sessionState...)
+			c.sessionState = c.sessionState[:0]
+		}
+	}
 
 	err := c.writePacket(data)
 	if err != nil {
@@ -297,8 +468,9 @@ func (c *Conn) writeOK(r *mysql.Result) error {
 func (c *Conn) writeError(e error) error {
 	var m *mysql.SqlError
 	var ok bool
-	if m, ok = e.(*mysql.SqlError); !ok {
-		m = mysql.NewError(mysql.ER_UNKNOWN_ERROR, e.Error())
+	if m, ok = errors.Cause(e).(*mysql.SqlError); !ok {
+		m = &mysql.SqlError{}
+		m.Code, m.State, m.Message = planbuilder.MySQLError(e)
 	}
 
 	data := make([]byte, 4, 16+len(m.Message))
@@ -324,7 +496,7 @@ func (c *Conn) writeEOF(status uint16) error {
 
 	data = append(data, mysql.EOF_HEADER)
 	if c.capability&mysql.CLIENT_PROTOCOL_41 > 0 {
-		data = append(data, 0, 0)
+		data = append(data, byte(c.warnings), byte(c.warnings>>8))
 		data = append(data, byte(status), byte(status>>8))
 	}
 
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"github.com/juju/errors"
+	log "github.com/ngaut/logging"
+	"github.com/wandoulabs/cm/sqlparser"
+)
+
+// handleDDL runs a DDL on the backends and then follows it in the
+// schema the proxy plans with, so that the cached rows and the plans of
+// the table match its new columns.
+func (c *Conn) handleDDL(ddl *sqlparser.DDL, sql string) error {
+	if err := c.handleExec(ddl, sql, nil, true); err != nil {
+		return errors.Trace(err)
+	}
+
+	si, ok := c.server.GetRowCacheSchema(c.db)
+	if !ok {
+		return nil
+	}
+	switch ddl.Action {
+	case sqlparser.AST_ALTER:
+		si.AlterTable(ddl)
+	case sqlparser.AST_DROP:
+		si.DropTable(string(ddl.Table))
+	case sqlparser.AST_CREATE, sqlparser.AST_RENAME:
+		if ddl.Action == sqlparser.AST_RENAME {
+			si.DropTable(string(ddl.Table))
+		}
+		if err := si.CreateOrUpdateTable(string(ddl.NewName)); err != nil {
+			// the DDL did run, only the proxy doesn't know the table
+			log.Errorf("table %s not loaded: %v", ddl.NewName, errors.ErrorStack(err))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"github.com/juju/errors"
+	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/sqlparser"
+	"github.com/wandoulabs/cm/sqltypes"
+	"github.com/wandoulabs/cm/vt/tabletserver"
+	"github.com/wandoulabs/cm/vt/tabletserver/planbuilder"
+)
+
+// execSubquery runs a dml on a cached table whose rows only the
+// subquery of plan finds. The pks it selects stay locked by the backend
+// until the dml, run on these pks alone, commits, so their cached rows
+// can't be filled again in between.
+func (c *Conn) execSubquery(plan *planbuilder.ExecPlan, ti *tabletserver.TableInfo, stmt sqlparser.Statement, args []interface{}) error {
+	bindVars := makeBindVars(args)
+	conns, err := c.getShardConns(false, stmt, bindVars)
+	if err != nil {
+		return errors.Trace(err)
+	} else if len(conns) == 0 {
+		return errors.Errorf("not server found %s", plan.FullQuery.Query)
+	}
+	defer c.closeShardConns(conns)
+
+	// the pks are bound into the queries, they go as text
+	binary := c.binaryProtocol
+	c.binaryProtocol = false
+	defer func() { c.binaryProtocol = binary }()
+
+	if err = c.beginShardConns(conns); err != nil {
+		return errors.Trace(err)
+	}
+	rs, err := c.execSubqueryPKs(plan, ti, conns, bindVars)
+	if err != nil {
+		c.rollbackShardConns(conns)
+		return errors.Trace(err)
+	}
+	if err = c.commitShardConns(conns); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(c.mergeExecResult(rs))
+}
+
+// execSubqueryPKs selects the pks of the rows of plan for update,
+// invalidates them and runs the dml on them.
+func (c *Conn) execSubqueryPKs(plan *planbuilder.ExecPlan, ti *tabletserver.TableInfo, conns []*mysql.SqlConn, bindVars map[string]interface{}) ([]*mysql.Result, error) {
+	bindVars["#maxLimit"] = noLimit
+	sql, err := planbuilder.GenerateBoundQuery(plan.Subquery, bindVars)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	rs, err := c.executeInShard(conns, sql, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var rows [][]sqltypes.Value
+	var keys []string
+	for _, r := range rs {
+		if r.Resultset == nil {
+			continue
+		}
+		for _, v := range r.Values {
+			row := make([]sqltypes.Value, len(v))
+			for i := range v {
+				if row[i], err = sqltypes.BuildValue(v[i]); err != nil {
+					return nil, errors.Trace(err)
+				}
+			}
+			rows = append(rows, row)
+			keys = append(keys, pkKey(row))
+		}
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	invalidCache(ti, keys)
+
+	bindVars["#pk"] = sqlparser.TupleEqualityList{Columns: ti.Indexes[0].Columns, Rows: rows}
+	if sql, err = planbuilder.GenerateBoundQuery(plan.OuterQuery, bindVars); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	rs, err = c.executeInShard(conns, sql, nil)
+	return rs, errors.Trace(err)
+}
@@ -0,0 +1,435 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wandoulabs/cm/config"
+	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/vt/schema"
+	"github.com/wandoulabs/cm/vt/tabletserver"
+	"github.com/wandoulabs/cm/vt/tabletserver/fakecache"
+)
+
+// dmlServer runs the queries of a client on one shard, completing them
+// with its queued results in turn.
+type dmlServer struct {
+	fakeServer
+	si    *tabletserver.SchemaInfo
+	shard *Shard
+	queue []interface{}
+}
+
+func (s *dmlServer) GetRowCacheSchema(db string) (*tabletserver.SchemaInfo, bool) {
+	return s.si, true
+}
+
+func (s *dmlServer) GetShardIds() []string { return []string{"shard1"} }
+
+func (s *dmlServer) GetShard(shardId string) *Shard { return s.shard }
+
+func (s *dmlServer) AsynExec(task *execTask) {
+	s.tasks = append(s.tasks, task)
+	task.rs[task.idx] = &mysql.Result{}
+	if len(s.queue) > 0 {
+		task.rs[task.idx], s.queue = s.queue[0], s.queue[1:]
+	}
+	task.done <- task.idx
+}
+
+// newDMLConn returns a conn in a transaction on the shard of a server
+// caching the rows of t in fm. Out of it the shard hands out an idle
+// backend conn.
+func newDMLConn(fm *fakecache.Memcache) (*Conn, *bufConn, *dmlServer) {
+	ta := schema.NewTable("t")
+	ta.AddColumn("id", "bigint(20)", "", nil, "")
+	ta.AddColumn("name", "varchar(32)", "", nil, "")
+	ta.AddColumn("email", "varchar(64)", "", nil, "")
+	ta.AddIndex("PRIMARY").AddColumn("id", 0)
+	ta.PKColumns = []int{0}
+	ta.CacheType = schema.CACHE_RW
+
+	cp := tabletserver.NewCachePool("test", tabletserver.RowCacheConfig{}, 0, 0)
+	cp.Connect(fm.Addr(), 1)
+	db, _ := mysql.Open("", "", "", "")
+	db.SetMaxIdleConnNum(1)
+	db.PushConn(&mysql.MySqlConn{}, nil)
+	s := &dmlServer{
+		si:    tabletserver.NewSchemaInfoOf(cp, ta),
+		shard: &Shard{cfg: config.ShardConfig{Id: "shard1"}, master: db},
+	}
+
+	c, bc := newTestConn(s)
+	c.status |= mysql.SERVER_STATUS_IN_TRANS
+	c.txConns = map[string]*mysql.SqlConn{"shard1": &mysql.SqlConn{MySqlConn: &mysql.MySqlConn{}}}
+	return c, bc, s
+}
+
+func pkResult(ids ...int64) *mysql.Result {
+	r := &mysql.Result{Resultset: &mysql.Resultset{}}
+	for _, id := range ids {
+		r.Values = append(r.Values, mysql.RowValue{id})
+	}
+	return r
+}
+
+func TestUpdateSubquery(t *testing.T) {
+	fm := fakecache.New()
+	defer fm.Close()
+	c, bc, s := newDMLConn(fm)
+	ti := s.si.GetTable("t")
+	ti.Cache.Set("2--", []byte("cached"), 0)
+
+	s.queue = []interface{}{pkResult(1, 3), &mysql.Result{AffectedRows: 2}}
+	if err := c.handleQuery("update t set name = 'a' where email = 'b' order by name limit 5"); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.tasks) != 2 {
+		t.Fatal(len(s.tasks))
+	}
+	if sql := s.tasks[0].sql; sql != "select id from t where email = 'b' order by name asc limit 5 for update" {
+		t.Fatal(sql)
+	}
+	if sql := s.tasks[1].sql; sql != "update t set name = 'a' where id in (1, 3) order by name asc limit 5" {
+		t.Fatal(sql)
+	}
+	for _, key := range []string{"1--", "3--"} {
+		if item, ok := fm.Item(ti.Cache.CacheKey(key)); !ok || item.Flags != tabletserver.RC_DELETED {
+			t.Fatal(key, item, ok)
+		}
+	}
+	if item, ok := fm.Item(ti.Cache.CacheKey("2--")); !ok || item.Flags == tabletserver.RC_DELETED {
+		t.Fatal("row not selected was invalidated", item, ok)
+	}
+	if c.affectedRows != 2 {
+		t.Fatal(c.affectedRows)
+	}
+	if b := bc.Bytes(); len(b) < 5 || b[4] != mysql.OK_HEADER {
+		t.Fatal(b)
+	}
+}
+
+func TestUpdateSubqueryNoRows(t *testing.T) {
+	fm := fakecache.New()
+	defer fm.Close()
+	c, bc, s := newDMLConn(fm)
+
+	s.queue = []interface{}{pkResult()}
+	if err := c.handleQuery("update t set name = 'a' where email = 'b'"); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.tasks) != 1 {
+		t.Fatal("dml run without rows", len(s.tasks))
+	}
+	if sql := s.tasks[0].sql; sql != "select id from t where email = 'b' limit 18446744073709551615 for update" {
+		t.Fatal(sql)
+	}
+	if c.affectedRows != 0 {
+		t.Fatal(c.affectedRows)
+	}
+	if b := bc.Bytes(); len(b) < 5 || b[4] != mysql.OK_HEADER {
+		t.Fatal(b)
+	}
+}
+
+func TestDeleteSubquery(t *testing.T) {
+	fm := fakecache.New()
+	defer fm.Close()
+	c, bc, s := newDMLConn(fm)
+	ti := s.si.GetTable("t")
+
+	s.queue = []interface{}{pkResult(4, 9), &mysql.Result{AffectedRows: 2}}
+	if err := c.handleQuery("delete from t where email = 'b' order by name desc limit 2"); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.tasks) != 2 {
+		t.Fatal(len(s.tasks))
+	}
+	if sql := s.tasks[0].sql; sql != "select id from t where email = 'b' order by name desc limit 2 for update" {
+		t.Fatal(sql)
+	}
+	if sql := s.tasks[1].sql; sql != "delete from t where id in (4, 9) order by name desc limit 2" {
+		t.Fatal(sql)
+	}
+	for _, key := range []string{"4--", "9--"} {
+		if item, ok := fm.Item(ti.Cache.CacheKey(key)); !ok || item.Flags != tabletserver.RC_DELETED {
+			t.Fatal(key, item, ok)
+		}
+	}
+	if c.affectedRows != 2 {
+		t.Fatal(c.affectedRows)
+	}
+	if b := bc.Bytes(); len(b) < 5 || b[4] != mysql.OK_HEADER {
+		t.Fatal(b)
+	}
+}
+
+func TestStmtDeleteSubquery(t *testing.T) {
+	fm := fakecache.New()
+	defer fm.Close()
+	c, _, s := newDMLConn(fm)
+	ti := s.si.GetTable("t")
+
+	stmt, err := c.prepareStmt("delete from t where email = ? order by name limit 1", c.getTableSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.queue = []interface{}{pkResult(5), &mysql.Result{AffectedRows: 1}}
+	if err := c.handleStmtExecute(executePacket(stmt.id, 7, true)); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.tasks) != 2 {
+		t.Fatal(len(s.tasks))
+	}
+	// the bound queries go as text
+	for _, task := range s.tasks {
+		if task.binary || task.args != nil {
+			t.Fatal(task.sql, task.binary, task.args)
+		}
+	}
+	if sql := s.tasks[0].sql; sql != "select id from t where email = 7 order by name asc limit 1 for update" {
+		t.Fatal(sql)
+	}
+	if sql := s.tasks[1].sql; sql != "delete from t where id in (5) order by name asc limit 1" {
+		t.Fatal(sql)
+	}
+	if item, ok := fm.Item(ti.Cache.CacheKey("5--")); !ok || item.Flags != tabletserver.RC_DELETED {
+		t.Fatal(item, ok)
+	}
+	if c.binaryProtocol {
+		t.Fatal("binary protocol left on")
+	}
+}
+
+func TestStmtSelectRowCache(t *testing.T) {
+	fm := fakecache.New()
+	defer fm.Close()
+	c, bc, s := newDMLConn(fm)
+	ti := s.si.GetTable("t")
+	ti.Cache.Set("1--", []byte{1, '1', 1, 'a', 1, 'b'}, 0)
+
+	stmt, err := c.prepareStmt("select * from t where id = ?", c.getTableSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a hit is sent from the cache, in binary
+	if err := c.handleStmtExecute(executePacket(stmt.id, 1, true)); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.tasks) != 0 {
+		t.Fatal(len(s.tasks))
+	}
+	var packets [][]byte
+	for b := bc.Bytes(); len(b) > 0; {
+		n := int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+		packets, b = append(packets, b[4:4+n]), b[4+n:]
+	}
+	// column count, 3 fields, EOF, the row, EOF
+	if len(packets) != 7 || packets[5][0] != mysql.OK_HEADER || len(packets[5]) != 1+1+8+2+2 {
+		t.Fatal(packets)
+	}
+
+	// a miss reads the row as text, which is cached
+	fields := []*mysql.Field{
+		{Name: []byte("id"), Type: mysql.MYSQL_TYPE_LONGLONG},
+		{Name: []byte("name"), Type: mysql.MYSQL_TYPE_VAR_STRING},
+		{Name: []byte("email"), Type: mysql.MYSQL_TYPE_VAR_STRING},
+	}
+	row := mysql.RowData{1, '2', 1, 'c', 1, 'd'}
+	s.queue = []interface{}{&mysql.Result{Resultset: &mysql.Resultset{
+		Fields:   fields,
+		RowDatas: []mysql.RowData{row},
+		Values:   []mysql.RowValue{{int64(2), []byte("c"), []byte("d")}},
+	}}}
+	if err := c.handleStmtExecute(executePacket(stmt.id, 2, false)); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.tasks) != 1 || s.tasks[0].binary {
+		t.Fatal(len(s.tasks))
+	}
+	if item, ok := fm.Item(ti.Cache.CacheKey("2--")); !ok || string(item.Value) != string(row) {
+		t.Fatal(item, ok)
+	}
+	if c.binaryProtocol {
+		t.Fatal("binary protocol left on")
+	}
+}
+
+func TestUpsertWithoutPK(t *testing.T) {
+	fm := fakecache.New()
+	defer fm.Close()
+	c, bc, s := newDMLConn(fm)
+
+	for _, sql := range []string{
+		"insert into t(name, email) values ('a', 'b') on duplicate key update name = values(name)",
+		"insert into t(id, name) select id, name from t where email = 'b' on duplicate key update name = 'c'",
+		"insert into t(id, name) values (1, 'a') on duplicate key update id = id + 1",
+	} {
+		s.tasks = nil
+		bc.buf.Reset()
+		s.queue = []interface{}{&mysql.Result{AffectedRows: 1}}
+		if err := c.handleQuery(sql); err != nil {
+			t.Fatal(sql, err)
+		}
+		if len(s.tasks) != 1 || s.tasks[0].sql != sql {
+			t.Fatal(sql, len(s.tasks))
+		}
+		if b := bc.Bytes(); len(b) < 5 || b[4] != mysql.OK_HEADER {
+			t.Fatal(sql, b)
+		}
+	}
+
+	// prepared ones are planned when prepared
+	stmt, err := c.prepareStmt("insert into t(name) values (?) on duplicate key update name = values(name)", c.getTableSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.tasks = nil
+	if err := c.handleStmtExecute(executePacket(stmt.id, 7, true)); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.tasks) != 1 {
+		t.Fatal(len(s.tasks))
+	}
+}
+
+func TestRewriteCachedRow(t *testing.T) {
+	defer func(rewrite bool) { rewriteCachedRows = rewrite }(rewriteCachedRows)
+	rewriteCachedRows = true
+
+	fm := fakecache.New()
+	defer fm.Close()
+	c, _, s := newDMLConn(fm)
+	ti := s.si.GetTable("t")
+	row := []byte{1, '1', 1, 'a', 1, 'b'}
+
+	// autocommitted, the cached row gets the values
+	c.status = mysql.SERVER_STATUS_AUTOCOMMIT
+	ti.Cache.Set("1--", row, 0)
+	s.queue = []interface{}{&mysql.Result{AffectedRows: 1}}
+	if err := c.handleQuery("update t set name = 'x' where id = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if item, ok := fm.Item(ti.Cache.CacheKey("1--")); !ok || item.Flags == tabletserver.RC_DELETED || string(item.Value) != string([]byte{1, '1', 1, 'x', 1, 'b'}) {
+		t.Fatal(item, ok)
+	}
+
+	// in a transaction that may roll back it is invalidated
+	c.status = mysql.SERVER_STATUS_AUTOCOMMIT | mysql.SERVER_STATUS_IN_TRANS
+	ti.Cache.Set("2--", row, 0)
+	s.queue = []interface{}{&mysql.Result{AffectedRows: 1}}
+	if err := c.handleQuery("update t set name = 'x' where id = 2"); err != nil {
+		t.Fatal(err)
+	}
+	if item, ok := fm.Item(ti.Cache.CacheKey("2--")); !ok || item.Flags != tabletserver.RC_DELETED {
+		t.Fatal(item, ok)
+	}
+}
+
+func TestAlterTable(t *testing.T) {
+	fm := fakecache.New()
+	defer fm.Close()
+	c, bc, s := newDMLConn(fm)
+	ti := s.si.GetTable("t")
+	ti.Cache.Set("1--", []byte{1, '1', 1, 'a', 1, 'b'}, 0)
+
+	sql := "alter table t add column age int(11)"
+	if err := c.handleQuery(sql); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.tasks) != 1 || s.tasks[0].sql != sql {
+		t.Fatal(len(s.tasks))
+	}
+	if b := bc.Bytes(); len(b) < 5 || b[4] != mysql.OK_HEADER {
+		t.Fatal(b)
+	}
+	// the proxy plans with the new column, the rows cached without it
+	// are gone
+	if ti := s.si.GetTable("t"); len(ti.Columns) != 4 || ti.Columns[3].Name != "age" {
+		t.Fatal(ti.Columns)
+	}
+	if item, ok := fm.Item(ti.Cache.CacheKey("1--")); ok && item.Flags != tabletserver.RC_DELETED {
+		t.Fatal("row cached with the old columns", item)
+	}
+}
+
+func TestPlansCached(t *testing.T) {
+	fm := fakecache.New()
+	defer fm.Close()
+	c, _, s := newDMLConn(fm)
+
+	plans := func() []string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/debug/plans/test", nil)
+		s.si.ServePlans(w, req)
+		var entries []struct{ SQL string }
+		if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+			t.Fatal(err, w.Body.String())
+		}
+		var sqls []string
+		for _, e := range entries {
+			sqls = append(sqls, e.SQL)
+		}
+		return sqls
+	}
+
+	const sql = "update t set name = 'a' where id = 1"
+	stmt, err := c.prepareStmt("update t set name = 'a' where id = ?", c.getTableSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.handleQuery(sql); err != nil {
+		t.Fatal(err)
+	}
+	if got := plans(); !reflect.DeepEqual(got, []string{sql, stmt.sql}) {
+		t.Fatal(got)
+	}
+
+	// the plans of t are made again after it changes, the prepared one
+	// too
+	if err := c.handleQuery("alter table t add column age int(11)"); err != nil {
+		t.Fatal(err)
+	}
+	if got := plans(); len(got) != 0 {
+		t.Fatal(got)
+	}
+	if _, _, err := c.bindStmtExecute(executePacket(stmt.id, 1, true)); err != nil {
+		t.Fatal(err)
+	}
+	if got := plans(); !reflect.DeepEqual(got, []string{stmt.sql}) {
+		t.Fatal(got)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	pm := tabletserver.NewPrometheusMetrics("cm")
+	tabletserver.SetMetrics(pm)
+	defer tabletserver.SetMetrics(nil)
+
+	fm := fakecache.New()
+	defer fm.Close()
+	c, _, s := newDMLConn(fm)
+	s.si.GetTable("t").Cache.Set("1--", []byte{1, '1', 1, 'a', 1, 'b'}, 0)
+	for i := 0; i < 2; i++ {
+		if err := c.dispatch(append([]byte{byte(mysql.COM_QUERY)}, "select * from t where id = 1"...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	body := string(pm.Text())
+	for _, line := range []string{
+		`cm_command_seconds_count{command="COM_QUERY"} 2`,
+		`cm_plans{plan="PK_IN",table="t"} 2`,
+		`cm_plan_cache_hits 1`,
+		`cm_plan_cache_misses 1`,
+		`cm_rowcache_hits{table="t"} 2`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("%q misses %q", body, line)
+		}
+	}
+}
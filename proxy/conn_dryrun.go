@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/sqlparser"
+	"github.com/wandoulabs/cm/sqltypes"
+	"github.com/wandoulabs/cm/vt/schema"
+	"github.com/wandoulabs/cm/vt/tabletserver/planbuilder"
+)
+
+// dryrunDirective in a DML makes the proxy answer with the queries it
+// would send and where, instead of running it.
+const dryrunDirective = "dryrun"
+
+// dryrunColumns are the columns of the dry run result, one row per query.
+var dryrunColumns = []string{"kind", "shards", "query"}
+
+// noLimit binds the row cap of the subqueries of dmls, it is the
+// largest LIMIT mysql takes.
+const noLimit = uint64(18446744073709551615)
+
+// isDryrun reports whether stmt is a DML carrying the /* dryrun */ comment.
+func isDryrun(stmt sqlparser.Statement) bool {
+	var comments sqlparser.Comments
+	switch v := stmt.(type) {
+	case *sqlparser.Insert:
+		comments = v.Comments
+	case *sqlparser.Replace:
+		comments = v.Comments
+	case *sqlparser.Update:
+		comments = v.Comments
+	case *sqlparser.Delete:
+		comments = v.Comments
+	}
+	for _, comment := range comments {
+		s := strings.TrimSuffix(strings.TrimPrefix(string(comment), "/*"), "*/")
+		if strings.EqualFold(strings.TrimSpace(s), dryrunDirective) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleDryrun writes the queries the DML stmt would run on the shards.
+func (c *Conn) handleDryrun(stmt sqlparser.Statement, sql string, args []interface{}) error {
+	r, err := c.dryrun(stmt, sql, args)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(c.writeResultset(c.status, r))
+}
+
+// dryrun plans stmt the way handleExec does and builds its dry run
+// resultset, failing where execPlan would.
+func (c *Conn) dryrun(stmt sqlparser.Statement, sql string, args []interface{}) (*mysql.Resultset, error) {
+	plan, ti, err := c.getPlanAndTableInfo(stmt, sql)
+	if err != nil && errors.Cause(err) != planbuilder.ErrTableNotFound {
+		return nil, errors.Trace(err)
+	}
+	plan, _, path, err := dmlPathOf(plan, ti, stmt, sql)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	bindVars := makeBindVars(args)
+	shards, err := c.getShardList(stmt, bindVars)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	ids := make([]string, 0, len(shards))
+	for _, shard := range shards {
+		ids = append(ids, shard.String())
+	}
+
+	r, err := c.buildDryrun(plan, path, sql, bindVars, ids)
+	return r, errors.Trace(err)
+}
+
+// buildDryrun builds the dry run resultset of sql, run by execPlan with
+// plan along path: sql itself, or the subquery of plan and its outer
+// query, whose pks the subquery selects.
+func (c *Conn) buildDryrun(plan *planbuilder.ExecPlan, path dmlPath, sql string, bindVars map[string]interface{}, shards []string) (*mysql.Resultset, error) {
+	shardList := []byte(strings.Join(shards, ","))
+	var rows []mysql.RowValue
+	if path == dmlBySubquery {
+		vars := copyBindVars(bindVars)
+		vars["#maxLimit"] = noLimit
+		subquery, err := plan.Subquery.GenerateQuery(vars)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		vars["#pk"] = sqltypes.MakeNumeric([]byte(":#pk"))
+		outer, err := plan.OuterQuery.GenerateQuery(vars)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		rows = append(rows, mysql.RowValue{[]byte("subquery"), shardList, subquery}, mysql.RowValue{[]byte("outer"), shardList, outer})
+	} else {
+		exec := []byte(sql)
+		if len(bindVars) > 0 && plan != nil && plan.FullQuery != nil {
+			var err error
+			if exec, err = plan.FullQuery.GenerateQuery(bindVars); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		rows = append(rows, mysql.RowValue{[]byte("exec"), shardList, exec})
+	}
+
+	nameTypes := make([]schema.TableColumn, len(dryrunColumns))
+	for i, name := range dryrunColumns {
+		nameTypes[i] = schema.TableColumn{Name: name, SqlType: mysql.MYSQL_TYPE_VAR_STRING, Collation: "utf8_general_ci"}
+	}
+	r, err := c.buildResultset(nameTypes, rows)
+	return r, errors.Trace(err)
+}
+
+func copyBindVars(bindVars map[string]interface{}) map[string]interface{} {
+	vars := make(map[string]interface{}, len(bindVars)+2)
+	for k, v := range bindVars {
+		vars[k] = v
+	}
+	return vars
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/ngaut/arena"
+	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/sqlparser"
+	"github.com/wandoulabs/cm/vt/tabletserver/fakecache"
+)
+
+func TestIsDryrun(t *testing.T) {
+	tests := []struct {
+		sql    string
+		dryrun bool
+	}{
+		{"update /* dryrun */ t set name = 'a' where id = 1", true},
+		{"delete /*DRYRUN*/ from t where id = 1", true},
+		{"insert /* dryrun */ into t values (1, 'a')", true},
+		{"update /* other */ t set name = 'a' where id = 1", false},
+		{"delete from t where id = 1", false},
+		{"select /* dryrun */ * from t", false},
+	}
+	for _, tt := range tests {
+		stmt, err := sqlparser.Parse(tt.sql, arena.NewArenaAllocator(1024))
+		if err != nil {
+			t.Fatal(tt.sql, err)
+		}
+		if isDryrun(stmt) != tt.dryrun {
+			t.Error(tt.sql)
+		}
+	}
+}
+
+// parseDryrun returns the rows of a dry run resultset as strings.
+func parseDryrun(t *testing.T, r *mysql.Resultset) [][]string {
+	var names []string
+	for _, f := range r.Fields {
+		names = append(names, string(f.Name))
+	}
+	if !reflect.DeepEqual(names, dryrunColumns) {
+		t.Fatal(names)
+	}
+	var rows [][]string
+	for _, data := range r.RowDatas {
+		row, err := data.ParseText(r.Fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var values []string
+		for _, v := range row {
+			values = append(values, string(v.([]byte)))
+		}
+		rows = append(rows, values)
+	}
+	return rows
+}
+
+// dryrunRows returns the rows of the dry run of sql on the cached t.
+func dryrunRows(t *testing.T, sql string, args []interface{}) [][]string {
+	fm := fakecache.New()
+	defer fm.Close()
+	c, _, s := newDMLConn(fm)
+	stmt, err := sqlparser.Parse(sql, c.alloc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.dryrun(stmt, sql, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.tasks) != 0 {
+		t.Fatal("dry run sent", s.tasks[0].sql)
+	}
+	return parseDryrun(t, r)
+}
+
+func TestDryrunUpdate(t *testing.T) {
+	// by pk, the update is sent as it is
+	sql := "update /* dryrun */ t set name = 'a' where id in (1, 2)"
+	want := [][]string{{"exec", "shard1", sql}}
+	if rows := dryrunRows(t, sql, nil); !reflect.DeepEqual(rows, want) {
+		t.Fatalf("%q", rows)
+	}
+
+	sql = "update /* dryrun */ t set name = 'a' where name = 'b' order by email limit 2"
+	want = [][]string{
+		{"subquery", "shard1", "select id from t where name = 'b' order by email asc limit 2 for update"},
+		{"outer", "shard1", "update /* dryrun */ t set name = 'a' where :#pk order by email asc limit 2"},
+	}
+	if rows := dryrunRows(t, sql, nil); !reflect.DeepEqual(rows, want) {
+		t.Fatalf("%q", rows)
+	}
+
+	// execPlan refuses it
+	fm := fakecache.New()
+	defer fm.Close()
+	c, _, _ := newDMLConn(fm)
+	sql = "update /* dryrun */ t set id = id + 1 where name = 'b'"
+	stmt, err := sqlparser.Parse(sql, c.alloc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.dryrun(stmt, sql, nil); err == nil {
+		t.Fatal("pk change dry run")
+	}
+}
+
+func TestDryrunDelete(t *testing.T) {
+	sql := "delete /* dryrun */ from t where id = :v1"
+	want := [][]string{{"exec", "shard1", "delete /* dryrun */ from t where id = 3"}}
+	if rows := dryrunRows(t, sql, []interface{}{int64(3)}); !reflect.DeepEqual(rows, want) {
+		t.Fatalf("%q", rows)
+	}
+
+	sql = "delete /* dryrun */ from t where name = 'b'"
+	want = [][]string{
+		{"subquery", "shard1", "select id from t where name = 'b' limit 18446744073709551615 for update"},
+		{"outer", "shard1", "delete /* dryrun */ from t where :#pk"},
+	}
+	if rows := dryrunRows(t, sql, nil); !reflect.DeepEqual(rows, want) {
+		t.Fatalf("%q", rows)
+	}
+}
+
+func TestStmtDryrun(t *testing.T) {
+	fm := fakecache.New()
+	defer fm.Close()
+	c, bc, s := newDMLConn(fm)
+
+	stmt, err := c.prepareStmt("delete /* dryrun */ from t where id = ?", c.getTableSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.handleStmtExecute(executePacket(stmt.id, 7, true)); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.tasks) != 0 {
+		t.Fatal("prepared dry run sent", s.tasks[0].sql)
+	}
+	if !bytes.Contains(bc.Bytes(), []byte("delete /* dryrun */ from t where id = 7")) {
+		t.Fatalf("%q", bc.Bytes())
+	}
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/sqlparser"
+	"github.com/wandoulabs/cm/vt/schema"
+	"github.com/wandoulabs/cm/vt/tabletserver/planbuilder"
+)
+
+// explainProxyDirective after EXPLAIN asks for the plan of the proxy
+// rather than the one of the backend.
+const explainProxyDirective = "/*proxy*/"
+
+// explainProxyColumns are the columns of the EXPLAIN /*proxy*/ result.
+var explainProxyColumns = []string{"plan", "reason", "reason_detail", "table", "index", "shards",
+	"full_query", "outer_query", "subquery", "field_query"}
+
+// explainProxyStmt returns the statement of an EXPLAIN /*proxy*/ <stmt>
+// query, false if sql is not one.
+func explainProxyStmt(sql string) (string, bool) {
+	sql = strings.TrimSpace(sql)
+	if len(sql) < len("explain") || !strings.EqualFold(sql[:len("explain")], "explain") {
+		return "", false
+	}
+	rest := strings.TrimSpace(sql[len("explain"):])
+	if !strings.HasPrefix(strings.ToLower(rest), explainProxyDirective) {
+		return "", false
+	}
+	return strings.TrimSpace(rest[len(explainProxyDirective):]), true
+}
+
+// explainAnalyzeStmt returns the select of an ANALYZE <select> statement
+// explained by EXPLAIN /*proxy*/, false if stmt is not one.
+func explainAnalyzeStmt(stmt string) (string, bool) {
+	fields := strings.Fields(stmt)
+	if len(fields) < 2 || !strings.EqualFold(fields[0], "analyze") {
+		return "", false
+	}
+	return strings.TrimSpace(stmt[len(fields[0]):]), true
+}
+
+// handleExplainAnalyze runs the select sql with ExplainAnalyze and writes
+// the analysis as a single JSON row.
+func (c *Conn) handleExplainAnalyze(sql string) error {
+	a, err := c.ExplainAnalyze(sql)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	b, err := json.Marshal(a)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	nameTypes := []schema.TableColumn{{Name: "analysis", SqlType: mysql.MYSQL_TYPE_VAR_STRING, Collation: "utf8_general_ci"}}
+	r, err := c.buildResultset(nameTypes, []mysql.RowValue{{b}})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(c.writeResultset(c.status, r))
+}
+
+// handleExplainProxy writes the plan of sql and the shards it's routed
+// to without running it.
+func (c *Conn) handleExplainProxy(sql string) error {
+	stmt, err := sqlparser.Parse(sql, c.alloc)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	plan, _, err := c.getPlanAndTableInfo(stmt, sql)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	shards, err := c.getShardList(stmt, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	ids := make([]string, 0, len(shards))
+	for _, shard := range shards {
+		ids = append(ids, shard.String())
+	}
+	r, err := c.buildExplainProxy(plan, ids)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(c.writeResultset(c.status, r))
+}
+
+// buildExplainProxy builds the single row resultset describing plan, in
+// explainProxyColumns order. Missing queries are empty.
+func (c *Conn) buildExplainProxy(plan *planbuilder.ExecPlan, shards []string) (*mysql.Resultset, error) {
+	query := func(pq *sqlparser.ParsedQuery) []byte {
+		if pq == nil {
+			return []byte{}
+		}
+		return []byte(pq.Query)
+	}
+	row := mysql.RowValue{
+		[]byte(plan.PlanId.String()),
+		[]byte(plan.Reason.String()),
+		[]byte(plan.ReasonDetail),
+		[]byte(plan.TableName),
+		[]byte(plan.IndexUsed),
+		[]byte(strings.Join(shards, ",")),
+		query(plan.FullQuery),
+		query(plan.OuterQuery),
+		query(plan.Subquery),
+		query(plan.FieldQuery),
+	}
+
+	nameTypes := make([]schema.TableColumn, len(explainProxyColumns))
+	for i, name := range explainProxyColumns {
+		nameTypes[i] = schema.TableColumn{Name: name, SqlType: mysql.MYSQL_TYPE_VAR_STRING, Collation: "utf8_general_ci"}
+	}
+	r, err := c.buildResultset(nameTypes, []mysql.RowValue{row})
+	return r, errors.Trace(err)
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/ngaut/arena"
+	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/vt/tabletserver"
+	"github.com/wandoulabs/cm/vt/tabletserver/fakecache"
+	"github.com/wandoulabs/cm/vt/tabletserver/planbuilder"
+)
+
+func TestExplainProxyStmt(t *testing.T) {
+	tests := []struct {
+		sql  string
+		stmt string
+		ok   bool
+	}{
+		{"explain /*proxy*/ select * from t where id = 1", "select * from t where id = 1", true},
+		{"  EXPLAIN   /*PROXY*/select 1", "select 1", true},
+		{"explain select * from t", "", false},
+		{"explain /* proxy */ select 1", "", false},
+		{"select 1 /*proxy*/", "", false},
+		{"expl", "", false},
+	}
+	for _, tt := range tests {
+		stmt, ok := explainProxyStmt(tt.sql)
+		if stmt != tt.stmt || ok != tt.ok {
+			t.Errorf("%q: %q %v", tt.sql, stmt, ok)
+		}
+	}
+}
+
+func TestBuildExplainProxy(t *testing.T) {
+	plan, err := planbuilder.GetSqlExecPlan("select name from t where id = 1", testStmtTable, arena.NewArenaAllocator(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := newTestConn(&fakeServer{})
+	r, err := c.buildExplainProxy(plan, []string{"shard1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, f := range r.Fields {
+		names = append(names, string(f.Name))
+	}
+	if !reflect.DeepEqual(names, explainProxyColumns) {
+		t.Fatal(names)
+	}
+
+	if len(r.RowDatas) != 1 {
+		t.Fatal(r.RowDatas)
+	}
+	row, err := r.RowDatas[0].ParseText(r.Fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for _, v := range row {
+		values = append(values, string(v.([]byte)))
+	}
+	// pk lookups go through the cache, only the fields query is generated
+	want := []string{"PK_IN", "DEFAULT", "", "t", "PRIMARY", "shard1", "", "", "", "select name from t where 1 != 1"}
+	if !reflect.DeepEqual(values, want) {
+		t.Fatalf("%q", values)
+	}
+}
+
+func TestExplainAnalyzeStmt(t *testing.T) {
+	tests := []struct {
+		stmt string
+		sel  string
+		ok   bool
+	}{
+		{"analyze select * from t where id = 1", "select * from t where id = 1", true},
+		{"ANALYZE  select 1", "select 1", true},
+		{"select * from analyze", "", false},
+		{"analyze", "", false},
+	}
+	for _, tt := range tests {
+		sel, ok := explainAnalyzeStmt(tt.stmt)
+		if sel != tt.sel || ok != tt.ok {
+			t.Errorf("%q: %q %v", tt.stmt, sel, ok)
+		}
+	}
+}
+
+func TestConnExplainAnalyze(t *testing.T) {
+	fm := fakecache.New()
+	defer fm.Close()
+	c, bc, s := newDMLConn(fm)
+	ti := s.si.GetTable("t")
+	ti.Cache.Set("1--", []byte{1, '1', 1, 'a', 1, 'b'}, 0)
+
+	row := &mysql.Result{Resultset: &mysql.Resultset{RowDatas: []mysql.RowData{mysql.RowData("row")}}}
+	s.queue = []interface{}{row, &mysql.Result{Resultset: &mysql.Resultset{}}}
+	a, err := c.ExplainAnalyze("select * from t where id in (1, 2, 3)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []tabletserver.KeyAnalysis{
+		{Key: "1--", Source: tabletserver.SOURCE_CACHE},
+		{Key: "2--", Source: tabletserver.SOURCE_BACKEND},
+		{Key: "3--", Source: tabletserver.SOURCE_ABSENT},
+	}
+	if !reflect.DeepEqual(a.Keys, expect) {
+		t.Fatal(a.Keys)
+	}
+	if a.BackendRows != 1 {
+		t.Fatal(a.BackendRows)
+	}
+	// each miss reads its own row
+	var sqls []string
+	for _, task := range s.tasks {
+		sqls = append(sqls, task.sql)
+	}
+	if !reflect.DeepEqual(sqls, []string{"select * from t where id=2;", "select * from t where id=3;"}) {
+		t.Fatal(sqls)
+	}
+	// nothing was filled
+	if _, ok := fm.Item(ti.Cache.CacheKey("2--")); ok {
+		t.Fatal("explain analyze filled the cache")
+	}
+
+	// and it's what EXPLAIN /*proxy*/ ANALYZE writes
+	s.tasks = nil
+	s.queue = []interface{}{row, &mysql.Result{Resultset: &mysql.Resultset{}}}
+	if err := c.handleQuery("explain /*proxy*/ analyze select * from t where id in (1, 2, 3)"); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.tasks) != 2 || !bytes.Contains(bc.Bytes(), []byte(`"Source":"absent"`)) {
+		t.Fatal(len(s.tasks), string(bc.Bytes()))
+	}
+}
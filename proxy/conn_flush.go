@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// flushedTable is a table named by a FLUSH, db is empty if it isn't
+// qualified.
+type flushedTable struct {
+	db   string
+	name string
+}
+
+// parseFlush recognizes FLUSH [LOCAL | NO_WRITE_TO_BINLOG] TABLES [t1, ...]
+// and the FLUSH CACHE [t1, ...] of the proxy, returning the tables named,
+// nil for all of them, and whether it is a FLUSH CACHE, which the
+// backends don't know. ok is false if sql is neither, or takes locks the
+// proxy can't.
+func parseFlush(sql string) (tables []flushedTable, cache bool, ok bool) {
+	words := strings.Fields(strings.Replace(sql, ",", " ", -1))
+	if len(words) < 2 || !strings.EqualFold(words[0], "flush") {
+		return nil, false, false
+	}
+	words = words[1:]
+	if strings.EqualFold(words[0], "local") || strings.EqualFold(words[0], "no_write_to_binlog") {
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		return nil, false, false
+	}
+	switch strings.ToLower(words[0]) {
+	case "tables", "table":
+	case "cache":
+		cache = true
+	default:
+		return nil, false, false
+	}
+
+	for _, word := range words[1:] {
+		// WITH READ LOCK, FOR EXPORT
+		if strings.EqualFold(word, "with") || strings.EqualFold(word, "for") {
+			return nil, false, false
+		}
+		var table flushedTable
+		if i := strings.LastIndex(word, "."); i >= 0 {
+			table.db = strings.ToLower(strings.Trim(word[:i], "`"))
+			word = word[i+1:]
+		}
+		table.name = strings.Trim(word, "`")
+		tables = append(tables, table)
+	}
+	return tables, cache, true
+}
+
+// handleFlush drops the cached rows of tables, of all the tables of the
+// current db if none is named. FLUSH TABLES is then run by the backends.
+func (c *Conn) handleFlush(sql string, tables []flushedTable, cache bool) error {
+	if len(tables) == 0 {
+		if si, ok := c.server.GetRowCacheSchema(c.db); ok {
+			si.FlushCache(nil)
+		}
+	}
+	byDB := make(map[string][]string)
+	for _, table := range tables {
+		db := table.db
+		if db == "" {
+			db = c.db
+		}
+		byDB[db] = append(byDB[db], table.name)
+	}
+	for db, names := range byDB {
+		if si, ok := c.server.GetRowCacheSchema(db); ok {
+			si.FlushCache(names)
+		}
+	}
+
+	if !cache {
+		return errors.Trace(c.handleShow(nil, sql, nil))
+	}
+	return errors.Trace(c.writeOkFlush(nil))
+}
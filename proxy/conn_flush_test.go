@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/wandoulabs/cm/vt/tabletserver"
+)
+
+func TestParseFlush(t *testing.T) {
+	tests := []struct {
+		sql    string
+		tables []flushedTable
+		cache  bool
+		ok     bool
+	}{
+		{"FLUSH TABLES t1, t2", []flushedTable{{"", "t1"}, {"", "t2"}}, false, true},
+		{"flush cache", nil, true, true},
+		{"FLUSH CACHE `t1`,`Db`.t2", []flushedTable{{"", "t1"}, {"db", "t2"}}, true, true},
+		{"flush local tables", nil, false, true},
+		{"flush no_write_to_binlog tables t1", []flushedTable{{"", "t1"}}, false, true},
+		{"flush tables t1 with read lock", nil, false, false},
+		{"flush tables t1 for export", nil, false, false},
+		{"flush logs", nil, false, false},
+		{"flush", nil, false, false},
+		{"select * from tables", nil, false, false},
+	}
+	for _, tt := range tests {
+		tables, cache, ok := parseFlush(tt.sql)
+		if !reflect.DeepEqual(tables, tt.tables) || cache != tt.cache || ok != tt.ok {
+			t.Errorf("%q: %v %v %v", tt.sql, tables, cache, ok)
+		}
+	}
+}
+
+// flushServer records the dbs whose row caches are asked for.
+type flushServer struct {
+	traceServer
+	dbs []string
+}
+
+func (s *flushServer) GetRowCacheSchema(db string) (*tabletserver.SchemaInfo, bool) {
+	s.dbs = append(s.dbs, db)
+	return s.traceServer.GetRowCacheSchema(db)
+}
+
+func TestHandleFlush(t *testing.T) {
+	s := &flushServer{}
+	c, bc := newTestConn(s)
+	c.db = "test"
+
+	// the tables are flushed in the db they are qualified with
+	if err := c.handleQuery("flush cache t1, other.t2"); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(s.dbs)
+	if !reflect.DeepEqual(s.dbs, []string{"other", "test"}) {
+		t.Fatal(s.dbs)
+	}
+	if p := bc.Bytes(); len(p) < 5 || p[4] != 0 {
+		t.Fatalf("%q", p)
+	}
+
+	// FLUSH CACHE flushes the current db only
+	s.dbs = nil
+	if err := c.handleQuery("flush cache"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.dbs, []string{"test"}) {
+		t.Fatal(s.dbs)
+	}
+
+	// FLUSH TABLES also goes to the backends, of which there are none
+	s.dbs = nil
+	if err := c.handleQuery("flush tables t1"); err == nil {
+		t.Fatal("flush tables not forwarded")
+	}
+	if !reflect.DeepEqual(s.dbs, []string{"test"}) {
+		t.Fatal(s.dbs)
+	}
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"encoding/binary"
+
+	"github.com/juju/errors"
+	"github.com/wandoulabs/cm/hack"
+	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/sqlparser"
+	"github.com/wandoulabs/cm/vt/tabletserver/planbuilder"
+)
+
+// checkCommand rejects the commands the fingerprint policy blocks. It's
+// run by dispatch for every command, whichever way the statement is
+// then run: planned, passed through or prepared.
+func (c *Conn) checkCommand(cmd mysql.MYSQL_COMMAND, data []byte) error {
+	switch cmd {
+	case mysql.COM_QUERY:
+		sql := sqlparser.TrimTrailing(hack.String(data))
+		if explained, ok := explainProxyStmt(sql); ok {
+			sql = explained
+			// EXPLAIN ANALYZE runs it
+			if analyzed, ok := explainAnalyzeStmt(explained); ok {
+				sql = analyzed
+			}
+		}
+		return errors.Trace(planbuilder.CheckPolicySQL(sql, c.alloc))
+	case mysql.COM_STMT_EXECUTE:
+		if len(data) < 4 {
+			return nil
+		}
+		// unknown statements are reported by handleStmtExecute
+		if s, ok := c.stmts[binary.LittleEndian.Uint32(data[0:4])]; ok {
+			return errors.Trace(planbuilder.CheckPolicy(s.s, c.alloc))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/arena"
+	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/sqlparser"
+	"github.com/wandoulabs/cm/vt/tabletserver/planbuilder"
+)
+
+func TestPolicyOnEveryCommand(t *testing.T) {
+	defer planbuilder.SetDeniedFingerprints(nil)
+	var denied []string
+	for _, sql := range []string{
+		"insert into t(id) values (1)",
+		"select * from t where name = @x",
+		"delete from t where id = 1",
+	} {
+		fp, err := sqlparser.Fingerprint(sql, arena.StdAllocator)
+		if err != nil {
+			t.Fatal(sql, err)
+		}
+		denied = append(denied, fp)
+	}
+	planbuilder.SetDeniedFingerprints(denied)
+
+	c, _ := newTestConn(&fakeServer{})
+	blocked := func(cmd mysql.MYSQL_COMMAND, data []byte) bool {
+		err := c.dispatch(append([]byte{byte(cmd)}, data...))
+		return errors.Cause(err) == planbuilder.ErrBlockedQuery
+	}
+
+	// plain inserts and selects of user variables are passed through
+	// without planning
+	if !blocked(mysql.COM_QUERY, []byte("insert into t(id) values (2)")) {
+		t.Fatal("plain insert not blocked")
+	}
+	if err := c.checkCommand(mysql.COM_QUERY, []byte("set @x = 'a'")); err != nil {
+		t.Fatal(err)
+	}
+	if !blocked(mysql.COM_QUERY, []byte("select * from t where name = @x")) {
+		t.Fatal("select of a user variable not blocked")
+	}
+	if !blocked(mysql.COM_QUERY, []byte("explain /*proxy*/ delete from t where id = 2")) {
+		t.Fatal("explained statement not blocked")
+	}
+	if err := c.checkCommand(mysql.COM_QUERY, []byte("insert into t(id, name) values (1, 'a')")); err != nil {
+		t.Fatal(err)
+	}
+
+	// prepared statements are checked when executed
+	s, err := c.prepareStmt("insert into t(id) values (?)", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !blocked(mysql.COM_STMT_EXECUTE, append(mysql.Uint32ToBytes(s.id), 0, 1, 0, 0, 0)) {
+		t.Fatal("prepared insert not blocked")
+	}
+}
+
+func TestMaintenanceOnEveryCommand(t *testing.T) {
+	defer planbuilder.SetMaintenance(false)
+	c, bc := newTestConn(&fakeServer{})
+	query := func(sql string) error {
+		return c.dispatch(append([]byte{byte(mysql.COM_QUERY)}, sql...))
+	}
+
+	planbuilder.SetMaintenance(true)
+	// none of these is planned
+	for _, sql := range []string{"begin", "select 1", "insert into t(id) values (1)", "set autocommit = 1", "show databases"} {
+		if err := query(sql); errors.Cause(err) != planbuilder.ErrMaintenance {
+			t.Fatal(sql, err)
+		}
+	}
+	for _, cmd := range []mysql.MYSQL_COMMAND{mysql.COM_PING, mysql.COM_INIT_DB, mysql.COM_STMT_PREPARE} {
+		if err := c.dispatch([]byte{byte(cmd)}); errors.Cause(err) != planbuilder.ErrMaintenance {
+			t.Fatal(cmd, err)
+		}
+	}
+	if c.inTransaction() || len(bc.Bytes()) != 0 {
+		t.Fatal("command run in maintenance", bc.Bytes())
+	}
+
+	planbuilder.SetMaintenance(false)
+	if err := query("begin"); err != nil {
+		t.Fatal(err)
+	}
+	if !c.inTransaction() {
+		t.Fatal("begin not run")
+	}
+}
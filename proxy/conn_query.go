@@ -3,13 +3,16 @@ package proxy
 import (
 	"bytes"
 	"fmt"
+	"math/rand"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
 
 	"github.com/juju/errors"
+	"github.com/ngaut/arena"
 	log "github.com/ngaut/logging"
+	"github.com/ngaut/sync2"
 	"github.com/wandoulabs/cm/hack"
 	"github.com/wandoulabs/cm/mysql"
 	"github.com/wandoulabs/cm/sqlparser"
@@ -31,8 +34,31 @@ func applyFilter(columnNumbers []int, input mysql.RowValue) (output mysql.RowVal
 }
 
 func (c *Conn) handleQuery(sql string) (err error) {
-	sql = strings.TrimRight(sql, ";")
+	span := c.startSpan("query", sql)
+	defer func() { c.endSpan(span, err) }()
+
+	sql = sqlparser.TrimTrailing(sql)
+	if explained, ok := explainProxyStmt(sql); ok {
+		if analyzed, ok := explainAnalyzeStmt(explained); ok {
+			c.server.IncCounter("explain_analyze")
+			return c.handleExplainAnalyze(analyzed)
+		}
+		c.server.IncCounter("explain_proxy")
+		return c.handleExplainProxy(explained)
+	}
+	if tables, cache, ok := parseFlush(sql); ok {
+		c.server.IncCounter("flush")
+		return c.handleFlush(sql, tables, cache)
+	}
+	// their values live in the sessions of the backends
+	if planbuilder.IsUserVarSelect(sql, c.alloc) {
+		c.server.IncCounter("select")
+		return c.handleShow(nil, sql, nil)
+	}
+
+	parseSpan := c.childSpan("parse")
 	stmt, err := sqlparser.Parse(sql, c.alloc)
+	parseSpan.Finish(err)
 	if err != nil {
 		log.Warning(c.connectionId, sql, err)
 		return c.handleShow(stmt, sql, nil)
@@ -46,7 +72,9 @@ func (c *Conn) handleQuery(sql string) (err error) {
 		return c.handleSelect(v, sql, nil)
 	case *sqlparser.Insert:
 		c.server.IncCounter("insert")
-		return c.handleExec(stmt, sql, nil, true)
+		// plain inserts can't touch cached rows, INSERT IGNORE and
+		// upserts can
+		return c.handleExec(stmt, sql, nil, !v.Ignore && v.OnDup == nil)
 	case *sqlparser.Replace:
 		c.server.IncCounter("replace")
 		return c.handleExec(stmt, sql, nil, false)
@@ -59,6 +87,9 @@ func (c *Conn) handleQuery(sql string) (err error) {
 	case *sqlparser.Set:
 		c.server.IncCounter("set")
 		return c.handleSet(v, sql)
+	case *sqlparser.DDL:
+		c.server.IncCounter("ddl")
+		return c.handleDDL(v, sql)
 	case *sqlparser.SimpleSelect:
 		c.server.IncCounter("simple_select")
 		return c.handleSimpleSelect(sql, v)
@@ -126,6 +157,10 @@ func (c *Conn) getConn(n *Shard, isSelect bool) (co *mysql.SqlConn, err error) {
 		return nil, errors.Trace(err)
 	}
 
+	if err = co.SetTimeZone(c.timeZoneName); err != nil {
+		return nil, errors.Trace(err)
+	}
+
 	return
 }
 
@@ -136,6 +171,8 @@ func (c *Conn) getShardConns(isSelect bool, stmt sqlparser.Statement, bindVars m
 	} else if shards == nil {
 		return nil, nil
 	}
+	// the rows of queries without ORDER BY come in shard order
+	sort.Sort(shardsById(shards))
 
 	conns := make([]*mysql.SqlConn, 0, len(shards))
 
@@ -153,39 +190,125 @@ func (c *Conn) getShardConns(isSelect bool, stmt sqlparser.Statement, bindVars m
 	return conns, errors.Trace(err)
 }
 
+// shardConcurrency bounds how many shards a query runs on at once, 0
+// runs it on all of them together.
+var shardConcurrency int
+
+// executeInShard runs sql on conns, at most shardConcurrency of them at
+// once. Once a shard fails the query is not started on the shards left,
+// unless partialResults wants the rows of the others.
 func (c *Conn) executeInShard(conns []*mysql.SqlConn, sql string, args []interface{}) ([]*mysql.Result, error) {
-	wg := &sync.WaitGroup{}
-	wg.Add(len(conns))
+	return c.executeInShardRows(conns, sql, args, 0)
+}
 
-	rs := make([]interface{}, len(conns))
+// readInShard is executeInShard for a result sent to the client,
+// which keeps one row past maxResultRows at most, enough for
+// writeResultRows to find the result too large.
+func (c *Conn) readInShard(conns []*mysql.SqlConn, sql string, args []interface{}) ([]*mysql.Result, error) {
+	maxRows := c.maxResultRows()
+	if maxRows > 0 {
+		maxRows++
+	}
+	return c.executeInShardRows(conns, sql, args, maxRows)
+}
 
-	for i, co := range conns {
-		c.server.AsynExec(
-			&execTask{
-				wg:   wg,
-				rs:   rs,
-				idx:  i,
-				co:   co,
-				sql:  sql,
-				args: args,
-			})
+// executeInShardRows is executeInShard keeping maxRows rows of all the
+// shards, zero for all of them.
+func (c *Conn) executeInShardRows(conns []*mysql.SqlConn, sql string, args []interface{}, maxRows int) (_ []*mysql.Result, err error) {
+	span := c.childSpan("execute")
+	defer func() { span.Finish(err) }()
+
+	limit := shardConcurrency
+	if limit <= 0 || limit > len(conns) {
+		limit = len(conns)
 	}
 
-	wg.Wait()
+	rs := make([]interface{}, len(conns))
+	done := make(chan int, len(conns))
+	canceled := new(sync2.AtomicInt32)
+	budget := newReadBudget(maxRows)
+	next, running := 0, 0
+	for next < len(conns) || running > 0 {
+		for ; running < limit && next < len(conns) && canceled.Get() == 0; next, running = next+1, running+1 {
+			c.backendQueries++
+			c.server.AsynExec(
+				&execTask{
+					done:     done,
+					canceled: canceled,
+					rs:       rs,
+					idx:      next,
+					co:       conns[next],
+					sql:      sql,
+					args:     args,
+					timeout:  c.queryTimeout,
+					binary:   c.binaryProtocol,
+					budget:   budget,
+				})
+		}
+		if running == 0 {
+			break
+		}
+
+		i := <-done
+		running--
+		if _, failed := rs[i].(error); failed && !partialResults {
+			canceled.Set(1)
+		}
+	}
+	for ; next < len(conns); next++ {
+		rs[next] = errShardCanceled
+	}
 
-	var err error
 	r := make([]*mysql.Result, len(conns))
 	for i, v := range rs {
-		if e, ok := v.(error); ok {
-			err = e
-			break
+		switch v := v.(type) {
+		case error:
+			// the first failure wins over an incomplete result, the
+			// shards that failed or were canceled are left nil
+			if err == nil || (v != errShardCanceled && (err == mysql.ErrBackendMidStream || err == errShardCanceled)) {
+				err = v
+			}
+		case *partialResult:
+			if err == nil {
+				err = mysql.ErrBackendMidStream
+			}
+			r[i] = v.Result
+		default:
+			r[i] = v.(*mysql.Result)
 		}
-		r[i] = rs[i].(*mysql.Result)
 	}
 
 	return r, errors.Trace(err)
 }
 
+// partialResults makes scatter reads return the rows of the shards that
+// succeeded, with a warning per failed shard, instead of failing.
+var partialResults bool
+
+// partialShardResults drops the shards that failed with err from rs so
+// that the others can be returned, counting a warning for each. err is
+// kept if no shard succeeded or a shard result is incomplete.
+func (c *Conn) partialShardResults(rs []*mysql.Result, err error) ([]*mysql.Result, error) {
+	if errors.Cause(err) == mysql.ErrBackendMidStream {
+		return rs, err
+	}
+
+	succeeded := make([]*mysql.Result, 0, len(rs))
+	for _, r := range rs {
+		if r != nil {
+			succeeded = append(succeeded, r)
+		}
+	}
+	if len(succeeded) == 0 {
+		return rs, err
+	}
+
+	failed := len(rs) - len(succeeded)
+	log.Warningf("connectionId: %d, %d of %d shards failed, partial result, %v", c.connectionId, failed, len(rs), err)
+	c.warnings += uint16(failed)
+	return succeeded, nil
+}
+
 func (c *Conn) closeShardConns(conns []*mysql.SqlConn) {
 	if c.needBeginTx() {
 		return
@@ -239,22 +362,7 @@ func (c *Conn) getTableSchema(tableName string) (table *schema.Table, ok bool) {
 		return nil, false
 	}
 
-	ti := schemaInfo.GetTable(tableName)
-	if ti == nil {
-		log.Debug("check if system table", tableName)
-		if strings.Index(strings.ToLower(tableName), "information_schema") >= 0 { //system table
-			return &schema.Table{
-				Name:      tableName,
-				CacheType: schema.CACHE_NONE,
-			}, true
-		} else {
-			return nil, false
-		}
-	}
-
-	log.Infof("%+v", ti.Table)
-
-	return ti.Table, true
+	return schemaInfo.SchemaTable(tableName)
 }
 
 func (c *Conn) getTableInfo(tableName string) *tabletserver.TableInfo {
@@ -266,54 +374,89 @@ func (c *Conn) getTableInfo(tableName string) *tabletserver.TableInfo {
 	return schema.GetTable(tableName)
 }
 
-func (c *Conn) getPlanAndTableInfo(stmt sqlparser.Statement) (*planbuilder.ExecPlan, *tabletserver.TableInfo, error) {
-	plan, err := planbuilder.GetStmtExecPlan(stmt, c.getTableSchema, c.alloc)
+// getPlanAndTableInfo plans stmt, parsed from sql.
+func (c *Conn) getPlanAndTableInfo(stmt sqlparser.Statement, sql string) (*planbuilder.ExecPlan, *tabletserver.TableInfo, error) {
+	span := c.childSpan("analyze")
+	plan, ti, err := c.getStmtPlan(stmt, sql, c.getTableSchema, c.alloc)
+	span.Finish(err)
 	if err != nil {
 		return nil, nil, errors.Trace(err)
 	}
 
 	log.Infof("%+v", plan)
 
-	ti := c.getTableInfo(plan.TableName)
-
 	return plan, ti, nil
 }
 
-func pkValuesToStrings(PKColumns []int, pkValues []interface{}) []string {
-	composedPkCnt := len(PKColumns)
-	s := make([]string, 0, len(pkValues))
-	var composedPk string
-	for i, values := range pkValues {
-		switch v := values.(type) {
+// getStmtPlan plans stmt, parsed from sql, with the plan cache of the
+// schema of the db, which drops the plans of the tables whose schema
+// changes. A db of no schema has no table the proxy knows, stmt is then
+// planned with getTable in alloc.
+func (c *Conn) getStmtPlan(stmt sqlparser.Statement, sql string, getTable planbuilder.TableGetter, alloc arena.ArenaAllocator) (*planbuilder.ExecPlan, *tabletserver.TableInfo, error) {
+	si, ok := c.server.GetRowCacheSchema(c.db)
+	if !ok {
+		plan, err := planbuilder.GetStmtExecPlan(stmt, getTable, alloc)
+		return plan, nil, errors.Trace(err)
+	}
+
+	plan, err := si.GetPlan(sql)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	return plan.ExecPlan, plan.TableInfo, nil
+}
+
+// pkValuesToStrings returns the cache keys of the rows the pk values of
+// a plan stand for.
+func pkValuesToStrings(pkValues []interface{}) []string {
+	rows := pkRows(pkValues)
+	s := make([]string, 0, len(rows))
+	for _, row := range rows {
+		s = append(s, pkKey(row))
+	}
+	return s
+}
+
+// pkRows expands the pk values of a plan, a value or a list of them per
+// pk column, into the pks they stand for.
+func pkRows(pkValues []interface{}) [][]sqltypes.Value {
+	rows := [][]sqltypes.Value{nil}
+	for _, pkValue := range pkValues {
+		var values []sqltypes.Value
+		switch v := pkValue.(type) {
 		case sqltypes.Value:
-			//todo: optimization
-			composedPk += v.String()
-			composedPk += "--"
-			if i%composedPkCnt == composedPkCnt-1 {
-				//todo:handle tab
-				composedPk = strings.Replace(composedPk, " ", "_", -1)
-				s = append(s, composedPk)
-				composedPk = "" //reset
-			}
+			values = []sqltypes.Value{v}
 		case []interface{}:
 			for _, value := range v {
-				//todo: optimization
-				composedPk += value.(sqltypes.Value).String()
-				composedPk += "--"
-			}
-
-			if i%composedPkCnt == composedPkCnt-1 {
-				//todo:handle tab
-				composedPk = strings.Replace(composedPk, " ", "_", -1)
-				s = append(s, composedPk)
-				composedPk = "" //reset
+				values = append(values, value.(sqltypes.Value))
 			}
 		default:
 			log.Fatal(v, reflect.TypeOf(v))
 		}
+
+		next := make([][]sqltypes.Value, 0, len(rows)*len(values))
+		for _, row := range rows {
+			for _, value := range values {
+				r := make([]sqltypes.Value, len(row), len(row)+1)
+				copy(r, row)
+				next = append(next, append(r, value))
+			}
+		}
+		rows = next
 	}
+	return rows
+}
 
-	return s
+// pkKey returns the cache key of the row of pk.
+func pkKey(pk []sqltypes.Value) string {
+	var key string
+	for _, v := range pk {
+		//todo: optimization
+		key += v.String()
+		key += "--"
+	}
+	//todo:handle tab
+	return strings.Replace(key, " ", "_", -1)
 }
 
 func getFieldNames(plan *planbuilder.ExecPlan, ti *tabletserver.TableInfo) []schema.TableColumn {
@@ -336,15 +479,76 @@ func (c *Conn) writeCacheResults(plan *planbuilder.ExecPlan, ti *tabletserver.Ta
 		values = append(values, retValue)
 	}
 
-	r, err := c.buildResultset(getFieldNames(plan, ti), values)
+	nameTypes := getFieldNames(plan, ti)
+	fields, err := ti.Fields(plan.ColumnNumbers, func() ([]*mysql.Field, error) {
+		// the flags follow the values, which a NULL leaves unset
+		for _, v := range values[0] {
+			if v == nil {
+				return nil, nil
+			}
+		}
+		return buildFields(nameTypes, values[0])
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	r, err := c.buildResultsetWithFields(fields, nameTypes, values)
 	if err != nil {
 		log.Error(err)
 		return errors.Trace(err)
 	}
 
+	if len(plan.OrderBy) > 0 {
+		// rows come in the order of the pk values
+		if err := sortCacheResults(r, nameTypes, values, plan.OrderBy); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err := limitCacheResults(r, plan.Limit); err != nil {
+		return errors.Trace(err)
+	}
+	if r.RowDatas, err = c.toSessionTimeZone(r.Fields, r.RowDatas); err != nil {
+		return errors.Trace(err)
+	}
+
 	return errors.Trace(c.writeResultset(c.status, r))
 }
 
+// limitCacheResults keeps the first limit rows of r, all of them if
+// limit is nil.
+func limitCacheResults(r *mysql.Resultset, limit interface{}) error {
+	if limit == nil {
+		return nil
+	}
+	v, err := sqltypes.BuildValue(limit)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	n, err := v.ParseInt64()
+	if err != nil || n < 0 {
+		return errors.Errorf("invalid limit %v", limit)
+	}
+	if n < int64(len(r.RowDatas)) {
+		r.RowDatas = r.RowDatas[:n]
+		if len(r.Values) > int(n) {
+			r.Values = r.Values[:n]
+		}
+	}
+	return nil
+}
+
+// sortCacheResults sorts the rows of r, built from values, by orderBy.
+func sortCacheResults(r *mysql.Resultset, nameTypes []schema.TableColumn, values []mysql.RowValue, orderBy []mysql.SortKey) error {
+	r.Values = values
+	r.FieldNames = make(map[string]int, len(nameTypes))
+	for i, tc := range nameTypes {
+		r.FieldNames[tc.Name] = i
+	}
+	// the plan is shared, Sort fills in the columns of the keys
+	return errors.Trace(r.Sort(append([]mysql.SortKey(nil), orderBy...)))
+}
+
 //todo: test select a == b && c == d
 //select c ==d && a == b
 func generateSelectSql(ti *tabletserver.TableInfo, plan *planbuilder.ExecPlan) (string, error) {
@@ -353,25 +557,29 @@ func generateSelectSql(ti *tabletserver.TableInfo, plan *planbuilder.ExecPlan) (
 		return "", errors.Errorf("PKColumns and PKValues not match, %+v, %+v", ti.PKColumns, plan.PKValues)
 	}
 
-	pks := make([]schema.TableColumn, 0, len(ti.PKColumns))
-	for i, _ := range ti.PKColumns {
-		pks = append(pks, ti.Columns[ti.PKColumns[i]])
+	rows := pkRows(plan.PKValues)
+	if len(rows) != 1 {
+		return "", errors.Errorf("%d rows selected by %+v, not one", len(rows), plan.PKValues)
 	}
+	return selectRowSql(ti, rows[0]), nil
+}
 
+// selectRowSql returns the query reading the row of pk from the backend.
+func selectRowSql(ti *tabletserver.TableInfo, pk []sqltypes.Value) string {
 	buf := &bytes.Buffer{}
 	buf.WriteString(fmt.Sprintf("select * from %s where ", ti.Name))
-	for i, pk := range pks {
-		buf.WriteString(pk.Name)
+	for i, v := range pk {
+		buf.WriteString(ti.Columns[ti.PKColumns[i]].Name)
 		buf.WriteString("=")
-		plan.PKValues[i].(sqltypes.Value).EncodeSql(buf)
-		if i < len(pks)-1 {
+		v.EncodeSql(buf)
+		if i < len(pk)-1 {
 			buf.WriteString(" and ")
 		}
 	}
 
 	buf.WriteString(";")
 
-	return buf.String(), nil
+	return buf.String()
 }
 
 func (c *Conn) fillCacheAndReturnResults(plan *planbuilder.ExecPlan, ti *tabletserver.TableInfo, keys []string) error {
@@ -388,16 +596,33 @@ func (c *Conn) fillCacheAndReturnResults(plan *planbuilder.ExecPlan, ti *tablets
 		return errors.Errorf("not enough connection for %s", rowsql)
 	}
 
+	restore := c.textProtocol()
 	rs, err := c.executeInShard(conns, rowsql, nil)
 	defer c.closeShardConns(conns)
 	if err != nil {
+		restore()
 		return errors.Trace(err)
 	}
 
 	//todo:fix hard code
 	result := rs[0]
 
+	//just do simple cache now
+	if len(result.Values) == 1 && len(keys) == 1 && ti.CacheType != schema.CACHE_NONE {
+		rows, err := c.toBackendTimeZone(result.Fields, result.RowDatas)
+		if err != nil {
+			restore()
+			return errors.Trace(err)
+		}
+		pks := pkValuesToStrings(plan.PKValues)
+		log.Debug("fill cache", pks)
+		c.server.IncCounter("fill")
+		ti.Cache.Set(pks[0], rows[0], 0)
+	}
+	restore()
+
 	if len(result.Values) == 0 {
+		ti.RecordAbsent()
 		log.Debug("empty set")
 		return c.writeResultset(result.Status, result.Resultset)
 	}
@@ -413,15 +638,64 @@ func (c *Conn) fillCacheAndReturnResults(plan *planbuilder.ExecPlan, ti *tablets
 		return errors.Trace(err)
 	}
 
-	//just do simple cache now
-	if len(result.Values) == 1 && len(keys) == 1 && ti.CacheType != schema.CACHE_NONE {
-		pks := pkValuesToStrings(ti.PKColumns, plan.PKValues)
-		log.Debug("fill cache", pks)
-		c.server.IncCounter("fill")
-		ti.Cache.Set(pks[0], result.RowDatas[0], 0)
+	return c.writeResultset(c.status, r)
+}
+
+// textProtocol has the backends reply in the text protocol, the one of
+// the cached rows, until the func returned restores the protocol of the
+// client.
+func (c *Conn) textProtocol() func() {
+	binary := c.binaryProtocol
+	c.binaryProtocol = false
+	return func() { c.binaryProtocol = binary }
+}
+
+// readRepairSampleRate is the fraction of the cache hits that are
+// checked against the backend by readRepair.
+var readRepairSampleRate float64
+
+// readRepair reads the row of key, found in the cache as cached, from the
+// backend and corrects the cache if they differ. It tells if they did.
+func (c *Conn) readRepair(plan *planbuilder.ExecPlan, ti *tabletserver.TableInfo, key string, cached tabletserver.RCResult) (bool, error) {
+	rowsql, err := generateSelectSql(ti, plan)
+	if err != nil {
+		return false, errors.Trace(err)
 	}
 
-	return c.writeResultset(c.status, r)
+	ti.Lock.Lock(hack.Slice(key))
+	defer ti.Lock.Unlock(hack.Slice(key))
+	defer c.textProtocol()()
+
+	conns, err := c.getShardConns(true, nil, nil)
+	if err != nil {
+		return false, errors.Trace(err)
+	} else if len(conns) == 0 {
+		return false, errors.Errorf("not enough connection for %s", rowsql)
+	}
+
+	rs, err := c.executeInShard(conns, rowsql, nil)
+	c.closeShardConns(conns)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	//todo:fix hard code
+	var row []byte
+	if result := rs[0]; len(result.RowDatas) > 0 {
+		rows, err := c.toBackendTimeZone(result.Fields, result.RowDatas[:1])
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		row = rows[0]
+	}
+	if !ti.Cache.Repair(key, cached, row, ti.Columns) {
+		return false, nil
+	}
+
+	ti.RecordRepair()
+	c.server.IncCounter("repair")
+	log.Warningf("stale cached row %s of %s repaired", key, ti.Name)
+	return true, nil
 }
 
 func (c *Conn) handleShow(stmt sqlparser.Statement /*Other*/, sql string, args []interface{}) error {
@@ -435,7 +709,7 @@ func (c *Conn) handleShow(stmt sqlparser.Statement /*Other*/, sql string, args [
 	}
 
 	var rs []*mysql.Result
-	rs, err = c.executeInShard(conns, sql, args)
+	rs, err = c.readInShard(conns, sql, args)
 	defer c.closeShardConns(conns)
 	if err != nil {
 		return errors.Trace(err)
@@ -447,7 +721,7 @@ func (c *Conn) handleShow(stmt sqlparser.Statement /*Other*/, sql string, args [
 	log.Debugf("%+v", rs[0])
 
 	//todo: handle set command when sharding
-	if stmt == nil {
+	if r == nil {
 		log.Warning(sql)
 		err := c.writeOkFlush(rs[0])
 		return errors.Trace(err)
@@ -466,28 +740,48 @@ func (c *Conn) handleShow(stmt sqlparser.Statement /*Other*/, sql string, args [
 
 func (c *Conn) handleSelect(stmt *sqlparser.Select, sql string, args []interface{}) error {
 	// handle cache
-	plan, ti, err := c.getPlanAndTableInfo(stmt)
+	plan, ti, err := c.getPlanAndTableInfo(stmt, sql)
 	if err != nil {
 		return errors.Trace(err)
 	}
 
+	return c.selectWithPlan(plan, ti, stmt, sql, args)
+}
+
+// selectWithPlan answers the select stmt, planned as plan on the table
+// ti, from the row cache when it can and from the backends otherwise.
+func (c *Conn) selectWithPlan(plan *planbuilder.ExecPlan, ti *tabletserver.TableInfo, stmt *sqlparser.Select, sql string, args []interface{}) error {
 	log.Debugf("handleSelect %s, %+v", sql, plan.PKValues)
 
 	c.server.IncCounter(plan.PlanId.String())
 
 	if ti != nil && len(plan.PKValues) > 0 && ti.CacheType != schema.CACHE_NONE {
-		pks := pkValuesToStrings(ti.PKColumns, plan.PKValues)
+		pks := pkValuesToStrings(plan.PKValues)
+		span := c.childSpan("rowcache")
 		items := ti.Cache.Get(pks, ti.Columns)
+		span.Finish(nil)
 		count := 0
-		for _, item := range items {
-			if item.Row != nil {
+		for _, pk := range pks {
+			if items[pk].Row != nil {
+				ti.RecordHit()
 				count++
+			} else {
+				ti.RecordMiss()
 			}
 		}
 
 		if count == len(pks) { //all cache hint
 			c.server.IncCounter("hint")
 			log.Info("hit cache!", sql, pks)
+			if plan.PlanId == planbuilder.PLAN_PK_IN && len(pks) == 1 &&
+				readRepairSampleRate > 0 && rand.Float64() < readRepairSampleRate {
+				repaired, err := c.readRepair(plan, ti, pks[0], items[pks[0]])
+				if err != nil {
+					log.Warningf("read repair of %s failed, %v", sql, err)
+				} else if repaired {
+					return c.selectFromShards(stmt, sql, args)
+				}
+			}
 			return c.writeCacheResults(plan, ti, pks, items)
 		}
 
@@ -499,6 +793,70 @@ func (c *Conn) handleSelect(stmt *sqlparser.Select, sql string, args []interface
 		}
 	}
 
+	return c.selectFromShards(stmt, sql, args)
+}
+
+// ExplainAnalyze runs the select sql the way handleSelect does, without
+// writing to the client, filling the cache or counting it, and reports
+// whether its rows came from the cache or the backend.
+func (c *Conn) ExplainAnalyze(sql string) (*tabletserver.Analysis, error) {
+	sql = sqlparser.TrimTrailing(sql)
+	stmt, err := sqlparser.Parse(sql, c.alloc)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sel, ok := stmt.(*sqlparser.Select)
+	if !ok {
+		return nil, errors.Errorf("explain analyze supports select only, %s", sql)
+	}
+
+	plan, ti, err := c.getPlanAndTableInfo(sel, sql)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var keys []string
+	pks := make(map[string][]sqltypes.Value)
+	if ti != nil && len(plan.PKValues) > 0 {
+		for _, pk := range pkRows(plan.PKValues) {
+			key := pkKey(pk)
+			keys = append(keys, key)
+			pks[key] = pk
+		}
+	}
+
+	// a missed key reads its row alone, the way fillCacheAndReturnResults
+	// does, the whole query is run only when the cache isn't used at all
+	fetch := func(key string) (int, error) {
+		query, stmt := sql, sqlparser.Statement(sel)
+		if key != "" {
+			query, stmt = selectRowSql(ti, pks[key]), nil
+		}
+		conns, err := c.getShardConns(true, stmt, nil)
+		if err != nil {
+			return 0, errors.Trace(err)
+		} else if len(conns) == 0 {
+			return 0, errors.Errorf("not enough connection for %s", query)
+		}
+		defer c.closeShardConns(conns)
+
+		rs, err := c.executeInShard(conns, query, nil)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		n := 0
+		for _, r := range rs {
+			if r.Resultset != nil {
+				n += len(r.RowDatas)
+			}
+		}
+		return n, nil
+	}
+
+	return tabletserver.ExplainAnalyze(plan, ti, keys, fetch)
+}
+
+func (c *Conn) selectFromShards(stmt *sqlparser.Select, sql string, args []interface{}) error {
 	bindVars := makeBindVars(args)
 	conns, err := c.getShardConns(true, stmt, bindVars)
 	if err != nil {
@@ -509,10 +867,25 @@ func (c *Conn) handleSelect(stmt *sqlparser.Select, sql string, args []interface
 	}
 
 	var rs []*mysql.Result
-	rs, err = c.executeInShard(conns, sql, args)
+	rs, err = c.readInShard(conns, sql, args)
 	c.closeShardConns(conns)
+	if err != nil && partialResults {
+		rs, err = c.partialShardResults(rs, err)
+	}
 	if err == nil {
 		err = c.mergeSelectResult(rs, stmt)
+	} else if errors.Cause(err) == mysql.ErrBackendMidStream {
+		// the client gets the rows we have, followed by an error
+		// packet instead of EOF so it knows the result is incomplete
+		status, r, err := c.mergeSelectRows(rs, stmt)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := c.writeResultRows(status, r); err != nil {
+			return errors.Trace(err)
+		}
+		log.Warningf("partial result of %d rows, %s", len(r.RowDatas), sql)
+		return errors.Trace(c.writeError(mysql.ErrBackendMidStream))
 	}
 
 	return errors.Trace(err)
@@ -520,39 +893,136 @@ func (c *Conn) handleSelect(stmt *sqlparser.Select, sql string, args []interface
 
 func invalidCache(ti *tabletserver.TableInfo, keys []string) {
 	for _, key := range keys {
+		ti.RecordInvalidation()
 		ti.Cache.Delete(key)
 	}
 }
 
+// rewriteCachedRows has the autocommitted updates by pk that allow it
+// rewrite the cached rows instead of invalidating them.
+var rewriteCachedRows bool
+
+// rewriteCache writes the values an update by pk set into the cached
+// rows of keys, invalidating the ones it can't rewrite.
+func rewriteCache(ti *tabletserver.TableInfo, plan *planbuilder.ExecPlan, keys []string) {
+	columns, values, ok := plan.RowUpdate(ti.Table)
+	if !ok {
+		invalidCache(ti, keys)
+		return
+	}
+	raw := make([][]byte, len(values))
+	for i, v := range values {
+		raw[i] = v.Raw()
+	}
+	for _, key := range keys {
+		if !ti.Cache.Rewrite(key, columns, raw) {
+			ti.RecordInvalidation()
+			ti.Cache.Delete(key)
+		}
+	}
+}
+
 func (c *Conn) handleExec(stmt sqlparser.Statement, sql string, args []interface{}, skipCache bool) error {
+	if isDryrun(stmt) {
+		c.server.IncCounter("dryrun")
+		return c.handleDryrun(stmt, sql, args)
+	}
+
+	var plan *planbuilder.ExecPlan
+	var ti *tabletserver.TableInfo
 	if !skipCache {
-		// handle cache
-		plan, ti, err := c.getPlanAndTableInfo(stmt)
+		var err error
+		plan, ti, err = c.getPlanAndTableInfo(stmt, sql)
 		if err != nil {
 			return errors.Trace(err)
 		}
+	}
 
-		if ti == nil {
-			return errors.Errorf("sql: %s not support", sql)
-		}
-
-		c.server.IncCounter(plan.PlanId.String())
-
-		if ti.CacheType != schema.CACHE_NONE {
-			if len(ti.PKColumns) != len(plan.PKValues) {
-				return errors.Errorf("updated/delete/replace without primary key not allowed %+v", plan.PKValues)
-			}
+	return c.execPlan(plan, ti, stmt, sql, args)
+}
 
-			if len(plan.PKValues) == 0 {
-				return errors.Errorf("pk not exist, sql: %s", sql)
-			}
+// dmlPath is how execPlan runs a dml.
+type dmlPath int
+
+const (
+	// the dml is sent as it is, it touches no cached row
+	dmlAsIs dmlPath = iota
+	// the dml is sent as it is, the rows of the pk values of its plan
+	// are invalidated around it
+	dmlByPK
+	// the subquery of the plan selects the pks of the rows, which are
+	// invalidated and then updated by the outer query
+	dmlBySubquery
+)
 
-			log.Debugf("%s %+v, %+v", sql, plan, plan.PKValues)
-			pks := pkValuesToStrings(ti.PKColumns, plan.PKValues)
+// dmlPathOf returns how execPlan runs stmt with plan on the table of
+// ti, and the plan and table it runs it with. It fails for the dmls on
+// cached tables that it can't run.
+func dmlPathOf(plan *planbuilder.ExecPlan, ti *tabletserver.TableInfo, stmt sqlparser.Statement, sql string) (*planbuilder.ExecPlan, *tabletserver.TableInfo, dmlPath, error) {
+	if _, ok := stmt.(*sqlparser.Insert); ok && plan != nil && plan.PlanId != planbuilder.PLAN_INSERT_PK {
+		// without pk values there is nothing to invalidate, INSERT
+		// IGNORE and upserts go through like plain inserts
+		return nil, nil, dmlAsIs, nil
+	}
+	if plan == nil {
+		return nil, nil, dmlAsIs, nil
+	}
+	if ti == nil && plan.PlanId != planbuilder.PLAN_PASS_DML {
+		return nil, nil, dmlAsIs, errors.Errorf("sql: %s not support", sql)
+	}
+	if ti == nil || ti.CacheType == schema.CACHE_NONE || plan.NoOp {
+		// SET col = col leaves the rows as they are, whichever
+		return plan, ti, dmlAsIs, nil
+	}
+	if plan.PlanId == planbuilder.PLAN_DML_SUBQUERY {
+		return plan, ti, dmlBySubquery, nil
+	}
+	if len(ti.PKColumns) != len(plan.PKValues) {
+		return nil, nil, dmlAsIs, errors.Errorf("updated/delete/replace without primary key not allowed %+v", plan.PKValues)
+	}
+	if len(plan.PKValues) == 0 {
+		return nil, nil, dmlAsIs, errors.Errorf("pk not exist, sql: %s", sql)
+	}
+	return plan, ti, dmlByPK, nil
+}
 
-			ti.Lock.Lock(hack.Slice(pks[0]))
-			defer ti.Lock.Unlock(hack.Slice(pks[0]))
+// execPlan runs a dml on the shards, invalidating the rows plan
+// touches first. A nil plan skips the cache.
+func (c *Conn) execPlan(plan *planbuilder.ExecPlan, ti *tabletserver.TableInfo, stmt sqlparser.Statement, sql string, args []interface{}) (err error) {
+	plan, ti, path, err := dmlPathOf(plan, ti, stmt, sql)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if plan != nil {
+		c.server.IncCounter(plan.PlanId.String())
+		if plan.NoOp && ti != nil && ti.CacheType != schema.CACHE_NONE {
+			c.server.IncCounter("noop-update")
+		}
+	}
 
+	switch path {
+	case dmlBySubquery:
+		return c.execSubquery(plan, ti, stmt, args)
+	case dmlByPK:
+		log.Debugf("%s %+v, %+v", sql, plan, plan.PKValues)
+		pks := pkValuesToStrings(plan.PKValues)
+
+		ti.Lock.Lock(hack.Slice(pks[0]))
+		defer ti.Lock.Unlock(hack.Slice(pks[0]))
+
+		if _, ok := stmt.(*sqlparser.Update); ok || plan.Ignore {
+			// the rows are only written if the dml affects some,
+			// invalidate them once it is known, still under the lock.
+			// On error it isn't known. Only committed values are
+			// written into the cache, a transaction may roll back.
+			defer func() {
+				if err == nil && c.affectedRows > 0 && rewriteCachedRows && !c.needBeginTx() {
+					rewriteCache(ti, plan, pks)
+				} else if err != nil || c.affectedRows > 0 {
+					invalidCache(ti, pks)
+				}
+			}()
+		} else {
 			invalidCache(ti, pks)
 		}
 	}
@@ -577,8 +1047,10 @@ func (c *Conn) handleExec(stmt sqlparser.Statement, sql string, args []interface
 	return errors.Trace(err)
 }
 
+// beginShardConns begins a transaction on conns unless the session
+// has one already, which getConn began.
 func (c *Conn) beginShardConns(conns []*mysql.SqlConn) error {
-	if c.inTransaction() {
+	if c.needBeginTx() {
 		return nil
 	}
 
@@ -592,7 +1064,7 @@ func (c *Conn) beginShardConns(conns []*mysql.SqlConn) error {
 }
 
 func (c *Conn) commitShardConns(conns []*mysql.SqlConn) error {
-	if c.inTransaction() {
+	if c.needBeginTx() {
 		return nil
 	}
 
@@ -605,6 +1077,18 @@ func (c *Conn) commitShardConns(conns []*mysql.SqlConn) error {
 	return nil
 }
 
+func (c *Conn) rollbackShardConns(conns []*mysql.SqlConn) {
+	if c.needBeginTx() {
+		return
+	}
+
+	for _, co := range conns {
+		if err := co.Rollback(); err != nil {
+			log.Warning(err)
+		}
+	}
+}
+
 func (c *Conn) mergeExecResult(rs []*mysql.Result) error {
 	r := &mysql.Result{}
 
@@ -628,6 +1112,22 @@ func (c *Conn) mergeExecResult(rs []*mysql.Result) error {
 }
 
 func (c *Conn) mergeSelectResult(rs []*mysql.Result, stmt *sqlparser.Select) error {
+	status, r, err := c.mergeSelectRows(rs, stmt)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	/*
+		if err := c.limitSelectResult(r, stmt); err != nil {
+			return errors.Trace(err)
+		}
+	*/
+
+	return c.writeResultset(status, r)
+}
+
+// mergeSelectRows merges the rows of the shards into the resultset of
+// the first one and sorts them.
+func (c *Conn) mergeSelectRows(rs []*mysql.Result, stmt *sqlparser.Select) (uint16, *mysql.Resultset, error) {
 	r := rs[0].Resultset
 
 	status := c.status | rs[0].Status
@@ -642,13 +1142,22 @@ func (c *Conn) mergeSelectResult(rs []*mysql.Result, stmt *sqlparser.Select) err
 	}
 
 	c.sortSelectResult(r, stmt)
-	/*
-		if err := c.limitSelectResult(r, stmt); err != nil {
-			return errors.Trace(err)
-		}
-	*/
 
-	return c.writeResultset(status, r)
+	return status, r, nil
+}
+
+// maxMergeBytes caps the memory the rows buffered to merge the
+// result of a query may take, zero for no cap.
+var maxMergeBytes int64
+
+// newReadBudget returns the budget of the reads of a query on its
+// shards, which fail with ErrMergeBudget once their rows take more than
+// maxMergeBytes and keep maxRows rows. Nil if there's no cap.
+func newReadBudget(maxRows int) *mysql.ReadBudget {
+	if maxMergeBytes <= 0 && maxRows <= 0 {
+		return nil
+	}
+	return mysql.NewReadBudget(maxMergeBytes, maxRows)
 }
 
 func (c *Conn) sortSelectResult(r *mysql.Resultset, stmt *sqlparser.Select) error {
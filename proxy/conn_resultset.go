@@ -2,11 +2,34 @@ package proxy
 
 import (
 	"github.com/juju/errors"
+	log "github.com/ngaut/logging"
 	"github.com/wandoulabs/cm/hack"
 	"github.com/wandoulabs/cm/mysql"
 	"github.com/wandoulabs/cm/vt/schema"
 )
 
+// tinyIntAsBool makes buildResultset render TINYINT(1) columns as
+// booleans, any non zero value being sent as 1.
+var tinyIntAsBool bool
+
+// maxResultRows caps the rows of the resultsets sent to clients unless
+// a session sets its own cap, zero for no cap.
+var maxResultRows int
+
+func boolValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int64:
+		if v != 0 {
+			return int64(1)
+		}
+	case uint64:
+		if v != 0 {
+			return uint64(1)
+		}
+	}
+	return value
+}
+
 func formatField(field *mysql.Field, value interface{}) error {
 	switch value.(type) {
 	case int8, int16, int32, int64, int:
@@ -20,7 +43,7 @@ func formatField(field *mysql.Field, value interface{}) error {
 	case float32, float64:
 		field.Charset = 63
 	case string, []byte:
-		field.Charset = 33
+		field.Charset = schema.DefaultCharset
 		field.Type = mysql.MYSQL_TYPE_VARCHAR
 	case nil:
 		return nil
@@ -30,47 +53,100 @@ func formatField(field *mysql.Field, value interface{}) error {
 	return nil
 }
 
+// protocol returns the row format of the command being replied to.
+func (c *Conn) protocol() mysql.Protocol {
+	if c.binaryProtocol {
+		return mysql.BINARY_PROTOCOL
+	}
+	return mysql.TEXT_PROTOCOL
+}
+
 func (c *Conn) buildResultset(nameTypes []schema.TableColumn, values []mysql.RowValue) (*mysql.Resultset, error) {
-	r := &mysql.Resultset{Fields: make([]*mysql.Field, len(nameTypes))}
+	return c.buildResultsetWithFields(nil, nameTypes, values)
+}
 
-	var b []byte
-	var err error
+// buildResultsetWithFields is buildResultset with the fields built
+// already, or built from the first row if fields is nil.
+func (c *Conn) buildResultsetWithFields(fields []*mysql.Field, nameTypes []schema.TableColumn, values []mysql.RowValue) (*mysql.Resultset, error) {
+	r := &mysql.Resultset{Fields: fields}
+	if fields == nil {
+		r.Fields = make([]*mysql.Field, len(nameTypes))
+	}
 
 	for i, vs := range values {
 		if len(vs) != len(r.Fields) {
 			return nil, errors.Errorf("row %d has %d column not equal %d", i, len(vs), len(r.Fields))
 		}
 
-		var row []byte
-		for j, value := range vs {
-			field := &mysql.Field{}
-			if i == 0 {
-				r.Fields[j] = field
-				//log.Warningf("%+v", nameTypes[i])
-				field.Name = hack.Slice(nameTypes[j].Name)
-				if err = formatField(field, value); err != nil {
-					return nil, errors.Trace(err)
-				}
-				field.Type = nameTypes[j].SqlType
-				field.Charset = uint16(mysql.CollationNames[nameTypes[j].Collation])
-				field.IsUnsigned = nameTypes[j].IsUnsigned
+		if i == 0 && fields == nil {
+			var err error
+			if r.Fields, err = buildFields(nameTypes, vs); err != nil {
+				return nil, errors.Trace(err)
 			}
+		}
 
-			if value == nil {
-				row = append(row, "\xfb"...)
-			} else {
-				b = mysql.Raw(byte(field.Type), value, field.IsUnsigned)
-				row = append(row, mysql.PutLengthEncodedString(b, c.alloc)...)
+		if tinyIntAsBool {
+			vs = append(mysql.RowValue(nil), vs...)
+			for j := range vs {
+				if nameTypes[j].IsBoolean() {
+					vs[j] = boolValue(vs[j])
+				}
 			}
 		}
 
+		row, err := mysql.BuildRowData(r.Fields, vs, c.protocol())
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
 		r.RowDatas = append(r.RowDatas, row)
 	}
 
 	return r, nil
 }
 
+// buildFields builds the result fields of nameTypes, whose flags depend
+// on the values of row.
+func buildFields(nameTypes []schema.TableColumn, row mysql.RowValue) ([]*mysql.Field, error) {
+	fields := make([]*mysql.Field, len(nameTypes))
+	for j, value := range row {
+		field := &mysql.Field{}
+		fields[j] = field
+		field.Name = hack.Slice(nameTypes[j].Name)
+		if err := formatField(field, value); err != nil {
+			return nil, errors.Trace(err)
+		}
+		field.Type = nameTypes[j].SqlType
+		field.Charset = schema.FieldCharset(nameTypes[j])
+		field.IsUnsigned = nameTypes[j].IsUnsigned
+		field.Decimal = uint8(nameTypes[j].Scale)
+		if nameTypes[j].IsBoolean() {
+			field.ColumnLength = 1
+		} else {
+			// in bytes, clients size their buffers with it
+			field.ColumnLength = nameTypes[j].ByteLength()
+		}
+	}
+	return fields, nil
+}
+
 func (c *Conn) writeResultset(status uint16, r *mysql.Resultset) error {
+	if err := c.writeResultRows(status, r); err != nil {
+		return errors.Trace(err)
+	}
+
+	err := c.writeEOF(status)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(c.flush())
+}
+
+// writeResultRows writes the columns and rows of r, leaving the
+// terminating packet to the caller. If r has more rows than the
+// session allows only those are written and ErrTooManyRows is
+// returned, it must be sent instead of the terminating packet.
+func (c *Conn) writeResultRows(status uint16, r *mysql.Resultset) error {
 	c.affectedRows = int64(-1)
 	columnLen := mysql.PutLengthEncodedInt(uint64(len(r.Fields)))
 	data := c.alloc.AllocBytesWithLen(4, 1024)
@@ -79,19 +155,20 @@ func (c *Conn) writeResultset(status uint16, r *mysql.Resultset) error {
 		return errors.Trace(err)
 	}
 
-	for _, v := range r.Fields {
-		data = data[0:4]
-		data = append(data, v.Dump(c.alloc)...)
-		if err := c.writePacket(data); err != nil {
-			return errors.Trace(err)
-		}
+	if err := mysql.WriteFields(c.pkg, r.Fields, data); err != nil {
+		return errors.Trace(err)
 	}
 
 	if err := c.writeEOF(status); err != nil {
 		return errors.Trace(err)
 	}
 
-	for _, v := range r.RowDatas {
+	rows := r.RowDatas
+	max := c.maxResultRows()
+	if max > 0 && len(rows) > max {
+		rows = rows[:max]
+	}
+	for _, v := range rows {
 		data = data[0:4]
 		data = append(data, v...)
 		if err := c.writePacket(data); err != nil {
@@ -99,10 +176,18 @@ func (c *Conn) writeResultset(status uint16, r *mysql.Resultset) error {
 		}
 	}
 
-	err := c.writeEOF(status)
-	if err != nil {
-		return errors.Trace(err)
+	if len(rows) < len(r.RowDatas) {
+		log.Warningf("connectionId: %d, result of %d rows cut at %d", c.connectionId, len(r.RowDatas), max)
+		return errors.Trace(mysql.ErrTooManyRows)
 	}
+	return nil
+}
 
-	return errors.Trace(c.flush())
+// maxResultRows returns how many rows a resultset sent to the client
+// may have, zero for no limit.
+func (c *Conn) maxResultRows() int {
+	if c.resultRowsLimit != 0 {
+		return c.resultRowsLimit
+	}
+	return maxResultRows
 }
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/sqlparser"
+	"github.com/wandoulabs/cm/vt/schema"
+	"github.com/wandoulabs/cm/vt/tabletserver"
+)
+
+func TestBuildResultsetTinyIntAsBool(t *testing.T) {
+	defer func(v bool) { tinyIntAsBool = v }(tinyIntAsBool)
+
+	ta := schema.NewTable("t")
+	ta.AddColumn("flag", "tinyint(1)", "", nil, "")
+	ta.AddColumn("level", "tinyint(4)", "", nil, "")
+	values := []mysql.RowValue{{int64(5), int64(5)}}
+
+	c, _ := newTestConn(&fakeServer{})
+	for _, asBool := range []bool{false, true} {
+		tinyIntAsBool = asBool
+		r, err := c.buildResultset(ta.Columns, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Fields[0].ColumnLength != 1 || r.Fields[1].ColumnLength != 0 {
+			t.Fatal(r.Fields[0].ColumnLength, r.Fields[1].ColumnLength)
+		}
+
+		expect := "\x015\x015"
+		if asBool {
+			expect = "\x011\x015"
+		}
+		if string(r.RowDatas[0]) != expect {
+			t.Fatalf("%v: %q", asBool, r.RowDatas[0])
+		}
+	}
+}
+
+func TestBuildResultsetColumnLength(t *testing.T) {
+	ta := schema.NewTable("t")
+	ta.AddColumn("name", "varchar(10)", "utf8mb4_general_ci", nil, "")
+	ta.AddColumn("code", "char(10)", "latin1_swedish_ci", nil, "")
+	ta.AddColumn("raw", "varbinary(10)", "", nil, "")
+	values := []mysql.RowValue{{"a", "b", "c"}}
+
+	c, _ := newTestConn(&fakeServer{})
+	r, err := c.buildResultset(ta.Columns, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expect := range []uint32{40, 10, 10} {
+		if n := r.Fields[i].ColumnLength; n != expect {
+			t.Fatal(ta.Columns[i].Name, n)
+		}
+	}
+	if r.Fields[0].Charset != uint16(mysql.CollationNames["utf8mb4_general_ci"]) {
+		t.Fatal(r.Fields[0].Charset)
+	}
+}
+
+func benchmarkWriteCacheResults(b *testing.B, cached bool) {
+	ta := schema.NewTable("t")
+	for _, name := range []string{"id", "uid", "score"} {
+		ta.AddColumn(name, "bigint(20)", "", nil, "")
+	}
+	for _, name := range []string{"name", "email", "city"} {
+		ta.AddColumn(name, "varchar(64)", "utf8_general_ci", nil, "")
+	}
+	ti := &tabletserver.TableInfo{Table: ta}
+	values := []mysql.RowValue{{int64(1), int64(2), int64(3), "a", "b", "c"}}
+	columns := []int{0, 1, 2, 3, 4, 5}
+
+	c, bc := newTestConn(&fakeServer{})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var fields []*mysql.Field
+		if cached {
+			fields, _ = ti.Fields(columns, func() ([]*mysql.Field, error) {
+				return buildFields(ta.Columns, values[0])
+			})
+		}
+		r, err := c.buildResultsetWithFields(fields, ta.Columns, values)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := c.writeResultset(c.status, r); err != nil {
+			b.Fatal(err)
+		}
+		bc.buf.Reset()
+		c.alloc.Reset()
+	}
+}
+
+func BenchmarkWriteCacheResults(b *testing.B) {
+	benchmarkWriteCacheResults(b, false)
+}
+
+func BenchmarkWriteCacheResultsCachedFields(b *testing.B) {
+	benchmarkWriteCacheResults(b, true)
+}
+
+func TestBuildResultsetDecimal(t *testing.T) {
+	ta := schema.NewTable("t")
+	ta.AddColumn("price", "decimal(10,2)", "", nil, "")
+
+	c, _ := newTestConn(&fakeServer{})
+	r, err := c.buildResultset(ta.Columns, []mysql.RowValue{{[]byte("1.50")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Fields[0].Decimal != 2 || string(r.RowDatas[0]) != "\x041.50" {
+		t.Fatal(r.Fields[0].Decimal, r.RowDatas[0])
+	}
+}
+
+func TestSortCacheResults(t *testing.T) {
+	ta := schema.NewTable("t")
+	ta.AddColumn("id", "bigint(20)", "", nil, "")
+	ta.AddColumn("name", "varbinary(32)", "", nil, "")
+	// in the order of the pk values of: where id in (3, 1, 2)
+	values := []mysql.RowValue{{int64(3), []byte("b")}, {int64(1), []byte("b")}, {int64(2), []byte("c")}}
+
+	c, _ := newTestConn(&fakeServer{})
+	r, err := c.buildResultset(ta.Columns, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orderBy := []mysql.SortKey{{Name: "name", Direction: mysql.SortDesc}, {Name: "id", Direction: mysql.SortAsc}}
+	if err := sortCacheResults(r, ta.Columns, values, orderBy); err != nil {
+		t.Fatal(err)
+	}
+	for i, expect := range []string{"\x012\x01c", "\x011\x01b", "\x013\x01b"} {
+		if string(r.RowDatas[i]) != expect {
+			t.Fatalf("%d: %q", i, r.RowDatas[i])
+		}
+	}
+
+	// the limit applies to the sorted rows
+	if err := limitCacheResults(r, int64(2)); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.RowDatas) != 2 || string(r.RowDatas[1]) != "\x011\x01b" {
+		t.Fatalf("%q", r.RowDatas)
+	}
+	if err := limitCacheResults(r, nil); err != nil || len(r.RowDatas) != 2 {
+		t.Fatal(err, len(r.RowDatas))
+	}
+}
+
+func TestMaxResultRows(t *testing.T) {
+	defer func(v int) { maxResultRows = v }(maxResultRows)
+	maxResultRows = 3
+
+	r := &mysql.Resultset{Fields: []*mysql.Field{&mysql.Field{Name: []byte("id")}}}
+	for i := 0; i < 5; i++ {
+		r.RowDatas = append(r.RowDatas, mysql.RowData{1, byte('0' + i)})
+	}
+
+	c, bc := newTestConn(&fakeServer{})
+	err := c.writeResultset(c.status, r)
+	if errors.Cause(err) != mysql.ErrTooManyRows {
+		t.Fatal(err)
+	}
+	c.writeError(err)
+
+	// column count, field, EOF, the first rows only, then an error
+	var packets [][]byte
+	for b := bc.Bytes(); len(b) > 0; {
+		n := int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+		packets, b = append(packets, b[4:4+n]), b[4+n:]
+	}
+	if len(packets) != 3+3+1 || string(packets[5]) != "\x012" || packets[6][0] != mysql.ERR_HEADER {
+		t.Fatal(packets)
+	}
+
+	// the session can't raise the cap over the global one
+	stmt, err := sqlparser.Parse("set proxy_max_result_rows = 10", c.alloc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.handleSet(stmt.(*sqlparser.Set), ""); err != nil {
+		t.Fatal(err)
+	}
+	if c.maxResultRows() != 3 {
+		t.Fatal(c.maxResultRows())
+	}
+
+	// without one it can
+	maxResultRows = 0
+	if err := c.handleSet(stmt.(*sqlparser.Set), ""); err != nil {
+		t.Fatal(err)
+	}
+	if c.maxResultRows() != 10 {
+		t.Fatal(c.maxResultRows())
+	}
+	if err := c.writeResultset(c.status, r); err != nil {
+		t.Fatal(err)
+	}
+
+	// and goes back to the global one
+	maxResultRows = 3
+	stmt, _ = sqlparser.Parse("set proxy_max_result_rows = 0", c.alloc)
+	if err := c.handleSet(stmt.(*sqlparser.Set), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.writeResultset(c.status, r); errors.Cause(err) != mysql.ErrTooManyRows {
+		t.Fatal(err)
+	}
+}
@@ -9,89 +9,97 @@ import (
 	"github.com/wandoulabs/cm/hack"
 	"github.com/wandoulabs/cm/mysql"
 	"github.com/wandoulabs/cm/sqlparser"
+	"github.com/wandoulabs/cm/sqltypes"
+	"github.com/wandoulabs/cm/vt/schema"
+	"github.com/wandoulabs/cm/vt/tabletserver/planbuilder"
 )
 
 func (c *Conn) handleSimpleSelect(sql string, stmt *sqlparser.SimpleSelect) error {
-	//todo: handle multi set statement like: set x=1, y=2
-	/*
-		if len(stmt.SelectExprs) != 1 {
-			return errors.Errorf("support select one informaction function, %s", sql)
-		}
-	*/
 	log.Debug(sql)
-	expr, ok := stmt.SelectExprs[0].(*sqlparser.NonStarExpr)
-	if !ok {
-		return errors.Errorf("support select informaction function, %s", sql)
+	plan, _, err := c.getPlanAndTableInfo(stmt, sql)
+	if err != nil {
+		return errors.Trace(err)
 	}
-
-	var funcExpr *sqlparser.FuncExpr
-	var specialColumn *sqlparser.ColName
-
-	switch v := expr.Expr.(type) {
-	case *sqlparser.FuncExpr:
-		funcExpr = v
-	case *sqlparser.ColName:
-		specialColumn = v
-		log.Debug(string(specialColumn.Name))
-	case sqlparser.NumVal: //select 1
-		return errors.Trace(c.handleShow(stmt, sql, nil))
-	case *sqlparser.BinaryExpr: //select 2 * 3
+	if !plan.Local || c.setsLocalVariable(stmt) {
 		return errors.Trace(c.handleShow(stmt, sql, nil))
-	default:
-		return errors.Errorf("support select informaction function, %s, %T", sql, v)
 	}
 
-	var r *mysql.Resultset
-	var err error
+	return errors.Trace(c.writeResultset(c.status, c.buildLocalSelectResult(stmt)))
+}
 
-	if funcExpr != nil {
-		switch strings.ToLower(string(funcExpr.Name)) {
+// localValue returns the value of expr, one of the functions or @@
+// variables the proxy answers itself.
+func (c *Conn) localValue(expr sqlparser.Expr) (interface{}, []byte, bool) {
+	switch v := expr.(type) {
+	case *sqlparser.FuncExpr:
+		switch strings.ToLower(string(v.Name)) {
 		case "last_insert_id":
-			r, err = c.buildSimpleSelectResult(c.lastInsertId, funcExpr.Name, expr.As)
+			return c.lastInsertId, v.Name, true
 		case "row_count":
-			r, err = c.buildSimpleSelectResult(c.affectedRows, funcExpr.Name, expr.As)
+			return c.affectedRows, v.Name, true
 		case "version":
-			r, err = c.buildSimpleSelectResult(mysql.ServerVersion, funcExpr.Name, expr.As)
+			return mysql.ServerVersion, v.Name, true
 		case "connection_id":
-			r, err = c.buildSimpleSelectResult(c.connectionId, funcExpr.Name, expr.As)
+			return int64(c.connectionId), v.Name, true
 		case "database":
-			if len(c.db) > 0 {
-				r, err = c.buildSimpleSelectResult(c.db, funcExpr.Name, expr.As)
-			} else {
-				r, err = c.buildSimpleSelectResult("NULL", funcExpr.Name, expr.As)
+			if len(c.db) == 0 {
+				return nil, v.Name, true
 			}
-		case "user": // select USER()
-			r, err = c.buildSimpleSelectResult(c.user, funcExpr.Name, expr.As)
-		default:
-			log.Warning(c.connectionId, sql)
-			//todo: more strict
-			return errors.Trace(c.handleShow(stmt, sql, nil))
-			//return errors.Errorf("function %s not support, %+v", funcExpr.Name, funcExpr)
+			return c.db, v.Name, true
+		case "user":
+			return c.user, v.Name, true
 		}
+	case *sqlparser.ColName:
+		value, ok := localVariable(v)
+		return value, v.Name, ok
+	}
+	return nil, nil, false
+}
 
-		if err != nil {
-			return errors.Trace(err)
+// buildLocalSelectResult answers stmt, which plan.Local tells the
+// proxy knows all the expressions of, in a single row.
+func (c *Conn) buildLocalSelectResult(stmt *sqlparser.SimpleSelect) *mysql.Resultset {
+	r := &mysql.Resultset{}
+	var row []byte
+	for _, expr := range stmt.SelectExprs {
+		nonStar := expr.(*sqlparser.NonStarExpr)
+		value, name, _ := c.localValue(nonStar.Expr)
+		field := &mysql.Field{Name: name, OrgName: name}
+		if nonStar.As != nil {
+			field.Name = nonStar.As
 		}
-	} else {
-		return errors.Trace(c.handleShow(stmt, sql, nil))
+		formatField(field, value)
+		r.Fields = append(r.Fields, field)
+		if value == nil {
+			field.Type = mysql.MYSQL_TYPE_NULL
+			row = append(row, 0xfb)
+			continue
+		}
+		row = append(row, mysql.PutLengthEncodedString(mysql.Raw(byte(field.Type), value, false), c.alloc)...)
 	}
-
-	return errors.Trace(c.writeResultset(c.status, r))
+	r.RowDatas = append(r.RowDatas, row)
+	return r
 }
 
-func (c *Conn) buildSimpleSelectResult(value interface{}, name []byte, asName []byte) (*mysql.Resultset, error) {
-	field := &mysql.Field{Name: name, OrgName: name}
-	if asName != nil {
-		field.Name = asName
+// localVariable returns the value of the @@ variable of col, if the
+// proxy answers it.
+func localVariable(col *sqlparser.ColName) (interface{}, bool) {
+	if col.Qualifier != nil {
+		return nil, false
 	}
+	v, ok := planbuilder.LocalVariables[strings.ToLower(string(col.Name))]
+	return v, ok
+}
 
-	formatField(field, value)
-
-	r := &mysql.Resultset{Fields: []*mysql.Field{field}}
-	row := mysql.Raw(byte(field.Type), value, false)
-	r.RowDatas = append(r.RowDatas, mysql.PutLengthEncodedString(row, c.alloc))
-
-	return r, nil
+// setsLocalVariable tells if stmt selects a local variable the session
+// has SET, whose value is then the one of the backends.
+func (c *Conn) setsLocalVariable(stmt *sqlparser.SimpleSelect) bool {
+	for _, expr := range stmt.SelectExprs {
+		if col, ok := expr.(*sqlparser.NonStarExpr).Expr.(*sqlparser.ColName); ok && c.setVariables[strings.ToLower(string(col.Name))] {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *Conn) getShardIds(table string) ([]string, error) {
@@ -115,6 +123,10 @@ func (c *Conn) handleFieldList(data []byte) error {
 	index := bytes.IndexByte(data, 0x00)
 	table := hack.String(data[0:index])
 	wildcard := hack.String(data[index+1:])
+	if ti := c.getTableInfo(table); ti != nil && (wildcard == "" || wildcard == "%") {
+		return errors.Trace(c.writeFieldList(c.status, buildFieldList(ti.Table, c.db, fieldListDefaults)))
+	}
+
 	shardIds, err := c.getShardIds(table)
 	if err != nil {
 		return err
@@ -141,6 +153,7 @@ func (c *Conn) handleFieldList(data []byte) error {
 		return errors.Trace(err)
 	}
 
+	c.backendQueries++
 	if fs, err := co.FieldList(table, wildcard); err != nil {
 		return errors.Trace(err)
 	} else {
@@ -148,17 +161,31 @@ func (c *Conn) handleFieldList(data []byte) error {
 	}
 }
 
+// fieldListDefaults makes the COM_FIELD_LIST replies built from the
+// schema carry the column default values.
+var fieldListDefaults bool
+
+// buildFieldList returns the COM_FIELD_LIST reply of table, the
+// definitions of all its columns, with their default values if
+// withDefaults is set.
+func buildFieldList(table *schema.Table, db string, withDefaults bool) []*mysql.Field {
+	fs := make([]*mysql.Field, 0, len(table.Columns))
+	for _, col := range table.Columns {
+		f := schema.FieldFromColumn(col, table.Name, db)
+		if v, ok := col.Default.(sqltypes.Value); ok && withDefaults && !v.IsNull() {
+			f.DefaultValue = v.Raw()
+			f.DefaultValueLength = uint64(len(f.DefaultValue))
+		}
+		fs = append(fs, f)
+	}
+	return fs
+}
+
 func (c *Conn) writeFieldList(status uint16, fs []*mysql.Field) error {
 	c.affectedRows = int64(-1)
 
-	data := make([]byte, 4, 1024)
-
-	for _, v := range fs {
-		data = data[0:4]
-		data = append(data, v.Dump(c.alloc)...)
-		if err := c.writePacket(data); err != nil {
-			return errors.Trace(err)
-		}
+	if err := mysql.WriteFields(c.pkg, fs, c.alloc.AllocBytesWithLen(4, 1024)); err != nil {
+		return errors.Trace(err)
 	}
 
 	err := c.writeEOF(status)
@@ -1,15 +1,22 @@
 package proxy
 
 import (
+	"strconv"
+	"strings"
+
 	"github.com/juju/errors"
 	log "github.com/ngaut/logging"
 	"github.com/wandoulabs/cm/mysql"
 	"github.com/wandoulabs/cm/sqlparser"
-	"strings"
+	"github.com/wandoulabs/cm/vt/tabletserver/planbuilder"
 )
 
 var nstring = sqlparser.String
 
+// sessionMaxResultRows is the session variable through which clients
+// change the maximum rows of a resultset, zero restores the global one.
+const sessionMaxResultRows = "proxy_max_result_rows"
+
 func (c *Conn) handleSet(stmt *sqlparser.Set, sql string) error {
 	switch stmt.Scope {
 	case "global":
@@ -26,7 +33,14 @@ func (c *Conn) handleSet(stmt *sqlparser.Set, sql string) error {
 		return c.handleSetAutoCommit(stmt.Exprs[0].Expr, sql)
 	case `NAMES`:
 		return c.handleSetNames(stmt.Exprs[0].Expr)
+	case `PROXY_QUERY_TIMEOUT`:
+		return c.handleSetQueryTimeout(stmt)
+	case `PROXY_MAX_RESULT_ROWS`:
+		return c.handleSetMaxResultRows(stmt.Exprs[0].Expr)
+	case `TIME_ZONE`:
+		return c.handleSetTimeZone(stmt.Exprs[0].Expr)
 	default:
+		c.trackSetVariables(stmt)
 		//todo:strict condition
 		return c.handleShow(nil, sql, nil) //errors.Errorf("set %s is not supported now", k)
 	}
@@ -42,10 +56,12 @@ func (c *Conn) handleSetAutoCommit(val sqlparser.ValExpr, sql string) error {
 	case '1':
 		//default value is 1, no need to do anything
 		log.Warning("set autocommit 1")
+		c.trackSystemVariable("autocommit", "ON")
 	case '0':
 		log.Warning("set autocommit 0")
 		c.server.IncCounter("set autocommit 0")
 		c.status &= ^mysql.SERVER_STATUS_AUTOCOMMIT
+		c.trackSystemVariable("autocommit", "OFF")
 	default:
 		return errors.Errorf("invalid autocommit flag %s", value)
 	}
@@ -54,6 +70,43 @@ func (c *Conn) handleSetAutoCommit(val sqlparser.ValExpr, sql string) error {
 	return errors.Trace(err)
 }
 
+func (c *Conn) handleSetQueryTimeout(stmt *sqlparser.Set) error {
+	if _, ok := stmt.Exprs[0].Expr.(sqlparser.NumVal); !ok {
+		return errors.Errorf("set %s error", planbuilder.SessionQueryTimeout)
+	}
+
+	plan, err := planbuilder.GetStmtExecPlan(stmt, nil, c.alloc)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	c.queryTimeout = plan.Timeout
+	c.trackSystemVariable(planbuilder.SessionQueryTimeout, strconv.FormatFloat(plan.Timeout.Seconds(), 'f', -1, 64))
+
+	err = c.writeOkFlush(nil)
+	return errors.Trace(err)
+}
+
+func (c *Conn) handleSetMaxResultRows(val sqlparser.ValExpr) error {
+	value, ok := val.(sqlparser.NumVal)
+	if !ok {
+		return errors.Errorf("set %s error", sessionMaxResultRows)
+	}
+	n, err := strconv.Atoi(string(value))
+	if err != nil || n < 0 {
+		return errors.Errorf("invalid %s %s", sessionMaxResultRows, value)
+	}
+
+	if maxResultRows > 0 && n > maxResultRows {
+		n = maxResultRows
+	}
+	c.resultRowsLimit = n
+	c.trackSystemVariable(sessionMaxResultRows, strconv.Itoa(c.maxResultRows()))
+
+	err = c.writeOkFlush(nil)
+	return errors.Trace(err)
+}
+
 func (c *Conn) handleSetNames(val sqlparser.ValExpr) error {
 	value, ok := val.(sqlparser.StrVal)
 	if !ok {
@@ -72,3 +125,18 @@ func (c *Conn) handleSetNames(val sqlparser.ValExpr) error {
 	err := c.writeOkFlush(nil)
 	return errors.Trace(err)
 }
+
+// trackSetVariables records the local variables stmt sets, their
+// selects go to the backends from then on.
+func (c *Conn) trackSetVariables(stmt *sqlparser.Set) {
+	for _, expr := range stmt.Exprs {
+		name := "@@" + strings.ToLower(strings.TrimPrefix(string(expr.Name.Name), "@@"))
+		if _, ok := planbuilder.LocalVariables[name]; !ok {
+			continue
+		}
+		if c.setVariables == nil {
+			c.setVariables = make(map[string]bool)
+		}
+		c.setVariables[name] = true
+	}
+}
@@ -3,10 +3,13 @@ package proxy
 import (
 	"encoding/binary"
 	"fmt"
+	"math"
+
+	"github.com/juju/errors"
 	"github.com/ngaut/arena"
 	"github.com/wandoulabs/cm/mysql"
 	"github.com/wandoulabs/cm/sqlparser"
-	"math"
+	"github.com/wandoulabs/cm/vt/tabletserver/planbuilder"
 )
 
 var paramFieldData []byte
@@ -20,18 +23,254 @@ func init() {
 }
 
 type Stmt struct {
-	id      uint32
-	params  int
-	columns int
-	args    []interface{}
-	s       sqlparser.Statement
-	sql     string
+	id         uint32
+	params     int
+	columns    int
+	args       []interface{}
+	s          sqlparser.Statement
+	sql        string
+	paramTypes []byte                //types sent with the last bound params
+	plan       *planbuilder.ExecPlan //nil for statements the cache ignores
 }
 
 func (s *Stmt) ResetParams() {
 	s.args = make([]interface{}, s.params)
 }
 
+// countParams returns the number of ? placeholders in sql.
+func countParams(sql string, alloc arena.ArenaAllocator) int {
+	tkn := sqlparser.NewStringTokenizer(sql, alloc)
+	n := 0
+	for {
+		switch typ, _ := tkn.Scan(); typ {
+		case 0, sqlparser.LEX_ERROR:
+			return n
+		case sqlparser.VALUE_ARG:
+			n++
+		}
+	}
+}
+
+// prepareStmt parses sql and plans it for all its executions, getTable
+// is for the dbs of no schema. The statement outlives the command so
+// it's built on the heap rather than in the connection arena.
+func (c *Conn) prepareStmt(sql string, getTable planbuilder.TableGetter) (*Stmt, error) {
+	sql = sqlparser.TrimTrailing(sql)
+	stmt, err := sqlparser.Parse(sql, arena.StdAllocator)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	s := &Stmt{
+		params: countParams(sql, arena.StdAllocator),
+		s:      stmt,
+		sql:    sql,
+	}
+
+	switch v := stmt.(type) {
+	case *sqlparser.Select, *sqlparser.Replace, *sqlparser.Update, *sqlparser.Delete:
+		s.plan, _, err = c.getStmtPlan(stmt, sql, getTable, arena.StdAllocator)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	case *sqlparser.Insert:
+		// upserts update the rows they conflict with, plain inserts
+		// can't touch cached rows
+		if v.OnDup != nil {
+			s.plan, _, err = c.getStmtPlan(stmt, sql, getTable, arena.StdAllocator)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+	default:
+		return nil, errors.Errorf("statement %T not support in prepare, %s", stmt, sql)
+	}
+
+	if c.stmts == nil {
+		c.stmts = make(map[uint32]*Stmt)
+	}
+	c.stmtId++
+	s.id = c.stmtId
+	s.ResetParams()
+	c.stmts[s.id] = s
+
+	return s, nil
+}
+
+func (c *Conn) handleStmtPrepare(sql string) error {
+	s, err := c.prepareStmt(sql, c.getTableSchema)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	data := c.alloc.AllocBytesWithLen(4, 16)
+	//status ok
+	data = append(data, mysql.OK_HEADER)
+	//stmt id
+	data = append(data, mysql.Uint32ToBytes(s.id)...)
+	//number columns, sent with the results instead
+	data = append(data, mysql.Uint16ToBytes(uint16(s.columns))...)
+	//number params
+	data = append(data, mysql.Uint16ToBytes(uint16(s.params))...)
+	//filter [00]
+	data = append(data, 0)
+	//warning count
+	data = append(data, 0, 0)
+	if err := c.writePacket(data); err != nil {
+		return errors.Trace(err)
+	}
+
+	if s.params > 0 {
+		for i := 0; i < s.params; i++ {
+			data = data[0:4]
+			data = append(data, paramFieldData...)
+			if err := c.writePacket(data); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		if err := c.writeEOF(c.status); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return errors.Trace(c.flush())
+}
+
+// bindStmtExecute decodes a COM_STMT_EXECUTE packet into the args of
+// its statement and returns the prepared plan bound to them.
+func (c *Conn) bindStmtExecute(data []byte) (*Stmt, *planbuilder.ExecPlan, error) {
+	if len(data) < 9 {
+		return nil, nil, mysql.ErrMalformPacket
+	}
+
+	pos := 0
+	id := binary.LittleEndian.Uint32(data[0:4])
+	pos += 4
+
+	s, ok := c.stmts[id]
+	if !ok {
+		return nil, nil, mysql.NewError(mysql.ER_UNKNOWN_STMT_HANDLER,
+			fmt.Sprintf("Unknown prepared statement handler (%d) given to stmt_execute", id))
+	}
+
+	flag := data[pos]
+	pos++
+	if flag != 0 {
+		return nil, nil, errors.Errorf("unsupported cursor flag %d", flag)
+	}
+
+	//skip iteration-count, always 1
+	pos += 4
+
+	s.ResetParams()
+	if s.params > 0 {
+		nullBitmapLen := (s.params + 7) >> 3
+		if len(data) < (pos + nullBitmapLen + 1) {
+			return nil, nil, mysql.ErrMalformPacket
+		}
+		nullBitmap := data[pos : pos+nullBitmapLen]
+		pos += nullBitmapLen
+
+		//new param bound flag
+		if data[pos] == 1 {
+			pos++
+			if len(data) < (pos + (s.params << 1)) {
+				return nil, nil, mysql.ErrMalformPacket
+			}
+			s.paramTypes = append(s.paramTypes[:0], data[pos:pos+(s.params<<1)]...)
+			pos += s.params << 1
+		} else {
+			pos++
+		}
+
+		if len(s.paramTypes) != s.params<<1 {
+			return nil, nil, mysql.ErrMalformPacket
+		}
+
+		if err := c.bindStmtArgs(s, nullBitmap, s.paramTypes, data[pos:]); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+	}
+
+	if s.plan == nil {
+		return s, nil, nil
+	}
+	// the cached plan is dropped when the schema it's planned on changes
+	if si, ok := c.server.GetRowCacheSchema(c.db); ok {
+		span := c.childSpan("analyze")
+		ep, err := si.GetPlan(s.sql)
+		span.Finish(err)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		s.plan = ep.ExecPlan
+	}
+
+	plan, err := s.plan.Bind(makeBindVars(s.args))
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	return s, plan, nil
+}
+
+func (c *Conn) handleStmtExecute(data []byte) (err error) {
+	var sql string
+	if len(data) >= 4 {
+		if s, ok := c.stmts[binary.LittleEndian.Uint32(data[0:4])]; ok {
+			sql = s.sql
+		}
+	}
+	span := c.startSpan("stmt_execute", sql)
+	defer func() { c.endSpan(span, err) }()
+
+	s, plan, err := c.bindStmtExecute(data)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if isDryrun(s.s) {
+		c.server.IncCounter("dryrun")
+		return c.handleDryrun(s.s, s.sql, s.args)
+	}
+
+	c.binaryProtocol = true
+	defer func() {
+		c.binaryProtocol = false
+	}()
+
+	switch stmt := s.s.(type) {
+	case *sqlparser.Select:
+		if plan == nil {
+			return c.selectFromShards(stmt, s.sql, s.args)
+		}
+		return c.selectWithPlan(plan, c.getTableInfo(plan.TableName), stmt, s.sql, s.args)
+	case *sqlparser.Insert:
+		if plan == nil {
+			return c.execPlan(nil, nil, stmt, s.sql, s.args)
+		}
+		return c.execPlan(plan, c.getTableInfo(plan.TableName), stmt, s.sql, s.args)
+	default:
+		return c.execPlan(plan, c.getTableInfo(plan.TableName), stmt, s.sql, s.args)
+	}
+}
+
+func (c *Conn) handleStmtReset(data []byte) error {
+	if len(data) < 4 {
+		return mysql.ErrMalformPacket
+	}
+
+	id := binary.LittleEndian.Uint32(data[0:4])
+	s, ok := c.stmts[id]
+	if !ok {
+		return mysql.NewError(mysql.ER_UNKNOWN_STMT_HANDLER,
+			fmt.Sprintf("Unknown prepared statement handler (%d) given to stmt_reset", id))
+	}
+
+	s.ResetParams()
+	return c.writeOkFlush(nil)
+}
+
 func (c *Conn) bindStmtArgs(s *Stmt, nullBitmap, paramTypes, paramValues []byte) error {
 	args := s.args
 
@@ -163,7 +402,8 @@ func (c *Conn) handleStmtClose(data []byte) error {
 		return nil
 	}
 
-	binary.LittleEndian.Uint32(data[0:4])
+	id := binary.LittleEndian.Uint32(data[0:4])
+	delete(c.stmts, id)
 
 	return nil
 }
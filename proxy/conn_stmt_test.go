@@ -1 +1,81 @@
 package proxy
+
+import (
+	"testing"
+
+	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/sqltypes"
+	"github.com/wandoulabs/cm/vt/schema"
+	"github.com/wandoulabs/cm/vt/tabletserver/planbuilder"
+)
+
+func testStmtTable(name string) (*schema.Table, bool) {
+	if name != "t" {
+		return nil, false
+	}
+	ta := schema.NewTable("t")
+	ta.AddColumn("id", "bigint(20)", "", nil, "")
+	ta.AddColumn("name", "varchar(32)", "", nil, "")
+	ta.AddIndex("PRIMARY").AddColumn("id", 0)
+	ta.PKColumns = []int{0}
+	ta.CacheType = schema.CACHE_RW
+	return ta, true
+}
+
+// executePacket builds a COM_STMT_EXECUTE payload with one bigint
+// param, sending its type only when bound is set.
+func executePacket(id uint32, v int64, bound bool) []byte {
+	data := append(mysql.Uint32ToBytes(id), 0, 1, 0, 0, 0)
+	data = append(data, 0) //null bitmap
+	if bound {
+		data = append(data, 1, mysql.MYSQL_TYPE_LONGLONG, 0)
+	} else {
+		data = append(data, 0)
+	}
+	return append(data, mysql.Uint64ToBytes(uint64(v))...)
+}
+
+func TestStmtPlanCache(t *testing.T) {
+	c, _ := newTestConn(&fakeServer{})
+
+	s, err := c.prepareStmt("select * from t where id = ?", testStmtTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.params != 1 || s.plan.PlanId != planbuilder.PLAN_PK_IN || c.stmts[s.id] != s {
+		t.Fatal(s.params, s.plan.PlanId)
+	}
+
+	for i, v := range []int64{7, 42, 3} {
+		got, plan, err := c.bindStmtExecute(executePacket(s.id, v, i == 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != s {
+			t.Fatal(got)
+		}
+		expect, _ := sqltypes.BuildValue(v)
+		if pk := plan.PKValues[0].(sqltypes.Value); pk.String() != expect.String() {
+			t.Fatal(v, pk)
+		}
+	}
+	if s.plan.PKValues[0] != ":v1" {
+		t.Fatal(s.plan.PKValues)
+	}
+
+	other, err := c.prepareStmt("delete from t where id = ?", testStmtTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.id == s.id {
+		t.Fatal(other.id)
+	}
+
+	c.handleStmtClose(mysql.Uint32ToBytes(s.id))
+	if _, _, err := c.bindStmtExecute(executePacket(s.id, 1, true)); err == nil {
+		t.Fatal("expect unknown stmt error")
+	}
+	if _, _, err := c.bindStmtExecute(executePacket(other.id, 1, false)); err != mysql.ErrMalformPacket {
+		t.Fatal("expect error for params never bound", err)
+	}
+}
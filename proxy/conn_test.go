@@ -1 +1,597 @@
 package proxy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/arena"
+	"github.com/ngaut/sync2"
+	"github.com/ngaut/tokenlimiter"
+	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/sqlparser"
+	"github.com/wandoulabs/cm/sqltypes"
+	"github.com/wandoulabs/cm/vt/schema"
+	"github.com/wandoulabs/cm/vt/tabletserver"
+	"github.com/wandoulabs/cm/vt/tabletserver/fakecache"
+	"github.com/wandoulabs/cm/vt/tabletserver/planbuilder"
+)
+
+type fakeServer struct {
+	IServer
+	schemas map[string]*Schema
+	tasks   []*execTask
+	result  interface{}   //what AsynExec completes tasks with, empty Result if nil
+	results []interface{} //per task index, overrides result
+	rwlock  sync.RWMutex
+}
+
+func (s *fakeServer) GetSchema(db string) *Schema {
+	return s.schemas[db]
+}
+
+// GetRowCacheSchema has the dbs no schema, the plans are made with the
+// getTable of the test.
+func (s *fakeServer) GetRowCacheSchema(db string) (*tabletserver.SchemaInfo, bool) {
+	return nil, false
+}
+
+func (s *fakeServer) GetToken() *tokenlimiter.Token { return nil }
+
+func (s *fakeServer) ReleaseToken(token *tokenlimiter.Token) {}
+
+func (s *fakeServer) GetRWlock() *sync.RWMutex { return &s.rwlock }
+
+func (s *fakeServer) IncCounter(key string) {}
+
+func (s *fakeServer) AsynExec(task *execTask) {
+	s.tasks = append(s.tasks, task)
+	task.rs[task.idx] = &mysql.Result{}
+	if s.result != nil {
+		task.rs[task.idx] = s.result
+	}
+	if task.idx < len(s.results) {
+		task.rs[task.idx] = s.results[task.idx]
+	}
+	task.done <- task.idx
+}
+
+type bufConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (b *bufConn) Write(p []byte) (int, error) {
+	return b.buf.Write(p)
+}
+
+func (b *bufConn) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+func newTestConn(s IServer) (*Conn, *bufConn) {
+	bc := &bufConn{}
+	c := &Conn{
+		pkg:        mysql.NewPacketIO(bc),
+		c:          bc,
+		server:     s,
+		capability: DEFAULT_CAPABILITY,
+		alloc:      arena.NewArenaAllocator(1024),
+	}
+	return c, bc
+}
+
+func TestInitDB(t *testing.T) {
+	s := &fakeServer{schemas: map[string]*Schema{"test": &Schema{db: "test"}}}
+	c, bc := newTestConn(s)
+
+	if err := c.handleInitDB([]byte("TEST")); err != nil {
+		t.Fatal(err)
+	}
+	if c.db != "test" {
+		t.Fatal(c.db)
+	}
+	if b := bc.Bytes(); len(b) < 5 || b[4] != mysql.OK_HEADER {
+		t.Fatal(b)
+	}
+}
+
+func TestInitUnknownDB(t *testing.T) {
+	s := &fakeServer{schemas: map[string]*Schema{"test": &Schema{db: "test"}}}
+	c, bc := newTestConn(s)
+	c.db = "test"
+
+	err := c.handleInitDB([]byte("nosuchdb"))
+	if err == nil {
+		t.Fatal("expect error")
+	}
+	if e, ok := errors.Cause(err).(*mysql.SqlError); !ok || e.Code != mysql.ER_BAD_DB_ERROR {
+		t.Fatal(err)
+	}
+	if c.db != "test" {
+		t.Fatal(c.db)
+	}
+
+	c.writeError(err)
+	b := bc.Bytes()
+	if len(b) < 7 || b[4] != mysql.ERR_HEADER || uint16(b[5])|uint16(b[6])<<8 != mysql.ER_BAD_DB_ERROR {
+		t.Fatal(b)
+	}
+}
+
+func TestSessionTrackSchema(t *testing.T) {
+	s := &fakeServer{schemas: map[string]*Schema{"test": &Schema{db: "test"}}}
+	c, bc := newTestConn(s)
+
+	if err := c.handleInitDB([]byte("test")); err != nil {
+		t.Fatal(err)
+	}
+
+	// header, ok, affected rows, insert id
+	b := bc.Bytes()[7:]
+	if status := uint16(b[0]) | uint16(b[1])<<8; status&mysql.SERVER_SESSION_STATE_CHANGED == 0 {
+		t.Fatal(status)
+	}
+	// skip status, warnings and empty info
+	b = b[5:]
+	expect := []byte{7, mysql.SESSION_TRACK_SCHEMA, 5, 4, 't', 'e', 's', 't'}
+	if !bytes.Equal(b, expect) {
+		t.Fatal(b)
+	}
+	if len(c.sessionState) != 0 {
+		t.Fatal("session state should be reset")
+	}
+}
+
+func TestSessionTrackDisabled(t *testing.T) {
+	s := &fakeServer{schemas: map[string]*Schema{"test": &Schema{db: "test"}}}
+	c, bc := newTestConn(s)
+	c.capability &= ^mysql.CLIENT_SESSION_TRACK
+
+	if err := c.handleInitDB([]byte("test")); err != nil {
+		t.Fatal(err)
+	}
+	if b := bc.Bytes(); len(b) != 11 {
+		t.Fatal(b)
+	}
+}
+
+func TestSetQueryTimeout(t *testing.T) {
+	s := &fakeServer{}
+	c, bc := newTestConn(s)
+
+	stmt, err := sqlparser.Parse("set proxy_query_timeout = 1.5", c.alloc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.handleSet(stmt.(*sqlparser.Set), ""); err != nil {
+		t.Fatal(err)
+	}
+	if c.queryTimeout != 1500*time.Millisecond {
+		t.Fatal(c.queryTimeout)
+	}
+	if b := bc.Bytes(); len(b) < 5 || b[4] != mysql.OK_HEADER {
+		t.Fatal(b)
+	}
+
+	if _, err := c.executeInShard([]*mysql.SqlConn{nil}, "select 1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.tasks) != 1 || s.tasks[0].timeout != 1500*time.Millisecond {
+		t.Fatal(s.tasks)
+	}
+}
+
+func TestKillAfter(t *testing.T) {
+	defer func(kill func(*mysql.SqlConn) error) { killQuery = kill }(killQuery)
+	killed := make(chan *mysql.SqlConn, 2)
+	killQuery = func(co *mysql.SqlConn) error {
+		killed <- co
+		return nil
+	}
+
+	co := &mysql.SqlConn{}
+	stop := killAfter(co, 10*time.Millisecond)
+	if got := <-killed; got != co {
+		t.Fatal(got)
+	}
+	stop()
+
+	// done in time
+	killAfter(co, 50*time.Millisecond)()
+	time.Sleep(100 * time.Millisecond)
+	if len(killed) != 0 {
+		t.Fatal("killed after the query")
+	}
+}
+
+func TestExecuteMidStream(t *testing.T) {
+	partial := &mysql.Result{Resultset: &mysql.Resultset{
+		Fields:   []*mysql.Field{&mysql.Field{Name: []byte("id")}},
+		RowDatas: []mysql.RowData{mysql.RowData("\x011")},
+	}}
+	s := &fakeServer{result: &partialResult{partial}}
+	c, bc := newTestConn(s)
+
+	rs, err := c.executeInShard(make([]*mysql.SqlConn, 1), "select id from t", nil)
+	if errors.Cause(err) != mysql.ErrBackendMidStream {
+		t.Fatal(err)
+	}
+	if rs[0] != partial {
+		t.Fatal(rs)
+	}
+
+	status, r, err := c.mergeSelectRows(rs, &sqlparser.Select{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.writeResultRows(status, r); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.writeError(mysql.ErrBackendMidStream); err != nil {
+		t.Fatal(err)
+	}
+
+	// column count, field, EOF, the row, then an error instead of EOF
+	var last []byte
+	b := bc.Bytes()
+	for i := 0; i < 5; i++ {
+		if len(b) < 4 {
+			t.Fatal(i, b)
+		}
+		n := int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+		last, b = b[4:4+n], b[4+n:]
+	}
+	if last[0] != mysql.ERR_HEADER || len(b) != 0 {
+		t.Fatal(last, b)
+	}
+}
+
+func TestWriteFieldList(t *testing.T) {
+	ta := schema.NewTable("t")
+	ta.AddColumn("id", "bigint(20)", "", sqltypes.NULL, "auto_increment")
+	ta.AddColumn("name", "varchar(32)", "utf8_general_ci", sqltypes.MakeString([]byte("none")), "")
+	ta.AddColumn("note", "varchar(64)", "utf8_general_ci", sqltypes.NULL, "")
+
+	for _, withDefaults := range []bool{false, true} {
+		c, bc := newTestConn(&fakeServer{})
+		if err := c.writeFieldList(c.status, buildFieldList(ta, "test", withDefaults)); err != nil {
+			t.Fatal(err)
+		}
+
+		// a column definition per column, then EOF
+		var packets [][]byte
+		for b := bc.Bytes(); len(b) > 0; {
+			n := int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+			packets, b = append(packets, b[4:4+n]), b[4+n:]
+		}
+		if len(packets) != len(ta.Columns)+1 || packets[len(packets)-1][0] != mysql.EOF_HEADER {
+			t.Fatal(packets)
+		}
+		for i, p := range packets[:len(ta.Columns)] {
+			f, err := mysql.FieldData(p).Parse()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(f.Name) != ta.Columns[i].Name || string(f.Table) != "t" || string(f.Schema) != "test" {
+				t.Fatalf("%+v", f)
+			}
+			// only non NULL defaults are sent
+			expect := withDefaults && i == 1
+			if (f.DefaultValue != nil) != expect || expect && string(f.DefaultValue) != "none" {
+				t.Fatalf("%v %d %+v", withDefaults, i, f)
+			}
+		}
+	}
+}
+
+func TestBackendQueries(t *testing.T) {
+	s := &fakeServer{}
+	c, _ := newTestConn(s)
+
+	// a PK lookup runs on one connection
+	if _, err := c.executeInShard(make([]*mysql.SqlConn, 1), "select * from t where id = 1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if c.BackendQueries() != 1 {
+		t.Fatal(c.BackendQueries())
+	}
+
+	// a subquery resolved before the outer query
+	fm := fakecache.New()
+	defer fm.Close()
+	dc, _, ds := newDMLConn(fm)
+	sql := "update t set name = 'a' where email = 'b' limit 5"
+	getTable := func(name string) (*schema.Table, bool) {
+		ti := ds.si.GetTable(name)
+		if ti == nil {
+			return nil, false
+		}
+		return ti.Table, true
+	}
+	plan, err := planbuilder.GetSqlExecPlan(sql, getTable, c.alloc)
+	if err != nil || plan.Subquery == nil {
+		t.Fatal(plan, err)
+	}
+	ds.queue = []interface{}{pkResult(1, 3), &mysql.Result{AffectedRows: 2}}
+	if err := dc.handleQuery(sql); err != nil {
+		t.Fatal(err)
+	}
+	if dc.BackendQueries() != 2 {
+		t.Fatal(dc.BackendQueries())
+	}
+
+	// a PK_IN batch over three shards
+	c.backendQueries = 0
+	if _, err := c.executeInShard(make([]*mysql.SqlConn, 3), "select * from t where id in (1, 2, 3)", nil); err != nil {
+		t.Fatal(err)
+	}
+	if c.BackendQueries() != 3 || len(s.tasks) != 4 {
+		t.Fatal(c.BackendQueries(), len(s.tasks))
+	}
+}
+
+func TestDebug(t *testing.T) {
+	c, bc := newTestConn(&fakeServer{})
+
+	for i := 0; i < 2; i++ {
+		if err := c.dispatch([]byte{byte(mysql.COM_DEBUG)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an OK per command, the connection is kept
+	b := bc.Bytes()
+	for i := 0; i < 2; i++ {
+		n := int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+		if b[4] != mysql.OK_HEADER {
+			t.Fatal(i, b)
+		}
+		b = b[4+n:]
+	}
+	if len(b) != 0 {
+		t.Fatal(b)
+	}
+}
+
+func TestMergeBudget(t *testing.T) {
+	defer func(v int64) { maxMergeBytes = v }(maxMergeBytes)
+	maxMergeBytes = 1024
+
+	// the reads of all the shards are bounded together
+	s := &fakeServer{}
+	c, _ := newTestConn(s)
+	if _, err := c.executeInShard(make([]*mysql.SqlConn, 2), "select 1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.tasks) != 2 || s.tasks[0].budget == nil || s.tasks[1].budget != s.tasks[0].budget {
+		t.Fatal(s.tasks)
+	}
+
+	maxMergeBytes = 0
+	s.tasks = nil
+	if _, err := c.executeInShard(make([]*mysql.SqlConn, 2), "select 1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if s.tasks[0].budget != nil {
+		t.Fatal(s.tasks[0].budget)
+	}
+}
+
+func TestPartialResults(t *testing.T) {
+	defer func(v bool) { partialResults = v }(partialResults)
+
+	shard := func(id string) *mysql.Result {
+		return &mysql.Result{Resultset: &mysql.Resultset{
+			Fields:   []*mysql.Field{&mysql.Field{Name: []byte("id")}},
+			Values:   []mysql.RowValue{{id}},
+			RowDatas: []mysql.RowData{mysql.RowData("\x01" + id)},
+		}}
+	}
+	failure := mysql.NewError(mysql.ER_UNKNOWN_ERROR, "shard down")
+
+	// all or nothing by default
+	s := &fakeServer{results: []interface{}{shard("1"), failure, shard("3")}}
+	c, _ := newTestConn(s)
+	rs, err := c.executeInShard(make([]*mysql.SqlConn, 3), "select id from t", nil)
+	if errors.Cause(err) != failure || rs[1] != nil {
+		t.Fatal(err, rs)
+	}
+
+	partialResults = true
+	s = &fakeServer{results: []interface{}{shard("1"), failure, shard("3")}}
+	c, bc := newTestConn(s)
+	rs, err = c.executeInShard(make([]*mysql.SqlConn, 3), "select id from t", nil)
+	if rs, err = c.partialShardResults(rs, err); err != nil || len(rs) != 2 {
+		t.Fatal(err, rs)
+	}
+	if err := c.mergeSelectResult(rs, &sqlparser.Select{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// column count, field, EOF, two rows, EOF with a warning
+	var packets [][]byte
+	for b := bc.Bytes(); len(b) > 0; {
+		n := int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+		packets, b = append(packets, b[4:4+n]), b[4+n:]
+	}
+	if len(packets) != 6 {
+		t.Fatal(packets)
+	}
+	if eof := packets[5]; eof[0] != mysql.EOF_HEADER || eof[1] != 1 || eof[2] != 0 {
+		t.Fatal(eof)
+	}
+
+	// nothing to return if every shard failed
+	s = &fakeServer{results: []interface{}{failure, failure}}
+	c, _ = newTestConn(s)
+	rs, err = c.executeInShard(make([]*mysql.SqlConn, 2), "select id from t", nil)
+	if _, err = c.partialShardResults(rs, err); errors.Cause(err) != failure {
+		t.Fatal(err)
+	}
+}
+
+// slowServer runs the tasks concurrently, the ones in fail fail at once
+// and the others take delay. It records how many ran and at most at once.
+type slowServer struct {
+	fakeServer
+	delay      time.Duration
+	fail       map[int]error
+	running    sync2.AtomicInt32
+	maxRunning sync2.AtomicInt32
+	ran        sync2.AtomicInt32
+}
+
+func (s *slowServer) AsynExec(task *execTask) {
+	go func() {
+		n := s.running.Add(1)
+		for m := s.maxRunning.Get(); n > m && !s.maxRunning.CompareAndSwap(m, n); m = s.maxRunning.Get() {
+		}
+		if err, ok := s.fail[task.idx]; ok {
+			task.rs[task.idx] = err
+		} else {
+			time.Sleep(s.delay)
+			task.rs[task.idx] = &mysql.Result{}
+		}
+		s.running.Add(-1)
+		s.ran.Add(1)
+		task.done <- task.idx
+	}()
+}
+
+func TestShardConcurrency(t *testing.T) {
+	defer func(v int, p bool) { shardConcurrency, partialResults = v, p }(shardConcurrency, partialResults)
+
+	s := &slowServer{delay: 50 * time.Millisecond}
+	c, _ := newTestConn(s)
+	start := time.Now()
+	if _, err := c.executeInShard(make([]*mysql.SqlConn, 6), "select 1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if s.maxRunning.Get() != 6 || time.Since(start) >= 6*s.delay {
+		t.Fatal(s.maxRunning.Get(), time.Since(start))
+	}
+
+	shardConcurrency = 2
+	s = &slowServer{delay: 20 * time.Millisecond}
+	c, _ = newTestConn(s)
+	if _, err := c.executeInShard(make([]*mysql.SqlConn, 6), "select 1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if s.maxRunning.Get() != 2 || s.ran.Get() != 6 || c.BackendQueries() != 6 {
+		t.Fatal(s.maxRunning.Get(), s.ran.Get(), c.BackendQueries())
+	}
+
+	// the first failure keeps the query off the shards left
+	failure := mysql.NewError(mysql.ER_UNKNOWN_ERROR, "shard down")
+	s = &slowServer{delay: 20 * time.Millisecond, fail: map[int]error{0: failure}}
+	c, _ = newTestConn(s)
+	rs, err := c.executeInShard(make([]*mysql.SqlConn, 6), "select 1", nil)
+	if errors.Cause(err) != failure {
+		t.Fatal(err)
+	}
+	if s.ran.Get() != 2 || rs[1] == nil || rs[2] != nil || rs[5] != nil {
+		t.Fatal(s.ran.Get(), rs)
+	}
+
+	// unless the rows of the others are wanted
+	partialResults = true
+	s = &slowServer{delay: 20 * time.Millisecond, fail: map[int]error{0: failure}}
+	c, _ = newTestConn(s)
+	if _, err := c.executeInShard(make([]*mysql.SqlConn, 6), "select 1", nil); errors.Cause(err) != failure {
+		t.Fatal(err)
+	}
+	if s.ran.Get() != 6 {
+		t.Fatal(s.ran.Get())
+	}
+}
+
+func TestSelectVersion(t *testing.T) {
+	c, bc := newTestConn(&fakeServer{})
+	c.db = "db1"
+	c.connectionId = 7
+	if err := c.handleQuery("select @@VERSION, DATABASE() as d, connection_id()"); err != nil {
+		t.Fatal(err)
+	}
+	b := bc.Bytes()
+	for _, s := range []string{"@@version", mysql.ServerVersion, "\x01d", "db1", "connection_id", "\x017"} {
+		if !bytes.Contains(b, []byte(s)) {
+			t.Fatalf("%s not in %q", s, b)
+		}
+	}
+}
+
+func TestLocalVariables(t *testing.T) {
+	planbuilder.SetLocalVariables(map[string]string{"version_comment": "cm proxy", "@@MAX_ALLOWED_PACKET": "16777216"})
+	defer planbuilder.SetLocalVariables(nil)
+
+	fm := fakecache.New()
+	defer fm.Close()
+	c, bc, s := newDMLConn(fm)
+	sql := "select @@version_comment, @@max_allowed_packet as p"
+	stmt, err := sqlparser.Parse(sql, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := c.buildLocalSelectResult(stmt.(*sqlparser.SimpleSelect))
+	if len(r.Fields) != 2 || string(r.Fields[1].Name) != "p" || r.Fields[1].Type != mysql.MYSQL_TYPE_LONGLONG {
+		t.Fatalf("%+v", r)
+	}
+	if err := c.handleQuery(sql); err != nil {
+		t.Fatal(err)
+	}
+	if b := bc.Bytes(); !bytes.Contains(b, []byte("cm proxy")) || !bytes.Contains(b, []byte("16777216")) {
+		t.Fatalf("%q", b)
+	}
+	if len(s.tasks) != 0 {
+		t.Fatal(s.tasks[0].sql)
+	}
+
+	// the others go to the backends, and the ones the session sets
+	for _, sql := range []string{
+		"select @@sql_mode",
+		"select @@version_comment, @@sql_mode",
+		"select @@session.version_comment",
+		"set @@session.version_comment = 'mine'",
+		"select @@version_comment",
+	} {
+		s.tasks = nil
+		s.queue = []interface{}{&mysql.Result{Resultset: &mysql.Resultset{}}}
+		if strings.HasPrefix(sql, "set") {
+			s.queue = nil
+		}
+		if err := c.handleQuery(sql); err != nil {
+			t.Fatal(sql, err)
+		}
+		if len(s.tasks) != 1 || s.tasks[0].sql != sql {
+			t.Fatal(sql, s.tasks)
+		}
+	}
+}
+
+func TestUserVarSelect(t *testing.T) {
+	fm := fakecache.New()
+	defer fm.Close()
+	c, bc, s := newDMLConn(fm)
+	for _, sql := range []string{"select @x := 1", "select * from t where id = @x"} {
+		s.tasks = nil
+		s.queue = []interface{}{&mysql.Result{Resultset: &mysql.Resultset{
+			Fields:   []*mysql.Field{{Name: []byte("@x := 1")}},
+			RowDatas: []mysql.RowData{mysql.PutLengthEncodedString([]byte("1"), nil)},
+		}}}
+		bc.buf.Reset()
+		if err := c.handleQuery(sql); err != nil {
+			t.Fatal(sql, err)
+		}
+		if len(s.tasks) != 1 || s.tasks[0].sql != sql {
+			t.Fatal(sql, s.tasks)
+		}
+		if b := bc.Bytes(); !bytes.Contains(b, []byte("@x := 1")) || !bytes.Contains(b, []byte("\x011")) {
+			t.Fatalf("%s: %q", sql, b)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/sqlparser"
+)
+
+// backendTimeZone is the time_zone of the backends, the zone the
+// TIMESTAMP values of the cached rows are in. The sessions can only set
+// another one if it is configured.
+var backendTimeZone *time.Location
+
+const timestampLayout = "2006-01-02 15:04:05"
+
+// parseTimeZone parses a time_zone value: SYSTEM, an offset like +08:00
+// or a named zone. SYSTEM yields nil.
+func parseTimeZone(zone string) (*time.Location, error) {
+	if strings.EqualFold(zone, "system") {
+		return nil, nil
+	}
+	if len(zone) == 6 && (zone[0] == '+' || zone[0] == '-') && zone[3] == ':' {
+		hours, err1 := strconv.Atoi(zone[1:3])
+		minutes, err2 := strconv.Atoi(zone[4:])
+		if err1 != nil || err2 != nil || hours > 14 || minutes > 59 {
+			return nil, errors.Errorf("unknown or incorrect time zone: '%s'", zone)
+		}
+		offset := hours*3600 + minutes*60
+		if zone[0] == '-' {
+			offset = -offset
+		}
+		return time.FixedZone(zone, offset), nil
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, errors.Errorf("unknown or incorrect time zone: '%s'", zone)
+	}
+	return loc, nil
+}
+
+// handleSetTimeZone sets the time_zone of the session, which its
+// backend conns get before running its queries. SYSTEM leaves them in
+// the one of the backends.
+func (c *Conn) handleSetTimeZone(val sqlparser.ValExpr) error {
+	value, ok := val.(sqlparser.StrVal)
+	if !ok {
+		return errors.Errorf("set time_zone error")
+	}
+	loc, err := parseTimeZone(string(value))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if loc != nil && backendTimeZone == nil {
+		// the cached rows could not be converted
+		return errors.Errorf("set time_zone needs the backend_time_zone of the proxy configured")
+	}
+
+	c.timeZone = loc
+	c.timeZoneName = ""
+	if loc != nil {
+		c.timeZoneName = string(value)
+	}
+	c.trackSystemVariable("time_zone", string(value))
+	return errors.Trace(c.writeOkFlush(nil))
+}
+
+// convertTimestamp moves a TIMESTAMP value from one zone to another,
+// keeping its fractional digits. Zero dates are left alone.
+func convertTimestamp(v []byte, from, to *time.Location) ([]byte, error) {
+	layout := timestampLayout
+	if len(v) > len(layout) && v[len(layout)] == '.' {
+		layout += "." + strings.Repeat("0", len(v)-len(layout)-1)
+	}
+	t, err := time.ParseInLocation(layout, string(v), from)
+	if err != nil {
+		if strings.HasPrefix(string(v), "0000-00-00") {
+			return v, nil
+		}
+		return nil, errors.Trace(err)
+	}
+	return []byte(t.In(to).Format(layout)), nil
+}
+
+// toSessionTimeZone returns cached rows, of fields, with their TIMESTAMP
+// values in the zone of the session.
+func (c *Conn) toSessionTimeZone(fields []*mysql.Field, rows []mysql.RowData) ([]mysql.RowData, error) {
+	return c.convertTimestamps(fields, rows, backendTimeZone, c.timeZone)
+}
+
+// toBackendTimeZone returns rows, of fields, read by the session with
+// their TIMESTAMP values in the zone of the backends, as they are cached.
+func (c *Conn) toBackendTimeZone(fields []*mysql.Field, rows []mysql.RowData) ([]mysql.RowData, error) {
+	return c.convertTimestamps(fields, rows, c.timeZone, backendTimeZone)
+}
+
+// convertTimestamps returns rows, of fields, with their TIMESTAMP values
+// moved from one zone to another, rows if there is nothing to convert.
+func (c *Conn) convertTimestamps(fields []*mysql.Field, rows []mysql.RowData, from, to *time.Location) ([]mysql.RowData, error) {
+	if from == nil || to == nil || from == to {
+		return rows, nil
+	}
+	var columns []int
+	for i, f := range fields {
+		if f.Type == mysql.MYSQL_TYPE_TIMESTAMP {
+			columns = append(columns, i)
+		}
+	}
+	if len(columns) == 0 {
+		return rows, nil
+	}
+
+	converted := make([]mysql.RowData, len(rows))
+	for i, data := range rows {
+		values, err := data.Parse(fields, c.binaryProtocol)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, j := range columns {
+			if v, ok := values[j].([]byte); ok {
+				if values[j], err = convertTimestamp(v, from, to); err != nil {
+					return nil, errors.Trace(err)
+				}
+			}
+		}
+		if converted[i], err = mysql.BuildRowData(fields, values, c.protocol()); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return converted, nil
+}
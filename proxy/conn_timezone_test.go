@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ngaut/arena"
+	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/sqlparser"
+)
+
+func TestParseTimeZone(t *testing.T) {
+	tests := []struct {
+		zone   string
+		offset int
+		ok     bool
+	}{
+		{"+08:00", 8 * 3600, true},
+		{"-05:30", -(5*3600 + 30*60), true},
+		{"UTC", 0, true},
+		{"+8:00", 0, false},
+		{"+15:00", 0, false},
+		{"Nowhere/Atlantis", 0, false},
+	}
+	now := time.Now()
+	for _, tt := range tests {
+		loc, err := parseTimeZone(tt.zone)
+		if (err == nil) != tt.ok {
+			t.Fatal(tt.zone, err)
+		}
+		if !tt.ok {
+			continue
+		}
+		if _, offset := now.In(loc).Zone(); offset != tt.offset {
+			t.Fatal(tt.zone, offset)
+		}
+	}
+	if loc, err := parseTimeZone("SYSTEM"); loc != nil || err != nil {
+		t.Fatal(loc, err)
+	}
+}
+
+func setTimeZone(t *testing.T, c *Conn, zone string) {
+	stmt, err := sqlparser.Parse("set time_zone = '"+zone+"'", arena.NewArenaAllocator(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.handleSet(stmt.(*sqlparser.Set), ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetTimeZoneNeedsBackendZone(t *testing.T) {
+	saved := backendTimeZone
+	defer func() { backendTimeZone = saved }()
+	backendTimeZone = nil
+
+	c, _ := newTestConn(&fakeServer{})
+	stmt, err := sqlparser.Parse("set time_zone = '+08:00'", arena.NewArenaAllocator(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.handleSet(stmt.(*sqlparser.Set), ""); err == nil || c.timeZone != nil {
+		t.Fatal("time_zone set without backend_time_zone", c.timeZone)
+	}
+	setTimeZone(t, c, "SYSTEM")
+
+	backendTimeZone = time.UTC
+	setTimeZone(t, c, "+08:00")
+	if c.timeZone == nil || c.timeZoneName != "+08:00" {
+		t.Fatal(c.timeZone, c.timeZoneName)
+	}
+	setTimeZone(t, c, "SYSTEM")
+	if c.timeZone != nil || c.timeZoneName != "" {
+		t.Fatal(c.timeZone, c.timeZoneName)
+	}
+}
+
+func TestConvertTimestamps(t *testing.T) {
+	saved := backendTimeZone
+	defer func() { backendTimeZone = saved }()
+	backendTimeZone = time.UTC
+
+	fields := []*mysql.Field{
+		{Name: []byte("created"), Type: mysql.MYSQL_TYPE_TIMESTAMP},
+		{Name: []byte("born"), Type: mysql.MYSQL_TYPE_DATETIME},
+	}
+	c, _ := newTestConn(&fakeServer{})
+	build := func(binary bool, values ...mysql.Value) []mysql.RowData {
+		protocol := mysql.TEXT_PROTOCOL
+		if binary {
+			protocol = mysql.BINARY_PROTOCOL
+		}
+		row, err := mysql.BuildRowData(fields, values, protocol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []mysql.RowData{row}
+	}
+	check := func(convert func([]*mysql.Field, []mysql.RowData) ([]mysql.RowData, error), rows []mysql.RowData, created, born string) {
+		rows, err := convert(fields, rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values, err := rows[0].Parse(fields, c.binaryProtocol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(values[0].([]byte)) != created || string(values[1].([]byte)) != born {
+			t.Fatalf("%s %s", values[0], values[1])
+		}
+	}
+
+	rows := build(false, []byte("2024-01-01 20:30:00.123"), []byte("2024-01-01 20:30:00"))
+	// the backend zone until the session sets one
+	check(c.toSessionTimeZone, rows, "2024-01-01 20:30:00.123", "2024-01-01 20:30:00")
+	check(c.toBackendTimeZone, rows, "2024-01-01 20:30:00.123", "2024-01-01 20:30:00")
+
+	setTimeZone(t, c, "+08:00")
+	check(c.toSessionTimeZone, rows, "2024-01-02 04:30:00.123", "2024-01-01 20:30:00")
+	// rows read in the zone of the session are cached in the one of the backends
+	check(c.toBackendTimeZone, rows, "2024-01-01 12:30:00.123", "2024-01-01 20:30:00")
+
+	setTimeZone(t, c, "-05:00")
+	check(c.toSessionTimeZone, rows, "2024-01-01 15:30:00.123", "2024-01-01 20:30:00")
+	zero := build(false, []byte("0000-00-00 00:00:00"), []byte("0000-00-00 00:00:00"))
+	check(c.toSessionTimeZone, zero, "0000-00-00 00:00:00", "0000-00-00 00:00:00")
+
+	c.binaryProtocol = true
+	check(c.toSessionTimeZone, build(true, []byte("2024-01-01 02:00:00"), []byte("2024-01-01 02:00:00")), "2023-12-31 21:00:00", "2024-01-01 02:00:00")
+	c.binaryProtocol = false
+
+	setTimeZone(t, c, "SYSTEM")
+	check(c.toSessionTimeZone, rows, "2024-01-01 20:30:00.123", "2024-01-01 20:30:00")
+}
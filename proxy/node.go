@@ -19,6 +19,14 @@ func (shard *Shard) String() string {
 	return shard.cfg.Id
 }
 
+// shardsById sorts shards by id, the order they are queried and their
+// rows merged in when a query scatters.
+type shardsById []*Shard
+
+func (s shardsById) Len() int           { return len(s) }
+func (s shardsById) Less(i, j int) bool { return s[i].cfg.Id < s[j].cfg.Id }
+func (s shardsById) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
 func (shard *Shard) Close() {
 	shard.master.Close()
 }
@@ -4,9 +4,13 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/juju/errors"
 	"github.com/ngaut/arena"
@@ -15,7 +19,9 @@ import (
 	"github.com/ngaut/tokenlimiter"
 	"github.com/wandoulabs/cm/config"
 	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/vt/schema"
 	"github.com/wandoulabs/cm/vt/tabletserver"
+	"github.com/wandoulabs/cm/vt/tabletserver/planbuilder"
 )
 
 var (
@@ -37,8 +43,12 @@ type Server struct {
 	concurrentLimiter *tokenlimiter.TokenLimiter
 
 	counter *stats.Counters
+	// eventLabels label the metrics of the counter by key
+	eventMu     sync.RWMutex
+	eventLabels map[string]tabletserver.Labels
 
-	clients map[uint32]*Conn
+	clientsMu sync.Mutex //guards clients, apart from rwlock
+	clients   map[uint32]*Conn
 }
 
 type IServer interface {
@@ -58,6 +68,27 @@ type IServer interface {
 
 func (s *Server) IncCounter(key string) {
 	s.counter.Add(key, 1)
+	tabletserver.GetMetrics().Counter("proxy_events", s.eventLabelsOf(key), 1)
+}
+
+// eventLabelsOf returns the labels of the metrics of the counter key,
+// built the first time.
+func (s *Server) eventLabelsOf(key string) tabletserver.Labels {
+	s.eventMu.RLock()
+	labels, ok := s.eventLabels[key]
+	s.eventMu.RUnlock()
+	if ok {
+		return labels
+	}
+
+	labels = tabletserver.Labels{"event": key}
+	s.eventMu.Lock()
+	if s.eventLabels == nil {
+		s.eventLabels = make(map[string]tabletserver.Labels)
+	}
+	s.eventLabels[key] = labels
+	s.eventMu.Unlock()
+	return labels
 }
 
 func (s *Server) DecCounter(key string) {
@@ -81,11 +112,14 @@ func (s *Server) GetRowCacheSchema(db string) (*tabletserver.SchemaInfo, bool) {
 	return si, ok
 }
 
+// GetShardIds returns the ids of the shards sorted, so that they are
+// picked and queried in the same order every time.
 func (s *Server) GetShardIds() []string {
 	ids := make([]string, 0, len(s.shards))
 	for id, _ := range s.shards {
 		ids = append(ids, id)
 	}
+	sort.Strings(ids)
 
 	return ids
 }
@@ -144,6 +178,26 @@ func (s *Server) newConn(co net.Conn) *Conn {
 	return c
 }
 
+// Clients returns a snapshot of the connected clients, ordered by
+// connection id.
+func (s *Server) Clients() []ConnInfo {
+	s.clientsMu.Lock()
+	infos := make([]ConnInfo, 0, len(s.clients))
+	for _, c := range s.clients {
+		infos = append(infos, c.Info())
+	}
+	s.clientsMu.Unlock()
+
+	sort.Sort(connInfos(infos))
+	return infos
+}
+
+type connInfos []ConnInfo
+
+func (ci connInfos) Len() int           { return len(ci) }
+func (ci connInfos) Less(i, j int) bool { return ci[i].Id < ci[j].Id }
+func (ci connInfos) Swap(i, j int)      { ci[i], ci[j] = ci[j], ci[i] }
+
 func (s *Server) GetRWlock() *sync.RWMutex {
 	return s.rwlock
 }
@@ -185,7 +239,11 @@ func (s *Server) loadSchemaInfo() error {
 
 		//fix hard code node
 		sc := s.cfg.Shards[0]
-		si := tabletserver.NewSchemaInfo(s.cfg.RowCacheConf, s.cfg.Shards[0].Master, sc.User, sc.Password, v.DB, overrides)
+		var snapshot string
+		if s.cfg.SchemaSnapshotDir != "" {
+			snapshot = filepath.Join(s.cfg.SchemaSnapshotDir, v.DB+".json")
+		}
+		si := tabletserver.NewSchemaInfo(s.cfg.RowCacheConf, s.cfg.Shards[0].Master, sc.User, sc.Password, v.DB, overrides, snapshot)
 
 		log.Infof("%+v", si)
 		s.autoSchamas[v.DB] = si
@@ -203,6 +261,47 @@ func makeServer(configFile string) *Server {
 
 	log.Warningf("%#v", cfg)
 
+	planbuilder.PassUnknownTables = cfg.PassUnknownTables
+	planbuilder.MaxQueryTimeout = time.Duration(cfg.MaxQueryTimeout) * time.Second
+	planbuilder.MaxFullScanRows = cfg.MaxFullScanRows
+	planbuilder.CheckJoinTypes = cfg.CheckJoinTypes
+	planbuilder.RejectCoercedJoins = cfg.RejectCoercedJoins
+	planbuilder.RejectSelectInto = cfg.RejectSelectInto
+	planbuilder.LogPlans = cfg.LogPlans
+	planbuilder.LogPlanValues = cfg.LogPlanValues
+	tinyIntAsBool = cfg.TinyIntAsBool
+	fieldListDefaults = cfg.FieldListDefaults
+	maxResultRows = cfg.MaxResultRows
+	maxMergeBytes = cfg.MaxMergeBytes
+	partialResults = cfg.PartialResults
+	shardConcurrency = cfg.ShardConcurrency
+	readRepairSampleRate = cfg.ReadRepairSampleRate
+	rewriteCachedRows = cfg.RewriteCachedRows
+	tabletserver.SchemaRefreshInterval = time.Duration(cfg.SchemaRefreshInterval) * time.Second
+	planbuilder.SetAllowedFingerprints(cfg.AllowedFingerprints)
+	planbuilder.SetDeniedFingerprints(cfg.DeniedFingerprints)
+	schema.CaseInsensitiveColumns = cfg.CaseInsensitiveColumns
+	planbuilder.SetLocalVariables(cfg.LocalVariables)
+	if cfg.DefaultCharset != "" {
+		if err := schema.SetDefaultCharset(cfg.DefaultCharset); err != nil {
+			log.Error(err.Error())
+			return nil
+		}
+	}
+	if cfg.PrometheusMetrics {
+		tabletserver.SetMetrics(tabletserver.NewPrometheusMetrics("cm"))
+	}
+	if cfg.BackendTimeZone != "" {
+		loc, err := parseTimeZone(cfg.BackendTimeZone)
+		if err != nil {
+			log.Error(err.Error())
+			return nil
+		}
+		if loc != nil {
+			backendTimeZone = loc
+		}
+	}
+
 	s := &Server{
 		configFile:        configFile,
 		cfg:               cfg,
@@ -217,22 +316,41 @@ func makeServer(configFile string) *Server {
 		clients:           make(map[uint32]*Conn),
 	}
 
-	f := func(wg *sync.WaitGroup, rs []interface{}, i int, co *mysql.SqlConn, sql string, args []interface{}) {
-		r, err := co.Execute(sql, args...)
-		if err != nil {
+	f := func(rs []interface{}, i int, co *mysql.SqlConn, sql string, args []interface{}, timeout time.Duration, binary bool, budget *mysql.ReadBudget) {
+		if timeout > 0 {
+			defer killAfter(co, timeout)()
+			co.SetDeadline(time.Now().Add(timeout + killGrace))
+			defer co.SetDeadline(time.Time{})
+		}
+		co.SetReadBudget(budget)
+		defer co.SetReadBudget(nil)
+
+		var r *mysql.Result
+		var err error
+		if binary {
+			r, err = co.ExecuteStmt(sql, args...)
+		} else {
+			r, err = co.Execute(sql, args...)
+		}
+		if err == mysql.ErrBackendMidStream {
+			rs[i] = &partialResult{r}
+		} else if err != nil {
 			log.Warning(err)
 			rs[i] = err
 		} else {
 			rs[i] = r
 		}
-
-		wg.Done()
 	}
 
 	for i := 0; i < 100; i++ {
 		go func() {
 			for task := range s.taskQ {
-				f(task.wg, task.rs, task.idx, task.co, task.sql, task.args)
+				if task.canceled.Get() != 0 {
+					task.rs[task.idx] = errShardCanceled
+				} else {
+					f(task.rs, task.idx, task.co, task.sql, task.args, task.timeout, task.binary, task.budget)
+				}
+				task.done <- task.idx
 			}
 		}()
 	}
@@ -268,11 +386,14 @@ func (s *Server) cleanup() {
 }
 
 func (s *Server) resetSchemaInfo() error {
+	s.clientsMu.Lock()
 	for _, c := range s.clients {
 		if len(c.txConns) > 0 {
+			s.clientsMu.Unlock()
 			return errors.Errorf("transaction exist")
 		}
 	}
+	s.clientsMu.Unlock()
 
 	cfg, err := config.ParseConfigFile(s.configFile)
 	if err != nil {
@@ -310,6 +431,73 @@ func (s *Server) HandleReload(w http.ResponseWriter, req *http.Request) {
 	io.WriteString(w, "ok")
 }
 
+// HandleMaintenance serves /api/maintenance, which reports whether the
+// proxy is in maintenance. POST it with on=1 to fail every query with
+// ErrMaintenance, on=0 to serve them again.
+func (s *Server) HandleMaintenance(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		on, err := strconv.ParseBool(req.FormValue("on"))
+		if err != nil {
+			http.Error(w, "on must be a boolean", http.StatusBadRequest)
+			return
+		}
+		log.Warningf("maintenance mode set to %v", on)
+		planbuilder.SetMaintenance(on)
+	}
+	io.WriteString(w, strconv.FormatBool(planbuilder.InMaintenance()))
+}
+
+const tableStatsURL = "/debug/table_stats/"
+
+// HandleTableStats serves /debug/table_stats/<db>/<table>, leaving
+// out the table lists the cached tables of db.
+func (s *Server) HandleTableStats(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, tableStatsURL)
+	db, table := path, ""
+	if pos := strings.Index(path, "/"); pos != -1 {
+		db, table = path[:pos], path[pos+1:]
+	}
+
+	s.rwlock.RLock()
+	defer s.rwlock.RUnlock()
+
+	si, ok := s.autoSchamas[db]
+	if !ok {
+		http.Error(w, "db "+db+" not found", http.StatusNotFound)
+		return
+	}
+	si.ServeTableStats(w, table)
+}
+
+const plansURL = "/debug/plans/"
+
+// HandlePlans serves /debug/plans/<db>, listing the cached plans of db.
+// An evict=<sql> parameter drops the plan of sql first.
+func (s *Server) HandlePlans(w http.ResponseWriter, req *http.Request) {
+	db := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, plansURL), "/")
+
+	s.rwlock.RLock()
+	defer s.rwlock.RUnlock()
+
+	si, ok := s.autoSchamas[db]
+	if !ok {
+		http.Error(w, "db "+db+" not found", http.StatusNotFound)
+		return
+	}
+	si.ServePlans(w, req)
+}
+
+// HandleMetrics serves /metrics in the Prometheus text format if
+// prometheus_metrics is set.
+func (s *Server) HandleMetrics(w http.ResponseWriter, req *http.Request) {
+	h, ok := tabletserver.GetMetrics().(http.Handler)
+	if !ok {
+		http.Error(w, "prometheus metrics are not enabled", http.StatusNotFound)
+		return
+	}
+	h.ServeHTTP(w, req)
+}
+
 func (s *Server) Run() error {
 	for {
 		conn, err := s.listener.Accept()
@@ -352,9 +540,17 @@ func (s *Server) onConn(c net.Conn) {
 		log.Infof("close %s", conn)
 	}()
 
-	s.rwlock.Lock()
+	s.clientsMu.Lock()
 	s.clients[conn.connectionId] = conn
-	s.rwlock.Unlock()
+	tabletserver.GetMetrics().Gauge("proxy_connections", nil, int64(len(s.clients)))
+	s.clientsMu.Unlock()
+
+	defer func() {
+		s.clientsMu.Lock()
+		delete(s.clients, conn.connectionId)
+		tabletserver.GetMetrics().Gauge("proxy_connections", nil, int64(len(s.clients)))
+		s.clientsMu.Unlock()
+	}()
 
 	conn.Run()
 }
@@ -1 +1,106 @@
 package proxy
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wandoulabs/cm/config"
+	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/sqlparser"
+)
+
+func TestClients(t *testing.T) {
+	c1, _ := newTestConn(&fakeServer{})
+	c1.connectionId, c1.user = 2, "u1"
+	c2, _ := newTestConn(&fakeServer{})
+	c2.connectionId, c2.user = 1, "u2"
+	c2.stmts = map[uint32]*Stmt{7: &Stmt{id: 7, sql: "select * from t where id = ?"}}
+
+	start := time.Now()
+	if err := c1.dispatch(append([]byte{byte(mysql.COM_QUERY)}, "begin"...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c1.dispatch([]byte{byte(mysql.COM_PING)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c1.dispatch(append([]byte{byte(mysql.COM_QUERY)}, "rollback"...)); err != nil {
+		t.Fatal(err)
+	}
+	c2.recordCommand(mysql.COM_STMT_EXECUTE, []byte{7, 0, 0, 0})
+
+	// the registry is not behind the lock of the config reloads
+	s := &Server{rwlock: &sync.RWMutex{}, clients: map[uint32]*Conn{2: c1, 1: c2}}
+	s.rwlock.Lock()
+	infos := s.Clients()
+	s.rwlock.Unlock()
+	if len(infos) != 2 || infos[0].Id != 1 || infos[1].Id != 2 {
+		t.Fatalf("%+v", infos)
+	}
+
+	// a ping is activity but not a query
+	if i := infos[1]; i.User != "u1" || i.Queries != 2 || i.LastQuery != "rollback" || i.LastActive.Before(start) {
+		t.Fatalf("%+v", i)
+	}
+	if i := infos[0]; i.Queries != 1 || i.LastQuery != "select * from t where id = ?" {
+		t.Fatalf("%+v", i)
+	}
+
+	// long queries are cut
+	c1.recordCommand(mysql.COM_QUERY, []byte("insert into t values "+strings.Repeat("(1),", 1000)+"(1)"))
+	if q := s.Clients()[1].LastQuery; len(q) != maxLastQuery || !strings.HasPrefix(q, "insert into t values (1),") {
+		t.Fatal(len(q))
+	}
+}
+
+func TestShardOrder(t *testing.T) {
+	ids := []string{"shard3", "shard1", "shard10", "shard2"}
+	s := &Server{shards: make(map[string]*Shard)}
+	for _, id := range ids {
+		s.shards[id] = &Shard{cfg: config.ShardConfig{Id: id}}
+	}
+	for i := 0; i < 20; i++ {
+		if got := s.GetShardIds(); !reflect.DeepEqual(got, []string{"shard1", "shard10", "shard2", "shard3"}) {
+			t.Fatal(got)
+		}
+	}
+
+	shards := make([]*Shard, 0, len(ids))
+	for _, id := range ids {
+		shards = append(shards, s.shards[id])
+	}
+	sort.Sort(shardsById(shards))
+	if fmt.Sprint(shards) != "[shard1 shard10 shard2 shard3]" {
+		t.Fatal(shards)
+	}
+
+	// an unordered scatter select returns the rows in shard order,
+	// whichever shard finishes first
+	for i := 0; i < 20; i++ {
+		var results []interface{}
+		for _, shard := range shards {
+			id := shard.cfg.Id
+			results = append(results, &mysql.Result{Resultset: &mysql.Resultset{
+				Fields:   []*mysql.Field{&mysql.Field{Name: []byte("id")}},
+				Values:   []mysql.RowValue{{id}},
+				RowDatas: []mysql.RowData{mysql.RowData(string(byte(len(id))) + id)},
+			}})
+		}
+		c, _ := newTestConn(&fakeServer{results: results})
+		rs, err := c.executeInShard(make([]*mysql.SqlConn, len(shards)), "select id from t", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, r, err := c.mergeSelectRows(rs, &sqlparser.Select{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(r.Values) != "[[shard1] [shard10] [shard2] [shard3]]" {
+			t.Fatal(r.Values)
+		}
+	}
+}
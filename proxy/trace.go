@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Span is an operation of a traced query.
+type Span interface {
+	// Child starts a span within this one.
+	Child(name string) Span
+	// Finish ends the span, err is the error of the operation if it
+	// failed.
+	Finish(err error)
+}
+
+// Tracer starts the spans of the queries. It is where a tracing library
+// like OpenTelemetry is plugged in, the proxy doesn't depend on any.
+type Tracer interface {
+	// StartSpan starts the span of a query. traceparent is the W3C trace
+	// context the query carries in a /* traceparent=... */ comment, ""
+	// if it has none.
+	StartSpan(name string, traceparent string) Span
+}
+
+// tracer traces the queries if set, see SetTracer.
+var tracer Tracer
+
+// SetTracer makes the queries traced by t, nil stops tracing. It must
+// be called before serving.
+func SetTracer(t Tracer) {
+	tracer = t
+}
+
+type noopSpan struct{}
+
+func (noopSpan) Child(name string) Span { return noopSpan{} }
+func (noopSpan) Finish(err error)       {}
+
+var traceparentRegexp = regexp.MustCompile(`traceparent\s*=\s*'?([0-9a-f]{2}-[0-9a-f]{32}-[0-9a-f]{16}-[0-9a-f]{2})`)
+
+// parseTraceparent returns the trace context in a comment of sql, ""
+// if there is none.
+func parseTraceparent(sql string) string {
+	for {
+		start := strings.Index(sql, "/*")
+		if start == -1 {
+			return ""
+		}
+		sql = sql[start+2:]
+		end := strings.Index(sql, "*/")
+		if end == -1 {
+			return ""
+		}
+		if m := traceparentRegexp.FindStringSubmatch(sql[:end]); m != nil {
+			return m[1]
+		}
+		sql = sql[end+2:]
+	}
+}
+
+// startSpan starts the span of the query sql, c.span until it's done.
+func (c *Conn) startSpan(name string, sql string) Span {
+	if tracer == nil {
+		return noopSpan{}
+	}
+	c.span = tracer.StartSpan(name, parseTraceparent(sql))
+	return c.span
+}
+
+// endSpan finishes the span of the query.
+func (c *Conn) endSpan(span Span, err error) {
+	span.Finish(err)
+	c.span = nil
+}
+
+// childSpan starts a span within the one of the query.
+func (c *Conn) childSpan(name string) Span {
+	if c.span == nil {
+		return noopSpan{}
+	}
+	return c.span.Child(name)
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/vt/tabletserver"
+	"github.com/wandoulabs/cm/vt/tabletserver/fakecache"
+)
+
+// fakeTracer logs the starts and finishes of its spans.
+type fakeTracer struct {
+	events []string
+}
+
+type fakeSpan struct {
+	tracer *fakeTracer
+	name   string
+}
+
+func (t *fakeTracer) StartSpan(name string, traceparent string) Span {
+	t.events = append(t.events, "start "+name+" "+traceparent)
+	return &fakeSpan{t, name}
+}
+
+func (s *fakeSpan) Child(name string) Span {
+	s.tracer.events = append(s.tracer.events, "start "+name)
+	return &fakeSpan{s.tracer, name}
+}
+
+func (s *fakeSpan) Finish(err error) {
+	event := "finish " + s.name
+	if err != nil {
+		event += " " + err.Error()
+	}
+	s.tracer.events = append(s.tracer.events, event)
+}
+
+// traceServer serves the tables of the information schema from no shard.
+type traceServer struct {
+	fakeServer
+}
+
+func (s *traceServer) GetRowCacheSchema(db string) (*tabletserver.SchemaInfo, bool) {
+	return tabletserver.NewSchemaInfoOf(tabletserver.NewCachePool("test", tabletserver.RowCacheConfig{}, 0, 0)), true
+}
+
+func (s *traceServer) GetShardIds() []string { return nil }
+
+func TestParseTraceparent(t *testing.T) {
+	const tp = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	cases := []struct {
+		sql, traceparent string
+	}{
+		{"/* traceparent=" + tp + " */ select 1", tp},
+		{"select /* app=x */ 1 /* traceparent='" + tp + "' */", tp},
+		{"select 1", ""},
+		{"/* traceparent=00-xyz */ select 1", ""},
+		{"select 'traceparent=" + tp + "'", ""},
+		{"/* unterminated traceparent=" + tp, ""},
+	}
+	for _, c := range cases {
+		if tp := parseTraceparent(c.sql); tp != c.traceparent {
+			t.Fatalf("%q: %q", c.sql, tp)
+		}
+	}
+}
+
+func TestTraceSelect(t *testing.T) {
+	ft := &fakeTracer{}
+	SetTracer(ft)
+	defer SetTracer(nil)
+
+	fm := fakecache.New()
+	defer fm.Close()
+	c, _, s := newDMLConn(fm)
+	s.si.GetTable("t").Cache.Set("1--", []byte{1, '1', 1, 'a', 1, 'b'}, 0)
+	const tp = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	if err := c.handleQuery("/* traceparent=" + tp + " */ select * from t where id = 1"); err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{
+		"start query " + tp,
+		"start parse",
+		"finish parse",
+		"start analyze",
+		"finish analyze",
+		"start rowcache",
+		"finish rowcache",
+		"finish query",
+	}
+	if !reflect.DeepEqual(ft.events, expect) {
+		t.Fatalf("%q", ft.events)
+	}
+	if c.span != nil {
+		t.Fatal("span left after the query")
+	}
+
+	// the backend part, under the span of the query
+	ft.events = nil
+	failure := mysql.NewError(mysql.ER_UNKNOWN_ERROR, "shard down")
+	c, _ = newTestConn(&fakeServer{result: failure})
+	span := c.startSpan("query", "select 1")
+	_, err := c.executeInShard(make([]*mysql.SqlConn, 1), "select 1", nil)
+	c.endSpan(span, err)
+	expect = []string{
+		"start query ",
+		"start execute",
+		"finish execute " + failure.Error(),
+		"finish query " + failure.Error(),
+	}
+	if !reflect.DeepEqual(ft.events, expect) {
+		t.Fatalf("%q", ft.events)
+	}
+
+	// untraced
+	SetTracer(nil)
+	c, _ = newTestConn(&fakeServer{})
+	if _, err := c.executeInShard(make([]*mysql.SqlConn, 1), "select 1", nil); err != nil || len(ft.events) != 4 {
+		t.Fatal(err, ft.events)
+	}
+}
+
+func TestTraceStmtExecute(t *testing.T) {
+	ft := &fakeTracer{}
+	SetTracer(ft)
+	defer SetTracer(nil)
+
+	fm := fakecache.New()
+	defer fm.Close()
+	c, _, _ := newDMLConn(fm)
+	const tp = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	stmt, err := c.prepareStmt("/* traceparent="+tp+" */ delete from t where id = ?", c.getTableSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.handleStmtExecute(executePacket(stmt.id, 1, true)); err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{
+		"start stmt_execute " + tp,
+		"start analyze",
+		"finish analyze",
+		"start execute",
+		"finish execute",
+		"finish stmt_execute",
+	}
+	if !reflect.DeepEqual(ft.events, expect) {
+		t.Fatalf("%q", ft.events)
+	}
+	if c.span != nil {
+		t.Fatal("span left after the statement")
+	}
+}
@@ -2,18 +2,69 @@ package proxy
 
 import (
 	"sync"
+	"time"
 
+	"github.com/juju/errors"
+	log "github.com/ngaut/logging"
+	"github.com/ngaut/sync2"
 	"github.com/wandoulabs/cm/mysql"
 	"github.com/wandoulabs/cm/vt/schema"
 )
 
 type execTask struct {
-	wg   *sync.WaitGroup
-	rs   []interface{}
-	idx  int
-	co   *mysql.SqlConn
-	sql  string
-	args []interface{}
+	done     chan<- int //gets idx once rs[idx] is set
+	canceled *sync2.AtomicInt32
+	rs       []interface{}
+	idx      int
+	co       *mysql.SqlConn
+	sql      string
+	args     []interface{}
+	timeout  time.Duration     //bounds the execution when non-zero
+	binary   bool              //execute as a prepared statement
+	budget   *mysql.ReadBudget //bounds the rows read, nil for no bound
+}
+
+// errShardCanceled is the result of the shards a query doesn't run on
+// because it failed on another one.
+var errShardCanceled = errors.New("shard query canceled")
+
+// killGrace is how long a backend has to abort a query it is sent a
+// KILL QUERY for before the proxy gives up on its conn.
+const killGrace = 5 * time.Second
+
+// killQuery aborts the query co runs.
+var killQuery = func(co *mysql.SqlConn) error {
+	return co.KillQuery()
+}
+
+// killAfter aborts the query co runs once timeout passes, unless the
+// returned func is called before. It waits for a kill being sent, which
+// then can't abort the next query of co.
+func killAfter(co *mysql.SqlConn, timeout time.Duration) func() {
+	var mu sync.Mutex
+	done := false
+	t := time.AfterFunc(timeout, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if done {
+			return
+		}
+		if err := killQuery(co); err != nil {
+			log.Warning(err)
+		}
+	})
+	return func() {
+		t.Stop()
+		mu.Lock()
+		done = true
+		mu.Unlock()
+	}
+}
+
+// partialResult holds the rows a shard returned before the backend
+// failed mid-stream.
+type partialResult struct {
+	*mysql.Result
 }
 
 func GetRowCacheType(rowCacheType string) int {
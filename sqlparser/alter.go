@@ -0,0 +1,274 @@
+package sqlparser
+
+import (
+	"strings"
+)
+
+const (
+	AST_ADD    = "add"
+	AST_MODIFY = "modify"
+)
+
+// AlterSpec is an operation of an ALTER TABLE the schema can follow
+// without a reload: the ADD, DROP or MODIFY of a column, or the ADD or
+// DROP of an index.
+type AlterSpec struct {
+	// Action is AST_ADD, AST_DROP or AST_MODIFY.
+	Action string
+	// Index is set for index operations, Unique for unique indexes.
+	Index  bool
+	Unique bool
+	Name   string
+
+	// The definition of ADD and MODIFY COLUMN, Default is nil for
+	// NULL or no default.
+	Type      string
+	Collation string
+	Default   []byte
+	Extra     string
+	Comment   string
+
+	// Columns are the key parts of ADD INDEX, like name or name(10).
+	Columns []string
+}
+
+type alterToken struct {
+	typ int
+	val string
+}
+
+// is tells if the token is the keyword or identifier word, whatever
+// its case.
+func (t alterToken) is(word string) bool {
+	return t.typ != STRING && strings.EqualFold(t.val, word)
+}
+
+// parseAlterSpecs parses the operations of an ALTER TABLE, nil if sql is
+// not one or has an operation AlterSpec can't describe.
+func parseAlterSpecs(sql string) []*AlterSpec {
+	tkn := NewStringTokenizer(sql, nil)
+	var tokens []alterToken
+	for {
+		typ, val := tkn.Scan()
+		if typ == 0 || typ == ';' {
+			break
+		}
+		if typ == LEX_ERROR {
+			return nil
+		}
+		if typ == COMMENT {
+			continue
+		}
+		tokens = append(tokens, alterToken{typ, string(val)})
+	}
+
+	// ALTER [IGNORE] TABLE name
+	if len(tokens) < 4 || !tokens[0].is("alter") {
+		return nil
+	}
+	tokens = tokens[1:]
+	if tokens[0].is("ignore") {
+		tokens = tokens[1:]
+	}
+	if len(tokens) < 3 || !tokens[0].is("table") {
+		return nil
+	}
+	tokens = tokens[2:]
+
+	var specs []*AlterSpec
+	for _, clause := range splitClauses(tokens) {
+		spec := parseAlterSpec(clause)
+		if spec == nil {
+			return nil
+		}
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+// splitClauses splits tokens at the commas outside parentheses.
+func splitClauses(tokens []alterToken) [][]alterToken {
+	var clauses [][]alterToken
+	depth, start := 0, 0
+	for i, t := range tokens {
+		switch t.typ {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				clauses = append(clauses, tokens[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(clauses, tokens[start:])
+}
+
+func parseAlterSpec(clause []alterToken) *AlterSpec {
+	if len(clause) < 2 {
+		return nil
+	}
+	spec := &AlterSpec{}
+	switch {
+	case clause[0].is("add"):
+		spec.Action = AST_ADD
+	case clause[0].is("drop"):
+		spec.Action = AST_DROP
+	case clause[0].is("modify"):
+		spec.Action = AST_MODIFY
+	default:
+		return nil
+	}
+	clause = clause[1:]
+
+	if spec.Action != AST_MODIFY {
+		if clause[0].is("unique") && spec.Action == AST_ADD {
+			spec.Index, spec.Unique = true, true
+			clause = clause[1:]
+			if len(clause) > 0 && (clause[0].is("index") || clause[0].is("key")) {
+				clause = clause[1:]
+			}
+		} else if clause[0].is("index") || clause[0].is("key") {
+			spec.Index = true
+			clause = clause[1:]
+		}
+	}
+	if spec.Index {
+		return parseIndexSpec(spec, clause)
+	}
+
+	if len(clause) > 0 && clause[0].is("column") {
+		clause = clause[1:]
+	}
+	if len(clause) == 0 || clause[0].typ != ID {
+		return nil
+	}
+	spec.Name = strings.ToLower(clause[0].val)
+	if spec.Action == AST_DROP {
+		if len(clause) != 1 {
+			return nil
+		}
+		return spec
+	}
+	return parseColumnDefinition(spec, clause[1:])
+}
+
+// parseIndexSpec parses [name] (key_part, ...) of ADD INDEX, or the name
+// of DROP INDEX.
+func parseIndexSpec(spec *AlterSpec, clause []alterToken) *AlterSpec {
+	if len(clause) > 0 && clause[0].typ != '(' {
+		spec.Name = clause[0].val
+		clause = clause[1:]
+	}
+	if spec.Action == AST_DROP {
+		if spec.Name == "" || len(clause) != 0 {
+			return nil
+		}
+		return spec
+	}
+
+	if len(clause) < 3 || clause[0].typ != '(' || clause[len(clause)-1].typ != ')' {
+		return nil
+	}
+	for _, part := range splitClauses(clause[1 : len(clause)-1]) {
+		if len(part) > 0 && (part[len(part)-1].is("asc") || part[len(part)-1].is("desc")) {
+			part = part[:len(part)-1]
+		}
+		switch {
+		case len(part) == 1 && part[0].typ == ID:
+			spec.Columns = append(spec.Columns, strings.ToLower(part[0].val))
+		case len(part) == 4 && part[0].typ == ID && part[1].typ == '(' && part[2].typ == NUMBER && part[3].typ == ')':
+			spec.Columns = append(spec.Columns, strings.ToLower(part[0].val)+"("+part[2].val+")")
+		default:
+			return nil
+		}
+	}
+	if spec.Name == "" {
+		// mysql names the index after its first column
+		spec.Name = strings.SplitN(spec.Columns[0], "(", 2)[0]
+	}
+	return spec
+}
+
+// parseColumnDefinition parses the type and attributes of a column.
+// Generated columns, inline keys and FIRST or AFTER aren't supported.
+func parseColumnDefinition(spec *AlterSpec, clause []alterToken) *AlterSpec {
+	if len(clause) == 0 || clause[0].typ != ID {
+		return nil
+	}
+	typ := strings.ToLower(clause[0].val)
+	clause = clause[1:]
+	if len(clause) > 0 && clause[0].typ == '(' {
+		var args []string
+		i := 1
+		for ; i < len(clause) && clause[i].typ != ')'; i++ {
+			switch clause[i].typ {
+			case ',':
+			case NUMBER:
+				args = append(args, clause[i].val)
+			case STRING:
+				args = append(args, "'"+strings.Replace(clause[i].val, "'", "''", -1)+"'")
+			default:
+				return nil
+			}
+		}
+		if i == len(clause) {
+			return nil
+		}
+		typ += "(" + strings.Join(args, ",") + ")"
+		clause = clause[i+1:]
+	}
+	for len(clause) > 0 && (clause[0].is("unsigned") || clause[0].is("zerofill")) {
+		typ += " " + strings.ToLower(clause[0].val)
+		clause = clause[1:]
+	}
+	spec.Type = typ
+
+	for len(clause) > 0 {
+		t := clause[0]
+		switch {
+		case t.is("null"):
+			clause = clause[1:]
+		case t.is("not") && len(clause) > 1 && clause[1].is("null"):
+			clause = clause[2:]
+		case t.is("auto_increment"):
+			spec.Extra = "auto_increment"
+			clause = clause[1:]
+		case t.is("default") && len(clause) > 1:
+			v := clause[1]
+			clause = clause[2:]
+			switch {
+			case v.is("null"):
+			case v.typ == '-' && len(clause) > 0 && clause[0].typ == NUMBER:
+				spec.Default = []byte("-" + clause[0].val)
+				clause = clause[1:]
+			case v.typ == NUMBER || v.typ == STRING || v.typ == ID:
+				spec.Default = []byte(v.val)
+			default:
+				return nil
+			}
+		case (t.is("collate") || t.is("comment")) && len(clause) > 1:
+			if t.is("collate") {
+				spec.Collation = strings.ToLower(clause[1].val)
+			} else {
+				spec.Comment = clause[1].val
+			}
+			clause = clause[2:]
+		case t.is("charset") && len(clause) > 1:
+			clause = clause[2:]
+		case t.is("character") && len(clause) > 2 && clause[1].is("set"):
+			clause = clause[3:]
+		case t.is("on") && len(clause) > 2 && clause[1].is("update"):
+			// ON UPDATE CURRENT_TIMESTAMP[()]
+			clause = clause[3:]
+			if len(clause) > 1 && clause[0].typ == '(' && clause[1].typ == ')' {
+				clause = clause[2:]
+			}
+		default:
+			return nil
+		}
+	}
+	return spec
+}
@@ -9,10 +9,78 @@ package sqlparser
 import (
 	"bytes"
 	"fmt"
+	"strings"
+
+	"github.com/ngaut/arena"
 	"github.com/wandoulabs/cm/hack"
 	"github.com/wandoulabs/cm/sqltypes"
 )
 
+// TrimTrailing strips the semicolons and whitespace clients may
+// append to a statement, which the grammar does not accept. A
+// semicolon inside a string literal is never trailing, the closing
+// quote comes after it.
+func TrimTrailing(sql string) string {
+	return strings.TrimRight(sql, "; \t\r\n")
+}
+
+// ReferencedTables returns every table sql touches, including the ones
+// of joins and subqueries, in order of appearance and without repeats.
+// Names are unquoted and keep their schema qualifier if they have one.
+func ReferencedTables(sql string, alloc arena.ArenaAllocator) ([]string, error) {
+	stmt, err := Parse(TrimTrailing(sql), alloc)
+	if err != nil {
+		return nil, err
+	}
+
+	var tables []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			tables = append(tables, name)
+		}
+	}
+
+	if ddl, ok := stmt.(*DDL); ok {
+		add(string(ddl.Table))
+		add(string(ddl.NewName))
+		return tables, nil
+	}
+
+	// formatting walks the whole tree, subqueries included
+	buf := NewTrackedBuffer(func(buf *TrackedBuffer, node SQLNode) {
+		if n, ok := node.(*TableName); ok {
+			if n.Qualifier != nil {
+				add(string(n.Qualifier) + "." + string(n.Name))
+			} else {
+				add(string(n.Name))
+			}
+		}
+		node.Format(buf)
+	}, alloc)
+	buf.Myprintf("%v", stmt)
+	return tables, nil
+}
+
+// HasUserVars returns true if sql references user variables like @x,
+// whose values live in the session of a backend connection. System
+// variables like @@autocommit don't count. It only tokenizes sql, so
+// it also works for statements the grammar does not accept, like
+// assignments with :=.
+func HasUserVars(sql string, alloc arena.ArenaAllocator) bool {
+	tkn := NewStringTokenizer(sql, alloc)
+	for {
+		typ, val := tkn.Scan()
+		switch {
+		case typ == 0:
+			return false
+		case typ == ID && len(val) > 1 && val[0] == '@' && val[1] != '@':
+			return true
+		}
+	}
+}
+
 // GetTableName returns the table name from the SimpleTableExpr
 // only if it's a simple expression. Otherwise, it returns "".
 func GetTableName(node SimpleTableExpr) string {
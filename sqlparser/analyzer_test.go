@@ -0,0 +1,56 @@
+package sqlparser
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ngaut/arena"
+)
+
+func TestReferencedTables(t *testing.T) {
+	cases := []struct {
+		sql    string
+		tables []string
+	}{
+		{"select * from t where id = 1", []string{"t"}},
+		{"select a.id from `a` join db.b on a.id = b.id left join c on c.id = a.id", []string{"a", "db.b", "c"}},
+		{"select * from t1, t2 where t1.id = t2.id", []string{"t1", "t2"}},
+		{"select * from t where id in (select id from u where x = (select max(x) from v))", []string{"t", "u", "v"}},
+		{"select * from t where exists (select 1 from t where id = 2)", []string{"t"}},
+		{"select * from (select id from u) as s", []string{"u"}},
+		{"select id from t union select id from db.u", []string{"t", "db.u"}},
+		{"insert into t(a) select a from u", []string{"t", "u"}},
+		{"update t set a = 1 where id in (select id from u)", []string{"t", "u"}},
+		{"delete from t where id = 1;", []string{"t"}},
+		{"rename table t to t_old", []string{"t", "t_old"}},
+	}
+	for _, c := range cases {
+		tables, err := ReferencedTables(c.sql, arena.NewArenaAllocator(1024))
+		if err != nil {
+			t.Fatal(c.sql, err)
+		}
+		if !reflect.DeepEqual(tables, c.tables) {
+			t.Fatal(c.sql, tables)
+		}
+	}
+
+	if _, err := ReferencedTables("select from", arena.NewArenaAllocator(1024)); err == nil {
+		t.Fatal("expect syntax error")
+	}
+}
+
+func TestHasUserVars(t *testing.T) {
+	cases := map[string]bool{
+		"select @x := 1":                     true,
+		"select * from t where id = @x":      true,
+		"select @@autocommit":                false,
+		"select * from t where name = '@x'":  false,
+		"select * from t where id = :id":     false,
+		"update t set a = @x + 1 where id=1": true,
+	}
+	for sql, expect := range cases {
+		if got := HasUserVars(sql, arena.NewArenaAllocator(1024)); got != expect {
+			t.Fatal(sql, got)
+		}
+	}
+}
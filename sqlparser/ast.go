@@ -32,6 +32,20 @@ func Parse(sql string, alloc arena.ArenaAllocator) (Statement, error) {
 	if yyParse(tokenizer) != 0 {
 		return nil, errors.New(tokenizer.LastError)
 	}
+	if ins, ok := tokenizer.ParseTree.(*Insert); ok {
+		ins.Ignore = tokenizer.insertIgnore
+	}
+	if tokenizer.selectInto != nil {
+		sel, ok := tokenizer.ParseTree.(*Select)
+		if !ok {
+			return nil, errors.New("into " + tokenizer.selectInto.Type + " is only supported in simple selects")
+		}
+		sel.Into = tokenizer.selectInto
+	}
+	if ddl, ok := tokenizer.ParseTree.(*DDL); ok && ddl.Action == AST_ALTER {
+		// the grammar skips what follows the table name
+		ddl.Specs = parseAlterSpecs(sql)
+	}
 	return tokenizer.ParseTree, nil
 }
 
@@ -87,6 +101,8 @@ type Select struct {
 	OrderBy     OrderBy
 	Limit       *Limit
 	Lock        string
+	// Into is set for SELECT ... INTO OUTFILE or DUMPFILE.
+	Into *SelectInto
 }
 
 // Select.Distinct
@@ -101,11 +117,31 @@ const (
 )
 
 func (node *Select) Format(buf *TrackedBuffer) {
-	buf.Myprintf("select %v%s%v from %v%v%v%v%v%v%s",
+	buf.Myprintf("select %v%s%v from %v%v%v%v%v%v%v%s",
 		node.Comments, node.Distinct, node.SelectExprs,
 		node.From, node.Where,
 		node.GroupBy, node.Having, node.OrderBy,
-		node.Limit, node.Lock)
+		node.Limit, node.Into, node.Lock)
+}
+
+// SelectInto represents the INTO OUTFILE or DUMPFILE clause of a
+// select, which makes the backend write the rows to a file on its host.
+type SelectInto struct {
+	Type string
+	File []byte
+}
+
+// SelectInto.Type
+const (
+	AST_OUTFILE  = "outfile"
+	AST_DUMPFILE = "dumpfile"
+)
+
+func (node *SelectInto) Format(buf *TrackedBuffer) {
+	if node == nil {
+		return
+	}
+	buf.Myprintf(" into %s %v", node.Type, StrVal(node.File))
 }
 
 // Union represents a UNION statement.
@@ -149,11 +185,18 @@ type Insert struct {
 	Columns  Columns
 	Rows     InsertRows
 	OnDup    OnDup
+	// Ignore is set for INSERT IGNORE, which skips the rows that fail
+	// with duplicate keys instead of failing.
+	Ignore bool
 }
 
 func (node *Insert) Format(buf *TrackedBuffer) {
-	buf.Myprintf("insert %vinto %v%v %v%v",
-		node.Comments,
+	ignore := ""
+	if node.Ignore {
+		ignore = "ignore "
+	}
+	buf.Myprintf("insert %v%sinto %v%v %v%v",
+		node.Comments, ignore,
 		node.Table, node.Columns, node.Rows, node.OnDup)
 }
 
@@ -241,6 +284,9 @@ type DDL struct {
 	Action  string
 	Table   []byte
 	NewName []byte
+	// Specs are the operations of an ALTER TABLE, nil if some of them
+	// can't be described by an AlterSpec.
+	Specs []*AlterSpec
 }
 
 const (
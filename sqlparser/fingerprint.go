@@ -0,0 +1,69 @@
+package sqlparser
+
+import (
+	"hash/fnv"
+	"strconv"
+
+	"github.com/ngaut/arena"
+)
+
+// Normalize returns the sql with literals replaced by ? and
+// whitespace and comments normalized, so that queries of the
+// same shape produce the same string.
+func Normalize(sql string, alloc arena.ArenaAllocator) (string, error) {
+	stmt, err := Parse(sql, alloc)
+	if err != nil {
+		return "", err
+	}
+	return NormalizeStmt(stmt, alloc), nil
+}
+
+// NormalizeStmt is Normalize for a parsed statement.
+func NormalizeStmt(stmt Statement, alloc arena.ArenaAllocator) string {
+	buf := NewTrackedBuffer(formatNormalized, alloc)
+	buf.Myprintf("%v", stmt)
+	return buf.String()
+}
+
+// Fingerprint returns a compact id of the normalized sql,
+// suitable for grouping queries by shape.
+func Fingerprint(sql string, alloc arena.ArenaAllocator) (string, error) {
+	stmt, err := Parse(sql, alloc)
+	if err != nil {
+		return "", err
+	}
+	return FingerprintStmt(stmt, alloc), nil
+}
+
+// FingerprintStmt is Fingerprint for a parsed statement.
+func FingerprintStmt(stmt Statement, alloc arena.ArenaAllocator) string {
+	h := fnv.New64a()
+	h.Write([]byte(NormalizeStmt(stmt, alloc)))
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+func formatNormalized(buf *TrackedBuffer, node SQLNode) {
+	switch node := node.(type) {
+	case Comments:
+		return
+	case StrVal, NumVal, ValArg:
+		buf.WriteByte('?')
+	case ValTuple, ListArg:
+		if IsSimpleTuple(node.(ValExpr)) {
+			buf.WriteString("(?)")
+			return
+		}
+		node.Format(buf)
+	case Values:
+		// rows of plain values collapse into a single row
+		for _, row := range node {
+			if !IsSimpleTuple(row) {
+				node.Format(buf)
+				return
+			}
+		}
+		buf.WriteString("values (?)")
+	default:
+		node.Format(buf)
+	}
+}
@@ -0,0 +1,73 @@
+package sqlparser
+
+import (
+	"testing"
+
+	"github.com/ngaut/arena"
+)
+
+func TestNormalize(t *testing.T) {
+	alloc := arena.NewArenaAllocator(1024)
+	s, err := Normalize("select /* x */ a from t  where id in (1, 2, 3) and name = 'abc'", alloc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "select a from t where id in (?) and name = ?" {
+		t.Fatal(s)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	alloc := arena.NewArenaAllocator(1024)
+	same := [][]string{
+		{"select a from t where id = 1", "SELECT a FROM t   WHERE id = 2"},
+		{"select a from t where name = 'x' limit 10", "select a from t where name = 'yy' limit 20"},
+		{"select a from t where id in (1, 2)", "select a from t where id in (3, 4, 5)"},
+		{"insert into t(a, b) values (1, 'a')", "insert into t(a, b) values (2, 'b'), (3, 'c')"},
+		{"update t set a = 1 where id = 2", "update /* comment */ t set a = 3 where id = 4"},
+	}
+	for _, pair := range same {
+		f1, err := Fingerprint(pair[0], alloc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f2, err := Fingerprint(pair[1], alloc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f1 != f2 {
+			t.Fatal(pair)
+		}
+	}
+
+	diff := [][]string{
+		{"select a from t where id = 1", "select b from t where id = 1"},
+		{"select a from t where id = 1", "select a from t where id > 1"},
+		{"select a from t where id = 1", "select a from t2 where id = 1"},
+		{"delete from t where id = 1", "select * from t where id = 1"},
+	}
+	for _, pair := range diff {
+		f1, _ := Fingerprint(pair[0], alloc)
+		f2, _ := Fingerprint(pair[1], alloc)
+		if f1 == f2 {
+			t.Fatal(pair)
+		}
+	}
+
+	if _, err := Fingerprint("select from where", alloc); err == nil {
+		t.Fatal("expect parse error")
+	}
+}
+
+func TestNilAllocator(t *testing.T) {
+	stmt, err := Parse("select a, 'x' from t where id = 1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := String(stmt, nil); s != "select a, 'x' from t where id = 1" {
+		t.Fatal(s)
+	}
+	if s, err := Fingerprint("select a from t where id = 1", nil); err != nil || s == "" {
+		t.Fatal(s, err)
+	}
+}
@@ -0,0 +1,108 @@
+package sqlparser
+
+import (
+	"testing"
+)
+
+func TestInsertIgnore(t *testing.T) {
+	cases := []struct {
+		sql    string
+		ignore bool
+		out    string
+	}{
+		{"insert into t(a) values (1)", false, "insert into t(a) values (1)"},
+		{"insert ignore into t(a) values (1)", true, "insert ignore into t(a) values (1)"},
+		{"INSERT IGNORE INTO t(a) VALUES (1)", true, "insert ignore into t(a) values (1)"},
+		{"insert /* c */ ignore into t set a = 1", true, "insert /* c */ ignore into t(a) values (1)"},
+		{"insert ignore into t(a) select a from u", true, "insert ignore into t(a) select a from u"},
+	}
+	for _, c := range cases {
+		stmt, err := Parse(c.sql, nil)
+		if err != nil {
+			t.Fatal(c.sql, err)
+		}
+		ins := stmt.(*Insert)
+		if ins.Ignore != c.ignore {
+			t.Fatal(c.sql, ins.Ignore)
+		}
+		if s := String(ins, nil); s != c.out {
+			t.Fatal(c.sql, s)
+		}
+	}
+
+	// ignore is only a modifier of insert
+	if _, err := Parse("select ignore from t", nil); err == nil {
+		t.Fatal("expect syntax error")
+	}
+}
+
+func TestSelectInto(t *testing.T) {
+	cases := []struct {
+		sql string
+		out string
+	}{
+		{"select * from t where id = 1 into outfile '/tmp/t.txt'", "select * from t where id = 1 into outfile '/tmp/t.txt'"},
+		{"select id INTO DUMPFILE 'it''s' from t limit 1", "select id from t limit 1 into dumpfile 'it\\'s'"},
+		{"select * from t into outfile 'x' for update", "select * from t into outfile 'x' for update"},
+	}
+	for _, c := range cases {
+		stmt, err := Parse(c.sql, nil)
+		if err != nil {
+			t.Fatal(c.sql, err)
+		}
+		if sel := stmt.(*Select); sel.Into == nil {
+			t.Fatal(c.sql)
+		}
+		if s := String(stmt, nil); s != c.out {
+			t.Fatal(c.sql, s)
+		}
+	}
+
+	for _, sql := range []string{
+		"select * from t into @x",
+		"select * from t into outfile",
+		"select a from t union select a from u into outfile 'x'",
+	} {
+		if _, err := Parse(sql, nil); err == nil {
+			t.Fatal(sql)
+		}
+	}
+
+	stmt, err := Parse("insert into t select * from u", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sel := stmt.(*Insert).Rows.(*Select); sel.Into != nil {
+		t.Fatal(sel.Into)
+	}
+}
+
+func TestAlterSpecs(t *testing.T) {
+	stmt, err := Parse("alter table t add column `Email` varchar(64) not null default '' comment 'c', drop index idx_a, modify b enum('x','y') default 'x'", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	specs := stmt.(*DDL).Specs
+	if len(specs) != 3 {
+		t.Fatal(specs)
+	}
+	if s := specs[0]; s.Action != AST_ADD || s.Index || s.Name != "email" || s.Type != "varchar(64)" || string(s.Default) != "" || s.Default == nil || s.Comment != "c" {
+		t.Fatalf("%+v", s)
+	}
+	if s := specs[1]; s.Action != AST_DROP || !s.Index || s.Name != "idx_a" {
+		t.Fatalf("%+v", s)
+	}
+	if s := specs[2]; s.Action != AST_MODIFY || s.Type != "enum('x','y')" || string(s.Default) != "x" {
+		t.Fatalf("%+v", s)
+	}
+
+	for _, sql := range []string{"alter table t engine = innodb", "alter view v as select 1", "drop index idx on t"} {
+		stmt, err := Parse(sql, nil)
+		if err != nil {
+			t.Fatal(sql, err)
+		}
+		if specs := stmt.(*DDL).Specs; specs != nil {
+			t.Fatal(sql, specs)
+		}
+	}
+}
@@ -30,11 +30,24 @@ type Tokenizer struct {
 	ParseTree     Statement
 
 	alloc arena.ArenaAllocator
+
+	// lastTyp is the last token returned to the parser, comments aside.
+	lastTyp int
+	// insertIgnore is set when the IGNORE of INSERT IGNORE was skipped,
+	// the grammar has no room for it.
+	insertIgnore bool
+	// selects is set once a SELECT was read, selectInto holds the INTO
+	// OUTFILE or DUMPFILE clause skipped after it.
+	selects    bool
+	selectInto *SelectInto
 }
 
 // NewStringTokenizer creates a new Tokenizer for the
-// sql string.
+// sql string. A nil alloc falls back to the go allocator.
 func NewStringTokenizer(sql string, alloc arena.ArenaAllocator) *Tokenizer {
+	if alloc == nil {
+		alloc = arena.StdAllocator
+	}
 	return &Tokenizer{
 		InStream: strings.NewReader(sql),
 		alloc:    alloc,
@@ -203,6 +216,31 @@ var keywords = map[string]int{
 // Lex returns the next token form the Tokenizer.
 // This function is used by go yacc.
 func (tkn *Tokenizer) Lex(lval *yySymType) int {
+	typ, val := tkn.scanToken()
+	if typ == IGNORE && tkn.lastTyp == INSERT {
+		tkn.insertIgnore = true
+		typ, val = tkn.scanToken()
+	}
+	if typ == INTO && tkn.selects {
+		typ, val = tkn.scanSelectInto()
+	}
+	if typ == SELECT {
+		tkn.selects = true
+	}
+	if typ != COMMENT {
+		tkn.lastTyp = typ
+	}
+	switch typ {
+	case ID, STRING, NUMBER, VALUE_ARG, LIST_ARG, COMMENT:
+		lval.bytes = val
+	}
+	tkn.errorToken = val
+	return typ
+}
+
+// scanToken returns the next token, skipping comments unless they
+// are allowed.
+func (tkn *Tokenizer) scanToken() (int, []byte) {
 	typ, val := tkn.Scan()
 	for typ == COMMENT {
 		if tkn.AllowComments {
@@ -210,12 +248,28 @@ func (tkn *Tokenizer) Lex(lval *yySymType) int {
 		}
 		typ, val = tkn.Scan()
 	}
-	switch typ {
-	case ID, STRING, NUMBER, VALUE_ARG, LIST_ARG, COMMENT:
-		lval.bytes = val
+	return typ, val
+}
+
+// scanSelectInto skips the OUTFILE or DUMPFILE clause that follows the
+// INTO of a select, which the grammar has no room for, and returns the
+// token after it.
+func (tkn *Tokenizer) scanSelectInto() (int, []byte) {
+	typ, kind := tkn.scanToken()
+	if typ != ID {
+		return typ, kind
 	}
-	tkn.errorToken = val
-	return typ
+	into := &SelectInto{Type: strings.ToLower(string(kind))}
+	if into.Type != AST_OUTFILE && into.Type != AST_DUMPFILE {
+		return LEX_ERROR, kind
+	}
+	typ, file := tkn.scanToken()
+	if typ != STRING {
+		return LEX_ERROR, file
+	}
+	into.File = append([]byte(nil), file...)
+	tkn.selectInto = into
+	return tkn.scanToken()
 }
 
 // Error is called by go yacc if there's a parsing error.
@@ -25,6 +25,9 @@ type TrackedBuffer struct {
 }
 
 func NewTrackedBuffer(nodeFormatter func(buf *TrackedBuffer, node SQLNode), alloc arena.ArenaAllocator) *TrackedBuffer {
+	if alloc == nil {
+		alloc = arena.StdAllocator
+	}
 	buf := &TrackedBuffer{
 		Buffer:        bytes.NewBuffer(alloc.AllocBytes(256)),
 		bindLocations: make([]bindLocation, 0, 4),
@@ -0,0 +1,87 @@
+package schema
+
+import (
+	"reflect"
+)
+
+// TableDiff lists what changed between two versions of a table.
+// Columns and indexes are named, changed means present in both with
+// a different definition.
+type TableDiff struct {
+	AddedColumns   []string
+	RemovedColumns []string
+	ChangedColumns []string
+	AddedIndexes   []string
+	RemovedIndexes []string
+	ChangedIndexes []string
+	PKChanged      bool
+}
+
+// IsEmpty tells if both versions are the same.
+func (d *TableDiff) IsEmpty() bool {
+	return len(d.AddedColumns) == 0 && len(d.RemovedColumns) == 0 && len(d.ChangedColumns) == 0 &&
+		len(d.AddedIndexes) == 0 && len(d.RemovedIndexes) == 0 && len(d.ChangedIndexes) == 0 && !d.PKChanged
+}
+
+// SchemaDiff compares two versions of a table. Index statistics like
+// the cardinality are not part of the definition.
+func SchemaDiff(oldTable, newTable *Table) *TableDiff {
+	d := &TableDiff{}
+
+	for _, col := range oldTable.Columns {
+		i := newTable.FindColumn(col.Name)
+		if i == -1 {
+			d.RemovedColumns = append(d.RemovedColumns, col.Name)
+		} else if !reflect.DeepEqual(col, newTable.Columns[i]) {
+			d.ChangedColumns = append(d.ChangedColumns, col.Name)
+		}
+	}
+	for _, col := range newTable.Columns {
+		if oldTable.FindColumn(col.Name) == -1 {
+			d.AddedColumns = append(d.AddedColumns, col.Name)
+		}
+	}
+
+	for _, index := range oldTable.Indexes {
+		other := findIndex(newTable, index.Name)
+		if other == nil {
+			d.RemovedIndexes = append(d.RemovedIndexes, index.Name)
+		} else if !sameIndex(index, other) {
+			d.ChangedIndexes = append(d.ChangedIndexes, index.Name)
+		}
+	}
+	for _, index := range newTable.Indexes {
+		if findIndex(oldTable, index.Name) == nil {
+			d.AddedIndexes = append(d.AddedIndexes, index.Name)
+		}
+	}
+
+	d.PKChanged = !reflect.DeepEqual(pkNames(oldTable), pkNames(newTable))
+	return d
+}
+
+func findIndex(ta *Table, name string) *Index {
+	for _, index := range ta.Indexes {
+		if index.Name == name {
+			return index
+		}
+	}
+	return nil
+}
+
+func sameIndex(a, b *Index) bool {
+	return reflect.DeepEqual(a.Columns, b.Columns) &&
+		reflect.DeepEqual(a.PrefixLengths, b.PrefixLengths) &&
+		reflect.DeepEqual(a.Descending, b.Descending) &&
+		reflect.DeepEqual(a.Expressions, b.Expressions)
+}
+
+// pkNames returns the primary key columns by name, their positions
+// move when columns are added before them.
+func pkNames(ta *Table) []string {
+	names := make([]string, 0, len(ta.PKColumns))
+	for _, i := range ta.PKColumns {
+		names = append(names, ta.Columns[i].Name)
+	}
+	return names
+}
@@ -0,0 +1,61 @@
+package schema
+
+import (
+	"reflect"
+	"testing"
+)
+
+func newDiffTable() *Table {
+	ta := NewTable("t")
+	ta.AddColumn("id", "int(11)", "", nil, "auto_increment")
+	ta.AddColumn("name", "varchar(32)", "utf8_general_ci", nil, "")
+	ta.AddIndex("PRIMARY").AddColumn("id", 0)
+	ta.AddIndex("idx_name").AddColumn("name", 0)
+	ta.PKColumns = []int{0}
+	return ta
+}
+
+func TestSchemaDiff(t *testing.T) {
+	if d := SchemaDiff(newDiffTable(), newDiffTable()); !d.IsEmpty() {
+		t.Fatalf("%+v", d)
+	}
+
+	// added column, before the pk which keeps its name
+	ta := newDiffTable()
+	ta.Columns = append([]TableColumn{{Name: "tenant", SqlType: 3}}, ta.Columns...)
+	ta.PKColumns = []int{1}
+	d := SchemaDiff(newDiffTable(), ta)
+	if !reflect.DeepEqual(d.AddedColumns, []string{"tenant"}) || d.PKChanged || len(d.ChangedColumns) != 0 {
+		t.Fatalf("%+v", d)
+	}
+
+	// removed index and a changed column
+	ta = newDiffTable()
+	ta.Indexes = ta.Indexes[:1]
+	ta.Columns[1].Length = 64
+	d = SchemaDiff(newDiffTable(), ta)
+	if !reflect.DeepEqual(d.RemovedIndexes, []string{"idx_name"}) || !reflect.DeepEqual(d.ChangedColumns, []string{"name"}) {
+		t.Fatalf("%+v", d)
+	}
+	if d.PKChanged || len(d.AddedIndexes) != 0 || len(d.RemovedColumns) != 0 {
+		t.Fatalf("%+v", d)
+	}
+
+	// pk change
+	ta = newDiffTable()
+	ta.Indexes[0] = NewIndex("PRIMARY")
+	ta.Indexes[0].AddColumn("id", 0)
+	ta.Indexes[0].AddColumn("name", 0)
+	ta.PKColumns = []int{0, 1}
+	d = SchemaDiff(newDiffTable(), ta)
+	if !d.PKChanged || !reflect.DeepEqual(d.ChangedIndexes, []string{"PRIMARY"}) {
+		t.Fatalf("%+v", d)
+	}
+
+	// cardinality is not part of the definition
+	ta = newDiffTable()
+	ta.Indexes[1].Cardinality[0] = 1000
+	if d := SchemaDiff(newDiffTable(), ta); !d.IsEmpty() {
+		t.Fatalf("%+v", d)
+	}
+}
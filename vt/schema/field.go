@@ -0,0 +1,216 @@
+package schema
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wandoulabs/cm/mysql"
+)
+
+var binaryCharset = uint16(mysql.CharsetIds["binary"])
+
+// DefaultCharset is the collation id given to the character fields the
+// proxy builds for columns of no known collation, see SetDefaultCharset.
+var DefaultCharset = uint16(mysql.DEFAULT_COLLATION_ID)
+
+// SetDefaultCharset sets DefaultCharset from a charset name like
+// utf8mb4, which stands for its default collation, or a collation name
+// like utf8mb4_bin.
+func SetDefaultCharset(name string) error {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if id, ok := mysql.CharsetIds[name]; ok {
+		DefaultCharset = uint16(id)
+		return nil
+	}
+	if id, ok := mysql.CollationNames[name]; ok {
+		DefaultCharset = uint16(id)
+		return nil
+	}
+	return fmt.Errorf("unknown charset %s", name)
+}
+
+type protocolType struct {
+	typ   byte
+	flags uint16
+}
+
+const (
+	numericFlags = mysql.BINARY_FLAG | mysql.NUM_FLAG
+	blobFlags    = mysql.BLOB_FLAG | mysql.BINARY_FLAG
+)
+
+// protocolTypes maps the base column types to the type and flags of
+// their fields, the type being the SqlType of the columns too. Types
+// without BINARY_FLAG are character types.
+var protocolTypes = map[string]protocolType{
+	"tinyint":    {mysql.MYSQL_TYPE_TINY, numericFlags},
+	"bool":       {mysql.MYSQL_TYPE_TINY, numericFlags},
+	"boolean":    {mysql.MYSQL_TYPE_TINY, numericFlags},
+	"smallint":   {mysql.MYSQL_TYPE_SHORT, numericFlags},
+	"mediumint":  {mysql.MYSQL_TYPE_INT24, numericFlags},
+	"int":        {mysql.MYSQL_TYPE_LONG, numericFlags},
+	"integer":    {mysql.MYSQL_TYPE_LONG, numericFlags},
+	"bigint":     {mysql.MYSQL_TYPE_LONGLONG, numericFlags},
+	"float":      {mysql.MYSQL_TYPE_FLOAT, numericFlags},
+	"double":     {mysql.MYSQL_TYPE_DOUBLE, numericFlags},
+	"real":       {mysql.MYSQL_TYPE_DOUBLE, numericFlags},
+	"decimal":    {mysql.MYSQL_TYPE_NEWDECIMAL, numericFlags},
+	"numeric":    {mysql.MYSQL_TYPE_NEWDECIMAL, numericFlags},
+	"bit":        {mysql.MYSQL_TYPE_BIT, mysql.UNSIGNED_FLAG | mysql.BINARY_FLAG},
+	"year":       {mysql.MYSQL_TYPE_YEAR, mysql.UNSIGNED_FLAG | mysql.ZEROFILL_FLAG | numericFlags},
+	"date":       {mysql.MYSQL_TYPE_DATE, mysql.BINARY_FLAG},
+	"time":       {mysql.MYSQL_TYPE_TIME, mysql.BINARY_FLAG},
+	"datetime":   {mysql.MYSQL_TYPE_DATETIME, mysql.BINARY_FLAG},
+	"timestamp":  {mysql.MYSQL_TYPE_TIMESTAMP, mysql.BINARY_FLAG},
+	"char":       {mysql.MYSQL_TYPE_STRING, 0},
+	"varchar":    {mysql.MYSQL_TYPE_VAR_STRING, 0},
+	"binary":     {mysql.MYSQL_TYPE_STRING, mysql.BINARY_FLAG},
+	"varbinary":  {mysql.MYSQL_TYPE_VAR_STRING, mysql.BINARY_FLAG},
+	"tinytext":   {mysql.MYSQL_TYPE_BLOB, mysql.BLOB_FLAG},
+	"text":       {mysql.MYSQL_TYPE_BLOB, mysql.BLOB_FLAG},
+	"mediumtext": {mysql.MYSQL_TYPE_BLOB, mysql.BLOB_FLAG},
+	"longtext":   {mysql.MYSQL_TYPE_BLOB, mysql.BLOB_FLAG},
+	"tinyblob":   {mysql.MYSQL_TYPE_BLOB, blobFlags},
+	"blob":       {mysql.MYSQL_TYPE_BLOB, blobFlags},
+	"mediumblob": {mysql.MYSQL_TYPE_BLOB, blobFlags},
+	"longblob":   {mysql.MYSQL_TYPE_BLOB, blobFlags},
+	"json":       {mysql.MYSQL_TYPE_BLOB, blobFlags},
+	"enum":       {mysql.MYSQL_TYPE_STRING, mysql.ENUM_FLAG},
+	"set":        {mysql.MYSQL_TYPE_STRING, mysql.SET_FLAG},
+	"geometry":   {mysql.MYSQL_TYPE_GEOMETRY, blobFlags},
+}
+
+// SQLTypeToMySQLType maps a column type as SHOW COLUMNS reports it, e.g.
+// "int(10) unsigned" or "decimal(10,2)", to the type, flags and charset
+// of its fields. Character types get DefaultCharset, the fields
+// of a column take the one of its collation. Unknown types are sent as
+// strings like MySQL does.
+func SQLTypeToMySQLType(typeString string) (typ byte, flags uint16, charset uint16) {
+	typeString = strings.ToLower(strings.TrimSpace(typeString))
+	base := typeString
+	if i := strings.IndexAny(base, "( "); i >= 0 {
+		base = base[:i]
+	}
+
+	pt, ok := protocolTypes[base]
+	if !ok {
+		return mysql.MYSQL_TYPE_VAR_STRING, 0, DefaultCharset
+	}
+
+	flags = pt.flags
+	if strings.Contains(typeString, " unsigned") {
+		flags |= mysql.UNSIGNED_FLAG
+	}
+	if strings.Contains(typeString, " zerofill") {
+		flags |= mysql.ZEROFILL_FLAG | mysql.UNSIGNED_FLAG
+	}
+
+	charset = binaryCharset
+	if flags&mysql.BINARY_FLAG == 0 {
+		charset = DefaultCharset
+	}
+	return pt.typ, flags, charset
+}
+
+// FieldFromColumn builds the result metadata of col, for results the
+// proxy makes up instead of reading from the backend. The nullability
+// and key flags other than auto_increment are not part of the column
+// model and are left unset.
+func FieldFromColumn(col TableColumn, table, schema string) *mysql.Field {
+	f := &mysql.Field{
+		Schema:     []byte(schema),
+		Table:      []byte(table),
+		OrgTable:   []byte(table),
+		Name:       []byte(col.Name),
+		OrgName:    []byte(col.Name),
+		IsUnsigned: col.IsUnsigned,
+	}
+
+	f.Type, f.Flag, f.Charset = fieldType(col)
+
+	switch f.Type {
+	case mysql.MYSQL_TYPE_NEWDECIMAL:
+		// digits, the point and the sign
+		f.ColumnLength = uint32(col.Precision)
+		if col.Scale > 0 {
+			f.ColumnLength++
+		}
+		if !col.IsUnsigned {
+			f.ColumnLength++
+		}
+		f.Decimal = uint8(col.Scale)
+	case mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VAR_STRING, mysql.MYSQL_TYPE_STRING,
+		mysql.MYSQL_TYPE_ENUM, mysql.MYSQL_TYPE_SET, mysql.MYSQL_TYPE_BLOB:
+		f.ColumnLength = col.ByteLength()
+	default:
+		f.ColumnLength = uint32(col.Length)
+	}
+
+	if col.IsUnsigned {
+		f.Flag |= mysql.UNSIGNED_FLAG
+	}
+	if col.IsAuto {
+		// auto_increment columns can not be NULL
+		f.Flag |= mysql.AUTO_INCREMENT_FLAG | mysql.NOT_NULL_FLAG
+	}
+	return f
+}
+
+// FieldCharset returns the collation id of the fields of col: the one
+// of its collation if known, else the one of its type.
+func FieldCharset(col TableColumn) uint16 {
+	_, _, charset := fieldType(col)
+	return charset
+}
+
+func fieldType(col TableColumn) (typ byte, flags uint16, charset uint16) {
+	if col.Type != "" {
+		typ, flags, charset = SQLTypeToMySQLType(col.Type)
+	} else {
+		typ, flags, charset = fieldTypeOf(col)
+	}
+	if id, ok := mysql.CollationNames[col.Collation]; ok && flags&mysql.BINARY_FLAG == 0 {
+		charset = uint16(id)
+	}
+	return typ, flags, charset
+}
+
+// fieldTypeOf is SQLTypeToMySQLType for the columns built without their
+// type string.
+func fieldTypeOf(col TableColumn) (typ byte, flags uint16, charset uint16) {
+	switch col.SqlType {
+	case mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VAR_STRING, mysql.MYSQL_TYPE_STRING,
+		mysql.MYSQL_TYPE_ENUM, mysql.MYSQL_TYPE_SET, mysql.MYSQL_TYPE_BLOB:
+		if col.Collation == "" {
+			// binary strings have no collation
+			flags = mysql.BINARY_FLAG
+		}
+		switch col.SqlType {
+		case mysql.MYSQL_TYPE_ENUM:
+			flags |= mysql.ENUM_FLAG
+		case mysql.MYSQL_TYPE_SET:
+			flags |= mysql.SET_FLAG
+		case mysql.MYSQL_TYPE_BLOB:
+			flags |= mysql.BLOB_FLAG
+		}
+		if flags&mysql.BINARY_FLAG != 0 {
+			return col.SqlType, flags, binaryCharset
+		}
+		return col.SqlType, flags, DefaultCharset
+	case mysql.MYSQL_TYPE_NEWDECIMAL:
+		return col.SqlType, numericFlags, binaryCharset
+	}
+	if isNumeric(col.SqlType) {
+		return col.SqlType, numericFlags, binaryCharset
+	}
+	return col.SqlType, mysql.BINARY_FLAG, binaryCharset
+}
+
+func isNumeric(t byte) bool {
+	switch t {
+	case mysql.MYSQL_TYPE_TINY, mysql.MYSQL_TYPE_SHORT, mysql.MYSQL_TYPE_INT24, mysql.MYSQL_TYPE_LONG,
+		mysql.MYSQL_TYPE_LONGLONG, mysql.MYSQL_TYPE_FLOAT, mysql.MYSQL_TYPE_DOUBLE, mysql.MYSQL_TYPE_YEAR:
+		return true
+	}
+	return false
+}
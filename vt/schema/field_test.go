@@ -0,0 +1,98 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/wandoulabs/cm/mysql"
+)
+
+func TestFieldFromColumn(t *testing.T) {
+	ta := NewTable("t")
+	ta.AddColumn("id", "bigint(20) unsigned", "", nil, "auto_increment")
+	ta.AddColumn("name", "varchar(32)", "utf8mb4_general_ci", nil, "")
+
+	f := FieldFromColumn(ta.Columns[0], "t", "test")
+	if string(f.Name) != "id" || string(f.OrgName) != "id" || string(f.Table) != "t" || string(f.Schema) != "test" {
+		t.Fatalf("%+v", f)
+	}
+	expect := uint16(mysql.UNSIGNED_FLAG | mysql.AUTO_INCREMENT_FLAG | mysql.NOT_NULL_FLAG | mysql.BINARY_FLAG | mysql.NUM_FLAG)
+	if f.Type != mysql.MYSQL_TYPE_LONGLONG || f.Flag != expect || f.Charset != 63 || f.ColumnLength != 20 || !f.IsUnsigned {
+		t.Fatalf("%+v", f)
+	}
+
+	f = FieldFromColumn(ta.Columns[1], "t", "test")
+	if f.Type != mysql.MYSQL_TYPE_VAR_STRING || f.Flag != 0 || f.ColumnLength != 128 {
+		t.Fatalf("%+v", f)
+	}
+	if f.Charset != uint16(mysql.CollationNames["utf8mb4_general_ci"]) {
+		t.Fatal(f.Charset)
+	}
+}
+
+func TestSQLTypeToMySQLType(t *testing.T) {
+	cases := []struct {
+		sqlType string
+		typ     byte
+		flags   uint16
+		charset uint16
+	}{
+		{"int(11)", mysql.MYSQL_TYPE_LONG, mysql.BINARY_FLAG | mysql.NUM_FLAG, 63},
+		{"int(10) unsigned", mysql.MYSQL_TYPE_LONG, mysql.BINARY_FLAG | mysql.NUM_FLAG | mysql.UNSIGNED_FLAG, 63},
+		{"tinyint(1)", mysql.MYSQL_TYPE_TINY, mysql.BINARY_FLAG | mysql.NUM_FLAG, 63},
+		{"smallint(5) unsigned zerofill", mysql.MYSQL_TYPE_SHORT, mysql.BINARY_FLAG | mysql.NUM_FLAG | mysql.UNSIGNED_FLAG | mysql.ZEROFILL_FLAG, 63},
+		{"mediumint(8)", mysql.MYSQL_TYPE_INT24, mysql.BINARY_FLAG | mysql.NUM_FLAG, 63},
+		{"BIGINT(20) UNSIGNED", mysql.MYSQL_TYPE_LONGLONG, mysql.BINARY_FLAG | mysql.NUM_FLAG | mysql.UNSIGNED_FLAG, 63},
+		{"decimal(10,2)", mysql.MYSQL_TYPE_NEWDECIMAL, mysql.BINARY_FLAG | mysql.NUM_FLAG, 63},
+		{"double", mysql.MYSQL_TYPE_DOUBLE, mysql.BINARY_FLAG | mysql.NUM_FLAG, 63},
+		{"datetime", mysql.MYSQL_TYPE_DATETIME, mysql.BINARY_FLAG, 63},
+		{"timestamp", mysql.MYSQL_TYPE_TIMESTAMP, mysql.BINARY_FLAG, 63},
+		{"varchar(32)", mysql.MYSQL_TYPE_VAR_STRING, 0, 33},
+		{"char(4)", mysql.MYSQL_TYPE_STRING, 0, 33},
+		{"varbinary(16)", mysql.MYSQL_TYPE_VAR_STRING, mysql.BINARY_FLAG, 63},
+		{"text", mysql.MYSQL_TYPE_BLOB, mysql.BLOB_FLAG, 33},
+		{"blob", mysql.MYSQL_TYPE_BLOB, mysql.BLOB_FLAG | mysql.BINARY_FLAG, 63},
+		{"enum('a','b')", mysql.MYSQL_TYPE_STRING, mysql.ENUM_FLAG, 33},
+		{"set('a','b')", mysql.MYSQL_TYPE_STRING, mysql.SET_FLAG, 33},
+		{"unknown", mysql.MYSQL_TYPE_VAR_STRING, 0, 33},
+	}
+	for _, c := range cases {
+		typ, flags, charset := SQLTypeToMySQLType(c.sqlType)
+		if typ != c.typ || flags != c.flags || charset != c.charset {
+			t.Fatal(c.sqlType, typ, flags, charset)
+		}
+	}
+}
+
+func TestDefaultCharset(t *testing.T) {
+	defer func(v uint16) { DefaultCharset = v }(DefaultCharset)
+
+	if err := SetDefaultCharset("utf9"); err == nil {
+		t.Fatal("not an error")
+	} else if DefaultCharset != uint16(mysql.DEFAULT_COLLATION_ID) {
+		t.Fatal(DefaultCharset)
+	}
+	if err := SetDefaultCharset("utf8mb4"); err != nil {
+		t.Fatal(err)
+	}
+	utf8mb4 := uint16(mysql.CollationNames["utf8mb4_general_ci"])
+	if DefaultCharset != utf8mb4 {
+		t.Fatal(DefaultCharset)
+	}
+
+	ta := NewTable("t")
+	ta.AddColumn("name", "varchar(32)", "", nil, "")
+	ta.AddColumn("code", "char(4)", "latin1_swedish_ci", nil, "")
+	ta.AddColumn("id", "int(11)", "", nil, "")
+	for i, expect := range []uint16{utf8mb4, uint16(mysql.CollationNames["latin1_swedish_ci"]), 63} {
+		if f := FieldFromColumn(ta.Columns[i], "t", "test"); f.Charset != expect {
+			t.Fatal(ta.Columns[i].Name, f.Charset)
+		}
+		if charset := FieldCharset(ta.Columns[i]); charset != expect {
+			t.Fatal(ta.Columns[i].Name, charset)
+		}
+	}
+
+	if err := SetDefaultCharset("utf8mb4_bin"); err != nil || DefaultCharset != uint16(mysql.CollationNames["utf8mb4_bin"]) {
+		t.Fatal(err, DefaultCharset)
+	}
+}
@@ -8,6 +8,7 @@ package schema
 // It contains a data structure that's shared between sqlparser & tabletserver
 
 import (
+	"strconv"
 	"strings"
 
 	log "github.com/ngaut/logging"
@@ -29,6 +30,24 @@ type TableColumn struct {
 	Default    mysql.Value
 	Collation  string
 	IsUnsigned bool
+	// Length is the declared length or display width, e.g. 255 for
+	// varchar(255). Precision and Scale are only set for decimals.
+	Length    int
+	Precision int
+	Scale     int
+	// IsGenerated is set for generated columns, IsVirtual if their
+	// values are computed on read rather than stored.
+	IsGenerated bool
+	IsVirtual   bool
+	// OnUpdate is set for columns the backend sets on every update,
+	// e.g. ON UPDATE CURRENT_TIMESTAMP.
+	OnUpdate bool
+	// Type is the column type as SHOW COLUMNS reports it, e.g.
+	// "int(10) unsigned".
+	Type string
+	// Comment is the COMMENT of the column, which tools use to tag
+	// columns, e.g. as holding personal data.
+	Comment string
 }
 
 type Table struct {
@@ -37,6 +56,12 @@ type Table struct {
 	Indexes   []*Index
 	PKColumns []int
 	CacheType int
+	// EstimatedRows is the row count information_schema reports, only
+	// an estimate for InnoDB.
+	EstimatedRows uint64
+	// HasUniqueKeys is set if the table has unique keys besides its
+	// primary key, which upserts may conflict with.
+	HasUniqueKeys bool
 }
 
 func NewTable(name string) *Table {
@@ -47,49 +72,16 @@ func NewTable(name string) *Table {
 	}
 }
 
-var typesMap = map[string]byte{
-	"int":       mysql.MYSQL_TYPE_LONG,
-	"long":      mysql.MYSQL_TYPE_LONG,
-	"bigint":    mysql.MYSQL_TYPE_LONGLONG,
-	"short":     mysql.MYSQL_TYPE_SHORT,
-	"tiny":      mysql.MYSQL_TYPE_TINY,
-	"tinyint":   mysql.MYSQL_TYPE_TINY,
-	"smallint":  mysql.MYSQL_TYPE_TINY,
-	"varbinary": mysql.MYSQL_TYPE_VARCHAR,
-	"blob":      mysql.MYSQL_TYPE_BLOB,
-	"datetime":  mysql.MYSQL_TYPE_DATETIME,
-	"date":      mysql.MYSQL_TYPE_DATE,
-	"timestamp": mysql.MYSQL_TYPE_TIMESTAMP,
-	"data":      mysql.MYSQL_TYPE_DATE,
-	"float":     mysql.MYSQL_TYPE_FLOAT,
-	"double":    mysql.MYSQL_TYPE_DOUBLE,
-	"enum":      mysql.MYSQL_TYPE_ENUM,
-	"text":      mysql.MYSQL_TYPE_STRING,
-	"varchar":   mysql.MYSQL_TYPE_VARCHAR,
-	"string":    mysql.MYSQL_TYPE_STRING,
-	"char":      mysql.MYSQL_TYPE_STRING,
-}
-
-func str2mysqlType(columnType string) byte {
-	b, ok := typesMap[columnType]
-	if !ok {
-		log.Fatalf("%s not exist", columnType)
-	}
-
-	return b
-}
-
 func (ta *Table) AddColumn(name string, columnType string, collation string, defval mysql.Value, extra string) {
 	index := len(ta.Columns)
 	name = strings.ToLower(name)
-	ta.Columns = append(ta.Columns, TableColumn{Name: name})
 	columnType = strings.ToLower(columnType)
+	ta.Columns = append(ta.Columns, TableColumn{Name: name, Type: columnType})
 
+	ta.Columns[index].SqlType, _, _ = SQLTypeToMySQLType(columnType)
 	endPos := strings.Index(columnType, "(") //handle something like: int(11)
 	if endPos > 0 {
-		ta.Columns[index].SqlType = str2mysqlType(strings.TrimSpace(columnType[:endPos]))
-	} else {
-		ta.Columns[index].SqlType = str2mysqlType(strings.TrimSpace(columnType))
+		ta.Columns[index].parseTypeArgs(columnType[endPos+1:])
 	}
 
 	ta.Columns[index].Collation = collation
@@ -99,7 +91,21 @@ func (ta *Table) AddColumn(name string, columnType string, collation string, def
 
 	log.Info(name, ta.Columns[index].SqlType, columnType)
 
-	if extra == "auto_increment" {
+	switch strings.ToUpper(extra) {
+	case "VIRTUAL GENERATED":
+		ta.Columns[index].IsGenerated = true
+		ta.Columns[index].IsVirtual = true
+		return
+	case "STORED GENERATED":
+		ta.Columns[index].IsGenerated = true
+		return
+	}
+
+	if strings.Contains(strings.ToLower(extra), "on update") {
+		ta.Columns[index].OnUpdate = true
+	}
+
+	if strings.Contains(strings.ToLower(extra), "auto_increment") {
 		ta.Columns[index].IsAuto = true
 		// Ignore default value, if any
 		return
@@ -110,9 +116,59 @@ func (ta *Table) AddColumn(name string, columnType string, collation string, def
 	ta.Columns[index].Default = defval
 }
 
+// parseTypeArgs fills in the length, precision and scale from the
+// arguments of a column type, args being what follows the "(".
+func (col *TableColumn) parseTypeArgs(args string) {
+	endPos := strings.Index(args, ")")
+	if endPos < 0 {
+		return
+	}
+
+	parts := strings.Split(args[:endPos], ",")
+	nums := make([]int, 0, len(parts))
+	for _, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil { //enum or set values
+			return
+		}
+		nums = append(nums, n)
+	}
+
+	if col.SqlType != mysql.MYSQL_TYPE_NEWDECIMAL {
+		col.Length = nums[0]
+		return
+	}
+
+	col.Precision = nums[0]
+	if len(nums) > 1 {
+		col.Scale = nums[1]
+	}
+}
+
+// IsBoolean reports whether the column is a TINYINT(1), which most
+// clients and ORMs map to a boolean.
+func (col *TableColumn) IsBoolean() bool {
+	return col.SqlType == mysql.MYSQL_TYPE_TINY && col.Length == 1
+}
+
+// ByteLength returns the most bytes a value of a character column takes,
+// its declared length in characters times the width of its charset,
+// e.g. 40 for a utf8mb4 varchar(10). It is 0 for other columns.
+func (col *TableColumn) ByteLength() uint32 {
+	switch col.SqlType {
+	case mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VAR_STRING, mysql.MYSQL_TYPE_STRING:
+		return uint32(col.Length) * mysql.CollationMaxLen(col.Collation)
+	}
+	return 0
+}
+
+// CaseInsensitiveColumns makes FindColumn ignore case, like a backend
+// running with lower_case_table_names set.
+var CaseInsensitiveColumns bool
+
 func (ta *Table) FindColumn(name string) int {
 	for i, col := range ta.Columns {
-		if col.Name == name {
+		if col.Name == name || (CaseInsensitiveColumns && strings.EqualFold(col.Name, name)) {
 			return i
 		}
 	}
@@ -136,18 +192,66 @@ type Index struct {
 	Columns     []string
 	Cardinality []uint64
 	DataColumns []string
+	// PrefixLengths holds the length of prefix key parts like name(10),
+	// 0 for the columns indexed as a whole.
+	PrefixLengths []int
+	// Descending marks the key parts stored in descending order, which
+	// SHOW INDEX reports with collation D since MySQL 8.
+	Descending []bool
+	// Expressions holds the expression of the functional key parts of
+	// MySQL 8, whose column name is left empty.
+	Expressions []string
 }
 
 func NewIndex(name string) *Index {
-	return &Index{name, make([]string, 0, 8), make([]uint64, 0, 8), nil}
+	return &Index{name, make([]string, 0, 8), make([]uint64, 0, 8), nil, make([]int, 0, 8), make([]bool, 0, 8), make([]string, 0, 8)}
 }
 
 func (idx *Index) AddColumn(name string, cardinality uint64) {
+	idx.AddPrefixColumn(name, cardinality, 0)
+}
+
+func (idx *Index) AddPrefixColumn(name string, cardinality uint64, prefixLength int) {
+	idx.AddKeyPart(name, cardinality, prefixLength, "A")
+}
+
+// AddKeyPart adds a column with the collation SHOW INDEX reports for
+// it, A for ascending, D for descending or empty if not sorted.
+func (idx *Index) AddKeyPart(name string, cardinality uint64, prefixLength int, collation string) {
+	idx.addKeyPart(name, "", cardinality, prefixLength, collation)
+}
+
+// AddExpressionKeyPart adds a functional key part. No column name
+// matches it, so the planner never uses the index past this part.
+func (idx *Index) AddExpressionKeyPart(expr string, cardinality uint64, collation string) {
+	idx.addKeyPart("", expr, cardinality, 0, collation)
+}
+
+func (idx *Index) addKeyPart(name string, expr string, cardinality uint64, prefixLength int, collation string) {
+	idx.Expressions = append(idx.Expressions, expr)
+	idx.Descending = append(idx.Descending, strings.EqualFold(collation, "D"))
 	idx.Columns = append(idx.Columns, name)
 	if cardinality == 0 {
 		cardinality = uint64(len(idx.Cardinality) + 1)
 	}
 	idx.Cardinality = append(idx.Cardinality, cardinality)
+	idx.PrefixLengths = append(idx.PrefixLengths, prefixLength)
+}
+
+// IsDescending tells if the i-th column of the index is sorted in
+// descending order.
+func (idx *Index) IsDescending(i int) bool {
+	return i < len(idx.Descending) && idx.Descending[i]
+}
+
+// IsFunctional tells if any key part of the index is an expression.
+func (idx *Index) IsFunctional() bool {
+	for _, expr := range idx.Expressions {
+		if expr != "" {
+			return true
+		}
+	}
+	return false
 }
 
 func (idx *Index) FindColumn(name string) int {
@@ -160,6 +264,13 @@ func (idx *Index) FindColumn(name string) int {
 	return -1
 }
 
+// AddDataColumn appends name to DataColumns unless it is already there.
+func (idx *Index) AddDataColumn(name string) {
+	if idx.FindDataColumn(name) == -1 {
+		idx.DataColumns = append(idx.DataColumns, name)
+	}
+}
+
 func (idx *Index) FindDataColumn(name string) int {
 	for i, colName := range idx.DataColumns {
 		if name == colName {
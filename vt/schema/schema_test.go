@@ -0,0 +1,112 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/wandoulabs/cm/mysql"
+)
+
+func TestAddColumnTypeArgs(t *testing.T) {
+	cases := []struct {
+		columnType string
+		sqlType    byte
+		length     int
+		precision  int
+		scale      int
+	}{
+		{"decimal(10,2)", mysql.MYSQL_TYPE_NEWDECIMAL, 0, 10, 2},
+		{"decimal(10)", mysql.MYSQL_TYPE_NEWDECIMAL, 0, 10, 0},
+		{"varchar(255)", mysql.MYSQL_TYPE_VAR_STRING, 255, 0, 0},
+		{"int(11)", mysql.MYSQL_TYPE_LONG, 11, 0, 0},
+		{"int(10) unsigned", mysql.MYSQL_TYPE_LONG, 10, 0, 0},
+		{"int unsigned", mysql.MYSQL_TYPE_LONG, 0, 0, 0},
+		{"smallint(6)", mysql.MYSQL_TYPE_SHORT, 6, 0, 0},
+		{"mediumint(9)", mysql.MYSQL_TYPE_INT24, 9, 0, 0},
+		{"bit(1)", mysql.MYSQL_TYPE_BIT, 1, 0, 0},
+		{"json", mysql.MYSQL_TYPE_BLOB, 0, 0, 0},
+		{"enum('a','b')", mysql.MYSQL_TYPE_STRING, 0, 0, 0},
+		{"text", mysql.MYSQL_TYPE_BLOB, 0, 0, 0},
+		{"point", mysql.MYSQL_TYPE_VAR_STRING, 0, 0, 0},
+	}
+	for _, c := range cases {
+		ta := NewTable("t")
+		ta.AddColumn("c", c.columnType, "", nil, "")
+		col := ta.Columns[0]
+		if col.SqlType != c.sqlType || col.Length != c.length || col.Precision != c.precision || col.Scale != c.scale {
+			t.Fatalf("%s: %+v", c.columnType, col)
+		}
+	}
+}
+
+func TestAddGeneratedColumn(t *testing.T) {
+	ta := NewTable("t")
+	ta.AddColumn("a", "int(11)", "", nil, "")
+	ta.AddColumn("v", "int(11)", "", nil, "VIRTUAL GENERATED")
+	ta.AddColumn("s", "int(11)", "", nil, "STORED GENERATED")
+	ta.AddColumn("ts", "timestamp", "", nil, "DEFAULT_GENERATED")
+
+	expect := []struct{ generated, virtual bool }{
+		{false, false},
+		{true, true},
+		{true, false},
+		{false, false},
+	}
+	for i, e := range expect {
+		col := ta.Columns[i]
+		if col.IsGenerated != e.generated || col.IsVirtual != e.virtual {
+			t.Fatalf("%s: %+v", col.Name, col)
+		}
+	}
+}
+
+func TestIsBoolean(t *testing.T) {
+	ta := NewTable("t")
+	ta.AddColumn("a", "tinyint(1)", "", nil, "")
+	ta.AddColumn("b", "tinyint(4)", "", nil, "")
+	ta.AddColumn("c", "int(1)", "", nil, "")
+	if !ta.Columns[0].IsBoolean() || ta.Columns[1].IsBoolean() || ta.Columns[2].IsBoolean() {
+		t.Fatal(ta.Columns)
+	}
+}
+
+func TestFindColumnCase(t *testing.T) {
+	defer func(v bool) { CaseInsensitiveColumns = v }(CaseInsensitiveColumns)
+
+	ta := NewTable("t")
+	ta.AddColumn("name", "varchar(32)", "", nil, "")
+	ta.AddColumn("ID", "int(11)", "", nil, "")
+
+	CaseInsensitiveColumns = false
+	if i := ta.FindColumn("id"); i != 1 {
+		t.Fatal(i)
+	}
+	if i := ta.FindColumn("ID"); i != -1 {
+		t.Fatal(i)
+	}
+
+	CaseInsensitiveColumns = true
+	if i := ta.FindColumn("ID"); i != 1 {
+		t.Fatal(i)
+	}
+	if i := ta.FindColumn("Name"); i != 0 {
+		t.Fatal(i)
+	}
+}
+
+func TestIndexDescending(t *testing.T) {
+	ta := NewTable("t")
+	idx := ta.AddIndex("idx_created")
+	idx.AddKeyPart("user_id", 0, 0, "A")
+	idx.AddKeyPart("created", 0, 0, "D")
+	idx.AddKeyPart("body", 0, 0, "")
+	idx.AddColumn("id", 0)
+
+	for i, expect := range []bool{false, true, false, false} {
+		if idx.IsDescending(i) != expect {
+			t.Fatal(i, idx.Descending)
+		}
+	}
+	if len(idx.Columns) != 4 || idx.Columns[1] != "created" {
+		t.Fatal(idx.Columns)
+	}
+}
@@ -0,0 +1,103 @@
+package tabletserver
+
+import (
+	"hash/crc32"
+	"sync"
+	"time"
+
+	"github.com/ngaut/memcache"
+)
+
+// affinitySlot parks a warm connection for the keys hashing to it.
+type affinitySlot struct {
+	mu   sync.Mutex
+	conn *memcache.Connection
+}
+
+// affinitySlot returns the slot of key, nil without affinity.
+func (cp *CachePool) affinitySlot(key string) *affinitySlot {
+	if len(cp.affinity) == 0 {
+		return nil
+	}
+	return &cp.affinity[crc32.ChecksumIEEE([]byte(key))%uint32(len(cp.affinity))]
+}
+
+// GetFor is Get for an operation on key. With AffinitySlots set it
+// returns the connection parked by the last operation on a key of the
+// same slot, if it is still there, so that back to back operations on
+// those keys reuse a warm connection.
+func (cp *CachePool) GetFor(key string, timeout time.Duration) *memcache.Connection {
+	slot := cp.affinitySlot(key)
+	if slot == nil {
+		return cp.Get(timeout)
+	}
+	slot.mu.Lock()
+	conn := slot.conn
+	slot.conn = nil
+	slot.mu.Unlock()
+
+	if conn != nil && cp.rowCacheConfig.ValidateOnGet && pingConn(conn) != nil {
+		cp.validationErrors.Add(1)
+		conn.Close()
+		cp.Put(nil)
+		conn = nil
+	}
+	if conn == nil {
+		cp.affinityMisses.Add(1)
+		GetMetrics().Counter("cache_pool_affinity_misses", cp.metricLabels(), 1)
+		return cp.Get(timeout)
+	}
+	cp.affinityHits.Add(1)
+	GetMetrics().Counter("cache_pool_affinity_hits", cp.metricLabels(), 1)
+	cp.lastUsed.Set(time.Now().UnixNano())
+	cp.checkouts.add(conn)
+	return conn
+}
+
+// PutFor is Put for a connection got by GetFor(key). The connection is
+// parked in the slot of key if it is free.
+func (cp *CachePool) PutFor(key string, conn *memcache.Connection) {
+	if slot := cp.affinitySlot(key); slot != nil && conn != nil {
+		slot.mu.Lock()
+		// checked under the slot lock so that Close releases what is
+		// parked before it
+		if slot.conn == nil && cp.closing.Get() == 0 {
+			cp.checkouts.remove(conn)
+			slot.conn = conn
+			slot.mu.Unlock()
+			return
+		}
+		slot.mu.Unlock()
+	}
+	cp.Put(conn)
+}
+
+// releaseAffinity hands the parked connections back to the pool, which
+// can't be closed or shrunk while they are out.
+func (cp *CachePool) releaseAffinity() {
+	for i := range cp.affinity {
+		slot := &cp.affinity[i]
+		slot.mu.Lock()
+		cp.releaseSlot(slot)
+		slot.mu.Unlock()
+	}
+}
+
+// releaseSlot hands the connection parked in slot back to the pool,
+// slot.mu must be held.
+func (cp *CachePool) releaseSlot(slot *affinitySlot) {
+	if slot.conn != nil {
+		cp.Put(slot.conn)
+		slot.conn = nil
+	}
+}
+
+// AffinityHits returns the number of GetFor served by a parked
+// connection, AffinityMisses the number that fell back to the pool.
+func (cp *CachePool) AffinityHits() int64 {
+	return cp.affinityHits.Get()
+}
+
+func (cp *CachePool) AffinityMisses() int64 {
+	return cp.affinityMisses.Get()
+}
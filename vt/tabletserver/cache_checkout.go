@@ -0,0 +1,71 @@
+package tabletserver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ngaut/memcache"
+)
+
+// checkouts has the time each connection out of the pool was got at,
+// to catch the code paths that Get without Put.
+type checkouts struct {
+	mu    sync.Mutex
+	since map[*memcache.Connection]time.Time
+}
+
+func (co *checkouts) add(conn *memcache.Connection) {
+	co.mu.Lock()
+	if co.since == nil {
+		co.since = make(map[*memcache.Connection]time.Time)
+	}
+	co.since[conn] = timeNow()
+	co.mu.Unlock()
+}
+
+// remove forgets conn, or the closed connections if conn is nil: they
+// are put back as nil.
+func (co *checkouts) remove(conn *memcache.Connection) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	if conn != nil {
+		delete(co.since, conn)
+		return
+	}
+	for c := range co.since {
+		if c.IsClosed() {
+			delete(co.since, c)
+		}
+	}
+}
+
+// LongestCheckout returns how long the connection out of the pool for
+// the longest has been, 0 if none is out. Connections parked for
+// affinity are not out.
+func (cp *CachePool) LongestCheckout() time.Duration {
+	now := timeNow()
+	cp.checkouts.mu.Lock()
+	defer cp.checkouts.mu.Unlock()
+	var longest time.Duration
+	for _, since := range cp.checkouts.since {
+		if d := now.Sub(since); d > longest {
+			longest = d
+		}
+	}
+	return longest
+}
+
+// CheckedOutLonger returns the number of connections out of the pool
+// for longer than d.
+func (cp *CachePool) CheckedOutLonger(d time.Duration) int {
+	now := timeNow()
+	cp.checkouts.mu.Lock()
+	defer cp.checkouts.mu.Unlock()
+	n := 0
+	for _, since := range cp.checkouts.since {
+		if now.Sub(since) > d {
+			n++
+		}
+	}
+	return n
+}
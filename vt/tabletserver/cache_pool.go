@@ -5,6 +5,8 @@
 package tabletserver
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"os"
 	"os/exec"
@@ -13,14 +15,28 @@ import (
 	"sync"
 	"time"
 
+	"github.com/juju/errors"
 	log "github.com/ngaut/logging"
 	"github.com/ngaut/memcache"
 	"github.com/ngaut/pools"
 	"github.com/ngaut/sync2"
+	"github.com/ngaut/timer"
 )
 
 const statsURL = "/debug/memcache/"
 
+// statsTimeout bounds how long ServeHTTP waits for a connection.
+var statsTimeout = 5 * time.Second
+
+// statsCommands are the memcache stats subcommands ServeHTTP runs.
+var statsCommands = map[string]bool{
+	"":         true,
+	"slabs":    true,
+	"items":    true,
+	"settings": true,
+	"sizes":    true,
+}
+
 type CreateCacheFunc func() (*memcache.Connection, error)
 
 //todo: copy from vitess
@@ -32,6 +48,42 @@ type RowCacheConfig struct {
 	Connections int    `json:"connections"`
 	Threads     int    `json:"threads"`
 	LockPaged   bool   `json:"lock_paged"`
+	// FlushOnRestart logically flushes the row cache when a connection
+	// lands on a memcached instance that was started after the one we
+	// saw last, since rows may have changed while it was away.
+	FlushOnRestart bool `json:"flush_on_restart"`
+	// AutoTune starts the pool at a quarter of its capacity and lets
+	// it grow or shrink within that range depending on wait metrics.
+	AutoTune bool `json:"auto_tune"`
+	// ValidateOnGet pings connections on checkout and replaces the
+	// ones that went stale while idle in the pool.
+	ValidateOnGet bool `json:"validate_on_get"`
+	// Cache operations slower than SlowThresholdMs are counted and
+	// recorded with their key, or only the table prefix of the key if
+	// RedactSlowKeys is set. 0 disables it.
+	SlowThresholdMs int  `json:"slow_threshold_ms"`
+	RedactSlowKeys  bool `json:"redact_slow_keys"`
+	// Namespace is prepended to every cache key so that several
+	// deployments can share a memcached cluster, e.g. "prod:".
+	Namespace string `json:"namespace"`
+	// MaxItemSize is the largest item memcached accepts, in bytes.
+	// Rows that would not fit are not cached. 0 keeps the memcached
+	// default of 1MB.
+	MaxItemSize int `json:"max_item_size"`
+	// IdleShutdownSec stops memcached once the cache saw no traffic for
+	// that many seconds, saving its memory. The next Get starts it again
+	// and waits for it. 0 keeps it running.
+	IdleShutdownSec int `json:"idle_shutdown_sec"`
+	// AffinitySlots parks up to that many connections out of the pool,
+	// each for the keys hashing to it, so that back to back operations
+	// on those keys reuse a warm connection. Parked connections count
+	// against Connections. 0 disables it.
+	AffinitySlots int `json:"affinity_slots"`
+	// AdmitAfter caches a row only once it was read that many times
+	// within AdmitWindowSec seconds, 60 if unset, so that one-off reads
+	// like scans don't push the hot rows out. 0 caches every row read.
+	AdmitAfter     int `json:"admit_after"`
+	AdmitWindowSec int `json:"admit_window_sec"`
 }
 
 func (c *RowCacheConfig) GetSubprocessFlags() []string {
@@ -59,9 +111,27 @@ func (c *RowCacheConfig) GetSubprocessFlags() []string {
 	if c.LockPaged {
 		cmd = append(cmd, "-k")
 	}
+	if c.MaxItemSize > 0 {
+		cmd = append(cmd, "-I", strconv.Itoa(c.MaxItemSize))
+	}
 	return cmd
 }
 
+const (
+	validateTimeout     = 100 * time.Millisecond
+	wakeRetryInterval   = 10 * time.Second
+	maxValidateAttempts = 3
+
+	// defaultMaxItemSize is the item size limit of memcached when -I
+	// is not given.
+	defaultMaxItemSize = 1024 * 1024
+	// itemOverhead is a conservative estimate of the memcached item
+	// header, which counts against the item size limit too.
+	itemOverhead = 64
+)
+
+var errValidateTimeout = errors.New("memcache ping timeout")
+
 var maxPrefix sync2.AtomicInt64
 
 func GetMaxPrefix() int64 {
@@ -70,23 +140,72 @@ func GetMaxPrefix() int64 {
 
 type CachePool struct {
 	name           string
+	labels         Labels //of the metrics of the pool
 	pool           *pools.ResourcePool
+	connect        pools.Factory //opens the connections of pool
 	cmd            *exec.Cmd
 	rowCacheConfig RowCacheConfig
 	capacity       int
 	port           string
 	idleTimeout    time.Duration
 	DeleteExpiry   uint64
+	SlowThreshold  time.Duration
+	Namespace      string
+	MaxItemSize    int
+	AdmitAfter     int
+	AdmitWindow    time.Duration
 	memcacheStats  *MemcacheStats
+	tuner          *poolTuner
 	mu             sync.Mutex
+
+	// memcached is stopped when lastUsed, the time of the last Get in
+	// unix nanoseconds, is older than idleShutdown. asleep is set while
+	// it's stopped, it's guarded by mu, and so is wakeRetry, before
+	// which it's not started again after it failed to.
+	idleShutdown time.Duration
+	idleChecker  *timer.Timer
+	lastUsed     sync2.AtomicInt64
+	asleep       bool
+	wakeRetry    time.Time
+
+	// startTime is the start time of the memcached instance last seen,
+	// generation is bumped every time it changes.
+	startMu    sync.Mutex
+	startTime  int64
+	generation sync2.AtomicInt64
+
+	validationErrors sync2.AtomicInt64
+	oversizedSkips   sync2.AtomicInt64
+	notAdmitted      sync2.AtomicInt64
+	checkouts        checkouts
+	slowOps          slowOpLog
+
+	// affinity has the slots of AffinitySlots, see GetFor.
+	affinity       []affinitySlot
+	affinityHits   sync2.AtomicInt64
+	affinityMisses sync2.AtomicInt64
+	// closing is set by Close, which the parked connections would block
+	closing sync2.AtomicInt32
 }
 
 func NewCachePool(name string, rowCacheConfig RowCacheConfig, queryTimeout time.Duration, idleTimeout time.Duration) *CachePool {
-	cp := &CachePool{name: name, idleTimeout: idleTimeout}
+	cp := &CachePool{name: name, idleTimeout: idleTimeout, labels: Labels{"pool": name}}
 	if rowCacheConfig.Binary == "" {
 		return cp
 	}
 	cp.rowCacheConfig = rowCacheConfig
+	cp.SlowThreshold = time.Duration(rowCacheConfig.SlowThresholdMs) * time.Millisecond
+	if strings.ContainsAny(rowCacheConfig.Namespace, ". \t\r\n") {
+		log.Fatalf("invalid rowcache namespace: %q", rowCacheConfig.Namespace)
+	}
+	cp.Namespace = rowCacheConfig.Namespace
+	cp.MaxItemSize = rowCacheConfig.MaxItemSize
+	cp.AdmitAfter = rowCacheConfig.AdmitAfter
+	cp.AdmitWindow = time.Duration(rowCacheConfig.AdmitWindowSec) * time.Second
+	if cp.AdmitWindow <= 0 {
+		cp.AdmitWindow = time.Minute
+	}
+	cp.idleShutdown = time.Duration(rowCacheConfig.IdleShutdownSec) * time.Second
 
 	// Start with memcached defaults
 	cp.capacity = 1024 - 50
@@ -106,6 +225,12 @@ func NewCachePool(name string, rowCacheConfig RowCacheConfig, queryTimeout time.
 		}
 		cp.capacity = rowCacheConfig.Connections - 50
 	}
+	if rowCacheConfig.AffinitySlots > 0 {
+		if rowCacheConfig.AffinitySlots >= cp.capacity {
+			log.Fatalf("affinity slots %d leave no connections in the pool of %d", rowCacheConfig.AffinitySlots, cp.capacity)
+		}
+		cp.affinity = make([]affinitySlot, rowCacheConfig.AffinitySlots)
+	}
 
 	seconds := uint64(queryTimeout / time.Second)
 	// Add an additional grace period for
@@ -125,25 +250,76 @@ func (cp *CachePool) Open() {
 	if cp.rowCacheConfig.Binary == "" {
 		panic("rowcache binary not specified")
 	}
-	cp.startMemcache()
+	if err := cp.open(); err != nil {
+		log.Fatal(err)
+	}
+	cp.closing.Set(0)
 	log.Infof("rowcache is enabled")
+	if cp.idleShutdown > 0 {
+		cp.idleChecker = timer.NewTimer(cp.idleShutdown / 2)
+		cp.idleChecker.Start(cp.checkIdle)
+	}
+}
+
+// Connect opens the pool on the memcached listening on addr, which
+// unlike the one of Open the pool doesn't start or stop.
+func (cp *CachePool) Connect(addr string, capacity int) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.pool != nil {
+		panic("rowcache is already open")
+	}
+	cp.port = addr
+	cp.capacity = capacity
+	f := func() (pools.Resource, error) {
+		return memcache.Connect(addr, 10*time.Second)
+	}
+	cp.pool = pools.NewResourcePool(f, capacity, capacity, cp.idleTimeout)
+	cp.connect = f
+	cp.closing.Set(0)
+	cp.lastUsed.Set(time.Now().UnixNano())
+}
+
+// open starts memcached and the pool of connections to it, cp.mu must
+// be held.
+func (cp *CachePool) open() error {
+	if err := cp.startMemcache(); err != nil {
+		return errors.Trace(err)
+	}
 	f := func() (pools.Resource, error) {
-		return memcache.Connect(cp.port, 10*time.Second)
+		conn, err := memcache.Connect(cp.port, 10*time.Second)
+		if err == nil && cp.rowCacheConfig.FlushOnRestart {
+			cp.checkRestart(conn)
+		}
+		return conn, err
 	}
-	cp.pool = pools.NewResourcePool(f, cp.capacity, cp.capacity, cp.idleTimeout)
+	if cp.rowCacheConfig.AutoTune {
+		minCap := cp.capacity / 4
+		if minCap < 1 {
+			minCap = 1
+		}
+		cp.pool = pools.NewResourcePool(f, minCap, cp.capacity, cp.idleTimeout)
+		cp.tuner = newPoolTuner(cp, int64(minCap), int64(cp.capacity))
+		cp.tuner.Open()
+	} else {
+		cp.pool = pools.NewResourcePool(f, cp.capacity, cp.capacity, cp.idleTimeout)
+	}
+	cp.connect = f
 	if cp.memcacheStats != nil {
 		cp.memcacheStats.Open()
 	}
+	cp.lastUsed.Set(time.Now().UnixNano())
+	return nil
 }
 
-func (cp *CachePool) startMemcache() {
+func (cp *CachePool) startMemcache() error {
 	if strings.Contains(cp.port, "/") {
 		_ = os.Remove(cp.port)
 	}
 	commandLine := cp.rowCacheConfig.GetSubprocessFlags()
 	cp.cmd = exec.Command(commandLine[0], commandLine[1:]...)
 	if err := cp.cmd.Start(); err != nil {
-		log.Fatalf("can't start memcache: %v", err)
+		return errors.Annotate(err, "can't start memcache")
 	}
 	attempts := 0
 	for {
@@ -152,23 +328,37 @@ func (cp *CachePool) startMemcache() {
 		if err != nil {
 			attempts++
 			if attempts >= 50 {
-				cp.cmd.Process.Kill()
-				// Avoid zombies
-				go cp.cmd.Wait()
-				// FIXME(sougou): Throw proper error if we can recover
-				log.Fatal("Can't connect to memcache")
+				cp.killMemcache()
+				return errors.New("can't connect to memcache")
 			}
 			continue
 		}
-		if _, err = c.Set("health", 0, 0, []byte("ok")); err != nil {
-			log.Fatalf("can't communicate with memcache: %v", err)
-		}
+		_, err = c.Set("health", 0, 0, []byte("ok"))
 		c.Close()
-		break
+		if err != nil {
+			cp.killMemcache()
+			return errors.Annotate(err, "can't communicate with memcache")
+		}
+		return nil
 	}
 }
 
+// killMemcache kills the memcached cp started.
+func (cp *CachePool) killMemcache() {
+	cp.cmd.Process.Kill()
+	// Avoid zombies
+	go cp.cmd.Wait()
+}
+
 func (cp *CachePool) Close() {
+	if cp.idleChecker != nil {
+		cp.idleChecker.Stop()
+	}
+	// a stopped memcached has nothing left to close
+	cp.mu.Lock()
+	cp.asleep = false
+	cp.mu.Unlock()
+
 	// Close the underlying pool first.
 	// You cannot close the pool while holding the
 	// lock because we have to still allow Put to
@@ -177,6 +367,11 @@ func (cp *CachePool) Close() {
 	if pool == nil {
 		return
 	}
+	if cp.tuner != nil {
+		cp.tuner.Close()
+	}
+	cp.closing.Set(1)
+	cp.releaseAffinity()
 	pool.Close()
 
 	// No new operations will be allowed now.
@@ -186,22 +381,135 @@ func (cp *CachePool) Close() {
 	if cp.pool == nil {
 		return
 	}
+	cp.stop()
+}
+
+// stop stops memcached once the pool is closed, cp.mu must be held.
+func (cp *CachePool) stop() {
 	if cp.memcacheStats != nil {
 		cp.memcacheStats.Close()
 	}
-	cp.cmd.Process.Kill()
-	// Avoid zombies
-	go cp.cmd.Wait()
-	if strings.Contains(cp.port, "/") {
-		_ = os.Remove(cp.port)
+	// one we connected to is left running
+	if cp.cmd != nil {
+		cp.killMemcache()
+		if strings.Contains(cp.port, "/") {
+			_ = os.Remove(cp.port)
+		}
 	}
 	cp.pool = nil
 }
 
+// checkIdle stops memcached if there was no Get for idleShutdown and
+// no connection is in use. The row cache is empty when it's back.
+func (cp *CachePool) checkIdle() {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.pool == nil || time.Since(time.Unix(0, cp.lastUsed.Get())) < cp.idleShutdown {
+		return
+	}
+	// held until the pool is closed, no connection is parked again
+	// after it's checked that none is in use
+	for i := range cp.affinity {
+		slot := &cp.affinity[i]
+		slot.mu.Lock()
+		defer slot.mu.Unlock()
+		cp.releaseSlot(slot)
+	}
+	if cp.pool.Available() < cp.pool.Capacity() {
+		return
+	}
+	log.Infof("rowcache idle for %v, stopping memcache", cp.idleShutdown)
+	if cp.tuner != nil {
+		cp.tuner.Close()
+	}
+	cp.pool.Close()
+	cp.stop()
+	cp.asleep = true
+}
+
+// wake returns the pool for a Get, starting memcached again if it was
+// stopped by checkIdle. Once that fails it's retried after
+// wakeRetryInterval, the Gets fail until then.
+func (cp *CachePool) wake() (*pools.ResourcePool, error) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.asleep {
+		if time.Now().Before(cp.wakeRetry) {
+			return nil, errors.New("rowcache memcache is not running")
+		}
+		log.Infof("rowcache used again, starting memcache")
+		if err := cp.open(); err != nil {
+			cp.wakeRetry = time.Now().Add(wakeRetryInterval)
+			return nil, errors.Trace(err)
+		}
+		cp.asleep = false
+	}
+	cp.lastUsed.Set(time.Now().UnixNano())
+	return cp.pool, nil
+}
+
+// checkRestart compares the start time of the memcached instance behind
+// conn with the last one seen and bumps the generation if it changed.
+func (cp *CachePool) checkRestart(conn *memcache.Connection) {
+	stats, err := conn.Stats("")
+	if err != nil {
+		log.Warningf("can't read memcache stats: %v", err)
+		return
+	}
+	cp.observeStartTime(parseStartTime(stats))
+}
+
+// observeStartTime records the backend start time and reports whether
+// it differs from the previous one, in which case all row cache
+// prefixes are invalidated.
+func (cp *CachePool) observeStartTime(startTime int64) bool {
+	if startTime == 0 {
+		return false
+	}
+	cp.startMu.Lock()
+	defer cp.startMu.Unlock()
+	restarted := cp.startTime != 0 && cp.startTime != startTime
+	if restarted {
+		gen := cp.generation.Add(1)
+		log.Warningf("memcache restarted at %d, flushing rowcache (generation %d)", startTime, gen)
+	}
+	cp.startTime = startTime
+	return restarted
+}
+
+// Generation changes every time the memcached behind the pool restarts.
+func (cp *CachePool) Generation() int64 {
+	return cp.generation.Get()
+}
+
+// parseStartTime derives the start time of a memcached instance from
+// the time and uptime fields of its stats. It returns 0 if unknown.
+func parseStartTime(stats []byte) int64 {
+	var now, uptime int64
+	for _, line := range strings.Split(string(stats), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "STAT" {
+			continue
+		}
+		switch fields[1] {
+		case "time":
+			now, _ = strconv.ParseInt(fields[2], 10, 64)
+		case "uptime":
+			uptime, _ = strconv.ParseInt(fields[2], 10, 64)
+		}
+	}
+	if now == 0 {
+		return 0
+	}
+	return now - uptime
+}
+
+// IsClosed tells if the pool is closed, it's not while memcached is
+// only stopped for being idle.
 func (cp *CachePool) IsClosed() bool {
 	cp.mu.Lock()
 	defer cp.mu.Unlock()
-	return cp.pool == nil
+	return cp.pool == nil && !cp.asleep
 }
 
 func (cp *CachePool) getPool() *pools.ResourcePool {
@@ -211,19 +519,185 @@ func (cp *CachePool) getPool() *pools.ResourcePool {
 }
 
 // You must call Put after Get.
+// Get waits at most timeout for a connection and returns nil if none
+// became available, a zero timeout waits forever. It also returns nil
+// if memcached, stopped for being idle, can't be started again, the
+// rows are then read from the backends.
 func (cp *CachePool) Get(timeout time.Duration) *memcache.Connection {
-	pool := cp.getPool()
+	start := time.Now()
+	defer func() {
+		GetMetrics().Histogram("cache_pool_wait_seconds", cp.metricLabels(), time.Since(start).Seconds())
+	}()
+	pool, err := cp.wake()
+	if err != nil {
+		log.Warning(err)
+		return nil
+	}
+	return cp.getFrom(pool, timeout)
+}
+
+// metricLabels labels the metrics of the pool.
+func (cp *CachePool) metricLabels() Labels {
+	return cp.labels
+}
+
+// getStats is Get for reading stats, which is no traffic that keeps an
+// idle memcached running.
+func (cp *CachePool) getStats(timeout time.Duration) *memcache.Connection {
+	return cp.getFrom(cp.getPool(), timeout)
+}
+
+func (cp *CachePool) getFrom(pool *pools.ResourcePool, timeout time.Duration) *memcache.Connection {
 	if pool == nil {
 		log.Fatal("cache pool is not open")
 	}
-	r, err := pool.Get()
-	if err != nil {
-		log.Fatal(err)
+	if timeout == 0 {
+		return cp.get(pool)
+	}
+
+	done := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			if x := recover(); x != nil {
+				done <- x
+			}
+		}()
+		done <- cp.get(pool)
+	}()
+	select {
+	case r := <-done:
+		if conn, ok := r.(*memcache.Connection); ok {
+			return conn
+		}
+		panic(r)
+	case <-time.After(timeout):
+		// hand the connection back once we get it
+		go func() {
+			if conn, ok := (<-done).(*memcache.Connection); ok {
+				cp.Put(conn)
+			}
+		}()
+		return nil
+	}
+}
+
+func (cp *CachePool) get(pool *pools.ResourcePool) *memcache.Connection {
+	for attempt := 1; ; attempt++ {
+		r, err := pool.Get()
+		if err != nil {
+			log.Fatal(err)
+		}
+		conn := r.(*memcache.Connection)
+		if !cp.rowCacheConfig.ValidateOnGet {
+			cp.checkouts.add(conn)
+			return conn
+		}
+		if err = pingConn(conn); err == nil {
+			cp.checkouts.add(conn)
+			return conn
+		}
+		cp.validationErrors.Add(1)
+		GetMetrics().Counter("cache_pool_validation_errors", cp.metricLabels(), 1)
+		log.Warningf("discard stale memcache connection: %v", err)
+		if attempt < maxValidateAttempts {
+			pool.Put(nil)
+			continue
+		}
+
+		// the idle ones may all be stale, a new one takes the slot
+		if r, err = cp.connect(); err != nil {
+			pool.Put(nil)
+			log.Fatal(err)
+		}
+		conn = r.(*memcache.Connection)
+		cp.checkouts.add(conn)
+		return conn
 	}
-	return r.(*memcache.Connection)
+}
+
+// pingConn checks that conn is still usable, closing it if it's not.
+func pingConn(conn *memcache.Connection) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Get("health")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			conn.Close()
+		}
+		return err
+	case <-time.After(validateTimeout):
+		// close it once the ping gives up
+		go func() {
+			<-done
+			conn.Close()
+		}()
+		return errValidateTimeout
+	}
+}
+
+// recordOp records the cache operation op on key if it took longer
+// than the slow threshold.
+func (cp *CachePool) recordOp(op string, key string, start time.Time) {
+	if cp.SlowThreshold == 0 {
+		return
+	}
+	d := time.Since(start)
+	if d < cp.SlowThreshold {
+		return
+	}
+	if cp.rowCacheConfig.RedactSlowKeys {
+		key = redactKey(key)
+	}
+	cp.slowOps.record(SlowOp{Op: op, Key: key, Duration: d, Time: start})
+}
+
+// SlowOps returns the number of slow operations per op.
+func (cp *CachePool) SlowOps() map[string]int64 {
+	return cp.slowOps.Counts()
+}
+
+// RecentSlowOps returns the latest slow operations, oldest first.
+func (cp *CachePool) RecentSlowOps() []SlowOp {
+	return cp.slowOps.Recent()
+}
+
+// fits tells if an item of key and value is within the item size
+// limit of memcached, counting it as skipped otherwise.
+func (cp *CachePool) fits(key string, value []byte) bool {
+	limit := cp.MaxItemSize
+	if limit <= 0 {
+		limit = defaultMaxItemSize
+	}
+	if len(key)+len(value)+itemOverhead <= limit {
+		return true
+	}
+	cp.oversizedSkips.Add(1)
+	GetMetrics().Counter("cache_pool_oversized_skips", cp.metricLabels(), 1)
+	return false
+}
+
+// OversizedSkips returns the number of values not cached because they
+// exceed the item size limit.
+func (cp *CachePool) OversizedSkips() int64 {
+	return cp.oversizedSkips.Get()
+}
+
+// NotAdmitted returns the number of rows not cached because they were
+// not read AdmitAfter times yet.
+func (cp *CachePool) NotAdmitted() int64 {
+	return cp.notAdmitted.Get()
+}
+
+// ValidationErrors returns the number of stale connections discarded.
+func (cp *CachePool) ValidationErrors() int64 {
+	return cp.validationErrors.Get()
 }
 
 func (cp *CachePool) Put(conn *memcache.Connection) {
+	cp.checkouts.remove(conn)
 	pool := cp.getPool()
 	if pool == nil {
 		return
@@ -235,12 +709,37 @@ func (cp *CachePool) Put(conn *memcache.Connection) {
 	}
 }
 
-func (cp *CachePool) StatsJSON() string {
+// SetCapacity resizes the connection pool. Connections in use are not
+// dropped, shrinking waits for them to be returned.
+func (cp *CachePool) SetCapacity(capacity int) error {
 	pool := cp.getPool()
 	if pool == nil {
-		return "{}"
+		return errors.New("cache pool is not open")
+	}
+	if capacity < 1 {
+		return errors.Errorf("invalid capacity %d", capacity)
 	}
-	return pool.StatsJSON()
+	if int64(capacity) > pool.MaxCap() {
+		return errors.Errorf("capacity %d exceeds max capacity %d", capacity, pool.MaxCap())
+	}
+	// shrinking waits for the parked connections otherwise
+	cp.releaseAffinity()
+	return errors.Trace(pool.SetCapacity(capacity))
+}
+
+// statsVersion is bumped whenever the layout of StatsJSON changes.
+const statsVersion = 1
+
+// StatsJSON returns the pool stats, nested under "Pool", along with
+// the pool name so that multiple pools can be told apart.
+func (cp *CachePool) StatsJSON() string {
+	poolStats := "{}"
+	if pool := cp.getPool(); pool != nil {
+		poolStats = pool.StatsJSON()
+	}
+	slowOps, _ := json.Marshal(cp.SlowOps())
+	return fmt.Sprintf("{\"Name\": %q, \"Version\": %d, \"Timestamp\": %d, \"ValidationErrors\": %d, \"OversizedSkips\": %d, \"LongestCheckout\": %d, \"SlowOps\": %s, \"Pool\": %s}",
+		cp.name, statsVersion, time.Now().Unix(), cp.ValidationErrors(), cp.OversizedSkips(), int64(cp.LongestCheckout()), slowOps, poolStats)
 }
 
 func (cp *CachePool) Capacity() int64 {
@@ -294,7 +793,8 @@ func (cp *CachePool) IdleTimeout() time.Duration {
 func (cp *CachePool) ServeHTTP(response http.ResponseWriter, request *http.Request) {
 	defer func() {
 		if x := recover(); x != nil {
-			response.Write(([]byte)(x.(error).Error()))
+			log.Errorf("memcache stats request %s failed: %s", request.URL.Path, fmt.Sprint(x))
+			http.Error(response, "internal error", http.StatusInternalServerError)
 		}
 	}()
 	response.Header().Set("Content-Type", "text/plain")
@@ -307,7 +807,15 @@ func (cp *CachePool) ServeHTTP(response http.ResponseWriter, request *http.Reque
 	if command == "stats" {
 		command = ""
 	}
-	conn := cp.Get(0)
+	if !statsCommands[command] {
+		http.Error(response, "unknown stats command "+command, http.StatusBadRequest)
+		return
+	}
+	conn := cp.getFrom(pool, statsTimeout)
+	if conn == nil {
+		http.Error(response, "no memcache connection available", http.StatusServiceUnavailable)
+		return
+	}
 	// This is not the same as defer rc.cachePool.Put(conn)
 	defer func() { cp.Put(conn) }()
 	r, err := conn.Stats(command)
@@ -0,0 +1,487 @@
+package tabletserver
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ngaut/memcache"
+	"github.com/ngaut/pools"
+	"github.com/wandoulabs/cm/vt/tabletserver/fakecache"
+)
+
+func TestParseStartTime(t *testing.T) {
+	stats := []byte("STAT pid 1234\r\nSTAT uptime 100\r\nSTAT time 1400000100\r\nEND\r\n")
+	if st := parseStartTime(stats); st != 1400000000 {
+		t.Fatal(st)
+	}
+
+	if st := parseStartTime([]byte("END\r\n")); st != 0 {
+		t.Fatal(st)
+	}
+}
+
+func TestFlushOnRestart(t *testing.T) {
+	cp := NewCachePool("test", RowCacheConfig{FlushOnRestart: true}, 0, 0)
+	rc := NewRowCache(nil, cp)
+	prefix := rc.getPrefix()
+
+	if cp.observeStartTime(parseStartTime([]byte("STAT uptime 10\r\nSTAT time 1010\r\n"))) {
+		t.Fatal("first backend should not be seen as restarted")
+	}
+	if cp.observeStartTime(parseStartTime([]byte("STAT uptime 20\r\nSTAT time 1020\r\n"))) {
+		t.Fatal("same backend should not be seen as restarted")
+	}
+	if rc.getPrefix() != prefix {
+		t.Fatal("prefix changed without restart")
+	}
+
+	// memcached came back with a new start time
+	if !cp.observeStartTime(parseStartTime([]byte("STAT uptime 1\r\nSTAT time 2000\r\n"))) {
+		t.Fatal("restart not detected")
+	}
+	if cp.Generation() != 1 {
+		t.Fatal(cp.Generation())
+	}
+	if rc.getPrefix() == prefix {
+		t.Fatal("prefix should change after restart")
+	}
+}
+
+func TestPoolTuner(t *testing.T) {
+	tuner := newPoolTuner(nil, 10, 100)
+
+	// callers keep waiting, grow
+	capacity := tuner.nextCapacity(10, 0, 50)
+	if capacity != 16 {
+		t.Fatal(capacity)
+	}
+	capacity = tuner.nextCapacity(capacity, 0, 200)
+	if capacity != 25 {
+		t.Fatal(capacity)
+	}
+
+	// few waits, keep the size
+	if c := tuner.nextCapacity(capacity, 0, 205); c != capacity {
+		t.Fatal(c)
+	}
+
+	// never beyond maxCap
+	if c := tuner.nextCapacity(90, 0, 1000); c != 100 {
+		t.Fatal(c)
+	}
+
+	// mostly idle, shrink
+	capacity = tuner.nextCapacity(100, 80, 1000)
+	if capacity != 75 {
+		t.Fatal(capacity)
+	}
+
+	// never below minCap
+	if c := tuner.nextCapacity(12, 12, 1000); c != 10 {
+		t.Fatal(c)
+	}
+}
+
+func newTestCachePool(capacity, maxCap int) *CachePool {
+	cp := NewCachePool("test", RowCacheConfig{}, 0, 0)
+	f := func() (pools.Resource, error) {
+		return &memcache.Connection{}, nil
+	}
+	cp.pool = pools.NewResourcePool(f, capacity, maxCap, 0)
+	return cp
+}
+
+func TestSetCapacity(t *testing.T) {
+	cp := newTestCachePool(10, 100)
+
+	if err := cp.SetCapacity(50); err != nil {
+		t.Fatal(err)
+	}
+	if cp.Capacity() != 50 {
+		t.Fatal(cp.Capacity())
+	}
+	conn := cp.Get(0)
+	cp.Put(conn)
+
+	if err := cp.SetCapacity(5); err != nil {
+		t.Fatal(err)
+	}
+	if cp.Capacity() != 5 {
+		t.Fatal(cp.Capacity())
+	}
+	conn = cp.Get(0)
+	cp.Put(conn)
+
+	if err := cp.SetCapacity(0); err == nil {
+		t.Fatal("expect error")
+	}
+	if err := cp.SetCapacity(101); err == nil {
+		t.Fatal("expect error")
+	}
+	if cp.Capacity() != 5 {
+		t.Fatal(cp.Capacity())
+	}
+
+	if err := NewCachePool("closed", RowCacheConfig{}, 0, 0).SetCapacity(10); err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+type poolStats struct {
+	Name      string
+	Version   int
+	Timestamp int64
+	Pool      map[string]interface{}
+}
+
+func TestStatsJSON(t *testing.T) {
+	var stats poolStats
+	cp := newTestCachePool(10, 100)
+	if err := json.Unmarshal([]byte(cp.StatsJSON()), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Name != "test" || stats.Version != statsVersion || stats.Timestamp == 0 {
+		t.Fatalf("%+v", stats)
+	}
+	if stats.Pool["Capacity"] != float64(10) {
+		t.Fatalf("%+v", stats.Pool)
+	}
+
+	stats = poolStats{}
+	closed := NewCachePool("closed", RowCacheConfig{}, 0, 0)
+	if err := json.Unmarshal([]byte(closed.StatsJSON()), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Name != "closed" || len(stats.Pool) != 0 {
+		t.Fatalf("%+v", stats)
+	}
+}
+
+func TestServeHTTPRecover(t *testing.T) {
+	cp := NewCachePool("test", RowCacheConfig{}, 0, 0)
+	f := func() (pools.Resource, error) {
+		panic("no connection")
+	}
+	cp.pool = pools.NewResourcePool(f, 1, 1, 0)
+
+	req, _ := http.NewRequest("GET", statsURL+"stats", nil)
+	w := httptest.NewRecorder()
+	cp.ServeHTTP(w, req)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatal(w.Code)
+	}
+	if body := strings.TrimSpace(w.Body.String()); body != "internal error" {
+		t.Fatal(body)
+	}
+}
+
+func newFakeCachePool(fm *fakecache.Memcache, capacity int) *CachePool {
+	cp := NewCachePool("test", RowCacheConfig{}, 0, 0)
+	cp.Connect(fm.Addr(), capacity)
+	return cp
+}
+
+func TestValidateOnGet(t *testing.T) {
+	fm := fakecache.New()
+	defer fm.Close()
+	cp := newFakeCachePool(fm, 1)
+	cp.rowCacheConfig.ValidateOnGet = true
+
+	conn := cp.Get(0)
+	if _, err := conn.Set("k", 0, 0, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	cp.Put(conn)
+
+	// the connection goes stale while idle in the pool
+	fm.DropConns()
+
+	conn = cp.Get(0)
+	defer cp.Put(conn)
+	if cp.ValidationErrors() != 1 {
+		t.Fatal(cp.ValidationErrors())
+	}
+	results, err := conn.Get("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || string(results[0].Value) != "v" {
+		t.Fatal(results)
+	}
+}
+
+func TestValidateOnGetAllStale(t *testing.T) {
+	fm := fakecache.New()
+	defer fm.Close()
+	cp := newFakeCachePool(fm, maxValidateAttempts)
+	cp.rowCacheConfig.ValidateOnGet = true
+
+	var conns []*memcache.Connection
+	for i := 0; i < maxValidateAttempts; i++ {
+		conns = append(conns, cp.Get(0))
+	}
+	for _, conn := range conns {
+		cp.Put(conn)
+	}
+	fm.DropConns()
+
+	conn := cp.Get(0)
+	defer cp.Put(conn)
+	if cp.ValidationErrors() != maxValidateAttempts {
+		t.Fatal(cp.ValidationErrors())
+	}
+	if _, err := conn.Set("k", 0, 0, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeHTTPCommands(t *testing.T) {
+	fm := fakecache.New()
+	defer fm.Close()
+	fm.SetStats("STAT pid 1\r\n")
+	cp := newFakeCachePool(fm, 1)
+
+	req, _ := http.NewRequest("GET", statsURL+"stats", nil)
+	w := httptest.NewRecorder()
+	cp.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "STAT pid 1\n" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", statsURL+"detail on", nil)
+	w = httptest.NewRecorder()
+	cp.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatal(w.Code)
+	}
+}
+
+func TestServeHTTPTimeout(t *testing.T) {
+	fm := fakecache.New()
+	defer fm.Close()
+	cp := newFakeCachePool(fm, 1)
+
+	defer func(d time.Duration) { statsTimeout = d }(statsTimeout)
+	statsTimeout = 50 * time.Millisecond
+
+	// exhaust the pool
+	conn := cp.Get(0)
+
+	req, _ := http.NewRequest("GET", statsURL+"stats", nil)
+	w := httptest.NewRecorder()
+	cp.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatal(w.Code)
+	}
+
+	// the connection is back for the abandoned wait
+	cp.Put(conn)
+	conn = cp.Get(time.Second)
+	if conn == nil {
+		t.Fatal("expect connection")
+	}
+	cp.Put(conn)
+}
+
+func TestIdleShutdown(t *testing.T) {
+	fm := fakecache.New()
+	defer fm.Close()
+	_, port, _ := net.SplitHostPort(fm.Addr())
+	tcpPort, _ := strconv.Atoi(port)
+
+	// true stands in for memcached, the fake one serves the connections
+	cp := NewCachePool("test", RowCacheConfig{Binary: "true", TcpPort: tcpPort, IdleShutdownSec: 3600}, 0, 0)
+	cp.Open()
+	defer cp.Close()
+
+	conn := cp.Get(0)
+	if _, err := conn.Set("k", 0, 0, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	cp.checkIdle()
+	if cp.getPool() == nil {
+		t.Fatal("stopped while in use")
+	}
+	cp.Put(conn)
+
+	cp.checkIdle()
+	if cp.getPool() == nil {
+		t.Fatal("stopped before the idle period")
+	}
+
+	cp.lastUsed.Set(time.Now().Add(-2 * time.Hour).UnixNano())
+	cp.checkIdle()
+	if cp.getPool() != nil {
+		t.Fatal("not stopped when idle")
+	}
+	if cp.IsClosed() {
+		t.Fatal("idle pool should not look closed")
+	}
+
+	// it can't be started again, the rows are read from the backends
+	cp.rowCacheConfig.Binary = "/nonexistent/memcached"
+	if conn = cp.Get(0); conn != nil {
+		t.Fatal("got a connection of a stopped memcached")
+	}
+	rc := NewRowCache(nil, cp)
+	if results := rc.Get([]string{"1"}, nil); len(results) != 0 {
+		t.Fatal(results)
+	}
+	rc.Delete("1")
+	cp.rowCacheConfig.Binary = "true"
+	if conn = cp.Get(0); conn != nil {
+		t.Fatal("started again before wakeRetryInterval")
+	}
+	cp.mu.Lock()
+	cp.wakeRetry = time.Time{}
+	cp.mu.Unlock()
+
+	// the next Get starts it again
+	conn = cp.Get(0)
+	if cp.getPool() == nil {
+		t.Fatal("not started again")
+	}
+	if _, err := conn.Get("k"); err != nil {
+		t.Fatal(err)
+	}
+	cp.Put(conn)
+
+	cp.Close()
+	if !cp.IsClosed() {
+		t.Fatal("not closed")
+	}
+}
+
+func TestAffinity(t *testing.T) {
+	cp := newTestCachePool(5, 5)
+	cp.affinity = make([]affinitySlot, 4)
+
+	// keys of the same slot and of another one
+	key, other := "k0", ""
+	for i := 1; other == ""; i++ {
+		if k := "k" + strconv.Itoa(i); cp.affinitySlot(k) != cp.affinitySlot(key) {
+			other = k
+		}
+	}
+
+	conn := cp.GetFor(key, 0)
+	cp.PutFor(key, conn)
+	if cp.Available() != 4 {
+		t.Fatal("not parked", cp.Available())
+	}
+	if got := cp.GetFor(key, 0); got != conn {
+		t.Fatal("parked connection not reused")
+	}
+	// the slot is free while its connection is out
+	second := cp.GetFor(key, 0)
+	if second == conn {
+		t.Fatal("connection handed out twice")
+	}
+	cp.PutFor(key, conn)
+	cp.PutFor(key, second)
+	if cp.Available() != 4 {
+		t.Fatal("slot parked two connections", cp.Available())
+	}
+	if got := cp.GetFor(other, 0); got == conn {
+		t.Fatal("connection of another slot")
+	} else {
+		cp.PutFor(other, got)
+	}
+	if hits, misses := cp.AffinityHits(), cp.AffinityMisses(); hits != 1 || misses != 3 {
+		t.Fatal(hits, misses)
+	}
+
+	cp.releaseAffinity()
+	if cp.Available() != 5 {
+		t.Fatal("parked connections not released", cp.Available())
+	}
+
+	// without slots connections always go back to the pool
+	cp.affinity = nil
+	conn = cp.GetFor(key, 0)
+	cp.PutFor(key, conn)
+	if cp.Available() != 5 {
+		t.Fatal(cp.Available())
+	}
+}
+
+// BenchmarkAffinity measures back to back gets of nearby keys through
+// the pool and through parked connections.
+func BenchmarkAffinity(b *testing.B) {
+	fm := fakecache.New()
+	defer fm.Close()
+	for _, slots := range []int{0, 16} {
+		b.Run("slots="+strconv.Itoa(slots), func(b *testing.B) {
+			cp := newFakeCachePool(fm, 32)
+			if slots > 0 {
+				cp.affinity = make([]affinitySlot, slots)
+			}
+			defer cp.releaseAffinity()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := "row:" + strconv.Itoa(i%64)
+				conn := cp.GetFor(key, 0)
+				if _, err := conn.Gets(key); err != nil {
+					b.Fatal(err)
+				}
+				cp.PutFor(key, conn)
+			}
+		})
+	}
+}
+
+func TestLongestCheckout(t *testing.T) {
+	defer func(f func() time.Time) { timeNow = f }(timeNow)
+	now := time.Unix(1000000, 0)
+	timeNow = func() time.Time { return now }
+
+	fm := fakecache.New()
+	defer fm.Close()
+	cp := newFakeCachePool(fm, 3)
+	if d := cp.LongestCheckout(); d != 0 {
+		t.Fatal(d)
+	}
+
+	held := cp.Get(0)
+	now = now.Add(time.Minute)
+	conn := cp.Get(0)
+	now = now.Add(time.Second)
+	if d := cp.LongestCheckout(); d != time.Minute+time.Second {
+		t.Fatal(d)
+	}
+	if n := cp.CheckedOutLonger(30 * time.Second); n != 1 {
+		t.Fatal(n)
+	}
+	cp.Put(conn)
+	if n := cp.CheckedOutLonger(0); n != 1 {
+		t.Fatal(n)
+	}
+
+	// closed connections are put back as nil
+	held.Close()
+	cp.Put(nil)
+	if d := cp.LongestCheckout(); d != 0 {
+		t.Fatal(d)
+	}
+
+	// parked connections are not out
+	cp.affinity = make([]affinitySlot, 1)
+	cp.PutFor("k", cp.GetFor("k", 0))
+	now = now.Add(time.Second)
+	if d := cp.LongestCheckout(); d != 0 {
+		t.Fatal(d)
+	}
+	conn = cp.GetFor("k", 0)
+	now = now.Add(time.Second)
+	if d := cp.LongestCheckout(); d != time.Second {
+		t.Fatal(d)
+	}
+	cp.releaseAffinity()
+	cp.Put(conn)
+}
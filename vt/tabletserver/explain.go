@@ -0,0 +1,74 @@
+package tabletserver
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/wandoulabs/cm/vt/schema"
+	"github.com/wandoulabs/cm/vt/tabletserver/planbuilder"
+)
+
+// Row sources reported by ExplainAnalyze.
+const (
+	SOURCE_CACHE   = "cache"
+	SOURCE_BACKEND = "backend"
+	// SOURCE_ABSENT is for rows neither the cache nor the backend has.
+	SOURCE_ABSENT = "absent"
+)
+
+// KeyAnalysis tells where the row of a pk was found.
+type KeyAnalysis struct {
+	Key    string
+	Source string
+}
+
+// Analysis is the outcome of ExplainAnalyze.
+type Analysis struct {
+	Plan        *planbuilder.ExecPlan
+	Keys        []KeyAnalysis `json:",omitempty"`
+	BackendRows int
+	CacheTime   time.Duration
+	BackendTime time.Duration
+}
+
+// BackendFunc runs the query on the backend for the row of key, or the
+// whole query if key is empty, returning the number of rows read.
+type BackendFunc func(key string) (int, error)
+
+// ExplainAnalyze runs plan the way a select does and reports whether
+// each row of keys came from the cache or the backend. Misses are read
+// with fetch but not cached, and neither the table stats nor the
+// cache stats are counted, so it can be used on a live proxy.
+func ExplainAnalyze(plan *planbuilder.ExecPlan, ti *TableInfo, keys []string, fetch BackendFunc) (*Analysis, error) {
+	a := &Analysis{Plan: plan}
+	if ti == nil || ti.CacheType == schema.CACHE_NONE || ti.Cache == nil || len(keys) == 0 {
+		start := time.Now()
+		n, err := fetch("")
+		a.BackendTime = time.Since(start)
+		a.BackendRows = n
+		return a, errors.Trace(err)
+	}
+
+	start := time.Now()
+	items := ti.Cache.Peek(keys, ti.Columns)
+	a.CacheTime = time.Since(start)
+
+	for _, key := range keys {
+		ka := KeyAnalysis{Key: key, Source: SOURCE_CACHE}
+		if items[key].Row == nil {
+			start := time.Now()
+			n, err := fetch(key)
+			a.BackendTime += time.Since(start)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			a.BackendRows += n
+			ka.Source = SOURCE_BACKEND
+			if n == 0 {
+				ka.Source = SOURCE_ABSENT
+			}
+		}
+		a.Keys = append(a.Keys, ka)
+	}
+	return a, nil
+}
@@ -0,0 +1,66 @@
+package tabletserver
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/vt/schema"
+	"github.com/wandoulabs/cm/vt/tabletserver/fakecache"
+	"github.com/wandoulabs/cm/vt/tabletserver/planbuilder"
+)
+
+func TestExplainAnalyze(t *testing.T) {
+	fm := fakecache.New()
+	defer fm.Close()
+	ti := &TableInfo{Table: schema.NewTable("t")}
+	ti.AddColumn("id", "bigint(20)", "", nil, "")
+	ti.CacheType = schema.CACHE_RW
+	ti.Cache = NewRowCache(ti, newFakeCachePool(fm, 1))
+	ti.Cache.Set("1", mysql.AppendLengthEncodedString(nil, []byte("1")), 0)
+
+	backend := map[string]int{"2": 1}
+	var fetched []string
+	fetch := func(key string) (int, error) {
+		fetched = append(fetched, key)
+		return backend[key], nil
+	}
+
+	plan := &planbuilder.ExecPlan{PlanId: planbuilder.PLAN_PK_IN}
+	a, err := ExplainAnalyze(plan, ti, []string{"1", "2", "3"}, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []KeyAnalysis{{"1", SOURCE_CACHE}, {"2", SOURCE_BACKEND}, {"3", SOURCE_ABSENT}}
+	if !reflect.DeepEqual(a.Keys, expect) || a.BackendRows != 1 {
+		t.Fatalf("%+v", a)
+	}
+	if !reflect.DeepEqual(fetched, []string{"2", "3"}) {
+		t.Fatal(fetched)
+	}
+
+	// misses are not cached and nothing is counted
+	if _, ok := fm.Item(ti.Cache.CacheKey("2")); ok {
+		t.Fatal("miss was cached")
+	}
+	if h, a, m, i := ti.Stats(); h+a+m+i != 0 {
+		t.Fatal(h, a, m, i)
+	}
+	if counts := ti.Cache.AccessAges().Counts(); !reflect.DeepEqual(counts, make([]int64, len(counts))) {
+		t.Fatal(counts)
+	}
+
+	// uncached tables go to the backend as a whole
+	fetched = nil
+	backend[""] = 5
+	a, err = ExplainAnalyze(plan, &TableInfo{Table: schema.NewTable("nocache")}, nil, fetch)
+	if err != nil || a.Keys != nil || a.BackendRows != 5 || !reflect.DeepEqual(fetched, []string{""}) {
+		t.Fatal(a, err, fetched)
+	}
+
+	fail := func(string) (int, error) { return 0, errors.New("backend down") }
+	if _, err := ExplainAnalyze(plan, ti, []string{"2"}, fail); err == nil {
+		t.Fatal("expect backend error")
+	}
+}
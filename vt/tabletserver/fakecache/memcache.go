@@ -0,0 +1,198 @@
+// Package fakecache is a minimal in-process memcached for the tests of
+// the row cache and of the proxy using it.
+package fakecache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Item is a stored value.
+type Item struct {
+	Flags uint16
+	Value []byte
+	Cas   uint64
+}
+
+// Memcache is a minimal in-process memcached speaking the text
+// protocol, just enough for the commands used by the rowcache.
+type Memcache struct {
+	listener net.Listener
+	mu       sync.Mutex
+	items    map[string]Item
+	conns    map[net.Conn]bool
+	cas      uint64
+	stats    string
+	delay    time.Duration
+}
+
+// New starts a Memcache listening on a local port.
+func New() *Memcache {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	fm := &Memcache{
+		listener: l,
+		items:    make(map[string]Item),
+		conns:    make(map[net.Conn]bool),
+	}
+	go fm.serve()
+	return fm
+}
+
+func (fm *Memcache) Addr() string {
+	return fm.listener.Addr().String()
+}
+
+func (fm *Memcache) Close() {
+	fm.listener.Close()
+	fm.DropConns()
+}
+
+// DropConns closes all client connections, leaving them stale.
+func (fm *Memcache) DropConns() {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	for c := range fm.conns {
+		c.Close()
+	}
+	fm.conns = make(map[net.Conn]bool)
+}
+
+func (fm *Memcache) SetDelay(d time.Duration) {
+	fm.mu.Lock()
+	fm.delay = d
+	fm.mu.Unlock()
+}
+
+func (fm *Memcache) SetStats(stats string) {
+	fm.mu.Lock()
+	fm.stats = stats
+	fm.mu.Unlock()
+}
+
+func (fm *Memcache) Item(key string) (Item, bool) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	item, ok := fm.items[key]
+	return item, ok
+}
+
+func (fm *Memcache) serve() {
+	for {
+		c, err := fm.listener.Accept()
+		if err != nil {
+			return
+		}
+		fm.mu.Lock()
+		fm.conns[c] = true
+		fm.mu.Unlock()
+		go fm.handle(c)
+	}
+}
+
+func (fm *Memcache) handle(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		fm.mu.Lock()
+		delay := fm.delay
+		fm.mu.Unlock()
+		time.Sleep(delay)
+
+		switch fields[0] {
+		case "get", "gets":
+			fm.mu.Lock()
+			for _, key := range fields[1:] {
+				item, ok := fm.items[key]
+				if !ok {
+					continue
+				}
+				if fields[0] == "gets" {
+					fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", key, item.Flags, len(item.Value), item.Cas)
+				} else {
+					fmt.Fprintf(w, "VALUE %s %d %d\r\n", key, item.Flags, len(item.Value))
+				}
+				w.Write(item.Value)
+				w.WriteString("\r\n")
+			}
+			fm.mu.Unlock()
+			w.WriteString("END\r\n")
+		case "set", "add", "cas":
+			flags, _ := strconv.ParseUint(fields[2], 10, 16)
+			size, _ := strconv.Atoi(fields[4])
+			value := make([]byte, size+2)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return
+			}
+			var cas uint64
+			if fields[0] == "cas" {
+				cas, _ = strconv.ParseUint(fields[5], 10, 64)
+			}
+			w.WriteString(fm.store(fields[0], fields[1], uint16(flags), value[:size], cas) + "\r\n")
+		case "delete":
+			fm.mu.Lock()
+			_, ok := fm.items[fields[1]]
+			delete(fm.items, fields[1])
+			fm.mu.Unlock()
+			if ok {
+				w.WriteString("DELETED\r\n")
+			} else {
+				w.WriteString("NOT_FOUND\r\n")
+			}
+		case "flush_all":
+			fm.mu.Lock()
+			fm.items = make(map[string]Item)
+			fm.mu.Unlock()
+			w.WriteString("OK\r\n")
+		case "stats":
+			fm.mu.Lock()
+			w.WriteString(fm.stats)
+			fm.mu.Unlock()
+			w.WriteString("END\r\n")
+		default:
+			w.WriteString("ERROR\r\n")
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (fm *Memcache) store(cmd, key string, flags uint16, value []byte, cas uint64) string {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	item, ok := fm.items[key]
+	switch cmd {
+	case "add":
+		if ok {
+			return "NOT_STORED"
+		}
+	case "cas":
+		if !ok {
+			return "NOT_FOUND"
+		}
+		if item.Cas != cas {
+			return "EXISTS"
+		}
+	}
+	fm.cas++
+	fm.items[key] = Item{Flags: flags, Value: value, Cas: fm.cas}
+	return "STORED"
+}
@@ -0,0 +1,50 @@
+package tabletserver
+
+import (
+	"sync"
+)
+
+// Labels tell apart the series of a metric, like the table of a row
+// cache counter.
+type Labels map[string]string
+
+// Metrics is the sink the components report what they count through.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// Counter adds delta to the counter name.
+	Counter(name string, labels Labels, delta int64)
+	// Gauge sets the gauge name to value.
+	Gauge(name string, labels Labels, value int64)
+	// Histogram records an observation of name, like a duration in
+	// seconds.
+	Histogram(name string, labels Labels, value float64)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) Counter(name string, labels Labels, delta int64)     {}
+func (noopMetrics) Gauge(name string, labels Labels, value int64)       {}
+func (noopMetrics) Histogram(name string, labels Labels, value float64) {}
+
+var (
+	metricsMu sync.RWMutex
+	metrics   Metrics = noopMetrics{}
+)
+
+// SetMetrics makes the components report through m, nil stops the
+// reports.
+func SetMetrics(m Metrics) {
+	if m == nil {
+		m = noopMetrics{}
+	}
+	metricsMu.Lock()
+	metrics = m
+	metricsMu.Unlock()
+}
+
+// GetMetrics returns the sink the components report through.
+func GetMetrics() Metrics {
+	metricsMu.RLock()
+	defer metricsMu.RUnlock()
+	return metrics
+}
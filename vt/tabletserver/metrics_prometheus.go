@@ -0,0 +1,231 @@
+package tabletserver
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// PrometheusBuckets are the upper bounds of the histogram buckets, fit
+// for durations in seconds.
+var PrometheusBuckets = []float64{.0005, .001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	mu sync.Mutex
+	// counts has one count per bucket, they are made cumulative when
+	// written
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// PrometheusMetrics is a Metrics keeping what is reported to it, which
+// it serves over http in the Prometheus text format.
+type PrometheusMetrics struct {
+	namespace string
+
+	// mu guards the maps of the series of each metric by their
+	// rendered labels, a series is updated in place once there
+	mu         sync.RWMutex
+	counters   map[string]map[string]*int64
+	gauges     map[string]map[string]*int64
+	histograms map[string]map[string]*histogram
+}
+
+// NewPrometheusMetrics creates a PrometheusMetrics that prefixes the
+// metric names with namespace_.
+func NewPrometheusMetrics(namespace string) *PrometheusMetrics {
+	return &PrometheusMetrics{
+		namespace:  namespace,
+		counters:   make(map[string]map[string]*int64),
+		gauges:     make(map[string]map[string]*int64),
+		histograms: make(map[string]map[string]*histogram),
+	}
+}
+
+func (pm *PrometheusMetrics) Counter(name string, labels Labels, delta int64) {
+	if delta < 0 {
+		// prometheus counters only go up
+		return
+	}
+	atomic.AddInt64(pm.series(pm.counters, name, formatLabels(labels)), delta)
+}
+
+func (pm *PrometheusMetrics) Gauge(name string, labels Labels, value int64) {
+	atomic.StoreInt64(pm.series(pm.gauges, name, formatLabels(labels)), value)
+}
+
+// series returns the value of the series key of the metric name of
+// metrics, adding it if it's new.
+func (pm *PrometheusMetrics) series(metrics map[string]map[string]*int64, name, key string) *int64 {
+	pm.mu.RLock()
+	v := metrics[name][key]
+	pm.mu.RUnlock()
+	if v != nil {
+		return v
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	series, ok := metrics[name]
+	if !ok {
+		series = make(map[string]*int64)
+		metrics[name] = series
+	}
+	if v = series[key]; v == nil {
+		v = new(int64)
+		series[key] = v
+	}
+	return v
+}
+
+func (pm *PrometheusMetrics) Histogram(name string, labels Labels, value float64) {
+	key := formatLabels(labels)
+	pm.mu.RLock()
+	h := pm.histograms[name][key]
+	pm.mu.RUnlock()
+	if h == nil {
+		pm.mu.Lock()
+		series, ok := pm.histograms[name]
+		if !ok {
+			series = make(map[string]*histogram)
+			pm.histograms[name] = series
+		}
+		if h = series[key]; h == nil {
+			h = &histogram{counts: make([]uint64, len(PrometheusBuckets))}
+			series[key] = h
+		}
+		pm.mu.Unlock()
+	}
+
+	i := sort.SearchFloat64s(PrometheusBuckets, value)
+	h.mu.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += value
+	h.mu.Unlock()
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (pm *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(pm.Text())
+}
+
+// Text renders the metrics in the Prometheus text format, sorted by name
+// and labels.
+func (pm *PrometheusMetrics) Text() []byte {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	var buf bytes.Buffer
+	for _, name := range sortedNames(pm.counters) {
+		pm.writeSeries(&buf, name, "counter", pm.counters[name])
+	}
+	for _, name := range sortedNames(pm.gauges) {
+		pm.writeSeries(&buf, name, "gauge", pm.gauges[name])
+	}
+
+	names := make([]string, 0, len(pm.histograms))
+	for name := range pm.histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		full := pm.fullName(name)
+		fmt.Fprintf(&buf, "# TYPE %s histogram\n", full)
+		series := pm.histograms[name]
+		for _, key := range sortedKeys(series) {
+			h := series[key]
+			h.mu.Lock()
+			var cumulative uint64
+			for i, bound := range PrometheusBuckets {
+				cumulative += h.counts[i]
+				fmt.Fprintf(&buf, "%s_bucket%s %d\n", full, withLabel(key, "le", formatFloat(bound)), cumulative)
+			}
+			fmt.Fprintf(&buf, "%s_bucket%s %d\n", full, withLabel(key, "le", "+Inf"), h.count)
+			fmt.Fprintf(&buf, "%s_sum%s %s\n", full, key, formatFloat(h.sum))
+			fmt.Fprintf(&buf, "%s_count%s %d\n", full, key, h.count)
+			h.mu.Unlock()
+		}
+	}
+	return buf.Bytes()
+}
+
+func (pm *PrometheusMetrics) writeSeries(buf *bytes.Buffer, name, typ string, series map[string]*int64) {
+	full := pm.fullName(name)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", full, typ)
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(buf, "%s%s %d\n", full, key, atomic.LoadInt64(series[key]))
+	}
+}
+
+func (pm *PrometheusMetrics) fullName(name string) string {
+	if pm.namespace == "" {
+		return name
+	}
+	return pm.namespace + "_" + name
+}
+
+func sortedNames(m map[string]map[string]*int64) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedKeys(series map[string]*histogram) []string {
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders labels like {pool="rowcache",table="t"}, sorted
+// by name so that equal labels render the same.
+func formatLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(labels[name]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLabel adds the label name to the rendered labels key.
+func withLabel(key, name, value string) string {
+	label := name + `="` + value + `"`
+	if key == "" {
+		return "{" + label + "}"
+	}
+	return key[:len(key)-1] + "," + label + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,124 @@
+package tabletserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ngaut/cache"
+	"github.com/wandoulabs/cm/vt/schema"
+)
+
+// fakeMetrics records the reports as name{labels}.
+type fakeMetrics struct {
+	mu      sync.Mutex
+	reports map[string]float64
+}
+
+func newFakeMetrics() *fakeMetrics {
+	return &fakeMetrics{reports: make(map[string]float64)}
+}
+
+func (fm *fakeMetrics) add(name string, labels Labels, value float64, set bool) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	key := name + formatLabels(labels)
+	if set {
+		fm.reports[key] = value
+	} else {
+		fm.reports[key] += value
+	}
+}
+
+func (fm *fakeMetrics) Counter(name string, labels Labels, delta int64) {
+	fm.add(name, labels, float64(delta), false)
+}
+
+func (fm *fakeMetrics) Gauge(name string, labels Labels, value int64) {
+	fm.add(name, labels, float64(value), true)
+}
+
+func (fm *fakeMetrics) Histogram(name string, labels Labels, value float64) {
+	fm.add(name, labels, 1, false)
+}
+
+func TestMetricsReports(t *testing.T) {
+	fm := newFakeMetrics()
+	SetMetrics(fm)
+	defer SetMetrics(nil)
+
+	ti := &TableInfo{Table: schema.NewTable("a")}
+	ti.AddColumn("id", "int(11)", "", nil, "")
+	ti.AddIndex("PRIMARY").AddColumn("id", 0)
+	ti.PKColumns = []int{0}
+	si := &SchemaInfo{
+		tables:  map[string]*TableInfo{"a": ti},
+		queries: cache.NewLRUCache(100),
+	}
+	for _, sql := range []string{"select * from a where id = 1", "select * from a where id = 1"} {
+		plan, err := si.GetPlan(sql)
+		if err != nil {
+			t.Fatal(sql, err)
+		}
+		plan.TableInfo.RecordMiss()
+	}
+	ti.RecordHit()
+	ti.RecordInvalidation()
+
+	expect := map[string]float64{
+		`plans{plan="PASS_SELECT",table="a"}`: 2,
+		`plan_cache_hits`:                     1,
+		`plan_cache_misses`:                   1,
+		`plan_cache_size`:                     1,
+		`rowcache_misses{table="a"}`:          2,
+		`rowcache_hits{table="a"}`:            1,
+		`rowcache_invalidations{table="a"}`:   1,
+	}
+	if fmt.Sprint(fm.reports) != fmt.Sprint(expect) {
+		t.Fatalf("%v, want %v", fm.reports, expect)
+	}
+
+	SetMetrics(nil)
+	ti.RecordHit()
+	if fm.reports[`rowcache_hits{table="a"}`] != 1 {
+		t.Fatal("reported after SetMetrics(nil)")
+	}
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	pm := NewPrometheusMetrics("cm")
+	pm.Counter("rowcache_hits", Labels{"table": "a"}, 2)
+	pm.Counter("rowcache_hits", Labels{"table": "a"}, 1)
+	pm.Counter("rowcache_hits", Labels{"table": `b"`}, 1)
+	pm.Counter("rowcache_hits", Labels{"table": "a"}, -1)
+	pm.Gauge("proxy_connections", nil, 3)
+	pm.Gauge("proxy_connections", nil, 2)
+	pm.Histogram("command_seconds", Labels{"command": "COM_QUERY"}, 0.002)
+	pm.Histogram("command_seconds", Labels{"command": "COM_QUERY"}, 20)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	pm.ServeHTTP(w, req)
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE cm_rowcache_hits counter",
+		`cm_rowcache_hits{table="a"} 3`,
+		`cm_rowcache_hits{table="b\""} 1`,
+		"# TYPE cm_proxy_connections gauge",
+		"cm_proxy_connections 2",
+		"# TYPE cm_command_seconds histogram",
+		`cm_command_seconds_bucket{command="COM_QUERY",le="0.001"} 0`,
+		`cm_command_seconds_bucket{command="COM_QUERY",le="0.005"} 1`,
+		`cm_command_seconds_bucket{command="COM_QUERY",le="10"} 1`,
+		`cm_command_seconds_bucket{command="COM_QUERY",le="+Inf"} 2`,
+		`cm_command_seconds_sum{command="COM_QUERY"} 20.002`,
+		`cm_command_seconds_count{command="COM_QUERY"} 2`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("%q misses %q", body, line)
+		}
+	}
+}
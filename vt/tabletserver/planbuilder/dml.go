@@ -6,17 +6,21 @@ package planbuilder
 
 import (
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ngaut/arena"
 	log "github.com/ngaut/logging"
+	"github.com/wandoulabs/cm/mysql"
 	"github.com/wandoulabs/cm/sqlparser"
+	"github.com/wandoulabs/cm/sqltypes"
 	"github.com/wandoulabs/cm/vt/schema"
 )
 
-func analyzeUpdate(upd *sqlparser.Update, getTable TableGetter, alloc arena.ArenaAllocator) (plan *ExecPlan, err error) {
-	plan = &ExecPlan{
-		PlanId:    PLAN_PASS_DML,
-		FullQuery: GenerateFullQuery(upd, alloc),
+func analyzeUpdate(upd *sqlparser.Update, getTable TableGetter, alloc arena.ArenaAllocator, classifyOnly bool) (plan *ExecPlan, err error) {
+	plan = &ExecPlan{PlanId: PLAN_PASS_DML}
+	if !classifyOnly {
+		plan.FullQuery = GenerateFullQuery(upd, alloc)
 	}
 
 	tableName := sqlparser.GetTableName(upd.Table)
@@ -28,6 +32,9 @@ func analyzeUpdate(upd *sqlparser.Update, getTable TableGetter, alloc arena.Aren
 	if err != nil {
 		return nil, err
 	}
+	if err := checkFullScan(upd.Where, tableInfo); err != nil {
+		return nil, err
+	}
 
 	if len(tableInfo.Indexes) == 0 || tableInfo.Indexes[0].Name != "PRIMARY" {
 		log.Warningf("no primary key for table %s", tableName)
@@ -35,6 +42,12 @@ func analyzeUpdate(upd *sqlparser.Update, getTable TableGetter, alloc arena.Aren
 		return plan, nil
 	}
 
+	plan.NoOp = isNoOpUpdate(upd.Exprs)
+	plan.UpdateColumns, plan.UpdateValues, err = analyzeUpdateColumns(upd.Exprs, tableInfo)
+	if err != nil {
+		return nil, err
+	}
+	plan.RewriteRows = canRewriteRows(upd, plan.UpdateColumns, tableInfo)
 	plan.SecondaryPKValues, err = analyzeUpdateExpressions(upd.Exprs, tableInfo.Indexes[0])
 	if err != nil {
 		if err == TooComplex {
@@ -44,7 +57,9 @@ func analyzeUpdate(upd *sqlparser.Update, getTable TableGetter, alloc arena.Aren
 		return nil, err
 	}
 
-	plan.OuterQuery = GenerateUpdateOuterQuery(upd, alloc)
+	if !classifyOnly {
+		plan.OuterQuery = GenerateUpdateOuterQuery(upd, alloc)
+	}
 
 	if conditions := analyzeWhere(upd.Where); conditions != nil {
 		pkValues, err := getPKValues(conditions, tableInfo.Indexes[0])
@@ -59,14 +74,16 @@ func analyzeUpdate(upd *sqlparser.Update, getTable TableGetter, alloc arena.Aren
 	}
 
 	plan.PlanId = PLAN_DML_SUBQUERY
-	plan.Subquery = GenerateUpdateSubquery(upd, tableInfo, alloc)
+	if !classifyOnly {
+		plan.Subquery = GenerateUpdateSubquery(upd, tableInfo, alloc)
+	}
 	return plan, nil
 }
 
-func analyzeDelete(del *sqlparser.Delete, getTable TableGetter, alloc arena.ArenaAllocator) (plan *ExecPlan, err error) {
-	plan = &ExecPlan{
-		PlanId:    PLAN_PASS_DML,
-		FullQuery: GenerateFullQuery(del, alloc),
+func analyzeDelete(del *sqlparser.Delete, getTable TableGetter, alloc arena.ArenaAllocator, classifyOnly bool) (plan *ExecPlan, err error) {
+	plan = &ExecPlan{PlanId: PLAN_PASS_DML}
+	if !classifyOnly {
+		plan.FullQuery = GenerateFullQuery(del, alloc)
 	}
 
 	tableName := sqlparser.GetTableName(del.Table)
@@ -78,6 +95,9 @@ func analyzeDelete(del *sqlparser.Delete, getTable TableGetter, alloc arena.Aren
 	if err != nil {
 		return nil, err
 	}
+	if err := checkFullScan(del.Where, tableInfo); err != nil {
+		return nil, err
+	}
 
 	if len(tableInfo.Indexes) == 0 || tableInfo.Indexes[0].Name != "PRIMARY" {
 		log.Warningf("no primary key for table %s", tableName)
@@ -85,7 +105,9 @@ func analyzeDelete(del *sqlparser.Delete, getTable TableGetter, alloc arena.Aren
 		return plan, nil
 	}
 
-	plan.OuterQuery = GenerateDeleteOuterQuery(del, alloc)
+	if !classifyOnly {
+		plan.OuterQuery = GenerateDeleteOuterQuery(del, alloc)
+	}
 
 	if conditions := analyzeWhere(del.Where); conditions != nil {
 		pkValues, err := getPKValues(conditions, tableInfo.Indexes[0])
@@ -100,7 +122,9 @@ func analyzeDelete(del *sqlparser.Delete, getTable TableGetter, alloc arena.Aren
 	}
 
 	plan.PlanId = PLAN_DML_SUBQUERY
-	plan.Subquery = GenerateDeleteSubquery(del, tableInfo, alloc)
+	if !classifyOnly {
+		plan.Subquery = GenerateDeleteSubquery(del, tableInfo, alloc)
+	}
 	return plan, nil
 }
 
@@ -124,13 +148,36 @@ func analyzeSet(set *sqlparser.Set, alloc arena.ArenaAllocator) (plan *ExecPlan)
 	} else if fval, err := strconv.ParseFloat(val, 64); err == nil {
 		plan.SetValue = fval
 	}
+	if strings.EqualFold(plan.SetKey, SessionQueryTimeout) {
+		plan.Timeout = sessionTimeout(plan.SetValue)
+	}
 	return plan
 }
 
+// sessionTimeout converts a proxy_query_timeout value in seconds to a
+// duration capped at MaxQueryTimeout. Zero or negative values reset
+// the session to the global timeout.
+func sessionTimeout(value interface{}) time.Duration {
+	var timeout time.Duration
+	switch v := value.(type) {
+	case int64:
+		timeout = time.Duration(v) * time.Second
+	case float64:
+		timeout = time.Duration(v * float64(time.Second))
+	}
+	if timeout < 0 {
+		timeout = 0
+	}
+	if MaxQueryTimeout > 0 && timeout > MaxQueryTimeout {
+		timeout = MaxQueryTimeout
+	}
+	return timeout
+}
+
 func analyzeUpdateExpressions(exprs sqlparser.UpdateExprs, pkIndex *schema.Index) (pkValues []interface{}, err error) {
 	for _, expr := range exprs {
 		index := pkIndex.FindColumn(sqlparser.GetColName(expr.Name))
-		if index == -1 {
+		if index == -1 || isSelfAssignment(expr) {
 			continue
 		}
 		if !sqlparser.IsValue(expr.Expr) {
@@ -148,3 +195,173 @@ func analyzeUpdateExpressions(exprs sqlparser.UpdateExprs, pkIndex *schema.Index
 	}
 	return pkValues, nil
 }
+
+// isNoOpUpdate tells if every expression of a SET clause assigns a
+// column to itself.
+func isNoOpUpdate(exprs sqlparser.UpdateExprs) bool {
+	for _, expr := range exprs {
+		if !isSelfAssignment(expr) {
+			return false
+		}
+	}
+	return len(exprs) > 0
+}
+
+// isSelfAssignment tells if expr is like col = col or t.col = col.
+func isSelfAssignment(expr *sqlparser.UpdateExpr) bool {
+	col, ok := expr.Expr.(*sqlparser.ColName)
+	if !ok || !strings.EqualFold(string(col.Name), string(expr.Name.Name)) {
+		return false
+	}
+	return col.Qualifier == nil || expr.Name.Qualifier == nil || strings.EqualFold(string(col.Qualifier), string(expr.Name.Qualifier))
+}
+
+// ColumnKind tells how changing a column affects its cached rows.
+type ColumnKind int
+
+const (
+	// COLUMN_PK is a primary key column, the row moves to another key.
+	COLUMN_PK ColumnKind = iota
+	// COLUMN_CACHED is any other column, the cached rows are full rows.
+	COLUMN_CACHED
+)
+
+var columnKindName = []string{
+	"PK",
+	"CACHED",
+}
+
+func (kind ColumnKind) String() string {
+	return columnKindName[kind]
+}
+
+// UpdateColumn is a column of the set clause of an update.
+type UpdateColumn struct {
+	Name string
+	Kind ColumnKind
+	// Complex is set if the column is set to an expression, whose value
+	// is only known to the backend.
+	Complex bool
+}
+
+// analyzeUpdateColumns classifies the columns of a set clause and
+// extracts the values they are set to.
+func analyzeUpdateColumns(exprs sqlparser.UpdateExprs, tableInfo *schema.Table) ([]UpdateColumn, []interface{}, error) {
+	pkIndex := tableInfo.Indexes[0]
+	columns := make([]UpdateColumn, 0, len(exprs))
+	values := make([]interface{}, 0, len(exprs))
+	for _, expr := range exprs {
+		col := UpdateColumn{Name: sqlparser.GetColName(expr.Name), Kind: COLUMN_CACHED}
+		if pkIndex.FindColumn(col.Name) != -1 {
+			col.Kind = COLUMN_PK
+		}
+
+		var value interface{}
+		switch expr.Expr.(type) {
+		case sqlparser.StrVal, sqlparser.NumVal, sqlparser.ValArg, *sqlparser.NullVal:
+			v, err := sqlparser.AsInterface(expr.Expr)
+			if err != nil {
+				return nil, nil, err
+			}
+			value = v
+		default:
+			col.Complex = true
+		}
+		columns = append(columns, col)
+		values = append(values, value)
+	}
+	return columns, values, nil
+}
+
+// canRewriteRows tells if the cached rows an update of upd changes can
+// be rewritten with the values it sets rather than invalidated: its
+// where clause is on the pk only, it has no limit and sets columns
+// other than the pk to plain values, and no column of the table changes
+// along with them.
+func canRewriteRows(upd *sqlparser.Update, columns []UpdateColumn, table *schema.Table) bool {
+	if upd.Limit != nil || len(columns) == 0 {
+		return false
+	}
+	for _, col := range columns {
+		if col.Kind != COLUMN_CACHED || col.Complex {
+			return false
+		}
+		i := table.FindColumn(col.Name)
+		if i == -1 || !rewritableType(table.Columns[i]) {
+			return false
+		}
+	}
+	for _, col := range table.Columns {
+		if col.IsGenerated || col.OnUpdate {
+			return false
+		}
+	}
+	return true
+}
+
+// rewritableType tells if the values of col are stored as they are
+// written, for the types of rewritableValue.
+func rewritableType(col schema.TableColumn) bool {
+	switch col.SqlType {
+	case mysql.MYSQL_TYPE_TINY, mysql.MYSQL_TYPE_SHORT, mysql.MYSQL_TYPE_INT24, mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_LONGLONG:
+		return !strings.Contains(col.Type, "zerofill")
+	case mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VAR_STRING:
+		return col.Length > 0
+	}
+	return false
+}
+
+// integerBits are the sizes of the integer types.
+var integerBits = map[byte]uint{
+	mysql.MYSQL_TYPE_TINY:     8,
+	mysql.MYSQL_TYPE_SHORT:    16,
+	mysql.MYSQL_TYPE_INT24:    24,
+	mysql.MYSQL_TYPE_LONG:     32,
+	mysql.MYSQL_TYPE_LONGLONG: 64,
+}
+
+// rewritableValue tells if v is stored in col as it is: integers in the
+// range of the column, ascii strings no longer than it. The others may
+// be converted, truncated or clipped by the backend.
+func rewritableValue(col schema.TableColumn, v sqltypes.Value) bool {
+	if bits, ok := integerBits[col.SqlType]; ok {
+		if !v.IsNumeric() {
+			return false
+		}
+		if col.IsUnsigned {
+			n, err := v.ParseUint64()
+			return err == nil && (bits == 64 || n < 1<<bits)
+		}
+		n, err := v.ParseInt64()
+		return err == nil && (bits == 64 || (n >= -1<<(bits-1) && n < 1<<(bits-1)))
+	}
+	if !v.IsString() {
+		return false
+	}
+	raw := v.Raw()
+	for _, b := range raw {
+		if b >= 0x80 {
+			return false
+		}
+	}
+	return len(raw) <= col.Length
+}
+
+// RowUpdate returns the columns, by index in table, and the values a
+// bound update sets if RewriteRows is set and the values are stored as
+// they are. ok is false if the cached rows must be invalidated instead.
+func (node *ExecPlan) RowUpdate(table *schema.Table) (columns []int, values []sqltypes.Value, ok bool) {
+	if !node.RewriteRows || node.PlanId != PLAN_DML_PK {
+		return nil, nil, false
+	}
+	for i, col := range node.UpdateColumns {
+		v, isValue := node.UpdateValues[i].(sqltypes.Value)
+		index := table.FindColumn(col.Name)
+		if !isValue || index == -1 || !rewritableValue(table.Columns[index], v) {
+			return nil, nil, false
+		}
+		columns = append(columns, index)
+		values = append(values, v)
+	}
+	return columns, values, true
+}
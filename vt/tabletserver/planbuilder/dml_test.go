@@ -0,0 +1,222 @@
+package planbuilder
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ngaut/arena"
+	"github.com/wandoulabs/cm/sqlparser"
+	"github.com/wandoulabs/cm/sqltypes"
+	"github.com/wandoulabs/cm/vt/schema"
+)
+
+func TestSessionQueryTimeout(t *testing.T) {
+	defer func(max time.Duration) { MaxQueryTimeout = max }(MaxQueryTimeout)
+	MaxQueryTimeout = 10 * time.Second
+
+	cases := []struct {
+		sql     string
+		timeout time.Duration
+	}{
+		{"set proxy_query_timeout = 2", 2 * time.Second},
+		{"set PROXY_QUERY_TIMEOUT = 0.5", 500 * time.Millisecond},
+		{"set proxy_query_timeout = 60", 10 * time.Second},
+		{"set proxy_query_timeout = 0", 0},
+		{"set proxy_query_timeout = -1", 0},
+		{"set autocommit = 1", 0},
+	}
+	for _, c := range cases {
+		plan := getTestPlan(t, c.sql)
+		if plan.PlanId != PLAN_SET || plan.Timeout != c.timeout {
+			t.Fatal(c.sql, plan.PlanId, plan.Timeout)
+		}
+	}
+}
+
+func TestNoOpUpdate(t *testing.T) {
+	cases := []struct {
+		sql    string
+		planId PlanType
+		noOp   bool
+	}{
+		{"update t set name = name where id = 1", PLAN_DML_PK, true},
+		{"update t set name = t.name, email = EMAIL where id = 1", PLAN_DML_PK, true},
+		{"update t set id = id where id = 1", PLAN_DML_PK, true},
+		{"update t set name = 'a' where id = 1", PLAN_DML_PK, false},
+		{"update t set name = name, email = 'b' where id = 1", PLAN_DML_PK, false},
+		{"update t set name = email where id = 1", PLAN_DML_PK, false},
+		{"update t set id = 2 where id = 1", PLAN_DML_PK, false},
+	}
+	for _, c := range cases {
+		plan := getTestPlan(t, c.sql)
+		if plan.PlanId != c.planId || plan.NoOp != c.noOp {
+			t.Fatal(c.sql, plan.PlanId, plan.Reason, plan.NoOp)
+		}
+	}
+}
+
+func TestUpdateColumns(t *testing.T) {
+	cases := []struct {
+		sql     string
+		columns []UpdateColumn
+		values  []interface{}
+	}{
+		// columns of the cached rows, which are full rows
+		{"update t set name = 'a' where id = 1", []UpdateColumn{{"name", COLUMN_CACHED, false}}, []interface{}{sqltypes.MakeString([]byte("a"))}},
+		{"update t set name = :name, email = null where id = 1", []UpdateColumn{{"name", COLUMN_CACHED, false}, {"email", COLUMN_CACHED, false}}, []interface{}{":name", nil}},
+		{"update t set name = concat(name, 'x') where id = 1", []UpdateColumn{{"name", COLUMN_CACHED, true}}, []interface{}{nil}},
+		// the pk
+		{"update t set id = 2 where id = 1", []UpdateColumn{{"id", COLUMN_PK, false}}, []interface{}{sqltypes.MakeNumeric([]byte("2"))}},
+	}
+	for _, c := range cases {
+		plan := getTestPlan(t, c.sql)
+		if !reflect.DeepEqual(plan.UpdateColumns, c.columns) || !reflect.DeepEqual(plan.UpdateValues, c.values) {
+			t.Fatalf("%s: %v %v", c.sql, plan.UpdateColumns, plan.UpdateValues)
+		}
+	}
+
+	// prepared updates bind their values
+	plan := getTestPlan(t, "update t set name = :v1 where id = :v2")
+	bound, err := plan.Bind(map[string]interface{}{"v1": "a", "v2": int64(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := bound.UpdateValues[0].(sqltypes.Value); !ok || v.String() != "a" || plan.UpdateValues[0] != ":v1" {
+		t.Fatal(bound.UpdateValues, plan.UpdateValues)
+	}
+}
+
+func TestRowUpdate(t *testing.T) {
+	// u has a column set on every update
+	getTable := func(name string) (*schema.Table, bool) {
+		if name != "u" {
+			return testGetTable(name)
+		}
+		ta := newTestTable()
+		ta.Name = "u"
+		ta.AddColumn("mtime", "timestamp", "", nil, "on update CURRENT_TIMESTAMP")
+		return ta, true
+	}
+
+	cases := []struct {
+		sql     string
+		columns []int
+		values  []string
+	}{
+		{"update t set name = 'a' where id = 1", []int{1}, []string{"a"}},
+		{"update t set email = 'b', name = 'a' where id in (1, 2)", []int{2, 1}, []string{"b", "a"}},
+		// too long, non ascii, null, a number into a string, computed
+		{"update t set name = '012345678901234567890123456789012' where id = 1", nil, nil},
+		{"update t set name = 'é' where id = 1", nil, nil},
+		{"update t set name = null where id = 1", nil, nil},
+		{"update t set name = 1 where id = 1", nil, nil},
+		{"update t set name = concat(name, 'x') where id = 1", nil, nil},
+		// the pk, a limit, not by pk, an on update column
+		{"update t set id = 2 where id = 1", nil, nil},
+		{"update t set name = 'a' where id = 1 limit 1", nil, nil},
+		{"update t set name = 'a' where email = 'b'", nil, nil},
+		{"update u set name = 'a' where id = 1", nil, nil},
+	}
+	for _, c := range cases {
+		plan, err := GetSqlExecPlan(c.sql, getTable, arena.NewArenaAllocator(1024))
+		if err != nil {
+			t.Fatal(c.sql, err)
+		}
+		table, _ := getTable(plan.TableName)
+		columns, values, ok := plan.RowUpdate(table)
+		if ok != (c.columns != nil) || !reflect.DeepEqual(columns, c.columns) {
+			t.Fatal(c.sql, columns, ok)
+		}
+		for i, v := range values {
+			if v.String() != c.values[i] {
+				t.Fatal(c.sql, values)
+			}
+		}
+	}
+
+	// integers must fit their column, prepared values are bound
+	ta := newTestTable()
+	plan := getTestPlan(t, "update t set name = :v1 where id = :v2")
+	if _, _, ok := plan.RowUpdate(ta); ok {
+		t.Fatal("unbound values rewritten")
+	}
+	bound, err := plan.Bind(map[string]interface{}{"v1": "a", "v2": int64(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if columns, _, ok := bound.RowUpdate(ta); !ok || !reflect.DeepEqual(columns, []int{1}) {
+		t.Fatal(columns, ok)
+	}
+	ta.AddColumn("n", "tinyint(3) unsigned", "", nil, "")
+	for v, fits := range map[string]bool{"255": true, "256": false, "-1": false} {
+		plan, err := GetSqlExecPlan("update t set n = "+v+" where id = 1", func(string) (*schema.Table, bool) { return ta, true }, arena.NewArenaAllocator(1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, ok := plan.RowUpdate(ta); ok != fits {
+			t.Fatal(v, ok)
+		}
+	}
+}
+
+func TestUpdateOrderByLimit(t *testing.T) {
+	plan := getTestPlan(t, "update t set name = 'a' where email = 'b' order by name limit 5")
+	if plan.PlanId != PLAN_DML_SUBQUERY {
+		t.Fatal(plan.PlanId, plan.Reason)
+	}
+	if q := plan.Subquery.Query; q != "select id from t where email = 'b' order by name asc limit 5 for update" {
+		t.Fatal(q)
+	}
+	sql, err := GenerateBoundQuery(plan.OuterQuery, map[string]interface{}{
+		"#pk": sqlparser.TupleEqualityList{
+			Columns: []string{"id"},
+			Rows:    [][]sqltypes.Value{{sqltypes.MakeNumeric([]byte("1"))}, {sqltypes.MakeNumeric([]byte("2"))}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sql != "update t set name = 'a' where id in (1, 2) order by name asc limit 5" {
+		t.Fatal(sql)
+	}
+
+	// the pk values may match more rows than the limit
+	plan = getTestPlan(t, "update t set name = 'a' where id in (1, 2, 3) order by name limit :n")
+	if plan.PlanId != PLAN_DML_PK || len(plan.PKValues) != 1 {
+		t.Fatal(plan.PlanId, plan.PKValues)
+	}
+	if q := plan.OuterQuery.Query; q != "update t set name = 'a' where :#pk order by name asc limit :n" {
+		t.Fatal(q)
+	}
+}
+
+func TestDeleteOrderByLimit(t *testing.T) {
+	plan := getTestPlan(t, "delete from t where email = 'b' order by name limit 5")
+	if plan.PlanId != PLAN_DML_SUBQUERY {
+		t.Fatal(plan.PlanId, plan.Reason)
+	}
+	if q := plan.Subquery.Query; q != "select id from t where email = 'b' order by name asc limit 5 for update" {
+		t.Fatal(q)
+	}
+	sql, err := GenerateBoundQuery(plan.OuterQuery, map[string]interface{}{
+		"#pk": sqlparser.TupleEqualityList{
+			Columns: []string{"id"},
+			Rows:    [][]sqltypes.Value{{sqltypes.MakeNumeric([]byte("1"))}, {sqltypes.MakeNumeric([]byte("2"))}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sql != "delete from t where id in (1, 2) order by name asc limit 5" {
+		t.Fatal(sql)
+	}
+
+	plan = getTestPlan(t, "delete from t where id in (1, 2, 3) order by name desc limit 1")
+	if plan.PlanId != PLAN_DML_PK || len(plan.PKValues) != 1 {
+		t.Fatal(plan.PlanId, plan.PKValues)
+	}
+	if q := plan.OuterQuery.Query; q != "delete from t where :#pk order by name desc limit 1" {
+		t.Fatal(q)
+	}
+}
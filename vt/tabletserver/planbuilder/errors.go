@@ -0,0 +1,39 @@
+package planbuilder
+
+import (
+	"github.com/juju/errors"
+	"github.com/wandoulabs/cm/mysql"
+)
+
+// mysqlErrors maps the planner errors to the MySQL error codes clients
+// know them by.
+var mysqlErrors = map[error]uint16{
+	ErrTableNotFound: mysql.ER_NO_SUCH_TABLE,
+	ErrBadField:      mysql.ER_BAD_FIELD_ERROR,
+	ErrColumnCount:   mysql.ER_WRONG_VALUE_COUNT_ON_ROW,
+	TooComplex:       mysql.ER_NOT_SUPPORTED_YET,
+	ErrRowSubquery:   mysql.ER_NOT_SUPPORTED_YET,
+	// rejected by the configuration of the proxy
+	ErrFullScan:     mysql.ER_NOT_SUPPORTED_YET,
+	ErrCoercedJoin:  mysql.ER_NOT_SUPPORTED_YET,
+	ErrSelectInto:   mysql.ER_NOT_SUPPORTED_YET,
+	ErrBlockedQuery: mysql.ER_NOT_SUPPORTED_YET,
+	// 08S01, clients take it for a lost connection and can fail over
+	ErrMaintenance: mysql.ER_SERVER_SHUTDOWN,
+}
+
+// MySQLError translates err into the code, SQLSTATE and message of a
+// MySQL error packet. A *mysql.SqlError keeps its own, errors the
+// planner doesn't know are ER_UNKNOWN_ERROR.
+func MySQLError(err error) (code uint16, sqlstate string, msg string) {
+	cause := errors.Cause(err)
+	if e, ok := cause.(*mysql.SqlError); ok {
+		return e.Code, e.State, e.Message
+	}
+	code, ok := mysqlErrors[cause]
+	if !ok {
+		code = mysql.ER_UNKNOWN_ERROR
+	}
+	e := mysql.NewError(code, err.Error())
+	return e.Code, e.State, e.Message
+}
@@ -0,0 +1,47 @@
+package planbuilder
+
+import (
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/arena"
+	"github.com/wandoulabs/cm/mysql"
+)
+
+func TestMySQLError(t *testing.T) {
+	cases := []struct {
+		err   error
+		code  uint16
+		state string
+		msg   string
+	}{
+		{errors.Annotatef(ErrTableNotFound, "table a"), mysql.ER_NO_SUCH_TABLE, "42S02", "table a: not found in schema"},
+		{errors.Annotatef(ErrBadField, "column c in table a"), mysql.ER_BAD_FIELD_ERROR, "42S22", "column c in table a: unknown column"},
+		{ErrColumnCount, mysql.ER_WRONG_VALUE_COUNT_ON_ROW, "21S01", "column count doesn't match value count"},
+		{TooComplex, mysql.ER_NOT_SUPPORTED_YET, "42000", "Complex"},
+		{errors.Trace(ErrRowSubquery), mysql.ER_NOT_SUPPORTED_YET, "42000", "row subquery not supported for inserts"},
+		{ErrFullScan, mysql.ER_NOT_SUPPORTED_YET, "42000", "full table scan rejected"},
+		{ErrCoercedJoin, mysql.ER_NOT_SUPPORTED_YET, "42000", "join on columns of incompatible types"},
+		{ErrSelectInto, mysql.ER_NOT_SUPPORTED_YET, "42000", "select into a file rejected"},
+		{ErrBlockedQuery, mysql.ER_NOT_SUPPORTED_YET, "42000", "query blocked by policy"},
+		{ErrMaintenance, mysql.ER_SERVER_SHUTDOWN, "08S01", "server in maintenance"},
+		{errors.Trace(mysql.ErrTooManyRows), mysql.ER_QUERY_INTERRUPTED, "70100", mysql.ErrTooManyRows.Message},
+		{errors.New("boom"), mysql.ER_UNKNOWN_ERROR, "HY000", "boom"},
+	}
+	for _, c := range cases {
+		code, state, msg := MySQLError(c.err)
+		if code != c.code || state != c.state || msg != c.msg {
+			t.Fatalf("%v: %d %s %q", c.err, code, state, msg)
+		}
+	}
+
+	// as the planner returns them
+	_, err := GetSqlExecPlan("select * from nosuchtable", testGetTable, arena.NewArenaAllocator(1024))
+	if code, _, _ := MySQLError(err); code != mysql.ER_NO_SUCH_TABLE {
+		t.Fatal(err, code)
+	}
+	_, err = GetSqlExecPlan("select nosuchcolumn from t where id = 1", testGetTable, arena.NewArenaAllocator(1024))
+	if code, _, _ := MySQLError(err); code != mysql.ER_BAD_FIELD_ERROR {
+		t.Fatal(err, code)
+	}
+}
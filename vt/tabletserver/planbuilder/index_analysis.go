@@ -5,6 +5,7 @@
 package planbuilder
 
 import (
+	"github.com/juju/errors"
 	"github.com/wandoulabs/cm/hack"
 	"github.com/wandoulabs/cm/sqlparser"
 	"github.com/wandoulabs/cm/vt/schema"
@@ -88,6 +89,9 @@ func getPKValues(conditions []sqlparser.BoolExpr, pkIndex *schema.Index) (pkValu
 			if err != nil {
 				return nil, err
 			}
+			if list, ok := pkValues[index].([]interface{}); ok {
+				pkValues[index] = dropNulls(list)
+			}
 		default:
 			panic("unreachable")
 		}
@@ -100,6 +104,76 @@ func getPKValues(conditions []sqlparser.BoolExpr, pkIndex *schema.Index) (pkValu
 	return nil, nil
 }
 
+// missingPKColumns returns the pk columns conditions don't restrict with
+// = or IN when they do restrict others, nil if they restrict none.
+func missingPKColumns(conditions []sqlparser.BoolExpr, pkIndex *schema.Index) []string {
+	matched := make([]bool, len(pkIndex.Columns))
+	partial := false
+	for _, condition := range conditions {
+		condition, ok := condition.(*sqlparser.ComparisonExpr)
+		if !ok || !sqlparser.StringIn(condition.Operator, sqlparser.AST_EQ, sqlparser.AST_IN) {
+			continue
+		}
+		if index := pkIndex.FindColumn(hack.String(condition.Left.(*sqlparser.ColName).Name)); index != -1 {
+			matched[index] = true
+			partial = true
+		}
+	}
+	if !partial {
+		return nil
+	}
+
+	var missing []string
+	for i, m := range matched {
+		if !m {
+			missing = append(missing, pkIndex.Columns[i])
+		}
+	}
+	return missing
+}
+
+// dropNulls removes NULLs from an IN list, they can't match a pk.
+func dropNulls(list []interface{}) []interface{} {
+	vals := list[:0]
+	for _, v := range list {
+		if v != nil {
+			vals = append(vals, v)
+		}
+	}
+	return vals
+}
+
+// checkFullScan returns ErrFullScan if the table is larger than
+// MaxFullScanRows and no condition of the where clause is on the
+// leading column of an index. Clauses too complex to analyze are
+// let through.
+func checkFullScan(where *sqlparser.Where, table *schema.Table) error {
+	if MaxFullScanRows == 0 || table.EstimatedRows <= MaxFullScanRows {
+		return nil
+	}
+	if where != nil {
+		conditions := analyzeWhere(where)
+		if conditions == nil {
+			return nil
+		}
+		for _, condition := range conditions {
+			var col string
+			switch condition := condition.(type) {
+			case *sqlparser.ComparisonExpr:
+				col = string(condition.Left.(*sqlparser.ColName).Name)
+			case *sqlparser.RangeCond:
+				col = string(condition.Left.(*sqlparser.ColName).Name)
+			}
+			for _, index := range table.Indexes {
+				if len(index.Columns) > 0 && index.Columns[0] == col {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.Annotatef(ErrFullScan, "table %s", table.Name)
+}
+
 func getIndexMatch(conditions []sqlparser.BoolExpr, indexes []*schema.Index) *schema.Index {
 	indexScores := NewIndexScoreList(indexes)
 	for _, condition := range conditions {
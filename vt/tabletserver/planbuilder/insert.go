@@ -5,18 +5,19 @@
 package planbuilder
 
 import (
-	"errors"
+	"strings"
 
 	"github.com/ngaut/arena"
 	log "github.com/ngaut/logging"
 	"github.com/wandoulabs/cm/sqlparser"
+	"github.com/wandoulabs/cm/sqltypes"
 	"github.com/wandoulabs/cm/vt/schema"
 )
 
-func analyzeReplace(ins *sqlparser.Replace, getTable TableGetter, alloc arena.ArenaAllocator) (plan *ExecPlan, err error) {
-	plan = &ExecPlan{
-		PlanId:    PLAN_PASS_DML,
-		FullQuery: GenerateFullQuery(ins, alloc),
+func analyzeReplace(ins *sqlparser.Replace, getTable TableGetter, alloc arena.ArenaAllocator, classifyOnly bool) (plan *ExecPlan, err error) {
+	plan = &ExecPlan{PlanId: PLAN_PASS_DML}
+	if !classifyOnly {
+		plan.FullQuery = GenerateFullQuery(ins, alloc)
 	}
 	tableName := sqlparser.GetTableName(ins.Table)
 	if tableName == "" {
@@ -34,6 +35,12 @@ func analyzeReplace(ins *sqlparser.Replace, getTable TableGetter, alloc arena.Ar
 		return plan, nil
 	}
 
+	if hasGeneratedPK(tableInfo) {
+		// The server computes those pk values, we can't write them through.
+		plan.Reason = REASON_GENERATED_PK
+		return plan, nil
+	}
+
 	pkColumnNumbers := getInsertPKColumns(ins.Columns, tableInfo)
 
 	if ins.OnDup != nil {
@@ -45,8 +52,10 @@ func analyzeReplace(ins *sqlparser.Replace, getTable TableGetter, alloc arena.Ar
 
 	if sel, ok := ins.Rows.(sqlparser.SelectStatement); ok {
 		plan.PlanId = PLAN_INSERT_SUBQUERY
-		plan.OuterQuery = GenerateReplaceOuterQuery(ins, alloc)
-		plan.Subquery = GenerateSelectLimitQuery(sel, alloc)
+		if !classifyOnly {
+			plan.OuterQuery = GenerateReplaceOuterQuery(ins, alloc)
+			plan.Subquery = GenerateSelectLimitQuery(sel, alloc)
+		}
 		if len(ins.Columns) != 0 {
 			plan.ColumnNumbers, err = analyzeSelectExprs(sqlparser.SelectExprs(ins.Columns), tableInfo)
 			if err != nil {
@@ -78,10 +87,10 @@ func analyzeReplace(ins *sqlparser.Replace, getTable TableGetter, alloc arena.Ar
 	return plan, nil
 }
 
-func analyzeInsert(ins *sqlparser.Insert, getTable TableGetter, alloc arena.ArenaAllocator) (plan *ExecPlan, err error) {
-	plan = &ExecPlan{
-		PlanId:    PLAN_PASS_DML,
-		FullQuery: GenerateFullQuery(ins, alloc),
+func analyzeInsert(ins *sqlparser.Insert, getTable TableGetter, alloc arena.ArenaAllocator, classifyOnly bool) (plan *ExecPlan, err error) {
+	plan = &ExecPlan{PlanId: PLAN_PASS_DML, Ignore: ins.Ignore}
+	if !classifyOnly {
+		plan.FullQuery = GenerateFullQuery(ins, alloc)
 	}
 	tableName := sqlparser.GetTableName(ins.Table)
 	if tableName == "" {
@@ -99,19 +108,34 @@ func analyzeInsert(ins *sqlparser.Insert, getTable TableGetter, alloc arena.Aren
 		return plan, nil
 	}
 
+	if hasGeneratedPK(tableInfo) {
+		// The server computes those pk values, we can't write them through.
+		plan.Reason = REASON_GENERATED_PK
+		return plan, nil
+	}
+
 	pkColumnNumbers := getInsertPKColumns(ins.Columns, tableInfo)
 
 	if ins.OnDup != nil {
-		// Upserts are not safe for statement based replication:
-		// http://bugs.mysql.com/bug.php?id=58637
-		plan.Reason = REASON_UPSERT
-		return plan, nil
+		// The row an upsert updates is the one its pk values conflict
+		// with, unless they come from a select or another unique key
+		// may conflict instead.
+		if _, ok := ins.Rows.(sqlparser.SelectStatement); ok || tableInfo.HasUniqueKeys {
+			plan.Reason = REASON_UPSERT
+			return plan, nil
+		}
+		if changesPK(ins.OnDup, tableInfo.Indexes[0]) {
+			plan.Reason = REASON_PK_CHANGE
+			return plan, nil
+		}
 	}
 
 	if sel, ok := ins.Rows.(sqlparser.SelectStatement); ok {
 		plan.PlanId = PLAN_INSERT_SUBQUERY
-		plan.OuterQuery = GenerateInsertOuterQuery(ins, alloc)
-		plan.Subquery = GenerateSelectLimitQuery(sel, alloc)
+		if !classifyOnly {
+			plan.OuterQuery = GenerateInsertOuterQuery(ins, alloc)
+			plan.Subquery = GenerateSelectLimitQuery(sel, alloc)
+		}
 		if len(ins.Columns) != 0 {
 			plan.ColumnNumbers, err = analyzeSelectExprs(sqlparser.SelectExprs(ins.Columns), tableInfo)
 			if err != nil {
@@ -143,6 +167,36 @@ func analyzeInsert(ins *sqlparser.Insert, getTable TableGetter, alloc arena.Aren
 	return plan, nil
 }
 
+func hasGeneratedPK(tableInfo *schema.Table) bool {
+	for _, col := range tableInfo.PKColumns {
+		if tableInfo.Columns[col].IsGenerated {
+			return true
+		}
+	}
+	return false
+}
+
+// changesPK reports whether the ON DUPLICATE KEY UPDATE of an upsert
+// may move the conflicting row to another pk. Setting a pk column to
+// VALUES() of itself doesn't, it already holds that value.
+func changesPK(onDup sqlparser.OnDup, pkIndex *schema.Index) bool {
+	for _, expr := range onDup {
+		name := sqlparser.GetColName(expr.Name)
+		if pkIndex.FindColumn(name) == -1 {
+			continue
+		}
+		fn, ok := expr.Expr.(*sqlparser.FuncExpr)
+		if !ok || !strings.EqualFold(string(fn.Name), "values") || len(fn.Exprs) != 1 {
+			return true
+		}
+		arg, ok := fn.Exprs[0].(*sqlparser.NonStarExpr)
+		if !ok || !strings.EqualFold(sqlparser.GetColName(arg.Expr), name) {
+			return true
+		}
+	}
+	return false
+}
+
 func getInsertPKColumns(columns sqlparser.Columns, tableInfo *schema.Table) (pkColumnNumbers []int) {
 	if len(columns) == 0 {
 		return tableInfo.PKColumns
@@ -166,17 +220,25 @@ func getInsertPKValues(pkColumnNumbers []int, rowList sqlparser.Values, tableInf
 	pkValues = make([]interface{}, len(pkColumnNumbers))
 	for index, columnNumber := range pkColumnNumbers {
 		if columnNumber == -1 {
-			pkValues[index] = tableInfo.GetPKColumn(index).Default
+			// an omitted pk column gets its default, without one the
+			// server generates it
+			def := tableInfo.GetPKColumn(index).Default
+			if def == nil {
+				return nil, nil
+			}
+			if pkValues[index], err = sqltypes.BuildValue(def); err != nil {
+				return nil, err
+			}
 			continue
 		}
 		values := make([]interface{}, len(rowList))
 		for j := 0; j < len(rowList); j++ {
 			if _, ok := rowList[j].(*sqlparser.Subquery); ok {
-				return nil, errors.New("row subquery not supported for inserts")
+				return nil, ErrRowSubquery
 			}
 			row := rowList[j].(sqlparser.ValTuple)
 			if columnNumber >= len(row) {
-				return nil, errors.New("column count doesn't match value count")
+				return nil, ErrColumnCount
 			}
 			node := row[columnNumber]
 			if !sqlparser.IsValue(node) {
@@ -0,0 +1,148 @@
+package planbuilder
+
+import (
+	"testing"
+
+	"github.com/ngaut/arena"
+	"github.com/wandoulabs/cm/sqltypes"
+	"github.com/wandoulabs/cm/vt/schema"
+)
+
+func TestInsertGeneratedPK(t *testing.T) {
+	getTable := func(name string) (*schema.Table, bool) {
+		ta := schema.NewTable(name)
+		ta.AddColumn("a", "int(11)", "", nil, "")
+		ta.AddColumn("b", "int(11)", "", nil, "")
+		switch name {
+		case "stored":
+			ta.AddColumn("c", "int(11)", "", nil, "STORED GENERATED")
+		case "virtual":
+			ta.AddColumn("c", "int(11)", "", nil, "VIRTUAL GENERATED")
+		default:
+			return nil, false
+		}
+		pk := ta.AddIndex("PRIMARY")
+		pk.AddColumn("a", 0)
+		pk.AddColumn("c", 0)
+		ta.PKColumns = []int{0, 2}
+		ta.CacheType = schema.CACHE_RW
+		return ta, true
+	}
+
+	for _, sql := range []string{
+		"insert into stored(a, b) values (1, 2)",
+		"insert into virtual(a, b) values (1, 2)",
+		"replace into stored(a, b) values (1, 2)",
+	} {
+		plan, err := GetSqlExecPlan(sql, getTable, arena.NewArenaAllocator(1024))
+		if err != nil {
+			t.Fatal(sql, err)
+		}
+		if plan.PlanId != PLAN_PASS_DML || plan.Reason != REASON_GENERATED_PK || plan.PKValues != nil {
+			t.Fatal(sql, plan.PlanId, plan.Reason, plan.PKValues)
+		}
+	}
+
+	plan := getTestPlan(t, "insert into t(id, name) values (1, 'a')")
+	if plan.PlanId != PLAN_INSERT_PK {
+		t.Fatal(plan.PlanId, plan.Reason)
+	}
+}
+
+func TestInsertIgnore(t *testing.T) {
+	plan := getTestPlan(t, "insert ignore into t(id, name) values (1, 'a')")
+	if plan.PlanId != PLAN_INSERT_PK || !plan.Ignore {
+		t.Fatal(plan.PlanId, plan.Reason, plan.Ignore)
+	}
+	if q := plan.OuterQuery.Query; q != "insert ignore into t(id, name) values (1, 'a')" {
+		t.Fatal(q)
+	}
+
+	plan = getTestPlan(t, "insert ignore into t(id, name) select id, name from t where id = 1")
+	if plan.PlanId != PLAN_INSERT_SUBQUERY || !plan.Ignore {
+		t.Fatal(plan.PlanId, plan.Reason, plan.Ignore)
+	}
+	if q := plan.OuterQuery.Query; q != "insert ignore into t(id, name) values :#values" {
+		t.Fatal(q)
+	}
+
+	if plan := getTestPlan(t, "insert into t(id, name) values (1, 'a')"); plan.Ignore {
+		t.Fatal(plan.Ignore)
+	}
+}
+
+func TestInsertOnDupValues(t *testing.T) {
+	sql := "insert into t(id, name) values (1, 'a'), (2, 'b') on duplicate key update name = values(name)"
+	plan := getTestPlan(t, sql)
+	if plan.PlanId != PLAN_INSERT_PK {
+		t.Fatal(plan.PlanId, plan.Reason)
+	}
+	if pks, ok := plan.PKValues[0].([]interface{}); !ok || len(pks) != 2 {
+		t.Fatal(plan.PKValues)
+	}
+	if q := plan.OuterQuery.Query; q != sql {
+		t.Fatal(q)
+	}
+
+	// the conflicting row keeps its pk
+	plan = getTestPlan(t, "insert into t(id, name) values (1, 'a') on duplicate key update id = VALUES(id), name = values(name)")
+	if plan.PlanId != PLAN_INSERT_PK {
+		t.Fatal(plan.PlanId, plan.Reason)
+	}
+
+	for _, sql := range []string{
+		"insert into t(id, name) values (1, 'a') on duplicate key update id = id + 1",
+		"insert into t(id, name) values (1, 'a') on duplicate key update id = values(name)",
+	} {
+		if plan := getTestPlan(t, sql); plan.PlanId != PLAN_PASS_DML || plan.Reason != REASON_PK_CHANGE {
+			t.Fatal(sql, plan.PlanId, plan.Reason)
+		}
+	}
+
+	plan = getTestPlan(t, "insert into t(id, name) select id, name from t where id = 1 on duplicate key update name = values(name)")
+	if plan.PlanId != PLAN_PASS_DML || plan.Reason != REASON_UPSERT {
+		t.Fatal(plan.PlanId, plan.Reason)
+	}
+
+	// another unique key may be the one conflicting
+	getTable := func(name string) (*schema.Table, bool) {
+		ta := newTestTable()
+		ta.HasUniqueKeys = true
+		return ta, name == "t"
+	}
+	plan, err := GetSqlExecPlan(sql, getTable, arena.NewArenaAllocator(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.PlanId != PLAN_PASS_DML || plan.Reason != REASON_UPSERT {
+		t.Fatal(plan.PlanId, plan.Reason)
+	}
+}
+
+func TestInsertOmittedPK(t *testing.T) {
+	// id is auto incremented, the server picks it
+	plan := getTestPlan(t, "insert into t(name) values ('a') on duplicate key update name = values(name)")
+	if plan.PlanId != PLAN_PASS_DML || plan.PKValues != nil {
+		t.Fatal(plan.PlanId, plan.PKValues)
+	}
+
+	getTable := func(name string) (*schema.Table, bool) {
+		ta := schema.NewTable(name)
+		ta.AddColumn("id", "int(11)", "", []byte("7"), "")
+		ta.AddColumn("name", "varchar(32)", "", nil, "")
+		ta.AddIndex("PRIMARY").AddColumn("id", 0)
+		ta.PKColumns = []int{0}
+		ta.CacheType = schema.CACHE_RW
+		return ta, true
+	}
+	plan, err := GetSqlExecPlan("insert into d(name) values ('a') on duplicate key update name = values(name)", getTable, arena.NewArenaAllocator(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.PlanId != PLAN_INSERT_PK {
+		t.Fatal(plan.PlanId, plan.Reason)
+	}
+	if v, ok := plan.PKValues[0].(sqltypes.Value); !ok || v.String() != "7" {
+		t.Fatal(plan.PKValues)
+	}
+}
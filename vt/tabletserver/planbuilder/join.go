@@ -0,0 +1,156 @@
+package planbuilder
+
+import (
+	"github.com/juju/errors"
+	log "github.com/ngaut/logging"
+	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/sqlparser"
+	"github.com/wandoulabs/cm/vt/schema"
+)
+
+// Type categories of columns. Comparing columns of different categories
+// makes MySQL convert them, which may be slow or match unexpected rows.
+const (
+	categoryOther = iota
+	categoryNumeric
+	categoryString
+	categoryTemporal
+)
+
+func typeCategory(t byte) int {
+	switch t {
+	case mysql.MYSQL_TYPE_TINY, mysql.MYSQL_TYPE_SHORT, mysql.MYSQL_TYPE_INT24, mysql.MYSQL_TYPE_LONG,
+		mysql.MYSQL_TYPE_LONGLONG, mysql.MYSQL_TYPE_FLOAT, mysql.MYSQL_TYPE_DOUBLE, mysql.MYSQL_TYPE_YEAR,
+		mysql.MYSQL_TYPE_DECIMAL, mysql.MYSQL_TYPE_NEWDECIMAL:
+		return categoryNumeric
+	case mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VAR_STRING, mysql.MYSQL_TYPE_STRING, mysql.MYSQL_TYPE_ENUM,
+		mysql.MYSQL_TYPE_SET, mysql.MYSQL_TYPE_TINY_BLOB, mysql.MYSQL_TYPE_MEDIUM_BLOB, mysql.MYSQL_TYPE_LONG_BLOB,
+		mysql.MYSQL_TYPE_BLOB:
+		return categoryString
+	case mysql.MYSQL_TYPE_DATE, mysql.MYSQL_TYPE_NEWDATE, mysql.MYSQL_TYPE_DATETIME, mysql.MYSQL_TYPE_TIMESTAMP,
+		mysql.MYSQL_TYPE_TIME:
+		return categoryTemporal
+	}
+	return categoryOther
+}
+
+// checkJoinTypes looks for the join conditions of a select that compare
+// columns of different type categories, like an int to a varchar. They
+// are logged if CheckJoinTypes is set and rejected with ErrCoercedJoin
+// if RejectCoercedJoins is. Columns that can't be resolved are skipped.
+func checkJoinTypes(sel *sqlparser.Select, getTable TableGetter) error {
+	if !CheckJoinTypes && !RejectCoercedJoins {
+		return nil
+	}
+
+	tables := make(map[string]*schema.Table)
+	var conditions []*sqlparser.ComparisonExpr
+	joined := len(sel.From) > 1
+	for _, expr := range sel.From {
+		if collectJoinTables(expr, getTable, tables, &conditions) {
+			joined = true
+		}
+	}
+	if !joined {
+		return nil
+	}
+	if sel.Where != nil {
+		conditions = collectColumnComparisons(sel.Where.Expr, conditions)
+	}
+
+	for _, cond := range conditions {
+		lt, lcol := resolveColumn(cond.Left.(*sqlparser.ColName), tables)
+		rt, rcol := resolveColumn(cond.Right.(*sqlparser.ColName), tables)
+		if lcol == nil || rcol == nil {
+			continue
+		}
+		lc, rc := typeCategory(lcol.SqlType), typeCategory(rcol.SqlType)
+		if lc == categoryOther || rc == categoryOther || lc == rc {
+			continue
+		}
+		err := errors.Annotatef(ErrCoercedJoin, "%s.%s (%s) %s %s.%s (%s)",
+			lt.Name, lcol.Name, lcol.Type, cond.Operator, rt.Name, rcol.Name, rcol.Type)
+		if RejectCoercedJoins {
+			return err
+		}
+		log.Warning(err)
+	}
+	return nil
+}
+
+// collectJoinTables adds the tables of expr to tables by alias or name
+// and the column comparisons of its ON clauses to conditions. It tells
+// if expr is a join.
+func collectJoinTables(expr sqlparser.TableExpr, getTable TableGetter, tables map[string]*schema.Table, conditions *[]*sqlparser.ComparisonExpr) bool {
+	switch expr := expr.(type) {
+	case *sqlparser.AliasedTableExpr:
+		name, ok := expr.Expr.(*sqlparser.TableName)
+		if !ok || name.Qualifier != nil {
+			return false
+		}
+		if table, ok := getTable(string(name.Name)); ok {
+			alias := string(name.Name)
+			if expr.As != nil {
+				alias = string(expr.As)
+			}
+			tables[alias] = table
+		}
+		return false
+	case *sqlparser.ParenTableExpr:
+		return collectJoinTables(expr.Expr, getTable, tables, conditions)
+	case *sqlparser.JoinTableExpr:
+		collectJoinTables(expr.LeftExpr, getTable, tables, conditions)
+		collectJoinTables(expr.RightExpr, getTable, tables, conditions)
+		if expr.On != nil {
+			*conditions = collectColumnComparisons(expr.On, *conditions)
+		}
+		return true
+	}
+	return false
+}
+
+// collectColumnComparisons adds the comparisons between two columns
+// that expr requires to hold to conditions.
+func collectColumnComparisons(expr sqlparser.BoolExpr, conditions []*sqlparser.ComparisonExpr) []*sqlparser.ComparisonExpr {
+	switch expr := expr.(type) {
+	case *sqlparser.AndExpr:
+		conditions = collectColumnComparisons(expr.Left, conditions)
+		return collectColumnComparisons(expr.Right, conditions)
+	case *sqlparser.ParenBoolExpr:
+		return collectColumnComparisons(expr.Expr, conditions)
+	case *sqlparser.ComparisonExpr:
+		_, lok := expr.Left.(*sqlparser.ColName)
+		_, rok := expr.Right.(*sqlparser.ColName)
+		if lok && rok {
+			conditions = append(conditions, expr)
+		}
+	}
+	return conditions
+}
+
+// resolveColumn finds the table and the definition of col, unqualified
+// columns must belong to a single table.
+func resolveColumn(col *sqlparser.ColName, tables map[string]*schema.Table) (*schema.Table, *schema.TableColumn) {
+	if col.Qualifier != nil {
+		table, ok := tables[string(col.Qualifier)]
+		if !ok {
+			return nil, nil
+		}
+		if i := table.FindColumn(string(col.Name)); i != -1 {
+			return table, &table.Columns[i]
+		}
+		return nil, nil
+	}
+
+	var found *schema.Table
+	var column *schema.TableColumn
+	for _, table := range tables {
+		if i := table.FindColumn(string(col.Name)); i != -1 {
+			if found != nil {
+				return nil, nil
+			}
+			found, column = table, &table.Columns[i]
+		}
+	}
+	return found, column
+}
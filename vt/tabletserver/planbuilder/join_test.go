@@ -0,0 +1,60 @@
+package planbuilder
+
+import (
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/arena"
+	"github.com/wandoulabs/cm/vt/schema"
+)
+
+func TestCoercedJoins(t *testing.T) {
+	defer func(check, reject bool) {
+		CheckJoinTypes, RejectCoercedJoins = check, reject
+	}(CheckJoinTypes, RejectCoercedJoins)
+
+	getTable := func(name string) (*schema.Table, bool) {
+		if name == "t" {
+			return newTestTable(), true
+		}
+		if name != "u" {
+			return nil, false
+		}
+		ta := schema.NewTable("u")
+		ta.AddColumn("uid", "bigint(20)", "", nil, "")
+		ta.AddColumn("code", "varchar(16)", "utf8_general_ci", nil, "")
+		ta.AddColumn("created", "datetime", "", nil, "")
+		return ta, true
+	}
+
+	cases := []struct {
+		sql     string
+		coerced bool
+	}{
+		{"select * from t join u on t.id = u.uid", false},
+		{"select * from t join u on t.name = u.code", false},
+		{"select * from t join u on t.id = u.code", true},
+		{"select * from t a join u b on b.code = a.id", true},
+		{"select * from t join u on (t.id = u.uid and t.name = u.created)", true},
+		{"select * from t left join u on id = code", true},
+		{"select * from t, u where t.id = u.code", true},
+		{"select * from t, u where t.id = u.uid or t.id = u.code", false},
+		{"select * from t join u on t.id = u.nosuchcolumn", false},
+		{"select * from t join nosuchtable x on t.id = x.code", false},
+		{"select * from t where id = name", false},
+	}
+
+	CheckJoinTypes, RejectCoercedJoins = true, true
+	for _, c := range cases {
+		_, err := GetSqlExecPlan(c.sql, getTable, arena.NewArenaAllocator(1024))
+		if (errors.Cause(err) == ErrCoercedJoin) != c.coerced {
+			t.Fatal(c.sql, err)
+		}
+	}
+
+	// only logged
+	RejectCoercedJoins = false
+	if _, err := GetSqlExecPlan("select * from t join u on t.id = u.code", getTable, arena.NewArenaAllocator(1024)); err != nil {
+		t.Fatal(err)
+	}
+}
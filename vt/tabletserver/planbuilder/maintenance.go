@@ -0,0 +1,28 @@
+package planbuilder
+
+import (
+	"sync/atomic"
+
+	"github.com/juju/errors"
+)
+
+// ErrMaintenance fails the queries while the server is in maintenance.
+var ErrMaintenance = errors.New("server in maintenance")
+
+var maintenance int32
+
+// SetMaintenance turns the maintenance mode on or off. In maintenance
+// every command of the clients but COM_QUIT fails with ErrMaintenance,
+// and so does planning. It can be toggled while serving.
+func SetMaintenance(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&maintenance, v)
+}
+
+// InMaintenance reports whether the maintenance mode is on.
+func InMaintenance() bool {
+	return atomic.LoadInt32(&maintenance) == 1
+}
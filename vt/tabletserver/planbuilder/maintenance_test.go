@@ -0,0 +1,41 @@
+package planbuilder
+
+import (
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/arena"
+	"github.com/wandoulabs/cm/sqlparser"
+)
+
+func TestMaintenance(t *testing.T) {
+	defer SetMaintenance(false)
+
+	sql := "select * from t where id = 1"
+	stmt, err := sqlparser.Parse(sql, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := func() []error {
+		_, err1 := GetSqlExecPlan(sql, testGetTable, arena.NewArenaAllocator(1024))
+		_, err2 := GetStmtExecPlan(stmt, testGetTable, arena.NewArenaAllocator(1024))
+		return []error{err1, err2}
+	}
+
+	SetMaintenance(true)
+	if !InMaintenance() {
+		t.Fatal("not in maintenance")
+	}
+	for _, err := range plan() {
+		if errors.Cause(err) != ErrMaintenance {
+			t.Fatal(err)
+		}
+	}
+
+	SetMaintenance(false)
+	for _, err := range plan() {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
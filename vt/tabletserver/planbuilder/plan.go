@@ -5,19 +5,76 @@
 package planbuilder
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/juju/errors"
 
 	"github.com/ngaut/arena"
 	log "github.com/ngaut/logging"
+	"github.com/wandoulabs/cm/mysql"
 	"github.com/wandoulabs/cm/sqlparser"
+	"github.com/wandoulabs/cm/sqltypes"
 	"github.com/wandoulabs/cm/vt/schema"
 )
 
 var (
-	TooComplex = errors.New("Complex")
-	execLimit  = &sqlparser.Limit{Rowcount: sqlparser.ValArg(":#maxLimit")}
+	TooComplex       = errors.New("Complex")
+	ErrTableNotFound = errors.New("not found in schema")
+	ErrBadField      = errors.New("unknown column")
+	ErrFullScan      = errors.New("full table scan rejected")
+	ErrCoercedJoin   = errors.New("join on columns of incompatible types")
+	ErrSelectInto    = errors.New("select into a file rejected")
+	ErrRowSubquery   = errors.New("row subquery not supported for inserts")
+	ErrColumnCount   = errors.New("column count doesn't match value count")
+	execLimit        = &sqlparser.Limit{Rowcount: sqlparser.ValArg(":#maxLimit")}
 )
 
+// PassUnknownTables makes the analyzer pass queries on tables that are
+// missing from the schema through to the backend instead of failing.
+var PassUnknownTables bool
+
+// SessionQueryTimeout is the session variable through which clients
+// set their own query timeout, in seconds.
+const SessionQueryTimeout = "proxy_query_timeout"
+
+// MaxQueryTimeout caps the timeout a session may ask for. Zero means
+// no cap.
+var MaxQueryTimeout time.Duration
+
+// MaxFullScanRows makes the analyzer reject with ErrFullScan the
+// queries that would scan a table of more rows without any index.
+// Zero disables the check.
+var MaxFullScanRows uint64
+
+// CheckJoinTypes makes the analyzer log the joins comparing columns of
+// incompatible types, RejectCoercedJoins rejects them with
+// ErrCoercedJoin.
+var (
+	CheckJoinTypes     bool
+	RejectCoercedJoins bool
+)
+
+// RejectSelectInto makes the analyzer reject with ErrSelectInto the
+// selects INTO OUTFILE or DUMPFILE, which write files on the backends.
+// They are passed through otherwise.
+var RejectSelectInto bool
+
+// LogPlans makes the analyzer log at debug level the queries it
+// generates for each plan, normalized. LogPlanValues logs them with
+// their literals and the pk, limit and set values of the plans too,
+// which may hold sensitive data.
+var (
+	LogPlans      bool
+	LogPlanValues bool
+)
+
+// debugf is where the plans are logged, replaced by the tests.
+var debugf = log.Debugf
+
 // ExecPlan is built for selects and DMLs.
 // PK Values values within ExecPlan can be:
 // sqltypes.Value: sourced form the query, or
@@ -28,6 +85,10 @@ type ExecPlan struct {
 	Reason    ReasonType
 	TableName string
 
+	// ReasonDetail tells more about why the plan is not a better one,
+	// like the pk columns a select misses to be a PK_IN.
+	ReasonDetail string
+
 	// FieldQuery is used to fetch field info
 	FieldQuery *sqlparser.ParsedQuery
 
@@ -52,21 +113,200 @@ type ExecPlan struct {
 	// PK_IN. Limit clause value.
 	Limit interface{}
 
+	// PK_IN. Order by clause on selected columns, cached rows must be
+	// sorted by it.
+	OrderBy []mysql.SortKey
+
 	// For update: set clause if pk is changing
 	SecondaryPKValues []interface{}
 
+	// For updates: the columns of the set clause and what they are
+	// set to, sqltypes.Value, a bind variable name or nil for NULL and
+	// the expressions, see UpdateColumn.
+	UpdateColumns []UpdateColumn
+	UpdateValues  []interface{}
+
+	// For PLAN_DML_PK updates: the cached rows may be rewritten with
+	// UpdateValues rather than invalidated, see RowUpdate.
+	RewriteRows bool
+
 	// For PLAN_INSERT_SUBQUERY: pk columns in the subquery result
 	SubqueryPKColumns []int
 
+	// For inserts: INSERT IGNORE, which may leave the rows as they are.
+	// Their cache only needs invalidating if the insert affected some.
+	Ignore bool
+
+	// For updates: every SET assigns a column to itself, the rows can't
+	// change and their cache is kept.
+	NoOp bool
+
+	// For selects without FROM: every expression is a value the proxy
+	// knows, like DATABASE() or @@version, it answers them itself.
+	Local bool
+
 	// PLAN_SET
 	SetKey   string
 	SetValue interface{}
+
+	// PLAN_SET of proxy_query_timeout: the capped session timeout,
+	// zero to fall back to the global one
+	Timeout time.Duration
+}
+
+// MarshalJSON renders the plan for tooling. Literal pk values are
+// rendered as their values and bind variables as their names.
+func (node *ExecPlan) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		PlanId            PlanType
+		Reason            ReasonType
+		ReasonDetail      string                 `json:",omitempty"`
+		TableName         string                 `json:",omitempty"`
+		IndexUsed         string                 `json:",omitempty"`
+		ColumnNumbers     []int                  `json:",omitempty"`
+		FieldQuery        *sqlparser.ParsedQuery `json:",omitempty"`
+		FullQuery         *sqlparser.ParsedQuery `json:",omitempty"`
+		OuterQuery        *sqlparser.ParsedQuery `json:",omitempty"`
+		Subquery          *sqlparser.ParsedQuery `json:",omitempty"`
+		PKValues          []interface{}          `json:",omitempty"`
+		Limit             interface{}            `json:",omitempty"`
+		SecondaryPKValues []interface{}          `json:",omitempty"`
+		Ignore            bool                   `json:",omitempty"`
+		Local             bool                   `json:",omitempty"`
+	}{
+		PlanId:            node.PlanId,
+		Reason:            node.Reason,
+		ReasonDetail:      node.ReasonDetail,
+		TableName:         node.TableName,
+		IndexUsed:         node.IndexUsed,
+		ColumnNumbers:     node.ColumnNumbers,
+		FieldQuery:        node.FieldQuery,
+		FullQuery:         node.FullQuery,
+		OuterQuery:        node.OuterQuery,
+		Subquery:          node.Subquery,
+		PKValues:          jsonValues(node.PKValues),
+		Limit:             jsonValue(node.Limit),
+		SecondaryPKValues: jsonValues(node.SecondaryPKValues),
+		Ignore:            node.Ignore,
+		Local:             node.Local,
+	})
+}
+
+// Clone returns a copy of the plan whose pk value lists can be changed
+// without affecting node. The generated queries are shared.
+func (node *ExecPlan) Clone() *ExecPlan {
+	plan := *node
+	plan.PKValues = cloneValues(node.PKValues)
+	plan.SecondaryPKValues = cloneValues(node.SecondaryPKValues)
+	plan.UpdateValues = cloneValues(node.UpdateValues)
+	return &plan
+}
+
+func cloneValues(values []interface{}) []interface{} {
+	if values == nil {
+		return nil
+	}
+	vals := make([]interface{}, len(values))
+	for i, v := range values {
+		if list, ok := v.([]interface{}); ok {
+			v = cloneValues(list)
+		}
+		vals[i] = v
+	}
+	return vals
+}
+
+// Bind returns a clone of the plan with the bind variables of its pk,
+// update values and limit replaced by their values in bindVars. node itself
+// is left untouched so that it can be bound again.
+func (node *ExecPlan) Bind(bindVars map[string]interface{}) (*ExecPlan, error) {
+	plan := node.Clone()
+	if err := bindValues(plan.PKValues, bindVars); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := bindValues(plan.SecondaryPKValues, bindVars); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := bindValues(plan.UpdateValues, bindVars); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if name, ok := plan.Limit.(string); ok {
+		limit, _, err := sqlparser.FetchBindVar(name, bindVars)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		plan.Limit = limit
+	}
+	return plan, nil
+}
+
+func bindValues(values []interface{}, bindVars map[string]interface{}) error {
+	for i, v := range values {
+		switch v := v.(type) {
+		case string:
+			supplied, isList, err := sqlparser.FetchBindVar(v, bindVars)
+			if err != nil {
+				return err
+			}
+			if isList {
+				list := make([]interface{}, len(supplied.([]interface{})))
+				copy(list, supplied.([]interface{}))
+				for j := range list {
+					if list[j], err = sqltypes.BuildValue(list[j]); err != nil {
+						return err
+					}
+				}
+				values[i] = list
+				continue
+			}
+			if supplied == nil {
+				values[i] = nil
+				continue
+			}
+			if values[i], err = sqltypes.BuildValue(supplied); err != nil {
+				return err
+			}
+		case []interface{}:
+			if err := bindValues(v, bindVars); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func jsonValues(values []interface{}) []interface{} {
+	if values == nil {
+		return nil
+	}
+	vals := make([]interface{}, len(values))
+	for i, v := range values {
+		vals[i] = jsonValue(v)
+	}
+	return vals
+}
+
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case sqltypes.Value:
+		if v.IsNull() {
+			return nil
+		}
+		if v.IsNumeric() || v.IsFractional() {
+			return json.RawMessage(v.String())
+		}
+		return v.String()
+	case []interface{}:
+		return jsonValues(v)
+	}
+	// bind variable names and nil
+	return value
 }
 
 func (node *ExecPlan) setTableInfo(tableName string, getTable TableGetter) (*schema.Table, error) {
 	tableInfo, ok := getTable(tableName)
 	if !ok {
-		return nil, errors.Errorf("table %s not found in schema", tableName)
+		return nil, errors.Annotatef(ErrTableNotFound, "table %s", tableName)
 	}
 	node.TableName = tableInfo.Name
 	return tableInfo, nil
@@ -75,52 +315,228 @@ func (node *ExecPlan) setTableInfo(tableName string, getTable TableGetter) (*sch
 type TableGetter func(tableName string) (*schema.Table, bool)
 
 func GetSqlExecPlan(sql string, getTable TableGetter, alloc arena.ArenaAllocator) (plan *ExecPlan, err error) {
+	if InMaintenance() {
+		return nil, ErrMaintenance
+	}
+	sql = sqlparser.TrimTrailing(sql)
+	if plan := passUserVars(sql, alloc); plan != nil {
+		return plan, nil
+	}
 	statement, err := sqlparser.Parse(sql, alloc)
 	if err != nil {
 		return nil, err
 	}
-	plan, err = analyzeSQL(statement, getTable, alloc)
+	plan, err = analyzeSQL(statement, getTable, alloc, false)
 	if err != nil {
-		return nil, err
+		if plan = passUnknownTable(statement, err, alloc); plan == nil {
+			return nil, err
+		}
 	}
 	if plan.PlanId == PLAN_PASS_DML {
 		log.Warningf("PASS_DML: %s", sql)
 	}
+	logPlan(plan)
 	return plan, nil
 }
 
 func GetStmtExecPlan(stmt sqlparser.Statement, getTable TableGetter, alloc arena.ArenaAllocator) (plan *ExecPlan, err error) {
-	plan, err = analyzeSQL(stmt, getTable, alloc)
+	if InMaintenance() {
+		return nil, ErrMaintenance
+	}
+	if plan := passUserVars(sqlparser.String(stmt, alloc), alloc); plan != nil {
+		return plan, nil
+	}
+	plan, err = analyzeSQL(stmt, getTable, alloc, false)
 	if err != nil {
-		return nil, err
+		if plan = passUnknownTable(stmt, err, alloc); plan == nil {
+			return nil, err
+		}
 	}
 
 	if plan.PlanId == PLAN_PASS_DML {
 		log.Warningf("PASS_DML: %s", sqlparser.String(stmt, alloc))
 	}
+	logPlan(plan)
 
 	return plan, nil
 }
 
-func analyzeSQL(statement sqlparser.Statement, getTable TableGetter, alloc arena.ArenaAllocator) (plan *ExecPlan, err error) {
+// logPlan logs the queries of plan if LogPlans is set, normalized unless
+// LogPlanValues is set too: the values of the clients stay out of the
+// logs.
+func logPlan(plan *ExecPlan) {
+	if !LogPlans {
+		return
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "plan %v table %q", plan.PlanId, plan.TableName)
+	for _, q := range []struct {
+		name  string
+		query *sqlparser.ParsedQuery
+	}{
+		{"field", plan.FieldQuery},
+		{"full", plan.FullQuery},
+		{"outer", plan.OuterQuery},
+		{"subquery", plan.Subquery},
+	} {
+		if q.query == nil {
+			continue
+		}
+		query := q.query.Query
+		if !LogPlanValues {
+			query = normalizeQuery(query)
+		}
+		fmt.Fprintf(&buf, " %s: %q", q.name, query)
+	}
+	if LogPlanValues {
+		var pkValues interface{}
+		if plan.PKValues != nil {
+			pkValues = plan.PKValues
+		}
+		for _, v := range []struct {
+			name  string
+			value interface{}
+		}{
+			{"pk values", pkValues},
+			{"limit", plan.Limit},
+			{"set value", plan.SetValue},
+		} {
+			if v.value == nil {
+				continue
+			}
+			b, _ := json.Marshal(jsonValue(v.value))
+			fmt.Fprintf(&buf, " %s: %s", v.name, b)
+		}
+	}
+	debugf("%s", buf.String())
+}
+
+// normalizeQuery returns the generated query with its literals replaced
+// by ?. The queries of :#pk like bind vars don't parse, their literals
+// are replaced token by token.
+func normalizeQuery(query string) string {
+	if normalized, err := sqlparser.Normalize(query, arena.StdAllocator); err == nil {
+		return normalized
+	}
+
+	var buf bytes.Buffer
+	// :_pk scans as a bind var, and is as long as :#pk
+	tkn := sqlparser.NewStringTokenizer(strings.Replace(query, ":#", ":_", -1), arena.StdAllocator)
+	prev := 0
+	for {
+		typ, _ := tkn.Scan()
+		// the tokenizer is one byte ahead
+		end := tkn.Position - 1
+		if end > len(query) {
+			end = len(query)
+		}
+		switch typ {
+		case 0:
+			return buf.String()
+		case sqlparser.LEX_ERROR:
+			// an unterminated literal
+			buf.WriteString(" ?")
+			return buf.String()
+		case sqlparser.STRING, sqlparser.NUMBER:
+			token := query[prev:end]
+			value := strings.TrimLeft(token, " \t\r\n")
+			buf.WriteString(token[:len(token)-len(value)])
+			buf.WriteByte('?')
+		default:
+			buf.WriteString(query[prev:end])
+		}
+		prev = end
+	}
+}
+
+// passUnknownTable returns a passthrough plan for statement if err is
+// about an unknown table and PassUnknownTables is set, nil otherwise.
+func passUnknownTable(statement sqlparser.Statement, err error, alloc arena.ArenaAllocator) *ExecPlan {
+	if !PassUnknownTables || errors.Cause(err) != ErrTableNotFound {
+		return nil
+	}
+	plan := &ExecPlan{
+		Reason:    REASON_TABLE,
+		FullQuery: GenerateFullQuery(statement, alloc),
+	}
+	switch statement.(type) {
+	case sqlparser.SelectStatement:
+		plan.PlanId = PLAN_PASS_SELECT
+		plan.FieldQuery = GenerateFieldQuery(statement, alloc)
+	case *sqlparser.Insert, *sqlparser.Replace, *sqlparser.Update, *sqlparser.Delete:
+		plan.PlanId = PLAN_PASS_DML
+	default:
+		return nil
+	}
+	return plan
+}
+
+// passUserVars returns a passthrough plan if sql is a select using user
+// variables, nil otherwise. Their values live in the session of the
+// backend connection, the row cache can't answer such selects. DMLs
+// using them keep their plan, the rows they change must still be
+// invalidated, and the variables never make up a pk value.
+func passUserVars(sql string, alloc arena.ArenaAllocator) *ExecPlan {
+	if !IsUserVarSelect(sql, alloc) {
+		return nil
+	}
+	return &ExecPlan{PlanId: PLAN_PASS_SELECT, Reason: REASON_USER_VAR}
+}
+
+// IsUserVarSelect tells if sql is a select using user variables. It
+// only tokenizes sql, the grammar rejects some of them, like the
+// assignments with :=.
+func IsUserVarSelect(sql string, alloc arena.ArenaAllocator) bool {
+	tkn := sqlparser.NewStringTokenizer(sql, alloc)
+	typ, _ := tkn.Scan()
+	for typ == sqlparser.COMMENT {
+		typ, _ = tkn.Scan()
+	}
+	return typ == sqlparser.SELECT && sqlparser.HasUserVars(sql, alloc)
+}
+
+// CanOptimize returns how sql would be planned. It runs the same
+// analysis as GetSqlExecPlan but skips generating the queries of the
+// plan, which makes it cheaper for tools only after the classification.
+func CanOptimize(sql string, getTable TableGetter, alloc arena.ArenaAllocator) (PlanType, ReasonType, error) {
+	sql = sqlparser.TrimTrailing(sql)
+	if plan := passUserVars(sql, alloc); plan != nil {
+		return plan.PlanId, plan.Reason, nil
+	}
+	statement, err := sqlparser.Parse(sql, alloc)
+	if err != nil {
+		return PLAN_PASS_SELECT, REASON_DEFAULT, err
+	}
+	plan, err := analyzeSQL(statement, getTable, alloc, true)
+	if err != nil {
+		if plan = passUnknownTable(statement, err, alloc); plan == nil {
+			return PLAN_PASS_SELECT, REASON_DEFAULT, err
+		}
+	}
+	return plan.PlanId, plan.Reason, nil
+}
+
+func analyzeSQL(statement sqlparser.Statement, getTable TableGetter, alloc arena.ArenaAllocator, classifyOnly bool) (plan *ExecPlan, err error) {
 	switch stmt := statement.(type) {
 	case *sqlparser.Union:
 		return &ExecPlan{
 			PlanId:     PLAN_PASS_SELECT,
 			FieldQuery: GenerateFieldQuery(stmt, alloc),
-			FullQuery:  GenerateFullQuery(stmt, alloc),
+			FullQuery:  GenerateSelectLimitQuery(stmt, alloc),
 			Reason:     REASON_SELECT,
 		}, nil
 	case *sqlparser.Select:
-		return analyzeSelect(stmt, getTable, alloc)
+		return analyzeSelect(stmt, getTable, alloc, classifyOnly)
+	case *sqlparser.SimpleSelect:
+		return analyzeSimpleSelect(stmt, alloc), nil
 	case *sqlparser.Insert:
-		return analyzeInsert(stmt, getTable, alloc)
+		return analyzeInsert(stmt, getTable, alloc, classifyOnly)
 	case *sqlparser.Replace:
-		return analyzeReplace(stmt, getTable, alloc)
+		return analyzeReplace(stmt, getTable, alloc, classifyOnly)
 	case *sqlparser.Update:
-		return analyzeUpdate(stmt, getTable, alloc)
+		return analyzeUpdate(stmt, getTable, alloc, classifyOnly)
 	case *sqlparser.Delete:
-		return analyzeDelete(stmt, getTable, alloc)
+		return analyzeDelete(stmt, getTable, alloc, classifyOnly)
 	case *sqlparser.Set:
 		return analyzeSet(stmt, alloc), nil
 	case *sqlparser.DDL:
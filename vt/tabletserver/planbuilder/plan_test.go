@@ -4,6 +4,18 @@
 
 package planbuilder
 
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/arena"
+	"github.com/wandoulabs/cm/sqlparser"
+	"github.com/wandoulabs/cm/sqltypes"
+)
+
 /*
 
 import (
@@ -228,3 +240,214 @@ func locateFile(name string) string {
 	return testfiles.Locate("tabletserver/" + name)
 }
 */
+
+func TestPlanJSON(t *testing.T) {
+	plan := getTestPlan(t, "select id, name from t where id in (1, :id)")
+	b, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `{"PlanId":"PK_IN","Reason":"DEFAULT","TableName":"t","IndexUsed":"PRIMARY",` +
+		`"ColumnNumbers":[0,1],"FieldQuery":"select id, name from t where 1 != 1",` +
+		`"PKValues":[[1,":id"]]}`
+	if string(b) != expect {
+		t.Fatal(string(b))
+	}
+
+	plan = getTestPlan(t, "update t set email = 'a@b.c' where id = 'x'")
+	b, err = json.Marshal(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err = json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["PlanId"] != "DML_PK" || m["TableName"] != "t" || m["FullQuery"] == nil || m["OuterQuery"] == nil {
+		t.Fatal(string(b))
+	}
+	if pks := m["PKValues"].([]interface{}); len(pks) != 1 || pks[0] != "x" {
+		t.Fatal(string(b))
+	}
+}
+
+func TestPassUnknownTables(t *testing.T) {
+	alloc := arena.NewArenaAllocator(1024)
+	sqls := []string{
+		"select * from unknown where id = 1",
+		"insert into unknown(id) values (1)",
+	}
+	for _, sql := range sqls {
+		if _, err := GetSqlExecPlan(sql, testGetTable, alloc); errors.Cause(err) != ErrTableNotFound {
+			t.Fatal(sql, err)
+		}
+	}
+
+	PassUnknownTables = true
+	defer func() { PassUnknownTables = false }()
+
+	plan := getTestPlan(t, sqls[0])
+	if plan.PlanId != PLAN_PASS_SELECT || plan.Reason != REASON_TABLE {
+		t.Fatal(plan.PlanId, plan.Reason)
+	}
+	if plan.FullQuery.Query != "select * from unknown where id = 1" || plan.FieldQuery == nil {
+		t.Fatal(plan.FullQuery.Query)
+	}
+
+	plan = getTestPlan(t, sqls[1])
+	if plan.PlanId != PLAN_PASS_DML || plan.Reason != REASON_TABLE {
+		t.Fatal(plan.PlanId, plan.Reason)
+	}
+	if plan.FullQuery.Query != "insert into unknown(id) values (1)" {
+		t.Fatal(plan.FullQuery.Query)
+	}
+}
+
+func TestCanOptimize(t *testing.T) {
+	for _, sql := range []string{
+		"select * from t where id = 1",
+		"select * from t where id in (1, 2)",
+		"select name from t where name = 'a'",
+		"select email from t where name = 'a'",
+		"select * from t where email = 'a'",
+		"select * from t order by id",
+		"select * from t where id = 1 for update",
+		"select * from t union select * from t",
+		"insert into t(id, name) values (1, 'a')",
+		"insert into t(id, name) select id, name from t",
+		"replace into t(id, name) values (1, 'a')",
+		"update t set name = 'a' where id = 1",
+		"update t set name = 'a' where email = 'b'",
+		"delete from t where id = 1",
+		"delete from t where email = 'b'",
+		"set autocommit = 1",
+	} {
+		plan := getTestPlan(t, sql)
+		planId, reason, err := CanOptimize(sql, testGetTable, arena.NewArenaAllocator(1024))
+		if err != nil {
+			t.Fatal(sql, err)
+		}
+		if planId != plan.PlanId || reason != plan.Reason {
+			t.Fatal(sql, planId, reason, plan.PlanId, plan.Reason)
+		}
+	}
+
+	if _, _, err := CanOptimize("select * from nosuchtable", testGetTable, arena.NewArenaAllocator(1024)); errors.Cause(err) != ErrTableNotFound {
+		t.Fatal(err)
+	}
+}
+
+func TestPlanBind(t *testing.T) {
+	plan := getTestPlan(t, "select * from t where id in (?, ?) limit ?")
+	if plan.PlanId != PLAN_PK_IN {
+		t.Fatal(plan.PlanId, plan.Reason)
+	}
+
+	for _, args := range [][]interface{}{{int64(1), int64(2), int64(10)}, {int32(3), nil, int64(5)}} {
+		bound, err := plan.Bind(map[string]interface{}{"v1": args[0], "v2": args[1], "v3": args[2]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pks := bound.PKValues[0].([]interface{})
+		if v, _ := sqltypes.BuildValue(args[0]); pks[0].(sqltypes.Value).String() != v.String() {
+			t.Fatal(pks)
+		}
+		if args[1] == nil && pks[1] != nil {
+			t.Fatal(pks)
+		}
+		if bound.Limit != args[2] {
+			t.Fatal(bound.Limit)
+		}
+	}
+
+	// the prepared plan keeps its bind variables
+	if pks := plan.PKValues[0].([]interface{}); pks[0] != ":v1" || pks[1] != ":v2" || plan.Limit != ":v3" {
+		t.Fatal(plan.PKValues, plan.Limit)
+	}
+
+	if _, err := plan.Bind(map[string]interface{}{"v1": int64(1)}); err == nil {
+		t.Fatal("expect missing bind var error")
+	}
+}
+
+func TestTrailingSemicolons(t *testing.T) {
+	expect := getTestPlan(t, "select * from t where id = 1")
+	for _, sql := range []string{
+		"select * from t where id = 1;",
+		"select * from t where id = 1 ;; ",
+		"select * from t where id = 1\n",
+		"select * from t where id = 1;\r\n\t",
+	} {
+		plan := getTestPlan(t, sql)
+		if plan.PlanId != expect.PlanId || plan.PKValues[0].(sqltypes.Value).String() != "1" {
+			t.Fatalf("%q: %+v", sql, plan)
+		}
+		if id, _, err := CanOptimize(sql, testGetTable, arena.NewArenaAllocator(1024)); err != nil || id != expect.PlanId {
+			t.Fatalf("%q: %v %v", sql, id, err)
+		}
+	}
+
+	// semicolons inside a literal are kept
+	if sql := sqlparser.TrimTrailing("select * from t where name = 'a;' ;"); sql != "select * from t where name = 'a;'" {
+		t.Fatal(sql)
+	}
+}
+
+func TestLogPlans(t *testing.T) {
+	var logged []string
+	defer func(saved func(string, ...interface{})) {
+		debugf, LogPlans, LogPlanValues = saved, false, false
+	}(debugf)
+	debugf = func(format string, v ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, v...))
+	}
+
+	sql := "select id from t where name = :name"
+	getTestPlan(t, sql)
+	if len(logged) != 0 {
+		t.Fatal(logged)
+	}
+
+	LogPlans = true
+	getTestPlan(t, sql)
+	if len(logged) != 1 {
+		t.Fatal(logged)
+	}
+	for _, s := range []string{
+		`plan SELECT_SUBQUERY table "t"`,
+		`field: "select id from t where ? != ?"`,
+		`outer: "select id, name, email from t where :#pk"`,
+		`subquery: "select id from t use index (idx_name) where name = :name limit :#maxLimit"`,
+	} {
+		if !strings.Contains(logged[0], s) {
+			t.Fatalf("%q misses %q", logged[0], s)
+		}
+	}
+	if strings.Contains(logged[0], "limit:") {
+		t.Fatal(logged[0])
+	}
+
+	// the values of the queries are not logged
+	getTestPlan(t, "select id from t where name = 'bob'")
+	for _, s := range []string{
+		`field: "select id from t where ? != ?"`,
+		`subquery: "select id from t use index (idx_name) where name = ? limit :#maxLimit"`,
+	} {
+		if !strings.Contains(logged[1], s) {
+			t.Fatalf("%q misses %q", logged[1], s)
+		}
+	}
+	if strings.Contains(logged[1], "bob") {
+		t.Fatal(logged[1])
+	}
+
+	LogPlanValues = true
+	getTestPlan(t, "select name from t where id in (42, :id) limit 5")
+	if !strings.Contains(logged[2], `pk values: [[42,":id"]] limit: 5`) {
+		t.Fatal(logged[2])
+	}
+	getTestPlan(t, "select id from t where name = 'bob'")
+	if !strings.Contains(logged[3], `name = 'bob'`) {
+		t.Fatal(logged[3])
+	}
+}
@@ -124,6 +124,11 @@ const (
 	REASON_PK_CHANGE
 	REASON_HAS_HINTS
 	REASON_UPSERT
+	REASON_GENERATED_PK
+	REASON_EXISTS
+	REASON_USER_VAR
+	REASON_INTO
+	REASON_NOCACHE_HINT
 )
 
 // Must exactly match order of reason constants.
@@ -144,6 +149,11 @@ var reasonName = []string{
 	"PK_CHANGE",
 	"HAS_HINTS",
 	"UPSERT",
+	"GENERATED_PK",
+	"EXISTS",
+	"USER_VAR",
+	"INTO",
+	"NOCACHE_HINT",
 }
 
 func (rt ReasonType) String() string {
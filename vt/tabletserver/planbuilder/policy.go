@@ -0,0 +1,91 @@
+package planbuilder
+
+import (
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/arena"
+	"github.com/wandoulabs/cm/sqlparser"
+)
+
+// ErrBlockedQuery rejects the statements whose shape the fingerprint
+// policy does not let through.
+var ErrBlockedQuery = errors.New("query blocked by policy")
+
+// fingerprintPolicy holds the fingerprints, as sqlparser.Fingerprint
+// computes them, of the statements allowed and denied.
+type fingerprintPolicy struct {
+	mu    sync.RWMutex
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+var policy fingerprintPolicy
+
+func fingerprintSet(fingerprints []string) map[string]bool {
+	if len(fingerprints) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(fingerprints))
+	for _, fp := range fingerprints {
+		set[fp] = true
+	}
+	return set
+}
+
+// SetAllowedFingerprints restricts the statements that can be planned
+// to the ones of fingerprints, others fail with ErrBlockedQuery. An
+// empty list lifts the restriction.
+func SetAllowedFingerprints(fingerprints []string) {
+	set := fingerprintSet(fingerprints)
+	policy.mu.Lock()
+	policy.allow = set
+	policy.mu.Unlock()
+}
+
+// SetDeniedFingerprints makes the statements of fingerprints fail with
+// ErrBlockedQuery, even if they are allowed.
+func SetDeniedFingerprints(fingerprints []string) {
+	set := fingerprintSet(fingerprints)
+	policy.mu.Lock()
+	policy.deny = set
+	policy.mu.Unlock()
+}
+
+// CheckPolicy returns ErrBlockedQuery if the fingerprint policy blocks
+// stmt. The proxy checks every statement it runs with it or with
+// CheckPolicySQL, planning doesn't.
+func CheckPolicy(stmt sqlparser.Statement, alloc arena.ArenaAllocator) error {
+	policy.mu.RLock()
+	defer policy.mu.RUnlock()
+	if policy.allow == nil && policy.deny == nil {
+		return nil
+	}
+
+	fp := sqlparser.FingerprintStmt(stmt, alloc)
+	if policy.deny[fp] || (policy.allow != nil && !policy.allow[fp]) {
+		return errors.Annotatef(ErrBlockedQuery, "fingerprint %s", fp)
+	}
+	return nil
+}
+
+// CheckPolicySQL is CheckPolicy for a statement not parsed yet, it is
+// only parsed if there is a policy. The statements that can't be parsed
+// have no fingerprint, they are blocked if only some are allowed.
+func CheckPolicySQL(sql string, alloc arena.ArenaAllocator) error {
+	policy.mu.RLock()
+	active, allowList := policy.allow != nil || policy.deny != nil, policy.allow != nil
+	policy.mu.RUnlock()
+	if !active {
+		return nil
+	}
+
+	stmt, err := sqlparser.Parse(sql, alloc)
+	if err != nil {
+		if allowList {
+			return errors.Annotatef(ErrBlockedQuery, "unparseable statement")
+		}
+		return nil
+	}
+	return CheckPolicy(stmt, alloc)
+}
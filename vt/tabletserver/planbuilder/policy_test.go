@@ -0,0 +1,72 @@
+package planbuilder
+
+import (
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/arena"
+	"github.com/wandoulabs/cm/sqlparser"
+)
+
+func TestFingerprintPolicy(t *testing.T) {
+	defer SetAllowedFingerprints(nil)
+	defer SetDeniedFingerprints(nil)
+
+	fingerprint := func(sql string) string {
+		fp, err := sqlparser.Fingerprint(sql, arena.StdAllocator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fp
+	}
+	blocked := func(sql string) bool {
+		err := CheckPolicySQL(sql, arena.NewArenaAllocator(1024))
+		if err != nil && errors.Cause(err) != ErrBlockedQuery {
+			t.Fatal(sql, err)
+		}
+		return err != nil
+	}
+
+	// the same shape with other values is blocked too
+	SetDeniedFingerprints([]string{fingerprint("delete from t where name = 'a'")})
+	if !blocked("delete from t where name = 'b'") {
+		t.Fatal("denied shape not blocked")
+	}
+	if blocked("delete from t where id = 1") || blocked("select * from t where name = 'b'") {
+		t.Fatal("other shapes blocked")
+	}
+
+	stmt, err := sqlparser.Parse("delete   from t where name = 'c'", arena.StdAllocator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckPolicy(stmt, arena.StdAllocator); errors.Cause(err) != ErrBlockedQuery {
+		t.Fatal(err)
+	}
+	// there is no fingerprint to deny
+	if blocked("not sql at all") {
+		t.Fatal("unparseable statement blocked")
+	}
+	// planning is not checked
+	if _, err := GetStmtExecPlan(stmt, testGetTable, arena.StdAllocator); err != nil {
+		t.Fatal(err)
+	}
+
+	// only allowed shapes pass, the deny list still wins
+	SetAllowedFingerprints([]string{fingerprint("select * from t where id = 1"), fingerprint("delete from t where name = 'a'")})
+	if blocked("select * from t where id = 2") {
+		t.Fatal("allowed shape blocked")
+	}
+	if !blocked("select * from t where name = 'b'") || !blocked("delete from t where name = 'b'") {
+		t.Fatal("shapes not allowed pass")
+	}
+	if !blocked("not sql at all") {
+		t.Fatal("unparseable statement passes")
+	}
+
+	SetAllowedFingerprints(nil)
+	SetDeniedFingerprints(nil)
+	if blocked("delete from t where name = 'b'") {
+		t.Fatal("blocked without policy")
+	}
+}
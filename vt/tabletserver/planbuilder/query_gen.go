@@ -7,6 +7,7 @@ package planbuilder
 import (
 	"fmt"
 
+	"github.com/juju/errors"
 	"github.com/ngaut/arena"
 	"github.com/wandoulabs/cm/sqlparser"
 	"github.com/wandoulabs/cm/vt/schema"
@@ -18,6 +19,19 @@ func GenerateFullQuery(statement sqlparser.Statement, alloc arena.ArenaAllocator
 	return buf.ParsedQuery()
 }
 
+// GenerateBoundQuery renders pq with bindVariables substituted, which
+// is handy to see the exact sql a plan sends to the backend.
+func GenerateBoundQuery(pq *sqlparser.ParsedQuery, bindVariables map[string]interface{}) (string, error) {
+	if pq == nil {
+		return "", errors.New("no query to bind")
+	}
+	b, err := pq.GenerateQuery(bindVariables)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return string(b), nil
+}
+
 func GenerateFieldQuery(statement sqlparser.Statement, alloc arena.ArenaAllocator) *sqlparser.ParsedQuery {
 	buf := sqlparser.NewTrackedBuffer(FormatImpossible, alloc)
 	buf.Myprintf("%v", statement)
@@ -47,9 +61,21 @@ func FormatImpossible(buf *sqlparser.TrackedBuffer, node sqlparser.SQLNode) {
 	}
 }
 
+// GenerateSelectLimitQuery generates selStmt capped at :#maxLimit rows
+// unless it has a limit. The limit of a union is the one of its last
+// select, which MySQL applies to the whole union, the limits of the
+// other selects only cap their own rows.
 func GenerateSelectLimitQuery(selStmt sqlparser.SelectStatement, alloc arena.ArenaAllocator) *sqlparser.ParsedQuery {
 	buf := sqlparser.NewTrackedBuffer(nil, alloc)
-	sel, ok := selStmt.(*sqlparser.Select)
+	last := selStmt
+	for {
+		union, ok := last.(*sqlparser.Union)
+		if !ok {
+			break
+		}
+		last = union.Right
+	}
+	sel, ok := last.(*sqlparser.Select)
 	if ok {
 		limit := sel.Limit
 		if limit == nil {
@@ -85,8 +111,13 @@ func GenerateReplaceOuterQuery(ins *sqlparser.Replace, alloc arena.ArenaAllocato
 
 func GenerateInsertOuterQuery(ins *sqlparser.Insert, alloc arena.ArenaAllocator) *sqlparser.ParsedQuery {
 	buf := sqlparser.NewTrackedBuffer(nil, alloc)
-	buf.Myprintf("insert %vinto %v%v values %a%v",
+	ignore := ""
+	if ins.Ignore {
+		ignore = "ignore "
+	}
+	buf.Myprintf("insert %v%sinto %v%v values %a%v",
 		ins.Comments,
+		ignore,
 		ins.Table,
 		ins.Columns,
 		":#values",
@@ -95,15 +126,19 @@ func GenerateInsertOuterQuery(ins *sqlparser.Insert, alloc arena.ArenaAllocator)
 	return buf.ParsedQuery()
 }
 
+// GenerateUpdateOuterQuery keeps the order by and limit of upd: the pk
+// values of a DML_PK plan may match more rows than the limit lets it
+// update. Those of a DML_SUBQUERY plan are already limited. The same
+// goes for GenerateDeleteOuterQuery.
 func GenerateUpdateOuterQuery(upd *sqlparser.Update, alloc arena.ArenaAllocator) *sqlparser.ParsedQuery {
 	buf := sqlparser.NewTrackedBuffer(nil, alloc)
-	buf.Myprintf("update %v%v set %v where %a", upd.Comments, upd.Table, upd.Exprs, ":#pk")
+	buf.Myprintf("update %v%v set %v where %a%v%v", upd.Comments, upd.Table, upd.Exprs, ":#pk", upd.OrderBy, upd.Limit)
 	return buf.ParsedQuery()
 }
 
 func GenerateDeleteOuterQuery(del *sqlparser.Delete, alloc arena.ArenaAllocator) *sqlparser.ParsedQuery {
 	buf := sqlparser.NewTrackedBuffer(nil, alloc)
-	buf.Myprintf("delete %vfrom %v where %a", del.Comments, del.Table, ":#pk")
+	buf.Myprintf("delete %vfrom %v where %a%v%v", del.Comments, del.Table, ":#pk", del.OrderBy, del.Limit)
 	return buf.ParsedQuery()
 }
 
@@ -0,0 +1,87 @@
+package planbuilder
+
+import (
+	"testing"
+
+	"github.com/wandoulabs/cm/sqlparser"
+	"github.com/wandoulabs/cm/sqltypes"
+)
+
+func TestGenerateBoundQuery(t *testing.T) {
+	plan := getTestPlan(t, "update t set email = 'x' where id = 1")
+	sql, err := GenerateBoundQuery(plan.OuterQuery, map[string]interface{}{
+		"#pk": sqlparser.TupleEqualityList{
+			Columns: []string{"id"},
+			Rows:    [][]sqltypes.Value{{sqltypes.MakeNumeric([]byte("1"))}, {sqltypes.MakeNumeric([]byte("2"))}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sql != "update t set email = 'x' where id in (1, 2)" {
+		t.Fatal(sql)
+	}
+
+	plan = getTestPlan(t, "insert into t(id, name) select id, name from t where id = 1")
+	sql, err = GenerateBoundQuery(plan.OuterQuery, map[string]interface{}{
+		"#values": [][]sqltypes.Value{{sqltypes.MakeNumeric([]byte("1")), sqltypes.MakeString([]byte("a"))}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sql != "insert into t(id, name) values (1, 'a')" {
+		t.Fatal(sql)
+	}
+
+	if _, err = GenerateBoundQuery(plan.OuterQuery, nil); err == nil {
+		t.Fatal("expect missing bind var error")
+	}
+}
+
+func TestGenerateNilAllocator(t *testing.T) {
+	stmt, err := sqlparser.Parse("select id, name from t where id in (1, 2) and name = 'x'", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sel := stmt.(*sqlparser.Select)
+	if q := GenerateFullQuery(sel, nil).Query; q != "select id, name from t where id in (1, 2) and name = 'x'" {
+		t.Fatal(q)
+	}
+	if q := GenerateFieldQuery(sel, nil).Query; q != "select id, name from t where 1 != 1" {
+		t.Fatal(q)
+	}
+	if q := GenerateSelectLimitQuery(sel, nil).Query; q != "select id, name from t where id in (1, 2) and name = 'x' limit :#maxLimit" {
+		t.Fatal(q)
+	}
+
+	plan, err := GetSqlExecPlan("update t set name = 'y' where id = 1", testGetTable, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.OuterQuery == nil {
+		t.Fatalf("%+v", plan)
+	}
+}
+
+func TestGenerateUnionLimitQuery(t *testing.T) {
+	tests := []struct {
+		sql  string
+		full string
+	}{
+		{"select id from t union all select id from u", "select id from t union all select id from u limit :#maxLimit"},
+		{"select id from t union select id from u union all select id from v", "select id from t union select id from u union all select id from v limit :#maxLimit"},
+		// the last limit is the one of the whole union
+		{"select id from t union all select id from u limit 10", "select id from t union all select id from u limit 10"},
+		// a branch limit leaves the union unbounded
+		{"select id from t limit 5 union all select id from u", "select id from t limit 5 union all select id from u limit :#maxLimit"},
+	}
+	for _, tt := range tests {
+		plan, err := GetSqlExecPlan(tt.sql, testGetTable, nil)
+		if err != nil {
+			t.Fatal(tt.sql, err)
+		}
+		if plan.PlanId != PLAN_PASS_SELECT || plan.FullQuery.Query != tt.full {
+			t.Errorf("%s: %v %s", tt.sql, plan.PlanId, plan.FullQuery.Query)
+		}
+	}
+}
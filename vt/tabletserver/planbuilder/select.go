@@ -5,20 +5,34 @@
 package planbuilder
 
 import (
-	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
 	"github.com/ngaut/arena"
+	"github.com/wandoulabs/cm/mysql"
 	"github.com/wandoulabs/cm/sqlparser"
 	"github.com/wandoulabs/cm/vt/schema"
 )
 
-func analyzeSelect(sel *sqlparser.Select, getTable TableGetter, alloc arena.ArenaAllocator) (plan *ExecPlan, err error) {
+func analyzeSelect(sel *sqlparser.Select, getTable TableGetter, alloc arena.ArenaAllocator, classifyOnly bool) (plan *ExecPlan, err error) {
 	// Default plan
+	// The field query is built even when classifyOnly is set, having
+	// none tells bind variables are used in the select list.
 	plan = &ExecPlan{
 		PlanId:     PLAN_PASS_SELECT,
 		FieldQuery: GenerateFieldQuery(sel, alloc),
 		//FullQuery:  GenerateSelectLimitQuery(sel),
 	}
 
+	if sel.Into != nil && RejectSelectInto {
+		return nil, errors.Annotatef(ErrSelectInto, "into %s %s", sel.Into.Type, sel.Into.File)
+	}
+
+	if err := checkJoinTypes(sel, getTable); err != nil {
+		return nil, err
+	}
+
 	// from
 	tableName, hasHints := analyzeFrom(sel.From)
 	if tableName == "" {
@@ -29,6 +43,19 @@ func analyzeSelect(sel *sqlparser.Select, getTable TableGetter, alloc arena.Aren
 	if err != nil {
 		return nil, err
 	}
+	if err := checkFullScan(sel.Where, tableInfo); err != nil {
+		return nil, err
+	}
+
+	// passed through whatever the table, once it is checked
+	if sel.Into != nil {
+		plan.Reason = REASON_INTO
+		return plan, nil
+	}
+	if hasNocacheHint(sel.Comments) {
+		plan.Reason = REASON_NOCACHE_HINT
+		return plan, nil
+	}
 
 	// There are bind variables in the SELECT list
 	if plan.FieldQuery == nil {
@@ -65,14 +92,19 @@ func analyzeSelect(sel *sqlparser.Select, getTable TableGetter, alloc arena.Aren
 	plan.ColumnNumbers = selects
 
 	// where
+	if sel.Where != nil && hasExists(sel.Where.Expr) {
+		plan.Reason = REASON_EXISTS
+		return plan, nil
+	}
 	conditions := analyzeWhere(sel.Where)
 	if conditions == nil {
 		plan.Reason = REASON_WHERE
 		return plan, nil
 	}
 
-	// order
-	if sel.OrderBy != nil {
+	// order, only pk plans can keep it, the proxy sorts their rows
+	orderBy := analyzeOrderBy(sel.OrderBy, selects, tableInfo)
+	if sel.OrderBy != nil && orderBy == nil {
 		plan.Reason = REASON_ORDER
 		return plan, nil
 	}
@@ -101,6 +133,15 @@ func analyzeSelect(sel *sqlparser.Select, getTable TableGetter, alloc arena.Aren
 		//todo:comment by liuqi, we do not need OuterQuery right now
 		//plan.OuterQuery = GenerateSelectOuterQuery(sel, tableInfo)
 		plan.PKValues = pkValues
+		plan.OrderBy = orderBy
+		return plan, nil
+	}
+	if missing := missingPKColumns(conditions, tableInfo.Indexes[0]); len(missing) != 0 {
+		plan.ReasonDetail = "missing PK column: " + strings.Join(missing, ", ")
+	}
+
+	if sel.OrderBy != nil {
+		plan.Reason = REASON_ORDER
 		return plan, nil
 	}
 
@@ -133,8 +174,10 @@ func analyzeSelect(sel *sqlparser.Select, getTable TableGetter, alloc arena.Aren
 		return plan, nil
 	}
 	plan.PlanId = PLAN_SELECT_SUBQUERY
-	plan.OuterQuery = GenerateSelectOuterQuery(sel, tableInfo, alloc)
-	plan.Subquery = GenerateSelectSubquery(sel, tableInfo, plan.IndexUsed, alloc)
+	if !classifyOnly {
+		plan.OuterQuery = GenerateSelectOuterQuery(sel, tableInfo, alloc)
+		plan.Subquery = GenerateSelectSubquery(sel, tableInfo, plan.IndexUsed, alloc)
+	}
 	return plan, nil
 }
 
@@ -155,7 +198,7 @@ func analyzeSelectExprs(exprs sqlparser.SelectExprs, table *schema.Table) (selec
 			}
 			colIndex := table.FindColumn(name)
 			if colIndex == -1 {
-				return nil, fmt.Errorf("column %s not found in table %s", name, table.Name)
+				return nil, errors.Annotatef(ErrBadField, "column %s in table %s", name, table.Name)
 			}
 			selects = append(selects, colIndex)
 		default:
@@ -165,8 +208,78 @@ func analyzeSelectExprs(exprs sqlparser.SelectExprs, table *schema.Table) (selec
 	return selects, nil
 }
 
+// LocalFunctions are the functions of no arguments the proxy answers
+// itself in the selects without FROM, LocalVariables the values of the
+// @@ variables by lower case name, see SetLocalVariables.
+var (
+	LocalFunctions = map[string]bool{
+		"database":       true,
+		"version":        true,
+		"user":           true,
+		"connection_id":  true,
+		"last_insert_id": true,
+		"row_count":      true,
+	}
+	LocalVariables = map[string]interface{}{
+		"@@version": mysql.ServerVersion,
+	}
+)
+
+// SetLocalVariables replaces LocalVariables with vars and @@version.
+// The values that are integers are kept as int64.
+func SetLocalVariables(vars map[string]string) {
+	m := make(map[string]interface{}, len(vars)+1)
+	m["@@version"] = mysql.ServerVersion
+	for name, value := range vars {
+		name = "@@" + strings.ToLower(strings.TrimPrefix(name, "@@"))
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			m[name] = n
+		} else {
+			m[name] = value
+		}
+	}
+	LocalVariables = m
+}
+
+// analyzeSimpleSelect plans the selects without FROM, like SELECT 1 or
+// SELECT @@version. They read no table and can run on any backend,
+// unless the proxy knows all they select.
+func analyzeSimpleSelect(sel *sqlparser.SimpleSelect, alloc arena.ArenaAllocator) *ExecPlan {
+	return &ExecPlan{
+		PlanId:     PLAN_PASS_SELECT,
+		Reason:     REASON_TABLE,
+		FieldQuery: GenerateFieldQuery(sel, alloc),
+		FullQuery:  GenerateFullQuery(sel, alloc),
+		Local:      IsLocalSelect(sel),
+	}
+}
+
+// IsLocalSelect tells if every expression of sel is one of
+// LocalFunctions or LocalVariables.
+func IsLocalSelect(sel *sqlparser.SimpleSelect) bool {
+	for _, expr := range sel.SelectExprs {
+		nonStar, ok := expr.(*sqlparser.NonStarExpr)
+		if !ok {
+			return false
+		}
+		switch v := nonStar.Expr.(type) {
+		case *sqlparser.FuncExpr:
+			if len(v.Exprs) != 0 || !LocalFunctions[strings.ToLower(string(v.Name))] {
+				return false
+			}
+		case *sqlparser.ColName:
+			if _, ok := LocalVariables[strings.ToLower(string(v.Name))]; !ok || v.Qualifier != nil {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 func analyzeFrom(tableExprs sqlparser.TableExprs) (tablename string, hasHints bool) {
-	if len(tableExprs) > 1 {
+	if len(tableExprs) != 1 {
 		return "", false
 	}
 
@@ -214,7 +327,7 @@ func analyzeBoolean(node sqlparser.BoolExpr) (conditions []sqlparser.BoolExpr) {
 				return []sqlparser.BoolExpr{node}
 			}
 		case node.Operator == sqlparser.AST_IN:
-			if sqlparser.IsColName(node.Left) && sqlparser.IsSimpleTuple(node.Right) {
+			if sqlparser.IsColName(node.Left) && isINTuple(node.Right) {
 				return []sqlparser.BoolExpr{node}
 			}
 		}
@@ -228,3 +341,103 @@ func analyzeBoolean(node sqlparser.BoolExpr) (conditions []sqlparser.BoolExpr) {
 	}
 	return nil
 }
+
+// analyzeOrderBy returns the sort keys of orderBy, nil if it is empty or
+// not only on plain selected columns the proxy sorts like the backend,
+// see sortableColumn.
+func analyzeOrderBy(orderBy sqlparser.OrderBy, selects []int, tableInfo *schema.Table) []mysql.SortKey {
+	if orderBy == nil {
+		return nil
+	}
+	keys := make([]mysql.SortKey, 0, len(orderBy))
+	for _, order := range orderBy {
+		col, ok := order.Expr.(*sqlparser.ColName)
+		if !ok {
+			return nil
+		}
+		index := tableInfo.FindColumn(string(col.Name))
+		selected := false
+		for _, cnum := range selects {
+			if cnum == index {
+				selected = true
+				break
+			}
+		}
+		if index == -1 || !selected || !sortableColumn(tableInfo.Columns[index]) {
+			return nil
+		}
+		direction := mysql.SortAsc
+		if order.Direction == sqlparser.AST_DESC {
+			direction = mysql.SortDesc
+		}
+		keys = append(keys, mysql.SortKey{Name: tableInfo.Columns[index].Name, Direction: direction})
+	}
+	return keys
+}
+
+// sortableColumn tells if the cached values of col sort like the backend
+// sorts them: numbers, which are decoded, and binary strings. Decimals,
+// enums and strings of other collations don't sort bytewise.
+func sortableColumn(col schema.TableColumn) bool {
+	switch col.SqlType {
+	case mysql.MYSQL_TYPE_TINY, mysql.MYSQL_TYPE_SHORT, mysql.MYSQL_TYPE_INT24, mysql.MYSQL_TYPE_LONG,
+		mysql.MYSQL_TYPE_LONGLONG, mysql.MYSQL_TYPE_YEAR, mysql.MYSQL_TYPE_FLOAT, mysql.MYSQL_TYPE_DOUBLE:
+		return true
+	}
+	return strings.HasPrefix(col.Type, "binary") || strings.HasPrefix(col.Type, "varbinary")
+}
+
+// hasExists reports whether node has an EXISTS subquery in any of its
+// branches. Such filters depend on other rows and can't be served
+// from the row cache.
+func hasExists(node sqlparser.BoolExpr) bool {
+	switch node := node.(type) {
+	case *sqlparser.ExistsExpr:
+		return true
+	case *sqlparser.AndExpr:
+		return hasExists(node.Left) || hasExists(node.Right)
+	case *sqlparser.OrExpr:
+		return hasExists(node.Left) || hasExists(node.Right)
+	case *sqlparser.NotExpr:
+		return hasExists(node.Expr)
+	case *sqlparser.ParenBoolExpr:
+		return hasExists(node.Expr)
+	}
+	return false
+}
+
+// isINTuple is like sqlparser.IsSimpleTuple, but it also accepts
+// NULLs as long as there's at least one real value. NULL never
+// matches anything in an IN list, so getPKValues drops it.
+func isINTuple(node sqlparser.ValExpr) bool {
+	vals, ok := node.(sqlparser.ValTuple)
+	if !ok {
+		return sqlparser.IsSimpleTuple(node)
+	}
+	hasValue := false
+	for _, n := range vals {
+		if _, ok := n.(*sqlparser.NullVal); ok {
+			continue
+		}
+		if !sqlparser.IsValue(n) {
+			return false
+		}
+		hasValue = true
+	}
+	return hasValue
+}
+
+// hasNocacheHint tells if comments have a /* nocache */ hint, which
+// makes the select bypass the row cache.
+func hasNocacheHint(comments sqlparser.Comments) bool {
+	for _, comment := range comments {
+		c := strings.TrimSpace(string(comment))
+		if !strings.HasPrefix(c, "/*") || !strings.HasSuffix(c, "*/") {
+			continue
+		}
+		if strings.EqualFold(strings.TrimSpace(c[2:len(c)-2]), "nocache") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,301 @@
+package planbuilder
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/arena"
+	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/vt/schema"
+)
+
+func newTestTable() *schema.Table {
+	ta := schema.NewTable("t")
+	ta.AddColumn("id", "int(11)", "", nil, "auto_increment")
+	ta.AddColumn("name", "varchar(32)", "utf8_general_ci", nil, "")
+	ta.AddColumn("email", "varchar(64)", "utf8_general_ci", nil, "")
+
+	pk := ta.AddIndex("PRIMARY")
+	pk.AddColumn("id", 0)
+	name := ta.AddIndex("idx_name")
+	name.AddColumn("name", 0)
+
+	ta.PKColumns = []int{0}
+	ta.CacheType = schema.CACHE_RW
+	return ta
+}
+
+func testGetTable(name string) (*schema.Table, bool) {
+	if name != "t" {
+		return nil, false
+	}
+	return newTestTable(), true
+}
+
+func getTestPlan(t *testing.T, sql string) *ExecPlan {
+	plan, err := GetSqlExecPlan(sql, testGetTable, arena.NewArenaAllocator(1024))
+	if err != nil {
+		t.Fatal(sql, err)
+	}
+	return plan
+}
+
+func TestPKInWithNull(t *testing.T) {
+	plan := getTestPlan(t, "select * from t where id in (1, null, 3)")
+	if plan.PlanId != PLAN_PK_IN {
+		t.Fatal(plan.PlanId, plan.Reason)
+	}
+	vals, ok := plan.PKValues[0].([]interface{})
+	if !ok || len(vals) != 2 {
+		t.Fatal(plan.PKValues)
+	}
+	for _, v := range vals {
+		if v == nil {
+			t.Fatal(plan.PKValues)
+		}
+	}
+
+	plan = getTestPlan(t, "select * from t where id in (null)")
+	if plan.PlanId == PLAN_PK_IN {
+		t.Fatal(plan.PKValues)
+	}
+}
+
+func TestSelectExists(t *testing.T) {
+	for _, sql := range []string{
+		"select * from t where exists (select 1 from t2 where t2.id = 1)",
+		"select * from t where id = 1 and exists (select 1 from t2 where t2.id = t.id)",
+		"select * from t where id = 1 or not (exists (select 1 from t2 where t2.id = t.id))",
+	} {
+		plan := getTestPlan(t, sql)
+		if plan.PlanId != PLAN_PASS_SELECT || plan.Reason != REASON_EXISTS {
+			t.Fatal(sql, plan.PlanId, plan.Reason)
+		}
+		if plan.FieldQuery == nil || plan.FieldQuery.Query != "select * from t where 1 != 1" {
+			t.Fatal(sql, plan.FieldQuery)
+		}
+	}
+
+	plan := getTestPlan(t, "select * from t where id = 1")
+	if plan.PlanId != PLAN_PK_IN {
+		t.Fatal(plan.PlanId, plan.Reason)
+	}
+}
+
+func TestFullScan(t *testing.T) {
+	MaxFullScanRows = 1000
+	defer func() { MaxFullScanRows = 0 }()
+
+	var rows uint64
+	getTable := func(name string) (*schema.Table, bool) {
+		ta, ok := testGetTable(name)
+		if ok {
+			ta.EstimatedRows = rows
+		}
+		return ta, ok
+	}
+
+	cases := []struct {
+		sql      string
+		fullScan bool
+	}{
+		{"select * from t where id = 1", false},
+		{"select * from t where name = 'a' and email = 'b'", false},
+		{"select * from t where id > 10", false},
+		{"select * from t where email = 'b'", true},
+		{"select * from t", true},
+		{"select /* nocache */ * from t where email = 'b'", true},
+		{"select * from t where email = 'b' into outfile '/tmp/t.txt'", true},
+		{"select * from t where id = 1 or email = 'b'", false},
+		{"update t set email = 'b' where name = 'a'", false},
+		{"update t set name = 'a' where email = 'b'", true},
+		{"delete from t where id in (1, 2)", false},
+		{"delete from t", true},
+	}
+	for _, size := range []uint64{10, 10000} {
+		rows = size
+		for _, c := range cases {
+			_, err := GetSqlExecPlan(c.sql, getTable, arena.NewArenaAllocator(1024))
+			expect := c.fullScan && size > MaxFullScanRows
+			if (errors.Cause(err) == ErrFullScan) != expect {
+				t.Fatal(size, c.sql, err)
+			}
+			if !expect && err != nil {
+				t.Fatal(size, c.sql, err)
+			}
+		}
+	}
+}
+
+func TestSelectUserVars(t *testing.T) {
+	for _, sql := range []string{
+		"select @x := 1",
+		"select * from t where id = @x",
+		"/* comment */ select id from t where id = @x",
+	} {
+		plan := getTestPlan(t, sql)
+		if plan.PlanId != PLAN_PASS_SELECT || plan.Reason != REASON_USER_VAR {
+			t.Fatal(sql, plan.PlanId, plan.Reason)
+		}
+		if planId, reason, err := CanOptimize(sql, testGetTable, arena.NewArenaAllocator(1024)); err != nil || planId != PLAN_PASS_SELECT || reason != REASON_USER_VAR {
+			t.Fatal(sql, planId, reason, err)
+		}
+	}
+
+	// system variables and quoted @ are not user variables
+	for _, sql := range []string{
+		"select * from t where id = 1 and @@autocommit = 1",
+		"select * from t where id = 1 and name = '@x'",
+	} {
+		if plan := getTestPlan(t, sql); plan.Reason == REASON_USER_VAR {
+			t.Fatal(sql)
+		}
+	}
+
+	// DMLs keep their plan so the rows they change get invalidated
+	if plan := getTestPlan(t, "update t set name = @x where id = 1"); plan.PlanId != PLAN_DML_PK {
+		t.Fatal(plan.PlanId, plan.Reason)
+	}
+}
+
+func TestPKInOrderBy(t *testing.T) {
+	plan := getTestPlan(t, "select id, name from t where id in (3, 1, 2) order by id desc limit 2")
+	if plan.PlanId != PLAN_PK_IN || plan.Limit != int64(2) {
+		t.Fatal(plan.PlanId, plan.Reason, plan.Limit)
+	}
+	expect := []mysql.SortKey{{Name: "id", Direction: mysql.SortDesc}}
+	if !reflect.DeepEqual(plan.OrderBy, expect) {
+		t.Fatal(plan.OrderBy)
+	}
+
+	// the proxy can only sort on the columns it returns, and bytewise,
+	// which isn't how a utf8_general_ci column sorts
+	for _, sql := range []string{
+		"select id from t where id in (3, 1, 2) order by name",
+		"select id, name from t where id in (3, 1, 2) order by length(name)",
+		"select id, name from t where id in (3, 1, 2) order by name desc, id",
+		"select * from t where name = 'a' order by id",
+	} {
+		if plan := getTestPlan(t, sql); plan.PlanId != PLAN_PASS_SELECT || plan.Reason != REASON_ORDER {
+			t.Fatal(sql, plan.PlanId, plan.Reason)
+		}
+	}
+}
+
+func TestSelectInto(t *testing.T) {
+	defer func(v bool) { RejectSelectInto = v }(RejectSelectInto)
+
+	sql := "select * from t where id = 1 into outfile '/tmp/t.txt'"
+	RejectSelectInto = false
+	plan := getTestPlan(t, sql)
+	if plan.PlanId != PLAN_PASS_SELECT || plan.Reason != REASON_INTO {
+		t.Fatal(plan.PlanId, plan.Reason)
+	}
+	if q := plan.FieldQuery.Query; q != "select * from t where 1 != 1" {
+		t.Fatal(q)
+	}
+
+	RejectSelectInto = true
+	if _, err := GetSqlExecPlan(sql, testGetTable, arena.NewArenaAllocator(1024)); errors.Cause(err) != ErrSelectInto {
+		t.Fatal(err)
+	}
+	if plan := getTestPlan(t, "select * from t where id = 1"); plan.PlanId != PLAN_PK_IN {
+		t.Fatal(plan.PlanId, plan.Reason)
+	}
+}
+
+func TestMissingPKColumns(t *testing.T) {
+	getTable := func(name string) (*schema.Table, bool) {
+		ta := schema.NewTable("c")
+		ta.AddColumn("a", "int(11)", "", nil, "")
+		ta.AddColumn("b", "int(11)", "", nil, "")
+		ta.AddColumn("v", "varchar(32)", "utf8_general_ci", nil, "")
+		pk := ta.AddIndex("PRIMARY")
+		pk.AddColumn("a", 0)
+		pk.AddColumn("b", 0)
+		ta.PKColumns = []int{0, 1}
+		ta.CacheType = schema.CACHE_RW
+		return ta, name == "c"
+	}
+
+	tests := []struct {
+		sql    string
+		detail string
+	}{
+		{"select * from c where a = 1", "missing PK column: b"},
+		{"select * from c where b in (1, 2) and v = 'x'", "missing PK column: a"},
+		{"select * from c where v = 'x'", ""},
+		{"select * from c where a > 1", ""},
+	}
+	for _, tt := range tests {
+		plan, err := GetSqlExecPlan(tt.sql, getTable, arena.NewArenaAllocator(1024))
+		if err != nil {
+			t.Fatal(tt.sql, err)
+		}
+		if plan.PlanId == PLAN_PK_IN || plan.ReasonDetail != tt.detail {
+			t.Errorf("%s: %v %q, want detail %q", tt.sql, plan.PlanId, plan.ReasonDetail, tt.detail)
+		}
+	}
+
+	plan, err := GetSqlExecPlan("select * from c where a = 1 and b = 2", getTable, arena.NewArenaAllocator(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.PlanId != PLAN_PK_IN || plan.ReasonDetail != "" {
+		t.Fatal(plan.PlanId, plan.ReasonDetail)
+	}
+}
+
+func TestNocacheHint(t *testing.T) {
+	plan := getTestPlan(t, "select * from t where id = 1")
+	if plan.PlanId != PLAN_PK_IN {
+		t.Fatal(plan.PlanId, plan.Reason)
+	}
+
+	for _, sql := range []string{
+		"select /* nocache */ * from t where id = 1",
+		"select /*NOCACHE*/ * from t where id = 1",
+		"select /* x */ /* nocache */ * from t where id = 1",
+	} {
+		plan := getTestPlan(t, sql)
+		if plan.PlanId != PLAN_PASS_SELECT || plan.Reason != REASON_NOCACHE_HINT || plan.PKValues != nil {
+			t.Fatal(sql, plan.PlanId, plan.Reason)
+		}
+	}
+
+	// hinted selects are still checked
+	if _, err := GetSqlExecPlan("select /* nocache */ * from unknown", testGetTable, arena.NewArenaAllocator(1024)); err == nil {
+		t.Fatal("unknown table not rejected")
+	}
+
+	// only a comment of its own is a hint
+	plan = getTestPlan(t, "select /* nocache please */ * from t where id = 1")
+	if plan.PlanId != PLAN_PK_IN {
+		t.Fatal(plan.PlanId, plan.Reason)
+	}
+}
+
+func TestSelectWithoutFrom(t *testing.T) {
+	cases := []struct {
+		sql   string
+		full  string
+		local bool
+	}{
+		{"select 1", "select 1", false},
+		{"select now()", "select now()", false},
+		{"select @@sql_mode", "select @@sql_mode", false},
+		{"select @@version", "select @@version", true},
+		{"SELECT DATABASE(), @@VERSION as v", "select DATABASE(), @@version as v", true},
+		{"select database(), 1", "select database(), 1", false},
+	}
+	for _, c := range cases {
+		plan := getTestPlan(t, c.sql)
+		if plan.PlanId != PLAN_PASS_SELECT || plan.Reason != REASON_TABLE || plan.TableName != "" {
+			t.Fatal(c.sql, plan.PlanId, plan.Reason, plan.TableName)
+		}
+		if plan.FullQuery.Query != c.full || plan.Local != c.local {
+			t.Fatal(c.sql, plan.FullQuery.Query, plan.Local)
+		}
+	}
+}
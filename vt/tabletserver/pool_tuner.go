@@ -0,0 +1,81 @@
+package tabletserver
+
+import (
+	"time"
+
+	log "github.com/ngaut/logging"
+	"github.com/ngaut/timer"
+)
+
+const (
+	tuneInterval = 10 * time.Second
+
+	// Grow the pool if more than tuneGrowWaits Gets had to wait
+	// for a connection during the last interval.
+	tuneGrowWaits = 10
+)
+
+// poolTuner resizes a CachePool between minCap and maxCap based on
+// how often callers had to wait for a connection.
+type poolTuner struct {
+	cachePool     *CachePool
+	ticks         *timer.Timer
+	minCap        int64
+	maxCap        int64
+	lastWaitCount int64
+}
+
+func newPoolTuner(cachePool *CachePool, minCap, maxCap int64) *poolTuner {
+	return &poolTuner{
+		cachePool: cachePool,
+		ticks:     timer.NewTimer(tuneInterval),
+		minCap:    minCap,
+		maxCap:    maxCap,
+	}
+}
+
+func (t *poolTuner) Open() {
+	t.ticks.Start(t.tune)
+}
+
+func (t *poolTuner) Close() {
+	t.ticks.Stop()
+}
+
+func (t *poolTuner) tune() {
+	pool := t.cachePool.getPool()
+	if pool == nil {
+		return
+	}
+	capacity := pool.Capacity()
+	newCap := t.nextCapacity(capacity, pool.Available(), pool.WaitCount())
+	if newCap == capacity {
+		return
+	}
+	log.Infof("resizing rowcache pool from %d to %d", capacity, newCap)
+	if err := t.cachePool.SetCapacity(int(newCap)); err != nil {
+		log.Warningf("can't resize rowcache pool: %v", err)
+	}
+}
+
+// nextCapacity returns the capacity the pool should have given its
+// current usage: it grows by half when callers keep waiting and
+// shrinks by a quarter when more than half of it is idle.
+func (t *poolTuner) nextCapacity(capacity, available, waitCount int64) int64 {
+	waits := waitCount - t.lastWaitCount
+	t.lastWaitCount = waitCount
+
+	switch {
+	case waits > tuneGrowWaits:
+		capacity += capacity/2 + 1
+	case waits == 0 && available > capacity/2:
+		capacity -= capacity / 4
+	}
+	if capacity > t.maxCap {
+		capacity = t.maxCap
+	}
+	if capacity < t.minCap {
+		capacity = t.minCap
+	}
+	return capacity
+}
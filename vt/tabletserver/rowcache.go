@@ -6,9 +6,15 @@ package tabletserver
 
 import (
 	"encoding/binary"
+	"fmt"
+	"reflect"
 	"strconv"
+	"sync"
+	"time"
 
+	"github.com/ngaut/cache"
 	log "github.com/ngaut/logging"
+	"github.com/ngaut/sync2"
 
 	"github.com/wandoulabs/cm/mysql"
 	"github.com/wandoulabs/cm/vt/schema"
@@ -24,12 +30,89 @@ const (
 
 	// MAX_DATA_LEN prevents large rows from being inserted in rowcache.
 	MAX_DATA_LEN = 8000
+
+	// MAX_TRACKED_WRITES bounds the write times kept per table for
+	// the access age stats.
+	MAX_TRACKED_WRITES = 10000
+
+	// MAX_TRACKED_READS bounds the rows whose reads are counted per
+	// table until they are admitted in the cache.
+	MAX_TRACKED_READS = 10000
 )
 
+// AccessAgeBuckets are the upper bounds of the access age buckets,
+// hits on entries older than the last one are counted as older.
+var AccessAgeBuckets = []time.Duration{time.Minute, 10 * time.Minute, time.Hour, 24 * time.Hour}
+
+var timeNow = time.Now
+
+type writeTime time.Time
+
+func (wt writeTime) Size() int {
+	return 1
+}
+
+// AccessAges counts cache hits by the age of the entry they hit, the
+// time since this proxy wrote it. Hits on entries written elsewhere
+// or no longer tracked are counted as unknown.
+type AccessAges struct {
+	buckets []sync2.AtomicInt64
+	unknown sync2.AtomicInt64
+}
+
+func newAccessAges() *AccessAges {
+	return &AccessAges{buckets: make([]sync2.AtomicInt64, len(AccessAgeBuckets)+1)}
+}
+
+func (aa *AccessAges) record(age time.Duration) {
+	i := 0
+	for i < len(AccessAgeBuckets) && age >= AccessAgeBuckets[i] {
+		i++
+	}
+	aa.buckets[i].Add(1)
+}
+
+// Counts returns the hits of each bucket in AccessAgeBuckets order,
+// followed by the older and the unknown ones.
+func (aa *AccessAges) Counts() []int64 {
+	counts := make([]int64, 0, len(aa.buckets)+1)
+	for i := range aa.buckets {
+		counts = append(counts, aa.buckets[i].Get())
+	}
+	return append(counts, aa.unknown.Get())
+}
+
+func (aa *AccessAges) StatsJSON() string {
+	counts := aa.Counts()
+	s := "{"
+	for i, bound := range AccessAgeBuckets {
+		s += fmt.Sprintf("\"%v\": %v, ", bound, counts[i])
+	}
+	n := len(AccessAgeBuckets)
+	return s + fmt.Sprintf("\"older\": %v, \"unknown\": %v}", counts[n], counts[n+1])
+}
+
+// readCount counts the reads of a row not admitted in the cache yet,
+// since the start of the window.
+type readCount struct {
+	count int
+	since time.Time
+}
+
+func (rc readCount) Size() int {
+	return 1
+}
+
 type RowCache struct {
-	tableInfo *TableInfo
-	prefix    string
-	cachePool *CachePool
+	tableInfo  *TableInfo
+	cachePool  *CachePool
+	mu         sync.Mutex
+	prefix     string
+	generation int64
+	written    *cache.LRUCache
+	ages       *AccessAges
+	// reads has the readCount of the rows missed, see admit
+	reads *cache.LRUCache
 }
 
 type RCResult struct {
@@ -38,31 +121,109 @@ type RCResult struct {
 }
 
 func NewRowCache(tableInfo *TableInfo, cachePool *CachePool) *RowCache {
-	prefix := strconv.FormatInt(GetMaxPrefix(), 36) + "."
-	return &RowCache{tableInfo, prefix, cachePool}
+	return &RowCache{
+		tableInfo:  tableInfo,
+		cachePool:  cachePool,
+		prefix:     newPrefix(),
+		generation: cachePool.Generation(),
+		written:    cache.NewLRUCache(MAX_TRACKED_WRITES),
+		ages:       newAccessAges(),
+		reads:      cache.NewLRUCache(MAX_TRACKED_READS),
+	}
+}
+
+// AccessAges returns the age distribution of the hits on this table.
+func (rc *RowCache) AccessAges() *AccessAges {
+	return rc.ages
+}
+
+func (rc *RowCache) recordAccess(mkey string, now time.Time) {
+	if wt, ok := rc.written.Peek(mkey); ok {
+		rc.ages.record(now.Sub(time.Time(wt.(writeTime))))
+	} else {
+		rc.ages.unknown.Add(1)
+	}
+}
+
+func newPrefix() string {
+	return strconv.FormatInt(GetMaxPrefix(), 36) + "."
+}
+
+// getPrefix returns the key prefix of the table, switching to a fresh
+// one if the cache pool was flushed since it was last used.
+func (rc *RowCache) getPrefix() string {
+	gen := rc.cachePool.Generation()
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.generation != gen {
+		rc.prefix = newPrefix()
+		rc.generation = gen
+	}
+	return rc.prefix
+}
+
+// Flush logically drops the cached rows of the table by switching it to
+// a fresh prefix, the old entries are left to expire.
+func (rc *RowCache) Flush() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.prefix = newPrefix()
+}
+
+func (rc *RowCache) keyPrefix() string {
+	return rc.cachePool.Namespace + rc.getPrefix()
+}
+
+// CacheKey returns the memcached key the row of key is stored under.
+func (rc *RowCache) CacheKey(key string) string {
+	return rc.keyPrefix() + key
 }
 
 func (rc *RowCache) Get(keys []string, tcs []schema.TableColumn) (results map[string]RCResult) {
+	return rc.get(keys, tcs, true)
+}
+
+// Peek is Get without touching the slow op log and the access ages.
+func (rc *RowCache) Peek(keys []string, tcs []schema.TableColumn) (results map[string]RCResult) {
+	return rc.get(keys, tcs, false)
+}
+
+func (rc *RowCache) get(keys []string, tcs []schema.TableColumn, record bool) (results map[string]RCResult) {
+	prefix := rc.keyPrefix()
 	mkeys := make([]string, 0, len(keys))
 	for _, key := range keys {
 		if len(key) > MAX_KEY_LEN {
 			continue
 		}
-		mkeys = append(mkeys, rc.prefix+key)
+		mkeys = append(mkeys, prefix+key)
 	}
 
-	prefixlen := len(rc.prefix)
-	conn := rc.cachePool.Get(0)
-	// This is not the same as defer rc.cachePool.Put(conn)
-	defer func() { rc.cachePool.Put(conn) }()
+	prefixlen := len(prefix)
+	affinityKey := ""
+	if len(mkeys) > 0 {
+		affinityKey = mkeys[0]
+	}
+	conn := rc.cachePool.GetFor(affinityKey, 0)
+	if conn == nil {
+		// all miss, the backends have the rows
+		return map[string]RCResult{}
+	}
+	// This is not the same as defer rc.cachePool.PutFor(affinityKey, conn)
+	defer func() { rc.cachePool.PutFor(affinityKey, conn) }()
 
+	start := time.Now()
 	mcresults, err := conn.Gets(mkeys...)
+	// one round trip, recorded once under its first key
+	if record && len(mkeys) > 0 {
+		rc.cachePool.recordOp("Get", mkeys[0], start)
+	}
 	if err != nil {
 		conn.Close()
 		conn = nil
 		log.Fatalf("%s", err)
 	}
 	results = make(map[string]RCResult, len(mkeys))
+	now := timeNow()
 	for _, mcresult := range mcresults {
 		if mcresult.Flags == RC_DELETED {
 			// The row was recently invalidated.
@@ -75,6 +236,9 @@ func (rc *RowCache) Get(keys []string, tcs []schema.TableColumn) (results map[st
 		if row == nil {
 			log.Fatalf("Corrupt data for %s", mcresult.Key)
 		}
+		if record {
+			rc.recordAccess(mcresult.Key, now)
+		}
 		results[mcresult.Key[prefixlen:]] = RCResult{Row: row, Cas: mcresult.Cas}
 	}
 	return
@@ -85,11 +249,24 @@ func (rc *RowCache) Set(key string, row []byte, cas uint64) {
 		return
 	}
 
-	conn := rc.cachePool.Get(0)
-	defer func() { rc.cachePool.Put(conn) }()
-	mkey := rc.prefix + key
+	mkey := rc.CacheKey(key)
+	if cas == 0 && !rc.admit(mkey) {
+		return
+	}
+	if !rc.cachePool.fits(mkey, row) {
+		// memcached would refuse it anyway
+		log.Debugf("row of %d bytes too large to cache: %s", len(row), mkey)
+		return
+	}
+
+	conn := rc.cachePool.GetFor(mkey, 0)
+	if conn == nil {
+		return
+	}
+	defer func() { rc.cachePool.PutFor(mkey, conn) }()
 
 	var err error
+	start := time.Now()
 	if cas == 0 {
 		// Either caller didn't find the value at all
 		// or they didn't look for it in the first place.
@@ -98,27 +275,153 @@ func (rc *RowCache) Set(key string, row []byte, cas uint64) {
 		// Caller is trying to update a row that recently changed.
 		_, err = conn.Cas(mkey, 0, 0, row, cas)
 	}
+	rc.cachePool.recordOp("Set", mkey, start)
 	if err != nil {
 		conn.Close()
 		conn = nil
 		log.Fatalf("%s", err)
 	}
+	rc.written.Set(mkey, writeTime(timeNow()))
+}
+
+// admit counts a read of the row of mkey that missed the cache and
+// tells if it was read AdmitAfter times within AdmitWindow, and can be
+// cached. Rows invalidated since they were cached are set with a cas
+// and don't go through it.
+func (rc *RowCache) admit(mkey string) bool {
+	cp := rc.cachePool
+	if cp.AdmitAfter <= 1 {
+		return true
+	}
+	now := timeNow()
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	reads := readCount{count: 1, since: now}
+	if v, ok := rc.reads.Get(mkey); ok {
+		if last := v.(readCount); now.Sub(last.since) < cp.AdmitWindow {
+			reads = readCount{count: last.count + 1, since: last.since}
+		}
+	}
+	if reads.count >= cp.AdmitAfter {
+		rc.reads.Delete(mkey)
+		return true
+	}
+	rc.reads.Set(mkey, reads)
+	cp.notAdmitted.Add(1)
+	GetMetrics().Counter("cache_pool_not_admitted", cp.metricLabels(), 1)
+	return false
 }
 
 func (rc *RowCache) Delete(key string) {
 	if len(key) > MAX_KEY_LEN {
 		return
 	}
-	conn := rc.cachePool.Get(0)
-	defer func() { rc.cachePool.Put(conn) }()
-	mkey := rc.prefix + key
+	mkey := rc.CacheKey(key)
+	conn := rc.cachePool.GetFor(mkey, 0)
+	if conn == nil {
+		// memcached isn't running, it starts empty
+		return
+	}
+	defer func() { rc.cachePool.PutFor(mkey, conn) }()
 
-	_, err := conn.Set(mkey, RC_DELETED, rc.cachePool.DeleteExpiry, nil)
+	start := time.Now()
+	_, err := conn.Set(mkey, RC_DELETED, rc.deleteExpiry(), nil)
+	rc.cachePool.recordOp("Delete", mkey, start)
 	if err != nil {
 		conn.Close()
 		conn = nil
 		log.Fatalf("%s", err)
 	}
+	rc.written.Delete(mkey)
+}
+
+// Rewrite replaces the given columns of the cached row of key with
+// values, text encoded like the backend sends them. It tells if the row
+// was rewritten: a missing or invalidated row is left alone, and so is
+// one that changed since it was read, which the caller should delete.
+func (rc *RowCache) Rewrite(key string, columns []int, values [][]byte) bool {
+	if len(key) > MAX_KEY_LEN {
+		return false
+	}
+	mkey := rc.CacheKey(key)
+	conn := rc.cachePool.GetFor(mkey, 0)
+	if conn == nil {
+		return false
+	}
+	defer func() { rc.cachePool.PutFor(mkey, conn) }()
+
+	start := time.Now()
+	mcresults, err := conn.Gets(mkey)
+	if err != nil {
+		conn.Close()
+		conn = nil
+		log.Fatalf("%s", err)
+	}
+	if len(mcresults) == 0 || mcresults[0].Flags == RC_DELETED {
+		return false
+	}
+	row, ok := rewriteRow(mcresults[0].Value, columns, values)
+	if !ok || !rc.cachePool.fits(mkey, row) {
+		return false
+	}
+	stored, err := conn.Cas(mkey, 0, 0, row, mcresults[0].Cas)
+	rc.cachePool.recordOp("Rewrite", mkey, start)
+	if err != nil {
+		conn.Close()
+		conn = nil
+		log.Fatalf("%s", err)
+	}
+	if stored {
+		rc.written.Set(mkey, writeTime(timeNow()))
+	}
+	return stored
+}
+
+// rewriteRow returns row with its columns replaced by values, false if
+// row doesn't have them.
+func rewriteRow(row []byte, columns []int, values [][]byte) ([]byte, bool) {
+	replaced := make(map[int][]byte, len(columns))
+	for i, col := range columns {
+		replaced[col] = values[i]
+	}
+	b := make([]byte, 0, len(row))
+	for col := 0; len(row) > 0; col++ {
+		n, err := mysql.SkipLengthEnodedString(row)
+		if err != nil {
+			return nil, false
+		}
+		if v, ok := replaced[col]; ok {
+			b = mysql.AppendLengthEncodedString(b, v)
+			delete(replaced, col)
+		} else {
+			b = append(b, row[:n]...)
+		}
+		row = row[n:]
+	}
+	return b, len(replaced) == 0
+}
+
+// Repair compares cached, the cached row of key, with row as the backend
+// has it, nil if it has none, and corrects the cache if they differ. It
+// tells if the cache was wrong.
+func (rc *RowCache) Repair(key string, cached RCResult, row []byte, tcs []schema.TableColumn) bool {
+	if row != nil && reflect.DeepEqual(rc.decodeRow(row, tcs), cached.Row) {
+		return false
+	}
+	if row == nil {
+		rc.Delete(key)
+	} else {
+		// a dml may have invalidated it since, that one wins
+		rc.Set(key, row, cached.Cas)
+	}
+	return true
+}
+
+func (rc *RowCache) deleteExpiry() uint64 {
+	if rc.tableInfo != nil && rc.tableInfo.DeleteExpiry != 0 {
+		return rc.tableInfo.DeleteExpiry
+	}
+	return rc.cachePool.DeleteExpiry
 }
 
 func (rc *RowCache) decodeRow(b []byte, tcs []schema.TableColumn) mysql.RowValue {
@@ -0,0 +1,259 @@
+package tabletserver
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/vt/schema"
+	"github.com/wandoulabs/cm/vt/tabletserver/fakecache"
+)
+
+func TestSlowCacheOps(t *testing.T) {
+	fm := fakecache.New()
+	defer fm.Close()
+	cp := newFakeCachePool(fm, 1)
+	cp.SlowThreshold = 10 * time.Millisecond
+	rc := NewRowCache(nil, cp)
+
+	rc.Set("1", []byte("a"), 0)
+	if n := len(cp.RecentSlowOps()); n != 0 {
+		t.Fatal(n)
+	}
+
+	fm.SetDelay(20 * time.Millisecond)
+	rc.Set("2", []byte("b"), 0)
+	rc.Delete("1")
+	rc.Get([]string{"3"}, nil)
+
+	counts := cp.SlowOps()
+	if counts["Set"] != 1 || counts["Delete"] != 1 || counts["Get"] != 1 {
+		t.Fatal(counts)
+	}
+	ops := cp.RecentSlowOps()
+	if len(ops) != 3 || ops[0].Op != "Set" || ops[0].Key != rc.getPrefix()+"2" || ops[0].Duration < cp.SlowThreshold {
+		t.Fatalf("%+v", ops)
+	}
+
+	cp.rowCacheConfig.RedactSlowKeys = true
+	rc.Delete("2")
+	ops = cp.RecentSlowOps()
+	if key := ops[len(ops)-1].Key; key != rc.getPrefix()+"?" {
+		t.Fatal(key)
+	}
+}
+
+func TestCacheKeyNamespace(t *testing.T) {
+	fm := fakecache.New()
+	defer fm.Close()
+
+	// two deployments sharing memcached start with the same prefixes
+	var caches []*RowCache
+	for _, ns := range []string{"prod:", "test:"} {
+		cp := newFakeCachePool(fm, 1)
+		cp.Namespace = ns
+		rc := NewRowCache(nil, cp)
+		rc.prefix = "1."
+		caches = append(caches, rc)
+	}
+
+	prod, test := caches[0], caches[1]
+	if prod.CacheKey("42") != "prod:1.42" || test.CacheKey("42") != "test:1.42" {
+		t.Fatal(prod.CacheKey("42"), test.CacheKey("42"))
+	}
+
+	prod.Set("42", []byte("a"), 0)
+	test.Set("42", []byte("b"), 0)
+	for key, value := range map[string]string{"prod:1.42": "a", "test:1.42": "b"} {
+		if item, ok := fm.Item(key); !ok || string(item.Value) != value {
+			t.Fatal(key, item, ok)
+		}
+	}
+}
+
+func TestAccessAges(t *testing.T) {
+	fm := fakecache.New()
+	defer fm.Close()
+	rc := NewRowCache(nil, newFakeCachePool(fm, 1))
+
+	start := time.Now()
+	defer func() { timeNow = time.Now }()
+	at := func(d time.Duration) {
+		timeNow = func() time.Time { return start.Add(d) }
+	}
+
+	tcs := []schema.TableColumn{{Name: "id", SqlType: mysql.MYSQL_TYPE_LONGLONG}}
+	row := mysql.AppendLengthEncodedString(nil, []byte("1"))
+	at(0)
+	rc.Set("1", row, 0)
+	at(time.Hour)
+	rc.Set("2", row, 0)
+	other := NewRowCache(nil, rc.cachePool) // another proxy
+	other.prefix = rc.prefix
+	other.Set("3", row, 0)
+
+	for _, d := range []time.Duration{time.Hour + 30*time.Second, 2 * time.Hour, 48 * time.Hour} {
+		at(d)
+		rc.Get([]string{"1", "2", "3"}, tcs)
+	}
+
+	// key 1 is 1h0m30s, 2h and 48h old, key 2 30s, 1h and 47h
+	expect := []int64{1, 0, 0, 3, 2, 3}
+	if counts := rc.AccessAges().Counts(); !reflect.DeepEqual(counts, expect) {
+		t.Fatal(counts)
+	}
+
+	rc.Delete("1")
+	if _, ok := rc.written.Peek(rc.CacheKey("1")); ok {
+		t.Fatal("deleted row still tracked")
+	}
+}
+
+func TestMaxItemSize(t *testing.T) {
+	config := RowCacheConfig{Binary: "memcached", MaxItemSize: 2048}
+	if flags := config.GetSubprocessFlags(); !reflect.DeepEqual(flags, []string{"memcached", "-I", "2048"}) {
+		t.Fatal(flags)
+	}
+
+	fm := fakecache.New()
+	defer fm.Close()
+	cp := newFakeCachePool(fm, 1)
+	cp.MaxItemSize = config.MaxItemSize
+	rc := NewRowCache(nil, cp)
+
+	rc.Set("1", make([]byte, 100), 0)
+	rc.Set("2", make([]byte, 4096), 0)
+	if _, ok := fm.Item(rc.CacheKey("1")); !ok {
+		t.Fatal("small row not cached")
+	}
+	if _, ok := fm.Item(rc.CacheKey("2")); ok {
+		t.Fatal("oversized row cached")
+	}
+	if n := cp.OversizedSkips(); n != 1 {
+		t.Fatal(n)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	fm := fakecache.New()
+	defer fm.Close()
+	rc := NewRowCache(nil, newFakeCachePool(fm, 1))
+	tcs := []schema.TableColumn{{Name: "id", SqlType: mysql.MYSQL_TYPE_LONG}, {Name: "name", SqlType: mysql.MYSQL_TYPE_VAR_STRING}}
+	row := func(id, name string) []byte {
+		return append(append([]byte{byte(len(id))}, id...), append([]byte{byte(len(name))}, name...)...)
+	}
+
+	rc.Set("1", row("1", "a"), 0)
+	cached := rc.Get([]string{"1"}, tcs)["1"]
+	if rc.Repair("1", cached, row("1", "a"), tcs) {
+		t.Fatal("same row repaired")
+	}
+
+	// an invalidation went missing, the backend has another name
+	if !rc.Repair("1", cached, row("1", "b"), tcs) {
+		t.Fatal("stale row not repaired")
+	}
+	if got := rc.Get([]string{"1"}, tcs)["1"]; !reflect.DeepEqual(got.Row, mysql.RowValue{int64(1), []byte("b")}) {
+		t.Fatalf("%#v", got.Row)
+	}
+
+	// the backend has no row
+	cached = rc.Get([]string{"1"}, tcs)["1"]
+	if !rc.Repair("1", cached, nil, tcs) {
+		t.Fatal("deleted row not repaired")
+	}
+	if got := rc.Get([]string{"1"}, tcs)["1"]; got.Row != nil {
+		t.Fatalf("%#v", got.Row)
+	}
+
+	// a dml invalidated the row since it was read, it's left alone
+	rc.Set("2", row("2", "a"), 0)
+	cached = rc.Get([]string{"2"}, tcs)["2"]
+	rc.Delete("2")
+	rc.Repair("2", cached, row("2", "b"), tcs)
+	if got := rc.Get([]string{"2"}, tcs)["2"]; got.Row != nil {
+		t.Fatalf("%#v", got.Row)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	fm := fakecache.New()
+	defer fm.Close()
+	rc := NewRowCache(nil, newFakeCachePool(fm, 1))
+	tcs := []schema.TableColumn{{Name: "id", SqlType: mysql.MYSQL_TYPE_LONG}, {Name: "name", SqlType: mysql.MYSQL_TYPE_VAR_STRING}, {Name: "email", SqlType: mysql.MYSQL_TYPE_VAR_STRING}}
+	row := []byte{1, '1', 1, 'a', 0xfb}
+
+	if rc.Rewrite("1", []int{1}, [][]byte{[]byte("b")}) {
+		t.Fatal("missing row rewritten")
+	}
+	rc.Set("1", row, 0)
+	if !rc.Rewrite("1", []int{2, 1}, [][]byte{[]byte("x@y"), []byte("bc")}) {
+		t.Fatal("row not rewritten")
+	}
+	got := rc.Get([]string{"1"}, tcs)["1"]
+	if !reflect.DeepEqual(got.Row, mysql.RowValue{int64(1), []byte("bc"), []byte("x@y")}) {
+		t.Fatalf("%#v", got.Row)
+	}
+
+	// a column the row doesn't have, an invalidated row
+	if rc.Rewrite("1", []int{3}, [][]byte{[]byte("b")}) {
+		t.Fatal("short row rewritten")
+	}
+	rc.Delete("1")
+	if rc.Rewrite("1", []int{1}, [][]byte{[]byte("b")}) {
+		t.Fatal("deleted row rewritten")
+	}
+}
+
+func TestAdmitAfter(t *testing.T) {
+	defer func(f func() time.Time) { timeNow = f }(timeNow)
+	now := time.Unix(1000000, 0)
+	timeNow = func() time.Time { return now }
+
+	fm := fakecache.New()
+	defer fm.Close()
+	cp := newFakeCachePool(fm, 1)
+	cp.AdmitAfter = 3
+	cp.AdmitWindow = time.Minute
+	rc := NewRowCache(nil, cp)
+	cached := func(key string) bool {
+		_, ok := fm.Item(rc.CacheKey(key))
+		return ok
+	}
+
+	rc.Set("1", []byte("a"), 0)
+	rc.Set("1", []byte("a"), 0)
+	if cached("1") {
+		t.Fatal("cached before the threshold")
+	}
+	rc.Set("1", []byte("a"), 0)
+	if !cached("1") {
+		t.Fatal("not cached at the threshold")
+	}
+
+	// the reads of another window don't add up
+	rc.Set("2", []byte("b"), 0)
+	rc.Set("2", []byte("b"), 0)
+	now = now.Add(2 * time.Minute)
+	rc.Set("2", []byte("b"), 0)
+	if cached("2") {
+		t.Fatal("cached across windows")
+	}
+	rc.Set("2", []byte("b"), 0)
+	rc.Set("2", []byte("b"), 0)
+	if !cached("2") {
+		t.Fatal("not cached at the threshold")
+	}
+	if n := cp.NotAdmitted(); n != 6 {
+		t.Fatal(n)
+	}
+
+	// invalidated rows are set back right away
+	rc.Delete("1")
+	got := rc.Get([]string{"1"}, nil)["1"]
+	rc.Set("1", []byte("c"), got.Cas)
+	if item, ok := fm.Item(rc.CacheKey("1")); !ok || string(item.Value) != "c" {
+		t.Fatal(item, ok)
+	}
+}
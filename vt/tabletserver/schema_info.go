@@ -5,23 +5,36 @@
 package tabletserver
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/juju/errors"
+	"github.com/ngaut/arena"
 	"github.com/ngaut/cache"
+	"github.com/ngaut/lockring"
 	log "github.com/ngaut/logging"
+	"github.com/ngaut/sync2"
 	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/sqlparser"
 	"github.com/wandoulabs/cm/sqltypes"
 	"github.com/wandoulabs/cm/vt/schema"
 	"github.com/wandoulabs/cm/vt/tabletserver/planbuilder"
 )
 
-const base_show_tables = "select table_name, table_type, unix_timestamp(create_time), table_comment from information_schema.tables where table_schema = database()"
+const base_show_tables = "select table_name, table_type, unix_timestamp(create_time), table_comment, table_rows from information_schema.tables where table_schema = database()"
 
 const maxTableCount = 10000
 
+// defaultQueryCacheSize is the number of plans GetPlan keeps, the
+// queries of literal values each have their own.
+const defaultQueryCacheSize = 5000
+
 type ExecPlan struct {
 	*planbuilder.ExecPlan
 	TableInfo  *TableInfo
@@ -30,6 +43,10 @@ type ExecPlan struct {
 	Time       time.Duration
 	RowCount   int64
 	ErrorCount int64
+	// hits counts the times GetPlan served the plan from the cache.
+	hits sync2.AtomicInt64
+	// labels of the metrics of the queries of the plan
+	labels Labels
 }
 
 func (*ExecPlan) Size() int {
@@ -68,19 +85,38 @@ type SchemaOverride struct {
 }
 
 type SchemaInfo struct {
+	// mu guards tables, which the schema refresh and the DDLs of the
+	// clients change while the other clients plan on them.
+	mu         sync.RWMutex
 	tables     map[string]*TableInfo
 	overrides  []SchemaOverride
 	queries    *cache.LRUCache
 	cachePool  *CachePool
 	connPool   *mysql.DB
 	lastChange time.Time
+	// done stops the schema refresh when closed.
+	done chan struct{}
 }
 
-func NewSchemaInfo(rowCacheConf RowCacheConfig, dbAddr string, user, pwd, dbName string, overrides []SchemaOverride) *SchemaInfo {
+// SchemaRefreshInterval is how often the tables are reloaded from the
+// backend, and saved to the schema snapshot if any. Zero reloads them
+// only once, in the background when they were loaded from the snapshot.
+var SchemaRefreshInterval time.Duration
+
+// schemaRetryInterval is how long the reload of the tables of a
+// snapshot waits after failing, the backend being down, before retrying.
+var schemaRetryInterval = 10 * time.Second
+
+// NewSchemaInfo loads the tables of overrides from the backend. If
+// snapshot, the path of a schema snapshot, is set they are loaded from it
+// instead when it can be read, and reloaded from the backend in the
+// background. They are saved to it once loaded from the backend.
+func NewSchemaInfo(rowCacheConf RowCacheConfig, dbAddr string, user, pwd, dbName string, overrides []SchemaOverride, snapshot string) *SchemaInfo {
 	si := &SchemaInfo{
-		queries:   cache.NewLRUCache(128 * 1024 * 1024),
+		queries:   cache.NewLRUCache(defaultQueryCacheSize),
 		tables:    make(map[string]*TableInfo),
 		cachePool: NewCachePool(dbName, rowCacheConf, 3*time.Second, 3*time.Second),
+		done:      make(chan struct{}),
 	}
 
 	var err error
@@ -94,69 +130,196 @@ func NewSchemaInfo(rowCacheConf RowCacheConfig, dbAddr string, user, pwd, dbName
 	log.Infof("%+v", si.overrides)
 	si.cachePool.Open()
 
-	for _, or := range si.overrides {
-		si.CreateOrUpdateTable(or.Name)
+	if err := si.load(snapshot); err != nil {
+		log.Fatal(errors.ErrorStack(err))
+	}
+
+	return si
+}
+
+// load loads the tables from snapshot if it can be read, reloading them
+// from the backend in the background, and from the backend otherwise.
+func (si *SchemaInfo) load(snapshot string) error {
+	if snapshot != "" {
+		err := si.LoadFrom(snapshot)
+		if err == nil {
+			si.mu.Lock()
+			si.override()
+			si.mu.Unlock()
+			log.Infof("schema loaded from %s", snapshot)
+			go si.refresh(snapshot, true)
+			return nil
+		}
+		if !os.IsNotExist(errors.Cause(err)) {
+			log.Warningf("schema snapshot not loaded: %v", errors.ErrorStack(err))
+		}
+	}
+
+	if err := si.reload(); err != nil {
+		return errors.Trace(err)
 	}
+	si.saveSnapshot(snapshot)
+	go si.refresh(snapshot, false)
+	return nil
+}
 
-	si.override()
+// reload loads the tables of the overrides from the backend, which
+// CreateOrUpdateTable applies the overrides to.
+func (si *SchemaInfo) reload() error {
+	si.mu.RLock()
+	overrides := si.overrides
+	si.mu.RUnlock()
+	for _, or := range overrides {
+		if err := si.CreateOrUpdateTable(or.Name); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
 
+// refresh reloads the tables every SchemaRefreshInterval and saves them
+// to snapshot. The stale tables of a snapshot are reloaded first, until
+// the backend answers.
+func (si *SchemaInfo) refresh(snapshot string, stale bool) {
+	for stale || SchemaRefreshInterval > 0 {
+		wait := SchemaRefreshInterval
+		if stale {
+			wait = 0
+		}
+		select {
+		case <-si.done:
+			return
+		case <-time.After(wait):
+		}
+
+		if err := si.reload(); err != nil {
+			log.Warningf("schema not reloaded: %v", errors.ErrorStack(err))
+			if stale {
+				select {
+				case <-si.done:
+					return
+				case <-time.After(schemaRetryInterval):
+				}
+			}
+			continue
+		}
+		stale = false
+		si.saveSnapshot(snapshot)
+	}
+}
+
+// saveSnapshot saves the tables to snapshot if set. Failing to is
+// logged only, the snapshot just gets older.
+func (si *SchemaInfo) saveSnapshot(snapshot string) {
+	if snapshot == "" {
+		return
+	}
+	if err := si.SaveTo(snapshot); err != nil {
+		log.Warningf("schema snapshot not saved: %v", errors.ErrorStack(err))
+	}
+}
+
+// NewSchemaInfoOf serves tables as they are given rather than loaded
+// from a backend, caching the rows of the CACHE_RW ones in cachePool.
+func NewSchemaInfoOf(cachePool *CachePool, tables ...*schema.Table) *SchemaInfo {
+	si := &SchemaInfo{
+		queries:   cache.NewLRUCache(defaultQueryCacheSize),
+		tables:    make(map[string]*TableInfo, len(tables)),
+		cachePool: cachePool,
+		done:      make(chan struct{}),
+	}
+	for _, table := range tables {
+		ti := &TableInfo{Table: table, Lock: lockring.New(65536)}
+		if table.CacheType == schema.CACHE_RW && !cachePool.IsClosed() {
+			ti.Cache = NewRowCache(ti, cachePool)
+		}
+		si.tables[table.Name] = ti
+	}
 	return si
 }
 
+// override applies the overrides to the tables, with si.mu held.
 func (si *SchemaInfo) override() {
 	for _, override := range si.overrides {
-		table, ok := si.tables[override.Name]
-		if !ok {
-			log.Warningf("Table not found for override: %v, %v", override, si.tables)
-			continue
-		}
-		if override.PKColumns != nil {
-			log.Infof("SetPK Table name %s, pk %v", override.Name, override.PKColumns)
-			if err := table.SetPK(override.PKColumns); err != nil {
-				log.Errorf("%s: %v", errors.ErrorStack(err), override)
-				continue
-			}
+		si.applyOverride(override)
+	}
+}
+
+// overrideTable applies its overrides to tableName, just loaded, and
+// has the CACHE_W tables sharing its cache use its new one, with si.mu
+// held.
+func (si *SchemaInfo) overrideTable(tableName string) {
+	for _, override := range si.overrides {
+		if override.Name == tableName {
+			si.applyOverride(override)
 		}
-		if si.cachePool.IsClosed() || override.Cache == nil {
-			log.Infof("%+v", override)
-			continue
+	}
+	for _, override := range si.overrides {
+		if override.Name != tableName && override.Cache != nil && override.Cache.Table == tableName {
+			si.applyOverride(override)
 		}
+	}
+}
 
-		switch override.Cache.Type {
-		case "RW":
-			table.CacheType = schema.CACHE_RW
-			table.Cache = NewRowCache(table, si.cachePool)
-		case "W":
-			table.CacheType = schema.CACHE_W
-			if len(override.Cache.Table) == 0 {
-				log.Warningf("Incomplete cache specs: %v", override)
-				continue
-			}
+func (si *SchemaInfo) applyOverride(override SchemaOverride) {
+	table, ok := si.tables[override.Name]
+	if !ok {
+		log.Warningf("Table not found for override: %v, %v", override, si.tables)
+		return
+	}
+	if override.PKColumns != nil {
+		log.Infof("SetPK Table name %s, pk %v", override.Name, override.PKColumns)
+		if err := table.SetPK(override.PKColumns); err != nil {
+			log.Errorf("%s: %v", errors.ErrorStack(err), override)
+			return
+		}
+	}
+	if si.cachePool.IsClosed() || override.Cache == nil {
+		log.Infof("%+v", override)
+		return
+	}
 
-			totable, ok := si.tables[override.Cache.Table]
-			if !ok {
-				log.Warningf("Table not found: %v", override)
-				continue
-			}
+	switch override.Cache.Type {
+	case "RW":
+		table.CacheType = schema.CACHE_RW
+		table.Cache = NewRowCache(table, si.cachePool)
+	case "W":
+		table.CacheType = schema.CACHE_W
+		if len(override.Cache.Table) == 0 {
+			log.Warningf("Incomplete cache specs: %v", override)
+			return
+		}
 
-			if totable.Cache == nil {
-				log.Warningf("Table has no cache: %v", override)
-				continue
-			}
+		totable, ok := si.tables[override.Cache.Table]
+		if !ok {
+			log.Warningf("Table not found: %v", override)
+			return
+		}
 
-			table.Cache = totable.Cache
-		default:
-			log.Warningf("Ignoring cache override: %+v", override)
+		if totable.Cache == nil {
+			log.Warningf("Table has no cache: %v", override)
+			return
 		}
+
+		table.Cache = totable.Cache
+	default:
+		log.Warningf("Ignoring cache override: %+v", override)
 	}
 }
 
 func (si *SchemaInfo) Close() {
+	if si.done != nil {
+		close(si.done)
+	}
+	si.mu.Lock()
 	si.tables = nil
 	si.overrides = nil
+	si.mu.Unlock()
 	si.queries.Clear()
 	si.cachePool.Close()
-	si.connPool.Close()
+	if si.connPool != nil {
+		si.connPool.Close()
+	}
 }
 
 func (si *SchemaInfo) Exec(sql string) (result *mysql.Result, err error) {
@@ -174,10 +337,12 @@ func (si *SchemaInfo) Exec(sql string) (result *mysql.Result, err error) {
 	return result, err
 }
 
-func (si *SchemaInfo) CreateOrUpdateTable(tableName string) {
+// CreateOrUpdateTable loads tableName from the backend, replacing the
+// loaded one if any. Only failing to reach the backend is an error.
+func (si *SchemaInfo) CreateOrUpdateTable(tableName string) error {
 	conn, err := si.connPool.PopConn()
 	if err != nil {
-		log.Fatal(err)
+		return errors.Trace(err)
 	}
 
 	defer func() {
@@ -186,7 +351,7 @@ func (si *SchemaInfo) CreateOrUpdateTable(tableName string) {
 
 	tables, err := conn.Execute(fmt.Sprintf("%s and table_name = '%s'", base_show_tables, tableName))
 	if err != nil {
-		log.Fatalf("Error fetching table %s: %v", tableName, err)
+		return errors.Annotatef(err, "fetching table %s", tableName)
 	}
 	/*
 		if len(tables.Rows) != 1 {
@@ -197,13 +362,13 @@ func (si *SchemaInfo) CreateOrUpdateTable(tableName string) {
 
 	if len(tables.Values) == 0 { //table not exist
 		log.Warningf("table %s not exist", tableName)
-		return
+		return nil
 	}
 
 	create_time, err := sqltypes.BuildValue(tables.Values[0][2]) // create_time
 	if err != nil {
 		log.Error(err)
-		return
+		return nil
 	}
 
 	tableInfo, err := NewTableInfo(
@@ -217,37 +382,120 @@ func (si *SchemaInfo) CreateOrUpdateTable(tableName string) {
 	if err != nil {
 		// This can happen if DDLs race with each other.
 		log.Error(err)
-		return
+		return nil
+	}
+
+	switch rows := tables.Values[0][4].(type) { // table_rows, NULL for views
+	case uint64:
+		tableInfo.EstimatedRows = rows
+	case int64:
+		tableInfo.EstimatedRows = uint64(rows)
 	}
 
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	if si.tables == nil {
+		// closed while loading
+		return nil
+	}
 	if _, ok := si.tables[tableName]; ok {
 		// If the table already exists, we overwrite it with the latest info.
-		// This also means that the query cache needs to be cleared.
+		// This also means that its plans need to be dropped.
 		// Otherwise, the query plans may not be in sync with the schema.
-		si.queries.Clear()
+		si.InvalidatePlansForTable(tableName)
 		log.Infof("Updating table %s", tableName)
 	}
 	si.tables[tableName] = tableInfo
+	si.overrideTable(tableName)
 
-	if tableInfo.CacheType == schema.CACHE_NONE {
+	if tableInfo.Cache == nil {
 		log.Infof("Initialized table: %s", tableName)
 	} else {
-		log.Infof("Initialized cached table: %s, prefix: %s", tableName, tableInfo.Cache.prefix)
+		log.Infof("Initialized cached table: %s, prefix: %s", tableName, tableInfo.Cache.getPrefix())
 	}
+	return nil
 }
 
 func (si *SchemaInfo) DropTable(tableName string) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
 	delete(si.tables, tableName)
-	si.queries.Clear()
+	si.InvalidatePlansForTable(tableName)
 	log.Infof("Table %s forgotten", tableName)
 }
 
+// AlterTable follows an ALTER TABLE, applying it to the loaded table
+// when ApplyAlter can and reloading the table otherwise.
+func (si *SchemaInfo) AlterTable(ddl *sqlparser.DDL) {
+	tableName := string(ddl.Table)
+	si.mu.Lock()
+	ti, ok := si.tables[tableName]
+	if !ok {
+		si.mu.Unlock()
+		return
+	}
+	err := ApplyAlter(ti, ddl)
+	if err == nil {
+		si.InvalidatePlansForTable(tableName)
+		si.mu.Unlock()
+		log.Infof("Table %s altered", tableName)
+		return
+	}
+	si.mu.Unlock()
+
+	log.Infof("Reloading table %s: %v", tableName, err)
+	if err := si.CreateOrUpdateTable(tableName); err != nil {
+		log.Errorf("table %s not reloaded: %v", tableName, errors.ErrorStack(err))
+	}
+}
+
+// FlushCache drops the cached rows of tableNames, of all the tables if
+// empty. Unknown and uncached tables are ignored.
+func (si *SchemaInfo) FlushCache(tableNames []string) {
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+	if len(tableNames) == 0 {
+		// the cache pool may hold the rows of other dbs
+		for name := range si.tables {
+			tableNames = append(tableNames, name)
+		}
+	}
+	for _, name := range tableNames {
+		if ti := si.tables[name]; ti != nil && ti.Cache != nil {
+			ti.Cache.Flush()
+			log.Infof("Table %s rowcache flushed", name)
+		}
+	}
+}
+
 func (si *SchemaInfo) GetTable(tableName string) *TableInfo {
+	si.mu.RLock()
 	ti := si.tables[tableName]
+	si.mu.RUnlock()
 	return ti
 }
 
+// SchemaTable returns the schema of tableName to plan with. The tables
+// of information_schema, which are not loaded, are planned as uncached
+// tables of no known column.
+func (si *SchemaInfo) SchemaTable(tableName string) (*schema.Table, bool) {
+	ti := si.GetTable(tableName)
+	if ti == nil {
+		log.Debug("check if system table", tableName)
+		if strings.Index(strings.ToLower(tableName), "information_schema") >= 0 { //system table
+			return &schema.Table{
+				Name:      tableName,
+				CacheType: schema.CACHE_NONE,
+			}, true
+		}
+		return nil, false
+	}
+	return ti.Table, true
+}
+
 func (si *SchemaInfo) GetSchema() []*schema.Table {
+	si.mu.RLock()
+	defer si.mu.RUnlock()
 	tables := make([]*schema.Table, 0, len(si.tables))
 	for _, v := range si.tables {
 		tables = append(tables, v.Table)
@@ -256,6 +504,136 @@ func (si *SchemaInfo) GetSchema() []*schema.Table {
 	return tables
 }
 
+// ServeTableStats writes the cache stats of tableName, or the sorted
+// list of cached tables if tableName is empty.
+func (si *SchemaInfo) ServeTableStats(response http.ResponseWriter, tableName string) {
+	response.Header().Set("Content-Type", "application/json")
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+	if tableName == "" {
+		names := make([]string, 0, len(si.tables))
+		for name, ti := range si.tables {
+			if ti.CacheType != schema.CACHE_NONE {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		b, _ := json.Marshal(names)
+		response.Write(b)
+		return
+	}
+
+	ti, ok := si.tables[tableName]
+	if !ok {
+		http.Error(response, fmt.Sprintf("table %s not found", tableName), http.StatusNotFound)
+		return
+	}
+	response.Write([]byte(ti.StatsJSON()))
+}
+
+// GetPlan returns the plan of sql, planned against the loaded tables the
+// first time and cached until the schema of its table changes.
+func (si *SchemaInfo) GetPlan(sql string) (*ExecPlan, error) {
+	if planbuilder.InMaintenance() {
+		// the cached plans too
+		return nil, errors.Trace(planbuilder.ErrMaintenance)
+	}
+	if plan := si.getQuery(sql); plan != nil {
+		plan.hits.Add(1)
+		plan.report(true)
+		return plan, nil
+	}
+
+	// the plan outlives the query, it can't use a per query arena
+	splan, err := planbuilder.GetSqlExecPlan(sql, si.SchemaTable, arena.StdAllocator)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	plan := &ExecPlan{
+		ExecPlan:  splan,
+		TableInfo: si.GetTable(splan.TableName),
+		labels:    Labels{"plan": splan.PlanId.String(), "table": splan.TableName},
+	}
+	si.queries.Set(sql, plan)
+	plan.report(false)
+	length, _, _, _ := si.queries.Stats()
+	GetMetrics().Gauge("plan_cache_size", nil, length)
+	return plan, nil
+}
+
+// report counts a query of plan by plan type and table, and whether the
+// plan was cached.
+func (plan *ExecPlan) report(cached bool) {
+	m := GetMetrics()
+	m.Counter("plans", plan.labels, 1)
+	if cached {
+		m.Counter("plan_cache_hits", nil, 1)
+	} else {
+		m.Counter("plan_cache_misses", nil, 1)
+	}
+}
+
+// InvalidatePlansForTable drops the cached plans of tableName so that
+// they are planned again against its new schema. The plans of no single
+// table, like joins, may use it too and are dropped as well.
+func (si *SchemaInfo) InvalidatePlansForTable(tableName string) {
+	for _, sql := range si.queries.Keys() {
+		v, ok := si.queries.Peek(sql)
+		if !ok {
+			continue
+		}
+		if table := v.(*ExecPlan).TableName; table == tableName || table == "" {
+			si.queries.Delete(sql)
+		}
+	}
+}
+
+// planEntry describes a cached plan on /debug/plans/.
+type planEntry struct {
+	SQL        string
+	Normalized string
+	Table      string
+	PlanId     planbuilder.PlanType
+	Hits       int64
+}
+
+// ServePlans writes the cached plans sorted by sql, after evicting the
+// plan of the sql given in the evict parameter if any.
+func (si *SchemaInfo) ServePlans(response http.ResponseWriter, request *http.Request) {
+	if sql := request.FormValue("evict"); sql != "" {
+		if !si.queries.Delete(sql) {
+			http.Error(response, fmt.Sprintf("plan of %s not found", sql), http.StatusNotFound)
+			return
+		}
+		log.Infof("plan of %s evicted", sql)
+	}
+
+	keys := si.queries.Keys()
+	sort.Strings(keys)
+	entries := make([]planEntry, 0, len(keys))
+	for _, sql := range keys {
+		v, ok := si.queries.Peek(sql)
+		if !ok {
+			continue
+		}
+		plan := v.(*ExecPlan)
+		normalized, err := sqlparser.Normalize(sql, arena.StdAllocator)
+		if err != nil {
+			normalized = sql
+		}
+		entries = append(entries, planEntry{
+			SQL:        sql,
+			Normalized: normalized,
+			Table:      plan.TableName,
+			PlanId:     plan.PlanId,
+			Hits:       plan.hits.Get(),
+		})
+	}
+	response.Header().Set("Content-Type", "application/json")
+	b, _ := json.MarshalIndent(entries, "", "  ")
+	response.Write(b)
+}
+
 func (si *SchemaInfo) getQuery(sql string) *ExecPlan {
 	if cacheResult, ok := si.queries.Get(sql); ok {
 		return cacheResult.(*ExecPlan)
@@ -273,6 +651,8 @@ func (si *SchemaInfo) SetQueryCacheSize(size int) {
 
 func (si *SchemaInfo) getTableStats() map[string]int64 {
 	tstats := make(map[string]int64)
+	si.mu.RLock()
+	defer si.mu.RUnlock()
 	for k, v := range si.tables {
 		if v.CacheType != schema.CACHE_NONE {
 			hits, absent, misses, _ := v.Stats()
@@ -286,6 +666,8 @@ func (si *SchemaInfo) getTableStats() map[string]int64 {
 
 func (si *SchemaInfo) getTableInvalidations() map[string]int64 {
 	tstats := make(map[string]int64)
+	si.mu.RLock()
+	defer si.mu.RUnlock()
 	for k, v := range si.tables {
 		if v.CacheType != schema.CACHE_NONE {
 			_, _, _, invalidations := v.Stats()
@@ -0,0 +1,215 @@
+package tabletserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/ngaut/cache"
+	"github.com/wandoulabs/cm/vt/schema"
+)
+
+func newTestSchemaInfo() *SchemaInfo {
+	cp := NewCachePool("test", RowCacheConfig{}, 0, 0)
+	cached := &TableInfo{Table: schema.NewTable("cached")}
+	cached.CacheType = schema.CACHE_RW
+	cached.Cache = NewRowCache(cached, cp)
+	for i := 0; i < 3; i++ {
+		cached.RecordHit()
+	}
+	cached.RecordMiss()
+
+	return &SchemaInfo{
+		tables: map[string]*TableInfo{
+			"cached":  cached,
+			"nocache": &TableInfo{Table: schema.NewTable("nocache")},
+		},
+		cachePool: cp,
+	}
+}
+
+func TestServeTableStats(t *testing.T) {
+	si := newTestSchemaInfo()
+
+	cases := []struct {
+		table string
+		code  int
+		body  string
+	}{
+		{"", http.StatusOK, `["cached"]`},
+		{"cached", http.StatusOK, `{"Hits": 3, "Absent": 0, "Misses": 1, "Invalidations": 0, "Repairs": 0, "AccessAges": {"1m0s": 0, "10m0s": 0, "1h0m0s": 0, "24h0m0s": 0, "older": 0, "unknown": 0}}`},
+		{"nocache", http.StatusOK, `null`},
+		{"unknown", http.StatusNotFound, "table unknown not found\n"},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		si.ServeTableStats(w, c.table)
+		if w.Code != c.code || w.Body.String() != c.body {
+			t.Fatal(c.table, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestInvalidatePlansForTable(t *testing.T) {
+	newTable := func(name string, columns ...string) *TableInfo {
+		ti := &TableInfo{Table: schema.NewTable(name)}
+		for _, col := range columns {
+			ti.AddColumn(col, "int(11)", "", nil, "")
+		}
+		ti.AddIndex("PRIMARY").AddColumn(columns[0], 0)
+		ti.PKColumns = []int{0}
+		return ti
+	}
+	si := &SchemaInfo{
+		tables: map[string]*TableInfo{
+			"a": newTable("a", "id", "v"),
+			"b": newTable("b", "id"),
+		},
+		queries: cache.NewLRUCache(100),
+	}
+
+	sqls := []string{"select * from a where id = 1", "select * from b where id = 1", "select * from a join b on a.id = b.id"}
+	plans := make([]*ExecPlan, len(sqls))
+	for i, sql := range sqls {
+		plan, err := si.GetPlan(sql)
+		if err != nil {
+			t.Fatal(sql, err)
+		}
+		if again, _ := si.GetPlan(sql); again != plan {
+			t.Fatal("plan not cached", sql)
+		}
+		plans[i] = plan
+	}
+	if plans[0].TableInfo != si.tables["a"] {
+		t.Fatal(plans[0].TableInfo)
+	}
+
+	// a is reloaded with a new column, its plans and the join go
+	si.tables["a"] = newTable("a", "id", "v", "w")
+	si.InvalidatePlansForTable("a")
+	for i, sql := range sqls {
+		_, cached := si.queries.Peek(sql)
+		if cached != (i == 1) {
+			t.Fatal(sql, cached)
+		}
+	}
+
+	plan, err := si.GetPlan(sqls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan == plans[0] || plan.TableInfo != si.tables["a"] {
+		t.Fatal("plan of a not replanned")
+	}
+	if plan, _ := si.GetPlan(sqls[1]); plan != plans[1] {
+		t.Fatal("plan of b replanned")
+	}
+}
+
+func TestFlushCache(t *testing.T) {
+	si := newTestSchemaInfo()
+	other := &TableInfo{Table: schema.NewTable("other")}
+	other.CacheType = schema.CACHE_RW
+	other.Cache = NewRowCache(other, si.cachePool)
+	si.tables["other"] = other
+
+	cached, otherPrefix := si.tables["cached"].Cache.getPrefix(), other.Cache.getPrefix()
+	si.FlushCache([]string{"cached", "nocache", "unknown"})
+	if p := si.tables["cached"].Cache.getPrefix(); p == cached {
+		t.Fatal("cached not flushed", p)
+	}
+	if p := other.Cache.getPrefix(); p != otherPrefix {
+		t.Fatal("other flushed", p)
+	}
+
+	cached = si.tables["cached"].Cache.getPrefix()
+	generation := si.cachePool.Generation()
+	si.FlushCache(nil)
+	if si.cachePool.Generation() != generation {
+		t.Fatal("cache pool flushed")
+	}
+	if p := si.tables["cached"].Cache.getPrefix(); p == cached {
+		t.Fatal("cached not flushed", p)
+	}
+	if p := other.Cache.getPrefix(); p == otherPrefix {
+		t.Fatal("other not flushed", p)
+	}
+}
+
+func TestServePlans(t *testing.T) {
+	ti := &TableInfo{Table: schema.NewTable("a")}
+	ti.AddColumn("id", "int(11)", "", nil, "")
+	ti.AddIndex("PRIMARY").AddColumn("id", 0)
+	ti.PKColumns = []int{0}
+	si := &SchemaInfo{
+		tables:  map[string]*TableInfo{"a": ti},
+		queries: cache.NewLRUCache(100),
+	}
+	for _, sql := range []string{"select * from a where id = 1", "select * from a where id = 1", "delete from a where id = 2"} {
+		if _, err := si.GetPlan(sql); err != nil {
+			t.Fatal(sql, err)
+		}
+	}
+
+	type entry struct {
+		SQL, Normalized, Table, PlanId string
+		Hits                           int64
+	}
+	serve := func(url string) (int, []entry) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", url, nil)
+		si.ServePlans(w, req)
+		var entries []entry
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+				t.Fatal(err, w.Body.String())
+			}
+		}
+		return w.Code, entries
+	}
+
+	code, entries := serve("/debug/plans/test")
+	want := []entry{
+		{"delete from a where id = 2", "delete from a where id = ?", "a", "DML_PK", 0},
+		{"select * from a where id = 1", "select * from a where id = ?", "a", "PASS_SELECT", 1},
+	}
+	if code != http.StatusOK || !reflect.DeepEqual(entries, want) {
+		t.Fatalf("%d %+v", code, entries)
+	}
+
+	code, entries = serve("/debug/plans/test?evict=" + url.QueryEscape("delete from a where id = 2"))
+	if code != http.StatusOK || !reflect.DeepEqual(entries, want[1:]) {
+		t.Fatalf("%d %+v", code, entries)
+	}
+	if code, _ = serve("/debug/plans/test?evict=" + url.QueryEscape("delete from a where id = 2")); code != http.StatusNotFound {
+		t.Fatal(code)
+	}
+}
+
+func TestOverrideTable(t *testing.T) {
+	cp := newTestCachePool(1, 1)
+	si := NewSchemaInfoOf(cp)
+	si.overrides = []SchemaOverride{
+		{Name: "rw", PKColumns: []string{"id"}, Cache: &OverrideCacheDesc{Type: "RW", Table: "rw"}},
+		{Name: "w", Cache: &OverrideCacheDesc{Type: "W", Table: "rw"}},
+	}
+	si.tables["rw"] = newSnapshotTable("rw", schema.CACHE_NONE)
+	si.tables["w"] = newSnapshotTable("w", schema.CACHE_NONE)
+	si.override()
+	old := si.tables["rw"].Cache
+
+	// rw is reloaded as the backend has it
+	si.tables["rw"] = newSnapshotTable("rw", schema.CACHE_NONE)
+	si.overrideTable("rw")
+	rw, w := si.tables["rw"], si.tables["w"]
+	// SetPK lists the data columns of the primary key
+	if len(rw.Indexes[0].DataColumns) != 4 || rw.CacheType != schema.CACHE_RW || rw.Cache == nil || rw.Cache == old {
+		t.Fatal(rw.Indexes[0], rw.CacheType, rw.Cache)
+	}
+	if w.CacheType != schema.CACHE_W || w.Cache != rw.Cache {
+		t.Fatal(w.CacheType, w.Cache)
+	}
+}
@@ -0,0 +1,159 @@
+package tabletserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/lockring"
+	log "github.com/ngaut/logging"
+	"github.com/wandoulabs/cm/sqltypes"
+	"github.com/wandoulabs/cm/vt/schema"
+)
+
+// schemaSnapshotVersion must be bumped whenever the snapshot layout
+// changes, LoadFrom refuses snapshots of other versions.
+const schemaSnapshotVersion = 1
+
+type schemaSnapshot struct {
+	Version int
+	Tables  []*tableSnapshot
+}
+
+type tableSnapshot struct {
+	Name          string
+	Columns       []columnSnapshot
+	Indexes       []*schema.Index
+	PKColumns     []int
+	CacheType     int
+	EstimatedRows uint64
+	DeleteExpiry  uint64
+	PrimaryKey    []string
+	// CacheTable is the table whose cache a CACHE_W table shares.
+	CacheTable string `json:",omitempty"`
+}
+
+type columnSnapshot struct {
+	schema.TableColumn
+	// Default is nil for NULL, like SHOW COLUMNS reports it. HasDefault
+	// is unset for the columns whose default is ignored, like the
+	// auto_increment ones.
+	HasDefault bool
+	Default    *string
+}
+
+// SaveTo writes the loaded tables to path, so that a proxy can start
+// with them while the backend is slow or down.
+func (si *SchemaInfo) SaveTo(path string) error {
+	snapshot := &schemaSnapshot{Version: schemaSnapshotVersion}
+	si.mu.RLock()
+	for _, ti := range si.tables {
+		ts := &tableSnapshot{
+			Name:          ti.Name,
+			Indexes:       ti.Indexes,
+			PKColumns:     ti.PKColumns,
+			CacheType:     ti.CacheType,
+			EstimatedRows: ti.EstimatedRows,
+			DeleteExpiry:  ti.DeleteExpiry,
+			PrimaryKey:    ti.primaryKey,
+		}
+		for _, col := range ti.Columns {
+			cs := columnSnapshot{TableColumn: col, HasDefault: col.Default != nil}
+			if v, ok := col.Default.(sqltypes.Value); ok && !v.IsNull() {
+				s := v.String()
+				cs.Default = &s
+			}
+			cs.TableColumn.Default = nil
+			ts.Columns = append(ts.Columns, cs)
+		}
+		if ti.CacheType == schema.CACHE_W {
+			for name, other := range si.tables {
+				if other.CacheType == schema.CACHE_RW && other.Cache == ti.Cache {
+					ts.CacheTable = name
+				}
+			}
+		}
+		snapshot.Tables = append(snapshot.Tables, ts)
+	}
+	si.mu.RUnlock()
+	sort.Sort(tableSnapshots(snapshot.Tables))
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// write aside and rename, a crash must not leave half a snapshot
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmp, path))
+}
+
+// LoadFrom replaces the loaded tables with the ones saved to path by
+// SaveTo. The tables can then be refreshed from the backend in the
+// background with CreateOrUpdateTable.
+func (si *SchemaInfo) LoadFrom(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var snapshot schemaSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return errors.Annotatef(err, "schema snapshot %s", path)
+	}
+	if snapshot.Version != schemaSnapshotVersion {
+		return errors.Errorf("schema snapshot %s has version %d, expect %d", path, snapshot.Version, schemaSnapshotVersion)
+	}
+
+	tables := make(map[string]*TableInfo, len(snapshot.Tables))
+	for _, ts := range snapshot.Tables {
+		ti := &TableInfo{Table: schema.NewTable(ts.Name), Lock: lockring.New(65536)}
+		for _, cs := range ts.Columns {
+			col := cs.TableColumn
+			if cs.Default != nil {
+				col.Default = sqltypes.MakeString([]byte(*cs.Default))
+			} else if cs.HasDefault {
+				col.Default = sqltypes.NULL
+			}
+			ti.Columns = append(ti.Columns, col)
+		}
+		ti.Indexes = ts.Indexes
+		ti.PKColumns = ts.PKColumns
+		ti.CacheType = ts.CacheType
+		ti.EstimatedRows = ts.EstimatedRows
+		ti.DeleteExpiry = ts.DeleteExpiry
+		ti.primaryKey = ts.PrimaryKey
+		if ti.CacheType == schema.CACHE_RW && !si.cachePool.IsClosed() {
+			ti.Cache = NewRowCache(ti, si.cachePool)
+		}
+		tables[ts.Name] = ti
+	}
+
+	for _, ts := range snapshot.Tables {
+		if ts.CacheType != schema.CACHE_W {
+			continue
+		}
+		if from, ok := tables[ts.CacheTable]; ok && from.Cache != nil {
+			tables[ts.Name].Cache = from.Cache
+		} else {
+			log.Warningf("table %s shares the cache of missing table %s", ts.Name, ts.CacheTable)
+		}
+	}
+
+	si.mu.Lock()
+	si.tables = tables
+	si.mu.Unlock()
+	si.queries.Clear()
+	return nil
+}
+
+type tableSnapshots []*tableSnapshot
+
+func (ts tableSnapshots) Len() int           { return len(ts) }
+func (ts tableSnapshots) Less(i, j int) bool { return ts[i].Name < ts[j].Name }
+func (ts tableSnapshots) Swap(i, j int)      { ts[i], ts[j] = ts[j], ts[i] }
@@ -0,0 +1,125 @@
+package tabletserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ngaut/cache"
+	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/sqltypes"
+	"github.com/wandoulabs/cm/vt/schema"
+)
+
+func newSnapshotTable(name string, cacheType int) *TableInfo {
+	ti := &TableInfo{Table: schema.NewTable(name)}
+	ti.AddColumn("id", "bigint(20) unsigned", "", sqltypes.NULL, "auto_increment")
+	ti.AddColumn("name", "varchar(32)", "utf8_general_ci", sqltypes.MakeString([]byte("none")), "")
+	ti.AddColumn("price", "decimal(10,2)", "", sqltypes.MakeString([]byte("0.00")), "")
+	ti.AddColumn("note", "varchar(64)", "", sqltypes.NULL, "")
+	ti.AddIndex("PRIMARY").AddColumn("id", 0)
+	ti.AddIndex("idx_name").AddKeyPart("name", 7, 10, "D")
+	ti.PKColumns = []int{0}
+	ti.primaryKey = []string{"id"}
+	ti.CacheType = cacheType
+	ti.EstimatedRows = 1000
+	ti.DeleteExpiry = 60
+	return ti
+}
+
+func TestSchemaSnapshot(t *testing.T) {
+	cp := newTestCachePool(1, 1)
+	si := &SchemaInfo{tables: make(map[string]*TableInfo), queries: cache.NewLRUCache(1024), cachePool: cp}
+	for name, cacheType := range map[string]int{"rw": schema.CACHE_RW, "w": schema.CACHE_W, "none": schema.CACHE_NONE} {
+		si.tables[name] = newSnapshotTable(name, cacheType)
+	}
+	si.tables["rw"].Cache = NewRowCache(si.tables["rw"], cp)
+	si.tables["w"].Cache = si.tables["rw"].Cache
+
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "schema.json")
+
+	if err := si.SaveTo(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &SchemaInfo{tables: make(map[string]*TableInfo), queries: cache.NewLRUCache(1024), cachePool: cp}
+	if err := loaded.LoadFrom(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.tables) != 3 {
+		t.Fatal(loaded.tables)
+	}
+	for name, expect := range si.tables {
+		got := loaded.tables[name]
+		if got == nil || !reflect.DeepEqual(got.Table, expect.Table) {
+			t.Fatalf("%s: %+v", name, got)
+		}
+		if got.DeleteExpiry != 60 || !reflect.DeepEqual(got.primaryKey, expect.primaryKey) || got.Lock == nil {
+			t.Fatalf("%s: %+v", name, got)
+		}
+	}
+	rw, w, none := loaded.tables["rw"], loaded.tables["w"], loaded.tables["none"]
+	if rw.Cache == nil || w.Cache != rw.Cache || none.Cache != nil {
+		t.Fatal(rw.Cache, w.Cache, none.Cache)
+	}
+
+	// snapshots of another layout are refused
+	if err := ioutil.WriteFile(path, []byte(`{"Version": 99}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.LoadFrom(path); err == nil {
+		t.Fatal("expect version error")
+	}
+	if len(loaded.tables) != 3 {
+		t.Fatal("failed load must keep the tables")
+	}
+}
+
+func TestLoadSchemaSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "schema.json")
+
+	cp := newTestCachePool(1, 1)
+	saved := NewSchemaInfoOf(cp, newSnapshotTable("rw", schema.CACHE_RW).Table)
+	if err := saved.SaveTo(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// the backend is down
+	newSchemaInfo := func() *SchemaInfo {
+		si := NewSchemaInfoOf(cp)
+		si.connPool, _ = mysql.Open("127.0.0.1:1", "", "", "test")
+		si.overrides = []SchemaOverride{{Name: "rw", PKColumns: []string{"id"}}}
+		return si
+	}
+
+	// the tables of the snapshot are served while they are reloaded
+	si := newSchemaInfo()
+	if err := si.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if ti := si.GetTable("rw"); ti == nil || ti.Cache == nil {
+		t.Fatal(ti)
+	}
+	time.Sleep(10 * time.Millisecond)
+	si.Close()
+
+	// without one, starting needs the backend
+	si = newSchemaInfo()
+	defer si.Close()
+	if err := si.load(filepath.Join(dir, "missing.json")); err == nil {
+		t.Fatal("expect backend error")
+	}
+}
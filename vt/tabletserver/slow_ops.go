@@ -0,0 +1,66 @@
+package tabletserver
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxSlowOps = 32
+
+// SlowOp is a cache operation that took longer than the slow threshold.
+// A Get of several keys is one operation, Key is its first one.
+type SlowOp struct {
+	Op       string
+	Key      string
+	Duration time.Duration
+	Time     time.Time
+}
+
+// slowOpLog counts slow cache operations per op and keeps the
+// most recent ones around.
+type slowOpLog struct {
+	mu     sync.Mutex
+	counts map[string]int64
+	recent []SlowOp
+	next   int
+}
+
+func (l *slowOpLog) record(op SlowOp) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts == nil {
+		l.counts = make(map[string]int64)
+	}
+	l.counts[op.Op]++
+	if len(l.recent) < maxSlowOps {
+		l.recent = append(l.recent, op)
+		return
+	}
+	l.recent[l.next] = op
+	l.next = (l.next + 1) % maxSlowOps
+}
+
+func (l *slowOpLog) Counts() map[string]int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	counts := make(map[string]int64, len(l.counts))
+	for op, n := range l.counts {
+		counts[op] = n
+	}
+	return counts
+}
+
+// Recent returns the recorded slow ops, oldest first.
+func (l *slowOpLog) Recent() []SlowOp {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ops := make([]SlowOp, 0, len(l.recent))
+	ops = append(ops, l.recent[l.next:]...)
+	return append(ops, l.recent[:l.next]...)
+}
+
+// redactKey keeps the table prefix of a cache key and hides the pk values.
+func redactKey(key string) string {
+	return key[:strings.Index(key, ".")+1] + "?"
+}
@@ -0,0 +1,189 @@
+package tabletserver
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/sqlparser"
+	"github.com/wandoulabs/cm/sqltypes"
+	"github.com/wandoulabs/cm/vt/schema"
+)
+
+// ErrAlterUnsupported is returned by ApplyAlter for the ALTERs it can't
+// follow, the table has to be reloaded instead.
+var ErrAlterUnsupported = errors.New("alter not supported")
+
+// ApplyAlter applies the operations of an ALTER TABLE to the schema of
+// ti, which is left untouched on error. Adding, dropping or changing the
+// type of a column flushes the cached rows, which were encoded with the
+// old columns and would decode wrong.
+func ApplyAlter(ti *TableInfo, ddl *sqlparser.DDL) error {
+	if ddl.Action != sqlparser.AST_ALTER || ddl.Specs == nil {
+		return errors.Trace(ErrAlterUnsupported)
+	}
+
+	table := copyTable(ti.Table)
+	flush := false
+	for _, spec := range ddl.Specs {
+		if spec.Index {
+			if err := alterIndex(table, spec); err != nil {
+				return errors.Trace(err)
+			}
+			continue
+		}
+		changed, err := alterColumn(table, spec)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		flush = flush || changed
+	}
+
+	ti.Table = table
+	if flush {
+		ti.fieldsMu.Lock()
+		ti.fields = nil
+		ti.fieldsMu.Unlock()
+		if ti.Cache != nil {
+			ti.Cache.Flush()
+		}
+	}
+	return nil
+}
+
+// copyTable copies the columns and indexes of ta so that they can be
+// changed without the readers of ta seeing it.
+func copyTable(ta *schema.Table) *schema.Table {
+	table := *ta
+	table.Columns = append([]schema.TableColumn(nil), ta.Columns...)
+	table.PKColumns = append([]int(nil), ta.PKColumns...)
+	table.Indexes = make([]*schema.Index, len(ta.Indexes))
+	for i, index := range ta.Indexes {
+		idx := *index
+		idx.Columns = append([]string(nil), index.Columns...)
+		idx.Cardinality = append([]uint64(nil), index.Cardinality...)
+		idx.DataColumns = append([]string(nil), index.DataColumns...)
+		idx.PrefixLengths = append([]int(nil), index.PrefixLengths...)
+		idx.Descending = append([]bool(nil), index.Descending...)
+		idx.Expressions = append([]string(nil), index.Expressions...)
+		table.Indexes[i] = &idx
+	}
+	return &table
+}
+
+// alterColumn applies spec to table, reporting whether the encoding of
+// the rows changed.
+func alterColumn(table *schema.Table, spec *sqlparser.AlterSpec) (bool, error) {
+	pos := table.FindColumn(spec.Name)
+	switch spec.Action {
+	case sqlparser.AST_ADD:
+		if pos != -1 {
+			return false, errors.Errorf("column %s of table %s already exists", spec.Name, table.Name)
+		}
+		if err := addColumnSpec(table, spec); err != nil {
+			return false, errors.Trace(err)
+		}
+		if len(table.Indexes) > 0 && table.Indexes[0].Name == "PRIMARY" {
+			table.Indexes[0].AddDataColumn(spec.Name)
+		}
+	case sqlparser.AST_MODIFY:
+		if pos == -1 {
+			return false, errors.Errorf("column %s of table %s not found", spec.Name, table.Name)
+		}
+		if err := addColumnSpec(table, spec); err != nil {
+			return false, errors.Trace(err)
+		}
+		last := len(table.Columns) - 1
+		old := table.Columns[pos]
+		table.Columns[pos] = table.Columns[last]
+		table.Columns = table.Columns[:last]
+		// a new default or comment leaves the rows as they are
+		return old.Type != table.Columns[pos].Type || old.Collation != table.Columns[pos].Collation, nil
+	case sqlparser.AST_DROP:
+		if pos == -1 {
+			return false, errors.Errorf("column %s of table %s not found", spec.Name, table.Name)
+		}
+		for _, index := range table.Indexes {
+			if index.FindColumn(table.Columns[pos].Name) != -1 {
+				// mysql shrinks or drops the indexes of the column
+				return false, errors.Annotatef(ErrAlterUnsupported, "column %s is indexed", spec.Name)
+			}
+		}
+		name := table.Columns[pos].Name
+		table.Columns = append(table.Columns[:pos], table.Columns[pos+1:]...)
+		for i, col := range table.PKColumns {
+			if col > pos {
+				table.PKColumns[i] = col - 1
+			}
+		}
+		for _, index := range table.Indexes {
+			if i := index.FindDataColumn(name); i != -1 {
+				index.DataColumns = append(index.DataColumns[:i], index.DataColumns[i+1:]...)
+			}
+		}
+	}
+	return true, nil
+}
+
+// addColumnSpec appends the column spec defines to table.
+func addColumnSpec(table *schema.Table, spec *sqlparser.AlterSpec) error {
+	var defval mysql.Value
+	if spec.Default != nil {
+		v, err := sqltypes.BuildValue(spec.Default)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defval = v
+	}
+	table.AddColumn(spec.Name, spec.Type, spec.Collation, defval, spec.Extra)
+	table.Columns[len(table.Columns)-1].Comment = spec.Comment
+	return nil
+}
+
+func alterIndex(table *schema.Table, spec *sqlparser.AlterSpec) error {
+	if strings.EqualFold(spec.Name, "PRIMARY") || len(table.Indexes) == 0 || table.Indexes[0].Name != "PRIMARY" {
+		return errors.Annotatef(ErrAlterUnsupported, "index %s", spec.Name)
+	}
+	pos := -1
+	for i, index := range table.Indexes {
+		if strings.EqualFold(index.Name, spec.Name) {
+			pos = i
+		}
+	}
+
+	if spec.Action == sqlparser.AST_DROP {
+		if table.HasUniqueKeys {
+			// whether a unique key remains isn't known
+			return errors.Annotatef(ErrAlterUnsupported, "index %s", spec.Name)
+		}
+		// secondary indexes are not all loaded, a missing one is fine
+		if pos != -1 {
+			table.Indexes = append(table.Indexes[:pos], table.Indexes[pos+1:]...)
+		}
+		return nil
+	}
+
+	if pos != -1 {
+		return errors.Errorf("index %s of table %s already exists", spec.Name, table.Name)
+	}
+	index := schema.NewIndex(spec.Name)
+	for _, part := range spec.Columns {
+		name, prefixLength, err := parseKeyPart(part)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if table.FindColumn(name) == -1 {
+			return errors.Errorf("column %s of table %s not found", name, table.Name)
+		}
+		index.AddPrefixColumn(name, 0, prefixLength)
+		index.AddDataColumn(name)
+	}
+	for _, name := range table.Indexes[0].Columns {
+		index.AddDataColumn(name)
+	}
+	table.Indexes = append(table.Indexes, index)
+	if spec.Unique {
+		table.HasUniqueKeys = true
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package tabletserver
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/arena"
+	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/sqlparser"
+	"github.com/wandoulabs/cm/vt/schema"
+	"github.com/wandoulabs/cm/vt/tabletserver/fakecache"
+)
+
+func newAlterTestTable() *TableInfo {
+	ti := &TableInfo{Table: schema.NewTable("t")}
+	ti.AddColumn("id", "bigint(20)", "", nil, "auto_increment")
+	ti.AddColumn("name", "varchar(32)", "utf8_general_ci", nil, "")
+	ti.AddColumn("age", "int(11)", "", nil, "")
+	ti.primaryKey = []string{"id"}
+	if err := ti.SetPK([]string{"id"}); err != nil {
+		panic(err)
+	}
+	return ti
+}
+
+func parseAlter(t *testing.T, sql string) *sqlparser.DDL {
+	stmt, err := sqlparser.Parse(sql, arena.NewArenaAllocator(1024))
+	if err != nil {
+		t.Fatal(sql, err)
+	}
+	return stmt.(*sqlparser.DDL)
+}
+
+func columnNames(ti *TableInfo) []string {
+	var names []string
+	for _, col := range ti.Columns {
+		names = append(names, col.Name)
+	}
+	return names
+}
+
+func TestApplyAlterAddColumn(t *testing.T) {
+	ti := newAlterTestTable()
+	old := ti.Table
+	ddl := parseAlter(t, "alter table t add column email varchar(64) not null default '' comment 'contact', add score decimal(10,2) unsigned")
+	if err := ApplyAlter(ti, ddl); err != nil {
+		t.Fatal(err)
+	}
+	if names := columnNames(ti); !reflect.DeepEqual(names, []string{"id", "name", "age", "email", "score"}) {
+		t.Fatal(names)
+	}
+	email := ti.Columns[3]
+	if email.SqlType != mysql.MYSQL_TYPE_VAR_STRING || email.Length != 64 || email.Comment != "contact" || email.Default == nil {
+		t.Fatalf("%+v", email)
+	}
+	score := ti.Columns[4]
+	if score.SqlType != mysql.MYSQL_TYPE_NEWDECIMAL || score.Precision != 10 || score.Scale != 2 || !score.IsUnsigned {
+		t.Fatalf("%+v", score)
+	}
+	if ti.Indexes[0].FindDataColumn("score") == -1 {
+		t.Fatal(ti.Indexes[0].DataColumns)
+	}
+	if len(old.Columns) != 3 {
+		t.Fatal("old schema changed", columnNames(&TableInfo{Table: old}))
+	}
+
+	if err := ApplyAlter(ti, parseAlter(t, "alter table t add name int")); err == nil {
+		t.Fatal("expect error adding an existing column")
+	}
+}
+
+func TestApplyAlterDropColumn(t *testing.T) {
+	ti := &TableInfo{Table: schema.NewTable("t")}
+	ti.AddColumn("name", "varchar(32)", "", nil, "")
+	ti.AddColumn("id", "bigint(20)", "", nil, "")
+	ti.AddColumn("age", "int(11)", "", nil, "")
+	if err := ti.SetPK([]string{"id"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ApplyAlter(ti, parseAlter(t, "ALTER TABLE t DROP COLUMN name")); err != nil {
+		t.Fatal(err)
+	}
+	if names := columnNames(ti); !reflect.DeepEqual(names, []string{"id", "age"}) {
+		t.Fatal(names)
+	}
+	if !reflect.DeepEqual(ti.PKColumns, []int{0}) || !reflect.DeepEqual(ti.Indexes[0].DataColumns, []string{"id", "age"}) {
+		t.Fatal(ti.PKColumns, ti.Indexes[0].DataColumns)
+	}
+
+	err := ApplyAlter(ti, parseAlter(t, "alter table t drop id"))
+	if errors.Cause(err) != ErrAlterUnsupported {
+		t.Fatal(err)
+	}
+	if names := columnNames(ti); !reflect.DeepEqual(names, []string{"id", "age"}) {
+		t.Fatal(names)
+	}
+}
+
+func TestApplyAlterAddIndex(t *testing.T) {
+	ti := newAlterTestTable()
+	if err := ApplyAlter(ti, parseAlter(t, "alter table t add index idx_name_age (name(10), age desc), add unique key (age)")); err != nil {
+		t.Fatal(err)
+	}
+	if len(ti.Indexes) != 3 {
+		t.Fatal(ti.Indexes)
+	}
+	index := ti.Indexes[1]
+	if index.Name != "idx_name_age" || !reflect.DeepEqual(index.Columns, []string{"name", "age"}) ||
+		!reflect.DeepEqual(index.PrefixLengths, []int{10, 0}) || !reflect.DeepEqual(index.DataColumns, []string{"name", "age", "id"}) {
+		t.Fatalf("%+v", index)
+	}
+	if ti.Indexes[2].Name != "age" || !ti.HasUniqueKeys {
+		t.Fatalf("%+v %v", ti.Indexes[2], ti.HasUniqueKeys)
+	}
+
+	// a column change flushes the rows cached with the old columns
+	ti.Cache = NewRowCache(ti, NewCachePool("test", RowCacheConfig{}, 0, 0))
+	prefix := ti.Cache.getPrefix()
+	if err := ApplyAlter(ti, parseAlter(t, "alter table t modify age bigint(20) default 0")); err != nil {
+		t.Fatal(err)
+	}
+	if ti.Columns[2].SqlType != mysql.MYSQL_TYPE_LONGLONG || ti.Cache.getPrefix() == prefix {
+		t.Fatalf("%+v", ti.Columns[2])
+	}
+}
+
+func TestApplyAlterUnsupported(t *testing.T) {
+	for _, sql := range []string{
+		"alter table t engine = innodb",
+		"alter table t add column email varchar(64) after name",
+		"alter table t change name full_name varchar(64)",
+		"alter table t drop primary key",
+		"alter table t add primary key (name)",
+		"alter table t drop index idx",
+	} {
+		ti := newAlterTestTable()
+		ti.HasUniqueKeys = true
+		if err := ApplyAlter(ti, parseAlter(t, sql)); errors.Cause(err) != ErrAlterUnsupported {
+			t.Error(sql, err)
+		}
+	}
+}
+
+func TestApplyAlterTypeChange(t *testing.T) {
+	fm := fakecache.New()
+	defer fm.Close()
+	ti := newAlterTestTable()
+	ti.Cache = NewRowCache(ti, newFakeCachePool(fm, 1))
+	row := func(values ...string) []byte {
+		var b []byte
+		for _, v := range values {
+			b = append(append(b, byte(len(v))), v...)
+		}
+		return b
+	}
+	cached := func() bool {
+		return ti.Cache.Get([]string{"1"}, ti.Columns)["1"].Row != nil
+	}
+
+	ti.Cache.Set("1", row("1", "a", "30"), 0)
+	if !cached() {
+		t.Fatal("row not cached")
+	}
+	// the rows are encoded the same with another comment
+	if err := ApplyAlter(ti, parseAlter(t, "alter table t modify age int(11) comment 'years'")); err != nil {
+		t.Fatal(err)
+	}
+	if !cached() {
+		t.Fatal("row flushed by a comment change")
+	}
+
+	if err := ApplyAlter(ti, parseAlter(t, "alter table t modify age varchar(8)")); err != nil {
+		t.Fatal(err)
+	}
+	if ti.Columns[2].SqlType != mysql.MYSQL_TYPE_VAR_STRING {
+		t.Fatalf("%+v", ti.Columns[2])
+	}
+	if cached() {
+		t.Fatal("row cached under the old type still hit")
+	}
+}
@@ -6,7 +6,10 @@ package tabletserver
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
+	"unsafe"
 
 	"github.com/juju/errors"
 	"github.com/ngaut/lockring"
@@ -21,8 +24,22 @@ type TableInfo struct {
 	Lock *lockring.LockRing
 	*schema.Table
 	Cache *RowCache
-	// stats updated by sqlquery.go
-	hits, absent, misses, invalidations sync2.AtomicInt64
+	// DeleteExpiry overrides the cache pool's grace period for deleted
+	// rows if set with a vtocc_delete_expiry=<seconds> table comment.
+	DeleteExpiry uint64
+	// primaryKey lists the columns of the backend primary key in
+	// index order, SetPK must follow it.
+	primaryKey []string
+	// stats updated through the Record methods
+	hits, absent, misses, invalidations, repairs sync2.AtomicInt64
+	// labels of the metrics of the table, built once
+	labelsOnce sync.Once
+	labels     Labels
+
+	// fields caches the serialized result fields by column set. A
+	// schema reload makes a new TableInfo, which drops them.
+	fieldsMu sync.Mutex
+	fields   map[string][]*mysql.Field
 }
 
 func NewTableInfo(conn *mysql.MySqlConn, tableName string, tableType string, createTime sqltypes.Value,
@@ -58,20 +75,9 @@ func (ti *TableInfo) fetchColumns(conn *mysql.MySqlConn) error {
 	}
 
 	for _, row := range columns.Values {
-		v, err := sqltypes.BuildValue(row[5])
-		if err != nil {
+		if err := ti.addColumnRow(row); err != nil {
 			return errors.Trace(err)
 		}
-
-		var collation string
-		if row[2] != nil {
-			collation = string(row[2].([]byte))
-		}
-		extra := string(row[6].([]byte))
-		columnType := string(row[1].([]byte))
-		columnName := string(row[0].([]byte))
-		ti.AddColumn(columnName, columnType, collation,
-			v, extra)
 	}
 
 	log.Debugf("%s %+v", ti.Name, ti.Columns)
@@ -79,114 +85,239 @@ func (ti *TableInfo) fetchColumns(conn *mysql.MySqlConn) error {
 	return nil
 }
 
+// addColumnRow adds the column of a SHOW FULL COLUMNS row, which unlike
+// DESCRIBE has the comment of the column.
+func (ti *TableInfo) addColumnRow(row mysql.RowValue) error {
+	v, err := sqltypes.BuildValue(row[5])
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var collation string
+	if row[2] != nil {
+		collation = string(row[2].([]byte))
+	}
+	extra := string(row[6].([]byte))
+	columnType := string(row[1].([]byte))
+	columnName := string(row[0].([]byte))
+	ti.AddColumn(columnName, columnType, collation,
+		v, extra)
+
+	if len(row) > 8 && row[8] != nil {
+		ti.Columns[len(ti.Columns)-1].Comment = string(row[8].([]byte))
+	}
+	return nil
+}
+
+// AutoIncColumn returns the index of the auto_increment column, or -1
+// if the table has none.
+func (ti *TableInfo) AutoIncColumn() int {
+	for i, col := range ti.Columns {
+		if col.IsAuto {
+			return i
+		}
+	}
+	return -1
+}
+
 func (ti *TableInfo) SetPK(colnames []string) error {
 	log.Debugf("table %s SetPK %s", ti.Name, colnames)
+	if err := ti.checkPKOrder(colnames); err != nil {
+		return errors.Trace(err)
+	}
+
 	pkIndex := schema.NewIndex("PRIMARY")
 	colnums := make([]int, len(colnames))
 	for i, colname := range colnames {
-		colnums[i] = ti.FindColumn(strings.ToLower(colname))
+		name, prefixLength, err := parseKeyPart(colname)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		colnums[i] = ti.FindColumn(name)
 		if colnums[i] == -1 {
 			return errors.Errorf("column %s not found, %+v", colname, ti.Columns)
 		}
-		pkIndex.AddColumn(strings.ToLower(colname), 1)
+		pkIndex.AddPrefixColumn(name, 1, prefixLength)
 	}
 
 	for _, col := range ti.Columns {
-		pkIndex.DataColumns = append(pkIndex.DataColumns, strings.ToLower(col.Name))
+		pkIndex.AddDataColumn(strings.ToLower(col.Name))
 	}
 
-	if len(ti.Indexes) == 0 {
-		ti.Indexes = make([]*schema.Index, 1)
-	} else if ti.Indexes[0].Name != "PRIMARY" {
-		ti.Indexes = append(ti.Indexes, nil)
-		copy(ti.Indexes[1:], ti.Indexes[:len(ti.Indexes)-1])
-	} // else we replace the currunt primary key
+	// The new primary key goes first, replacing the current one
+	// wherever it is, the secondary indexes keep their order.
+	indexes := make([]*schema.Index, 1, len(ti.Indexes)+1)
+	indexes[0] = pkIndex
+	for _, index := range ti.Indexes {
+		if index.Name != "PRIMARY" {
+			indexes = append(indexes, index)
+		}
+	}
 
-	ti.Indexes[0] = pkIndex
+	ti.Indexes = indexes
 	ti.PKColumns = colnums
 	return nil
 }
 
-func (ti *TableInfo) fetchIndexes(conn *mysql.MySqlConn) error {
-	/*
-		indexes, err := conn.Execute(fmt.Sprintf("show index from `%s`", ti.Name))
+// checkPKOrder makes sure colnames name the backend primary key columns
+// in index order, the order pk values are encoded in cache keys. Tables
+// without a primary key can use any unique key.
+func (ti *TableInfo) checkPKOrder(colnames []string) error {
+	if len(ti.primaryKey) == 0 {
+		return nil
+	}
+
+	names := make([]string, len(colnames))
+	for i, colname := range colnames {
+		name, _, err := parseKeyPart(colname)
 		if err != nil {
-			log.Error(err)
 			return errors.Trace(err)
 		}
+		names[i] = name
+	}
 
-		log.Debugf("%+v", indexes.Values)
-
-		var currentIndex *schema.Index
-		currentName := ""
-		for _, row := range indexes.Values {
-			indexName, err := mysql.Raw(row[2])
-			if err != nil {
-				log.Error(err)
-				return errors.Trace(err)
-			}
+	if len(names) != len(ti.primaryKey) {
+		return errors.Errorf("pk %v of table %s doesn't match its primary key %v", names, ti.Name, ti.primaryKey)
+	}
+	for i, name := range names {
+		if name != ti.primaryKey[i] {
+			return errors.Errorf("pk %v of table %s isn't in the order of its primary key %v", names, ti.Name, ti.primaryKey)
+		}
+	}
+	return nil
+}
 
-			if currentName != string(indexName) {
-				currentIndex = ti.AddIndex(string(indexName))
-				currentName = string(indexName)
-			}
+// parseKeyPart splits a key part like "name(10)" into the lower cased
+// column name and its prefix length, 0 if the whole column is used.
+func parseKeyPart(keyPart string) (name string, prefixLength int, err error) {
+	keyPart = strings.ToLower(strings.TrimSpace(keyPart))
+	pos := strings.Index(keyPart, "(")
+	if pos == -1 {
+		return keyPart, 0, nil
+	}
+	if !strings.HasSuffix(keyPart, ")") {
+		return "", 0, errors.Errorf("invalid key part %s", keyPart)
+	}
+	prefixLength, err = strconv.Atoi(keyPart[pos+1 : len(keyPart)-1])
+	if err != nil || prefixLength <= 0 {
+		return "", 0, errors.Errorf("invalid prefix length in key part %s", keyPart)
+	}
+	return strings.TrimSpace(keyPart[:pos]), prefixLength, nil
+}
 
-			var cardinality string
-			if row[6] != nil {
-				v, err := mysql.Raw(row[6])
-				if err != nil {
-					log.Warningf("%s", err)
-					return errors.Trace(err)
-				}
-				cardinality = string(v)
+func (ti *TableInfo) fetchIndexes(conn *mysql.MySqlConn) error {
+	unique, err := conn.Execute(fmt.Sprintf("show index from `%s` where Non_unique = 0", ti.Name))
+	if err != nil {
+		return errors.Trace(err)
+	}
 
-			}
-			val, err := strconv.ParseUint(cardinality, 0, 64)
-			if err != nil {
-				log.Warningf("%s", err)
-				return errors.Trace(err)
-			}
-			currentIndex.AddColumn(string(row[4].([]byte)), val)
+	// rows come in Seq_in_index order
+	ti.primaryKey = nil
+	ti.HasUniqueKeys = false
+	for _, row := range unique.Values {
+		if string(row[2].([]byte)) != "PRIMARY" {
+			ti.HasUniqueKeys = true
+			continue
 		}
+		ti.primaryKey = append(ti.primaryKey, strings.ToLower(string(row[4].([]byte))))
+	}
 
-		log.Debugf("table: %s, indexes: %+v", ti.Name, ti.Indexes)
+	// the indexes are only planned with, the pk of the row cache is
+	// still the one SetPK is given
+	indexes, err := conn.Execute(fmt.Sprintf("show index from `%s`", ti.Name))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := ti.addIndexes(indexes.Values); err != nil {
+		return errors.Trace(err)
+	}
+	ti.primaryFirst()
+	if len(ti.Indexes) > 0 && ti.Indexes[0].Name == "PRIMARY" {
+		ti.fillDataColumns()
+	}
+
+	return nil
+}
 
-		if len(ti.Indexes) == 0 {
-			return nil
+// primaryFirst moves the PRIMARY index, if any, before the others.
+func (ti *TableInfo) primaryFirst() {
+	for i, index := range ti.Indexes {
+		if index.Name == "PRIMARY" {
+			copy(ti.Indexes[1:i+1], ti.Indexes[:i])
+			ti.Indexes[0] = index
+			return
 		}
+	}
+}
 
-		pkIndex := ti.Indexes[0]
-		if pkIndex.Name != "PRIMARY" {
-			return nil
+// fillDataColumns sets the columns each index can serve without
+// a lookup, ti.Indexes[0] must be the primary key. Every column is
+// added once even if an index definition repeats it.
+func (ti *TableInfo) fillDataColumns() {
+	pkIndex := ti.Indexes[0]
+	// Primary key contains all table columns
+	for _, col := range ti.Columns {
+		pkIndex.AddDataColumn(col.Name)
+	}
+	// Secondary indices contain all primary key columns
+	for i := 1; i < len(ti.Indexes); i++ {
+		for _, c := range ti.Indexes[i].Columns {
+			// functional key parts have no column
+			if c != "" {
+				ti.Indexes[i].AddDataColumn(c)
+			}
 		}
-		ti.PKColumns = make([]int, len(pkIndex.Columns))
-		for i, pkCol := range pkIndex.Columns {
-			ti.PKColumns[i] = ti.FindColumn(pkCol)
+		for _, c := range pkIndex.Columns {
+			ti.Indexes[i].AddDataColumn(c)
 		}
-		// Primary key contains all table columns
-		for _, col := range ti.Columns {
-			pkIndex.DataColumns = append(pkIndex.DataColumns, col.Name)
+	}
+}
+
+// addIndexes adds the indexes listed by the rows of SHOW INDEX. The
+// functional key parts of MySQL 8 have no Column_name but an Expression.
+func (ti *TableInfo) addIndexes(rows []mysql.RowValue) error {
+	var currentIndex *schema.Index
+	currentName := ""
+	for _, row := range rows {
+		indexName := string(row[2].([]byte))
+		if currentName != indexName {
+			currentIndex = ti.AddIndex(indexName)
+			currentName = indexName
 		}
-		// Secondary indices contain all primary key columns
-		for i := 1; i < len(ti.Indexes); i++ {
-			for _, c := range ti.Indexes[i].Columns {
-				ti.Indexes[i].DataColumns = append(ti.Indexes[i].DataColumns, c)
-			}
-			for _, c := range pkIndex.Columns {
-				// pk columns may already be part of the index. So,
-				// check before adding.
-				if ti.Indexes[i].FindDataColumn(c) != -1 {
-					continue
-				}
-				ti.Indexes[i].DataColumns = append(ti.Indexes[i].DataColumns, c)
+
+		var cardinality uint64
+		switch v := row[6].(type) {
+		case nil:
+		case int64:
+			cardinality = uint64(v)
+		case uint64:
+			cardinality = v
+		case []byte:
+			val, err := strconv.ParseUint(string(v), 0, 64)
+			if err != nil {
+				return errors.Trace(err)
 			}
+			cardinality = val
 		}
-	*/
 
+		var collation string
+		if row[5] != nil {
+			collation = string(row[5].([]byte))
+		}
+
+		if row[4] != nil {
+			currentIndex.AddKeyPart(string(row[4].([]byte)), cardinality, 0, collation)
+		} else if len(row) > 14 && row[14] != nil {
+			currentIndex.AddExpressionKeyPart(string(row[14].([]byte)), cardinality, collation)
+		} else {
+			return errors.Errorf("index %s of %s has a key part without column or expression", indexName, ti.Name)
+		}
+	}
 	return nil
 }
 
 func (ti *TableInfo) initRowCache(tableType string, createTime sqltypes.Value, comment string, cachePool *CachePool) {
+	ti.DeleteExpiry = parseDeleteExpiry(comment)
 	if cachePool.IsClosed() {
 		return
 	}
@@ -216,14 +347,155 @@ func (ti *TableInfo) initRowCache(tableType string, createTime sqltypes.Value, c
 	ti.Cache = NewRowCache(ti, cachePool)
 }
 
+const deleteExpiryComment = "vtocc_delete_expiry="
+
+// parseDeleteExpiry returns the seconds given by a vtocc_delete_expiry=
+// table comment, or 0 if there's none.
+func parseDeleteExpiry(comment string) uint64 {
+	pos := strings.Index(comment, deleteExpiryComment)
+	if pos == -1 {
+		return 0
+	}
+	val := comment[pos+len(deleteExpiryComment):]
+	if end := strings.IndexFunc(val, func(r rune) bool { return r < '0' || r > '9' }); end != -1 {
+		val = val[:end]
+	}
+	expiry, err := strconv.ParseUint(val, 10, 64)
+	if err != nil {
+		log.Warningf("invalid %s in comment %q", deleteExpiryComment, comment)
+		return 0
+	}
+	return expiry
+}
+
+// Fields returns the result fields of the columns numbered by
+// columnNumbers, built with build the first time. The cached fields
+// have their definition serialized into Data, which is written as is.
+// build may return nil to skip caching.
+func (ti *TableInfo) Fields(columnNumbers []int, build func() ([]*mysql.Field, error)) ([]*mysql.Field, error) {
+	key := fieldsKey(columnNumbers)
+	ti.fieldsMu.Lock()
+	fields, ok := ti.fields[key]
+	ti.fieldsMu.Unlock()
+	if ok {
+		return fields, nil
+	}
+
+	fields, err := build()
+	if err != nil || fields == nil {
+		return fields, errors.Trace(err)
+	}
+	for _, f := range fields {
+		f.Data = f.AppendTo(nil)
+	}
+
+	ti.fieldsMu.Lock()
+	if ti.fields == nil {
+		ti.fields = make(map[string][]*mysql.Field)
+	}
+	ti.fields[key] = fields
+	ti.fieldsMu.Unlock()
+	return fields, nil
+}
+
+func fieldsKey(columnNumbers []int) string {
+	b := make([]byte, 0, 4*len(columnNumbers))
+	for _, n := range columnNumbers {
+		b = strconv.AppendInt(b, int64(n), 10)
+		b = append(b, ',')
+	}
+	return string(b)
+}
+
 func (ti *TableInfo) StatsJSON() string {
 	if ti.Cache == nil {
 		return fmt.Sprintf("null")
 	}
 	h, a, m, i := ti.Stats()
-	return fmt.Sprintf("{\"Hits\": %v, \"Absent\": %v, \"Misses\": %v, \"Invalidations\": %v}", h, a, m, i)
+	return fmt.Sprintf("{\"Hits\": %v, \"Absent\": %v, \"Misses\": %v, \"Invalidations\": %v, \"Repairs\": %v, \"AccessAges\": %v}",
+		h, a, m, i, ti.Repairs(), ti.Cache.AccessAges().StatsJSON())
+}
+
+// RecordHit counts a row found in the cache.
+func (ti *TableInfo) RecordHit() {
+	ti.hits.Add(1)
+	GetMetrics().Counter("rowcache_hits", ti.metricLabels(), 1)
+}
+
+// RecordAbsent counts a row missing from the cache that the backend
+// does not have either.
+func (ti *TableInfo) RecordAbsent() {
+	ti.absent.Add(1)
+	GetMetrics().Counter("rowcache_absent", ti.metricLabels(), 1)
+}
+
+// RecordMiss counts a row missing from the cache.
+func (ti *TableInfo) RecordMiss() {
+	ti.misses.Add(1)
+	GetMetrics().Counter("rowcache_misses", ti.metricLabels(), 1)
+}
+
+// RecordInvalidation counts a row removed from the cache by a DML.
+func (ti *TableInfo) RecordInvalidation() {
+	ti.invalidations.Add(1)
+	GetMetrics().Counter("rowcache_invalidations", ti.metricLabels(), 1)
+}
+
+// RecordRepair counts a cached row that read-repair found stale.
+func (ti *TableInfo) RecordRepair() {
+	ti.repairs.Add(1)
+	GetMetrics().Counter("rowcache_repairs", ti.metricLabels(), 1)
+}
+
+// metricLabels labels the metrics of the table.
+func (ti *TableInfo) metricLabels() Labels {
+	ti.labelsOnce.Do(func() { ti.labels = Labels{"table": ti.Name} })
+	return ti.labels
 }
 
 func (ti *TableInfo) Stats() (hits, absent, misses, invalidations int64) {
 	return ti.hits.Get(), ti.absent.Get(), ti.misses.Get(), ti.invalidations.Get()
 }
+
+// Repairs returns the number of stale cached rows read-repair corrected.
+func (ti *TableInfo) Repairs() int64 {
+	return ti.repairs.Get()
+}
+
+// SchemaFootprint estimates the bytes held by the schema metadata of
+// tables: their columns, indexes and the strings and lists those hold.
+// Row caches, locks and cached fields are left out.
+func SchemaFootprint(tables []*TableInfo) int64 {
+	var n int64
+	for _, ti := range tables {
+		n += int64(unsafe.Sizeof(*ti)) + stringsFootprint(ti.primaryKey)
+		if ti.Table == nil {
+			continue
+		}
+		n += int64(unsafe.Sizeof(*ti.Table)) + int64(len(ti.Name))
+		n += int64(cap(ti.Columns)) * int64(unsafe.Sizeof(schema.TableColumn{}))
+		for _, col := range ti.Columns {
+			n += int64(len(col.Name) + len(col.Collation) + len(col.Type) + len(col.Comment))
+			if v, ok := col.Default.(sqltypes.Value); ok {
+				n += int64(len(v.Raw()))
+			}
+		}
+		n += int64(cap(ti.PKColumns)) * int64(unsafe.Sizeof(int(0)))
+		n += int64(cap(ti.Indexes)) * int64(unsafe.Sizeof(&schema.Index{}))
+		for _, index := range ti.Indexes {
+			n += int64(unsafe.Sizeof(*index)) + int64(len(index.Name))
+			n += stringsFootprint(index.Columns) + stringsFootprint(index.DataColumns) + stringsFootprint(index.Expressions)
+			n += int64(cap(index.Cardinality))*int64(unsafe.Sizeof(uint64(0))) +
+				int64(cap(index.PrefixLengths))*int64(unsafe.Sizeof(int(0))) + int64(cap(index.Descending))
+		}
+	}
+	return n
+}
+
+func stringsFootprint(list []string) int64 {
+	n := int64(cap(list)) * int64(unsafe.Sizeof(""))
+	for _, s := range list {
+		n += int64(len(s))
+	}
+	return n
+}
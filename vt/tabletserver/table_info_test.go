@@ -0,0 +1,407 @@
+package tabletserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/arena"
+	"github.com/ngaut/cache"
+	"github.com/wandoulabs/cm/mysql"
+	"github.com/wandoulabs/cm/sqltypes"
+	"github.com/wandoulabs/cm/vt/schema"
+	"github.com/wandoulabs/cm/vt/tabletserver/planbuilder"
+)
+
+func TestParseDeleteExpiry(t *testing.T) {
+	cases := map[string]uint64{
+		"":                                  0,
+		"vtocc_nocache":                     0,
+		"vtocc_delete_expiry=600":           600,
+		"long tx, vtocc_delete_expiry=120 ": 120,
+		"vtocc_delete_expiry=abc":           0,
+	}
+	for comment, expect := range cases {
+		if v := parseDeleteExpiry(comment); v != expect {
+			t.Fatal(comment, v)
+		}
+	}
+}
+
+func TestDeleteExpiryOverride(t *testing.T) {
+	cp := NewCachePool("test", RowCacheConfig{}, 10*time.Second, 0)
+	cp.DeleteExpiry = 35
+
+	ti := &TableInfo{Table: schema.NewTable("t")}
+	ti.initRowCache("BASE TABLE", sqltypes.Value{}, "vtocc_delete_expiry=600", cp)
+	if ti.DeleteExpiry != 600 {
+		t.Fatal(ti.DeleteExpiry)
+	}
+	if e := NewRowCache(ti, cp).deleteExpiry(); e != 600 {
+		t.Fatal(e)
+	}
+
+	other := &TableInfo{Table: schema.NewTable("t2")}
+	if e := NewRowCache(other, cp).deleteExpiry(); e != 35 {
+		t.Fatal(e)
+	}
+}
+
+func TestAutoIncColumn(t *testing.T) {
+	ti := &TableInfo{Table: schema.NewTable("t")}
+	ti.AddColumn("name", "varchar(32)", "", nil, "")
+	if i := ti.AutoIncColumn(); i != -1 {
+		t.Fatal(i)
+	}
+
+	ti.AddColumn("id", "bigint(20) unsigned", "", nil, "AUTO_INCREMENT")
+	if i := ti.AutoIncColumn(); i != 1 || !ti.Columns[1].IsAuto || ti.Columns[0].IsAuto {
+		t.Fatal(i, ti.Columns)
+	}
+}
+
+func TestSetPKPrefix(t *testing.T) {
+	ti := &TableInfo{Table: schema.NewTable("t")}
+	ti.AddColumn("id", "int(11)", "", nil, "")
+	ti.AddColumn("name", "varchar(255)", "", nil, "")
+
+	if err := ti.SetPK([]string{"id", "Name(10)"}); err != nil {
+		t.Fatal(err)
+	}
+	pk := ti.Indexes[0]
+	if len(pk.Columns) != 2 || pk.Columns[1] != "name" || pk.PrefixLengths[0] != 0 || pk.PrefixLengths[1] != 10 {
+		t.Fatalf("%+v", pk)
+	}
+	if len(ti.PKColumns) != 2 || ti.PKColumns[1] != 1 {
+		t.Fatal(ti.PKColumns)
+	}
+
+	for _, bad := range []string{"name(x)", "name(0)", "name(10"} {
+		if err := ti.SetPK([]string{bad}); err == nil {
+			t.Fatal(bad)
+		}
+	}
+}
+
+func TestSetPKOrder(t *testing.T) {
+	ti := &TableInfo{Table: schema.NewTable("t")}
+	ti.AddColumn("a", "int(11)", "", nil, "")
+	ti.AddColumn("b", "int(11)", "", nil, "")
+	ti.AddColumn("c", "int(11)", "", nil, "")
+	ti.primaryKey = []string{"b", "a"}
+
+	if err := ti.SetPK([]string{"B", "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if ti.PKColumns[0] != 1 || ti.PKColumns[1] != 0 {
+		t.Fatal(ti.PKColumns)
+	}
+
+	for _, pk := range [][]string{{"a", "b"}, {"b"}, {"b", "a", "c"}, {"b", "c"}} {
+		if err := ti.SetPK(pk); err == nil {
+			t.Fatal(pk)
+		}
+	}
+	if ti.PKColumns[0] != 1 || ti.PKColumns[1] != 0 {
+		t.Fatal(ti.PKColumns)
+	}
+
+	// no backend primary key, any order goes
+	ti.primaryKey = nil
+	if err := ti.SetPK([]string{"c", "a"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetPKIndexes(t *testing.T) {
+	newTable := func(indexes ...string) *TableInfo {
+		ti := &TableInfo{Table: schema.NewTable("t")}
+		ti.AddColumn("id", "int(11)", "", nil, "")
+		ti.AddColumn("name", "varchar(32)", "", nil, "")
+		for _, name := range indexes {
+			ti.AddIndex(name).AddColumn("name", 0)
+		}
+		return ti
+	}
+
+	cases := []struct {
+		indexes []string
+		expect  []string
+	}{
+		{nil, []string{"PRIMARY"}},
+		{[]string{"idx_name"}, []string{"PRIMARY", "idx_name"}},
+		{[]string{"idx_a", "idx_b", "idx_c"}, []string{"PRIMARY", "idx_a", "idx_b", "idx_c"}},
+		{[]string{"PRIMARY", "idx_a"}, []string{"PRIMARY", "idx_a"}},
+		{[]string{"idx_a", "PRIMARY", "idx_b"}, []string{"PRIMARY", "idx_a", "idx_b"}},
+	}
+	for _, c := range cases {
+		ti := newTable(c.indexes...)
+		secondary := make(map[string]*schema.Index)
+		for _, index := range ti.Indexes {
+			secondary[index.Name] = index
+		}
+
+		if err := ti.SetPK([]string{"id"}); err != nil {
+			t.Fatal(err)
+		}
+		if len(ti.Indexes) != len(c.expect) {
+			t.Fatal(c.indexes, len(ti.Indexes))
+		}
+		for i, name := range c.expect {
+			index := ti.Indexes[i]
+			if index.Name != name {
+				t.Fatal(c.indexes, i, index.Name)
+			}
+			if i == 0 && (len(index.Columns) != 1 || index.Columns[0] != "id") {
+				t.Fatal(c.indexes, index.Columns)
+			}
+			if i > 0 && index != secondary[name] {
+				t.Fatal(c.indexes, name)
+			}
+		}
+	}
+}
+
+func TestFillDataColumns(t *testing.T) {
+	ti := &TableInfo{Table: schema.NewTable("t")}
+	ti.AddColumn("id", "int(11)", "", nil, "")
+	ti.AddColumn("name", "varchar(32)", "", nil, "")
+	ti.AddColumn("email", "varchar(64)", "", nil, "")
+	ti.AddIndex("PRIMARY").AddColumn("id", 0)
+	idx := ti.AddIndex("idx_name")
+	idx.AddColumn("name", 0)
+	idx.AddColumn("id", 0)
+	idx.AddColumn("name", 0)
+
+	ti.fillDataColumns()
+	if got := ti.Indexes[0].DataColumns; !reflect.DeepEqual(got, []string{"id", "name", "email"}) {
+		t.Fatal(got)
+	}
+	if got := idx.DataColumns; !reflect.DeepEqual(got, []string{"name", "id"}) {
+		t.Fatal(got)
+	}
+}
+
+// showIndexRow builds a SHOW INDEX row of MySQL 8, column is nil for
+// functional key parts.
+func showIndexRow(index string, seq int64, column interface{}, cardinality int64, expr interface{}) mysql.RowValue {
+	return mysql.RowValue{[]byte("t"), int64(1), []byte(index), seq, column, []byte("A"), cardinality,
+		nil, nil, []byte(""), []byte("BTREE"), []byte(""), []byte(""), []byte("YES"), expr}
+}
+
+func TestAddFunctionalIndexes(t *testing.T) {
+	ti := &TableInfo{Table: schema.NewTable("t")}
+	ti.AddColumn("id", "int(11)", "", nil, "")
+	ti.AddColumn("email", "varchar(64)", "", nil, "")
+
+	rows := []mysql.RowValue{
+		showIndexRow("PRIMARY", 1, []byte("id"), 10, nil),
+		showIndexRow("idx_lower", 1, nil, 8, []byte("lower(`email`)")),
+		showIndexRow("idx_lower", 2, []byte("id"), 10, nil),
+	}
+	if err := ti.addIndexes(rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(ti.Indexes) != 2 || ti.Indexes[0].IsFunctional() {
+		t.Fatalf("%+v", ti.Indexes)
+	}
+
+	idx := ti.Indexes[1]
+	if !idx.IsFunctional() || len(idx.Columns) != 2 || idx.Columns[0] != "" || idx.Columns[1] != "id" {
+		t.Fatalf("%+v", idx)
+	}
+	if idx.Expressions[0] != "lower(`email`)" || idx.Expressions[1] != "" || idx.Cardinality[0] != 8 {
+		t.Fatalf("%+v", idx)
+	}
+
+	ti.fillDataColumns()
+	if !reflect.DeepEqual(idx.DataColumns, []string{"id"}) {
+		t.Fatal(idx.DataColumns)
+	}
+
+	bad := []mysql.RowValue{showIndexRow("idx_bad", 1, nil, 1, nil)}
+	if err := ti.addIndexes(bad); err == nil {
+		t.Fatal("expect error for a key part without column or expression")
+	}
+}
+
+func TestLoadedIndexes(t *testing.T) {
+	defer func(max uint64) { planbuilder.MaxFullScanRows = max }(planbuilder.MaxFullScanRows)
+	planbuilder.MaxFullScanRows = 100
+
+	ti := &TableInfo{Table: schema.NewTable("t")}
+	ti.AddColumn("id", "int(11)", "", nil, "")
+	ti.AddColumn("email", "varchar(64)", "", nil, "")
+	ti.EstimatedRows = 1000
+	rows := []mysql.RowValue{
+		showIndexRow("idx_email", 1, []byte("email"), 8, nil),
+		showIndexRow("PRIMARY", 1, []byte("id"), 10, nil),
+	}
+	if err := ti.addIndexes(rows); err != nil {
+		t.Fatal(err)
+	}
+	ti.primaryFirst()
+	if ti.Indexes[0].Name != "PRIMARY" || ti.Indexes[1].Name != "idx_email" {
+		t.Fatalf("%+v", ti.Indexes)
+	}
+	ti.fillDataColumns()
+
+	// the secondary indexes stay once the table is cached
+	if err := ti.SetPK([]string{"id"}); err != nil {
+		t.Fatal(err)
+	}
+	ti.CacheType = schema.CACHE_RW
+	getTable := func(name string) (*schema.Table, bool) { return ti.Table, name == "t" }
+	for sql, fullScan := range map[string]bool{
+		"select * from t where email = 'a'":           false,
+		"select * from t where id = 1":                false,
+		"delete from t where email = 'a'":             false,
+		"select * from t where id > 0 or email = 'a'": false,
+		"update t set email = 'a'":                    true,
+	} {
+		_, err := planbuilder.GetSqlExecPlan(sql, getTable, arena.NewArenaAllocator(1024))
+		if (errors.Cause(err) == planbuilder.ErrFullScan) != fullScan {
+			t.Fatal(sql, err)
+		}
+	}
+}
+
+func TestRecordStats(t *testing.T) {
+	ti := &TableInfo{Table: schema.NewTable("t")}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				ti.RecordHit()
+				ti.RecordHit()
+				ti.RecordMiss()
+				ti.RecordAbsent()
+			}
+			ti.RecordInvalidation()
+			ti.RecordRepair()
+		}()
+	}
+	wg.Wait()
+
+	hits, absent, misses, invalidations := ti.Stats()
+	if hits != 2000 || absent != 1000 || misses != 1000 || invalidations != 10 {
+		t.Fatal(hits, absent, misses, invalidations)
+	}
+	if ti.Repairs() != 10 {
+		t.Fatal(ti.Repairs())
+	}
+}
+
+func TestFieldsCache(t *testing.T) {
+	si := &SchemaInfo{tables: make(map[string]*TableInfo), queries: cache.NewLRUCache(1024), cachePool: newTestCachePool(1, 1)}
+	si.tables["t"] = newSnapshotTable("t", schema.CACHE_NONE)
+
+	builds := 0
+	build := func() ([]*mysql.Field, error) {
+		builds++
+		return []*mysql.Field{{Name: []byte("id"), Type: mysql.MYSQL_TYPE_LONGLONG}}, nil
+	}
+	for i := 0; i < 3; i++ {
+		fields, err := si.GetTable("t").Fields([]int{0}, build)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := (&mysql.Field{Name: []byte("id"), Type: mysql.MYSQL_TYPE_LONGLONG}).AppendTo(nil)
+		if string(fields[0].Data) != string(expect) {
+			t.Fatal(fields[0].Data)
+		}
+	}
+	if builds != 1 {
+		t.Fatal(builds)
+	}
+
+	// another column set is cached on its own
+	si.GetTable("t").Fields([]int{0, 1}, build)
+	if builds != 2 {
+		t.Fatal(builds)
+	}
+
+	// a nil build is not cached
+	skip := func() ([]*mysql.Field, error) { return nil, nil }
+	si.GetTable("t").Fields([]int{1}, skip)
+	si.GetTable("t").Fields([]int{1}, build)
+	if builds != 3 {
+		t.Fatal(builds)
+	}
+
+	// reloading the schema drops them
+	dir, err := ioutil.TempDir("", "fields")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "schema.json")
+	if err := si.SaveTo(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := si.LoadFrom(path); err != nil {
+		t.Fatal(err)
+	}
+	si.GetTable("t").Fields([]int{0}, build)
+	if builds != 4 {
+		t.Fatal(builds)
+	}
+}
+
+func TestSchemaFootprint(t *testing.T) {
+	ti := &TableInfo{Table: schema.NewTable("t")}
+	ti.AddColumn("id", "bigint(20)", "", nil, "")
+	ti.AddColumn("name", "varchar(32)", "utf8_general_ci", sqltypes.MakeString([]byte("none")), "")
+	base := SchemaFootprint([]*TableInfo{ti})
+	if base <= 0 {
+		t.Fatal(base)
+	}
+
+	ti.AddColumn("email", "varchar(64)", "utf8_general_ci", nil, "")
+	withColumn := SchemaFootprint([]*TableInfo{ti})
+	if withColumn <= base {
+		t.Fatal(base, withColumn)
+	}
+
+	index := ti.AddIndex("idx_name")
+	index.AddColumn("name", 10)
+	ti.fillDataColumns()
+	withIndex := SchemaFootprint([]*TableInfo{ti})
+	if withIndex <= withColumn {
+		t.Fatal(withColumn, withIndex)
+	}
+
+	other := &TableInfo{Table: schema.NewTable("u")}
+	other.AddColumn("id", "int(11)", "", nil, "")
+	if n := SchemaFootprint([]*TableInfo{ti, other}); n != withIndex+SchemaFootprint([]*TableInfo{other}) {
+		t.Fatal(n)
+	}
+	if n := SchemaFootprint(nil); n != 0 {
+		t.Fatal(n)
+	}
+}
+
+func TestColumnComments(t *testing.T) {
+	// Field, Type, Collation, Null, Key, Default, Extra, Privileges, Comment
+	rows := []mysql.RowValue{
+		{[]byte("id"), []byte("int(11)"), nil, []byte("NO"), []byte("PRI"), nil, []byte("auto_increment"), []byte("select"), []byte("")},
+		{[]byte("email"), []byte("varchar(64)"), []byte("utf8_general_ci"), []byte("YES"), []byte(""), nil, []byte(""), []byte("select"), []byte("pii:email")},
+	}
+	ti := &TableInfo{Table: schema.NewTable("t")}
+	for _, row := range rows {
+		if err := ti.addColumnRow(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ti.Columns[0].Comment != "" || ti.Columns[1].Comment != "pii:email" || ti.Columns[1].Collation != "utf8_general_ci" {
+		t.Fatalf("%+v", ti.Columns)
+	}
+}